@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+func (proxy *Proxy) setupAdminToken() {
+	if proxy.AdminTokenFile == "" {
+		return
+	}
+
+	token, err := readTokenFile(proxy.AdminTokenFile)
+	if err != nil {
+		proxy.log.Fatal("reading admin token", zap.Error(err))
+	}
+	proxy.adminToken = token
+}
+
+// withAdminAuth guards the admin routes while they are served on the cache
+// listener. They require the bearer token from AdminTokenFile, reads included,
+// since exports and reports list everything in the cache. Without a token
+// they are refused, so they are only available on the AdminListen address.
+func (proxy *Proxy) withAdminAuth() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case proxy.adminToken == "":
+				answer(w, http.StatusForbidden, mimeText, "admin requests need --admin-listen or --admin-token-file\n")
+				return
+			case !hasBearerToken(r, proxy.adminToken):
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				answer(w, http.StatusUnauthorized, mimeText, "missing or invalid admin token\n")
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminRoutes are moved off the cache listener when AdminListen is set.
+func (proxy *Proxy) adminRoutes(r *mux.Router) {
+	r.HandleFunc("/catalog", proxy.catalogList).Methods("GET")
+	r.HandleFunc("/dedup", proxy.dedupReport).Methods("GET")
+	r.HandleFunc("/dedup/analysis", proxy.dedupAnalysisReport).Methods("GET")
+	r.HandleFunc("/replication/events", proxy.replicationEvents).Methods("GET")
+	r.HandleFunc("/replication/snapshot", proxy.replicationSnapshot).Methods("GET")
+	r.HandleFunc("/replication/promote", proxy.replicationPromote).Methods("POST")
+	r.HandleFunc("/audit", proxy.auditEvents).Methods("GET")
+	r.HandleFunc("/reconcile", proxy.reconcileHandler).Methods("POST")
+	r.HandleFunc("/verify/{hash:[0-9a-df-np-sv-z]{32}}", proxy.verifyStorePath).Methods("POST")
+	r.HandleFunc("/stats", proxy.statsReport).Methods("GET")
+	r.HandleFunc("/mirror", proxy.mirrorReport).Methods("GET")
+	r.HandleFunc("/jobs", proxy.jobsStatus).Methods("GET")
+	r.HandleFunc("/jobs/{name}/pause", proxy.jobsPause(true)).Methods("POST")
+	r.HandleFunc("/jobs/{name}/resume", proxy.jobsPause(false)).Methods("POST")
+	r.HandleFunc("/exports", proxy.exportsList).Methods("GET")
+	r.HandleFunc("/exports", proxy.exportsAdd).Methods("POST")
+	r.HandleFunc("/exports/{hash:[0-9a-df-np-sv-z]{32}}", proxy.exportsRemove).Methods("DELETE")
+	r.HandleFunc("/seed", proxy.seedExport).Methods("GET")
+	r.HandleFunc("/seed", proxy.seedImport).Methods("POST")
+
+	// not using Methods, so other methods on these paths fall through to the
+	// cache routes, or to a 404 on the admin listener, instead of a mismatch.
+	isDelete := func(r *http.Request, _ *mux.RouteMatch) bool { return r.Method == "DELETE" }
+	r.HandleFunc("/{hash:[0-9a-df-np-sv-z]{32}}.narinfo", proxy.deleteIndex).MatcherFunc(isDelete)
+	r.HandleFunc("/nar/{hash:[0-9a-df-np-sv-z]{52}}{ext:\\.nar|\\.drv}", proxy.deleteIndex).MatcherFunc(isDelete)
+}
+
+// adminRouter serves the metrics and admin API on the AdminListen address.
+func (proxy *Proxy) adminRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.NotFoundHandler = notFound{proxy.log}
+	r.MethodNotAllowedHandler = notAllowed{proxy.log}
+	r.Use(
+		withTracing(),
+		withHTTPLogging(proxy.log),
+		handlers.RecoveryHandler(handlers.PrintRecoveryStack(true)),
+		proxy.withAudit(),
+		proxy.withReadOnly(),
+	)
+
+	r.HandleFunc("/metrics", proxy.serveMetrics)
+	proxy.adminRoutes(r)
+
+	return r
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterAdminAuth(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.standby = 1
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Post("/replication/promote").
+		Expect(t).
+		Header("WWW-Authenticate", `Bearer realm="admin"`).
+		Status(http.StatusUnauthorized).
+		End()
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/seed").
+		Expect(t).
+		Header("WWW-Authenticate", `Bearer realm="admin"`).
+		Status(http.StatusUnauthorized).
+		End()
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/jobs").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/metrics").
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	proxy.adminToken = ""
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Post("/replication/promote").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusForbidden).
+		End()
+
+	if !proxy.isStandby() {
+		t.Fatal("expected the standby not to be promoted")
+	}
+}
+
+func TestRouterAdminListen(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.AdminListen = "127.0.0.1:7747"
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/jobs").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New().
+		Handler(proxy.adminRouter()).
+		Get("/jobs").
+		Expect(t).
+		Header(headerContentType, mimeJson).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(proxy.adminRouter()).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
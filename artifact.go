@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricArtifactHits        = metrics.MustCounter("spongix_artifact_hits", "Number of artifact requests served from the store without asking the origin")
+	metricArtifactMisses      = metrics.MustCounter("spongix_artifact_misses", "Number of artifacts fetched from their origin")
+	metricArtifactRevalidated = metrics.MustCounter("spongix_artifact_revalidated", "Number of expired artifacts the origin answered with 304 Not Modified")
+	metricArtifactStale       = metrics.MustCounter("spongix_artifact_stale", "Number of expired artifacts served because their origin failed")
+)
+
+// answered with a 404, so clients like the go command fall back to the next
+// proxy.
+var errArtifactNotFound = errors.New("artifact not found")
+
+// artifactMeta is stored next to the index of an artifact.
+type artifactMeta struct {
+	URL          string    `json:"url"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	// kept in the artifact bucket as a whole instead of chunked.
+	Object bool `json:"object,omitempty"`
+}
+
+// artifacts caches files outside of the Nix store, like the GitHub tarballs
+// of flake inputs, crates or npm packages. Their chunks share the local store
+// with NARs, the indices and metadata are kept below Dir/artifacts named after
+// the SHA-256 of the URL.
+type artifacts struct {
+	dir    string
+	index  desync.LocalIndexStore
+	hosts  map[string]struct{}
+	ttl    time.Duration
+	scheme string
+
+	// artifacts announced with at least streamSize bytes go to the bucket,
+	// unless it's nil.
+	bucket     artifactBucket
+	streamSize int64
+
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+func newArtifacts(dir string, hosts []string, ttl time.Duration) (*artifacts, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	index, err := desync.NewLocalIndexStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &artifacts{
+		dir:    dir,
+		index:  index,
+		hosts:  map[string]struct{}{},
+		ttl:    ttl,
+		scheme: "https",
+		locks:  map[string]*keyLock{},
+	}
+	for _, host := range hosts {
+		a.hosts[host] = yes
+	}
+	return a, nil
+}
+
+func (proxy *Proxy) setupArtifacts() {
+	a, err := newArtifacts(filepath.Join(proxy.Dir, "artifacts"), proxy.ArtifactHosts, proxy.ArtifactTTL)
+	if err != nil {
+		proxy.log.Fatal("failed setting up artifacts", zap.Error(err))
+	}
+
+	if proxy.ArtifactStreamSize > 0 {
+		if proxy.BucketURL == "" {
+			proxy.log.Fatal("--artifact-stream-size needs a --bucket-url to stream into")
+		}
+
+		u, err := url.Parse(proxy.BucketURL)
+		if err != nil {
+			proxy.log.Fatal("couldn't parse bucket url", zap.Error(err))
+		}
+
+		if a.bucket, err = newS3ArtifactBucket(u, proxy.BucketRegion, proxy.s3Budget); err != nil {
+			proxy.log.Fatal("failed setting up the artifact bucket", zap.Error(err))
+		}
+		a.streamSize = int64(proxy.ArtifactStreamSize)
+	}
+
+	proxy.artifacts = a
+}
+
+func (a *artifacts) name(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+// lock makes concurrent requests of the same URL wait for one fetch.
+func (a *artifacts) lock(name string) func() {
+	a.mu.Lock()
+	l, found := a.locks[name]
+	if !found {
+		l = &keyLock{}
+		a.locks[name] = l
+	}
+	l.refs++
+	a.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		a.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(a.locks, name)
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *artifacts) metaPath(name string) string {
+	return filepath.Join(a.dir, name+".json")
+}
+
+// get returns the metadata and index of the artifact, or nil if it isn't
+// stored or the store lost some of its chunks.
+func (a *artifacts) get(store desync.Store, name string) (*artifactMeta, desync.Index) {
+	content, err := os.ReadFile(a.metaPath(name))
+	if err != nil {
+		return nil, desync.Index{}
+	}
+
+	meta := &artifactMeta{}
+	if err := json.Unmarshal(content, meta); err != nil {
+		return nil, desync.Index{}
+	} else if meta.Object {
+		return meta, desync.Index{}
+	}
+
+	idx, err := a.index.GetIndex(name + ".caibx")
+	if err != nil {
+		return nil, desync.Index{}
+	}
+
+	for _, chunk := range idx.Chunks {
+		if found, _ := store.HasChunk(chunk.ID); !found {
+			return nil, desync.Index{}
+		}
+	}
+
+	return meta, idx
+}
+
+func (a *artifacts) putMeta(name string, meta *artifactMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(a.dir, ".tmp"+name)
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.metaPath(name))
+}
+
+// fetch asks the origin for the URL, conditionally if we have it already.
+// It returns whether the origin answered with 304 Not Modified.
+func (a *artifacts) fetch(store desync.WriteStore, name string, meta *artifactMeta) (*artifactMeta, desync.Index, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	url := meta.URL
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, desync.Index{}, false, err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, desync.Index{}, false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil, desync.Index{}, true, nil
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, desync.Index{}, false, errors.WithMessage(errArtifactNotFound, url)
+	default:
+		return nil, desync.Index{}, false, errors.Errorf("%s answered %s", url, res.Status)
+	}
+
+	fetched := &artifactMeta{
+		URL:          url,
+		ContentType:  res.Header.Get(headerContentType),
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+
+	// the origin has to tell the size up front, S3 would buffer parts of
+	// the maximum size otherwise.
+	if a.bucket != nil && res.ContentLength >= a.streamSize {
+		if err := a.bucket.put(ctx, name, res.Body, res.ContentLength, fetched.ContentType); err != nil {
+			return nil, desync.Index{}, false, errors.WithMessagef(err, "streaming %s", url)
+		}
+		metricArtifactObjects.Add(1)
+
+		// chunks of an earlier version are left to the GC.
+		_ = os.Remove(filepath.Join(a.dir, name+".caibx"))
+		fetched.Object = true
+		return fetched, desync.Index{}, false, a.putMeta(name, fetched)
+	}
+
+	chunker, err := desync.NewChunker(res.Body, chunkSizeMin(), chunkSizeAvg, chunkSizeMax())
+	if err != nil {
+		return nil, desync.Index{}, false, err
+	}
+
+	idx, err := desync.ChunkStream(ctx, chunker, store, defaultThreads)
+	if err != nil {
+		return nil, desync.Index{}, false, errors.WithMessagef(err, "chunking %s", url)
+	}
+
+	if err := a.index.StoreIndex(name+".caibx", idx); err != nil {
+		return nil, desync.Index{}, false, err
+	}
+
+	return fetched, idx, false, a.putMeta(name, fetched)
+}
+
+// GET /artifacts/<host>/<path>
+// Serves https://<host>/<path> from the store, and fetches it if it isn't
+// stored yet.
+func (proxy *Proxy) serveArtifact(w http.ResponseWriter, r *http.Request) {
+	a := proxy.artifacts
+	vars := mux.Vars(r)
+	if _, ok := a.hosts[vars["host"]]; !ok {
+		answer(w, http.StatusForbidden, mimeText, "host is not in --artifact-hosts\n")
+		return
+	}
+
+	url := a.scheme + "://" + vars["host"] + "/" + vars["path"]
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+
+	proxy.serveCachedURL(w, r, url, false, a.ttl)
+}
+
+// serveCachedURL serves the URL from the store, and fetches it if it isn't
+// stored yet. Unless it's immutable, the origin is asked whether it changed
+// after the TTL, and if that fails the stored file is served anyway.
+func (proxy *Proxy) serveCachedURL(w http.ResponseWriter, r *http.Request, url string, immutable bool, ttl time.Duration) {
+	a := proxy.artifacts
+	name := a.name(url)
+	unlock := a.lock(name)
+	meta, idx := a.get(proxy.localStore, name)
+
+	switch {
+	case meta == nil:
+		metricArtifactMisses.Add(1)
+		fetched, fetchedIdx, _, err := a.fetch(proxy.localStore, name, &artifactMeta{URL: url})
+		if err != nil {
+			unlock()
+			if errors.Is(err, errArtifactNotFound) {
+				serveNotFound(w, r)
+				return
+			}
+			proxy.log.Warn("fetching artifact", zap.String("url", url), zap.Error(err))
+			answer(w, http.StatusBadGateway, mimeText, "fetching artifact failed\n")
+			return
+		}
+		meta, idx = fetched, fetchedIdx
+		w.Header().Set(headerCache, headerCacheRemote)
+	case !immutable && time.Since(meta.Fetched) > ttl:
+		fetched, fetchedIdx, notModified, err := a.fetch(proxy.localStore, name, meta)
+		switch {
+		case err != nil:
+			metricArtifactStale.Add(1)
+			proxy.log.Warn("revalidating artifact, serving it stale", zap.String("url", url), zap.Error(err))
+		case notModified:
+			metricArtifactRevalidated.Add(1)
+			meta.Fetched = time.Now()
+			if err := a.putMeta(name, meta); err != nil {
+				proxy.log.Error("storing artifact metadata", zap.String("url", url), zap.Error(err))
+			}
+		default:
+			metricArtifactMisses.Add(1)
+			meta, idx = fetched, fetchedIdx
+		}
+		w.Header().Set(headerCache, headerCacheHit)
+	default:
+		metricArtifactHits.Add(1)
+		w.Header().Set(headerCache, headerCacheHit)
+	}
+	unlock()
+
+	if touch := proxy.touchChunks(); touch != nil && !meta.Object {
+		touch(idx)
+	}
+
+	if meta.ContentType != "" {
+		w.Header().Set(headerContentType, meta.ContentType)
+	} else {
+		w.Header().Set(headerContentType, mimeOctetStream)
+	}
+	if meta.ETag != "" {
+		w.Header().Set("ETag", meta.ETag)
+	}
+
+	modTime, _ := http.ParseTime(meta.LastModified)
+	if meta.Object {
+		obj, err := a.bucket.get(name)
+		if err != nil {
+			// fetched again on the next request.
+			proxy.log.Warn("getting artifact from the bucket", zap.String("url", url), zap.Error(err))
+			_ = os.Remove(a.metaPath(name))
+			answer(w, http.StatusBadGateway, mimeText, "getting artifact failed\n")
+			return
+		}
+		defer obj.Close()
+
+		http.ServeContent(w, r, "", modTime, obj)
+		return
+	}
+
+	asm := newAssembler(proxy.localStore, idx)
+	defer asm.Close()
+	http.ServeContent(w, r, "", modTime, asm)
+}
+
+// pruneArtifacts removes artifacts whose chunks were collected, they'd be
+// fetched again anyway.
+func (proxy *Proxy) pruneArtifacts() {
+	a := proxy.artifacts
+	if a == nil {
+		return
+	}
+
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		proxy.log.Error("listing artifacts", zap.Error(err))
+		return
+	}
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if name == entry.Name() || strings.HasPrefix(name, ".tmp") {
+			continue
+		}
+
+		unlock := a.lock(name)
+		if meta, _ := a.get(proxy.localStore, name); meta == nil {
+			_ = os.Remove(a.metaPath(name))
+			_ = os.Remove(filepath.Join(a.dir, name+".caibx"))
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+
+	minio "github.com/minio/minio-go/v6"
+	"github.com/pascaldekloe/metrics"
+)
+
+var metricArtifactObjects = metrics.MustCounter("spongix_artifact_objects", "Number of artifacts streamed into the bucket as a whole instead of being chunked")
+
+// artifactBucket keeps artifacts too large for chunking to pay off, like VM
+// images, as whole objects. Nothing shares chunks with them, and streaming the
+// origin's response straight into a multipart upload keeps memory flat and
+// makes them available after a single pass.
+type artifactBucket interface {
+	put(ctx context.Context, name string, rd io.Reader, size int64, contentType string) error
+	get(name string) (io.ReadSeekCloser, error)
+}
+
+// s3ArtifactBucket keeps the objects below artifacts/ in the --bucket-url.
+type s3ArtifactBucket struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	budget *s3Budget
+}
+
+func newS3ArtifactBucket(u *url.URL, region string, budget *s3Budget) (*s3ArtifactBucket, error) {
+	client, bucket, prefix, err := newS3Client(u, region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3ArtifactBucket{client: client, bucket: bucket, prefix: prefix + "artifacts/", budget: budget}, nil
+}
+
+// put uploads in parts if the object is large enough, each part is sent
+// before the next one is read.
+func (b *s3ArtifactBucket) put(ctx context.Context, name string, rd io.Reader, size int64, contentType string) error {
+	b.budget.spend("put")
+	_, err := b.client.PutObjectWithContext(ctx, b.bucket, b.prefix+name, rd, size, minio.PutObjectOptions{ContentType: contentType})
+	return countS3Error(err)
+}
+
+// get returns the object, it's only fetched from S3 as far as it's read, so
+// range requests only transfer the range.
+func (b *s3ArtifactBucket) get(name string) (io.ReadSeekCloser, error) {
+	b.budget.spend("get")
+	obj, err := b.client.GetObject(b.bucket, b.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, countS3Error(err)
+	}
+
+	// errors like a missing object only show up once it's accessed.
+	if _, err := obj.Stat(); err != nil {
+		_ = obj.Close()
+		return nil, countS3Error(err)
+	}
+	return obj, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+type fakeArtifactBucket map[string][]byte
+
+func (b fakeArtifactBucket) put(ctx context.Context, name string, rd io.Reader, size int64, contentType string) error {
+	content, err := io.ReadAll(rd)
+	if err != nil {
+		return err
+	} else if int64(len(content)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	b[name] = content
+	return nil
+}
+
+type nopSeekCloser struct{ *bytes.Reader }
+
+func (nopSeekCloser) Close() error { return nil }
+
+func (b fakeArtifactBucket) get(name string) (io.ReadSeekCloser, error) {
+	if content, found := b[name]; found {
+		return nopSeekCloser{bytes.NewReader(content)}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestRouterArtifactObjects(t *testing.T) {
+	requests := int32(0)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set(headerContentType, "application/octet-stream")
+		_, _ = w.Write([]byte("a large VM image"))
+	}))
+	defer origin.Close()
+
+	host := strings.TrimPrefix(origin.URL, "http://")
+	proxy := testProxy(t)
+	proxy.ArtifactHosts = []string{host}
+	router := testRouter(proxy)
+	bucket := fakeArtifactBucket{}
+	proxy.artifacts.scheme = "http"
+	proxy.artifacts.bucket, proxy.artifacts.streamSize = bucket, 10
+	url := "/artifacts/" + host + "/images/nixos.qcow2"
+	name := proxy.artifacts.name("http://" + host + "/images/nixos.qcow2")
+
+	get := func(tt *testing.T, cache string) {
+		apitest.New().
+			Handler(router).
+			Get(url).
+			Expect(tt).
+			Header(headerCache, cache).
+			Body("a large VM image").
+			Status(http.StatusOK).
+			End()
+	}
+
+	objects := metricArtifactObjects.Get()
+	get(t, headerCacheRemote)
+	if metricArtifactObjects.Get() != objects+1 {
+		t.Fatal("expected the artifact to be streamed into the bucket")
+	} else if string(bucket[name]) != "a large VM image" {
+		t.Fatalf("unexpected object %q", bucket[name])
+	} else if _, err := os.Stat(filepath.Join(proxy.artifacts.dir, name+".caibx")); !os.IsNotExist(err) {
+		t.Fatalf("expected no index, got %v", err)
+	}
+
+	get(t, headerCacheHit)
+	apitest.New().
+		Handler(router).
+		Get(url).
+		Header("Range", "bytes=2-6").
+		Expect(t).
+		Body("large").
+		Status(http.StatusPartialContent).
+		End()
+
+	// objects aren't pruned with the chunks.
+	proxy.pruneArtifacts()
+	get(t, headerCacheHit)
+
+	delete(bucket, name)
+	apitest.New().
+		Handler(router).
+		Get(url).
+		Expect(t).
+		Status(http.StatusBadGateway).
+		End()
+	get(t, headerCacheRemote)
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expected 2 origin requests, got %d", n)
+	}
+}
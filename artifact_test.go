@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterArtifacts(t *testing.T) {
+	requests := int32(0)
+	body, etag, fail := "tarball v1", `"v1"`, false
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if r.URL.Path != "/NixOS/nixpkgs/archive/abc.tar.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set(headerContentType, "application/x-gzip")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer origin.Close()
+
+	host := strings.TrimPrefix(origin.URL, "http://")
+	proxy := testProxy(t)
+	proxy.ArtifactHosts = []string{host}
+	router := testRouter(proxy)
+	proxy.artifacts.scheme = "http"
+	url := "/artifacts/" + host + "/NixOS/nixpkgs/archive/abc.tar.gz"
+
+	get := func(tt *testing.T, cache, expected string) {
+		apitest.New().
+			Handler(router).
+			Get(url).
+			Expect(tt).
+			Header(headerCache, cache).
+			Header(headerContentType, "application/x-gzip").
+			Body(expected).
+			Status(http.StatusOK).
+			End()
+	}
+
+	t.Run("miss", func(tt *testing.T) {
+		get(tt, headerCacheRemote, "tarball v1")
+	})
+
+	t.Run("hit", func(tt *testing.T) {
+		get(tt, headerCacheHit, "tarball v1")
+		if n := atomic.LoadInt32(&requests); n != 1 {
+			tt.Fatalf("expected 1 origin request, got %d", n)
+		}
+
+		apitest.New().
+			Handler(router).
+			Get(url).
+			Header("Range", "bytes=0-6").
+			Expect(tt).
+			Body("tarball").
+			Status(http.StatusPartialContent).
+			End()
+	})
+
+	proxy.artifacts.ttl = 0
+
+	t.Run("revalidate", func(tt *testing.T) {
+		revalidated := metricArtifactRevalidated.Get()
+		get(tt, headerCacheHit, "tarball v1")
+		if metricArtifactRevalidated.Get() != revalidated+1 {
+			tt.Fatal("expected a 304 from the origin")
+		}
+
+		body, etag = "tarball v2", `"v2"`
+		get(tt, headerCacheHit, "tarball v2")
+	})
+
+	t.Run("stale", func(tt *testing.T) {
+		fail = true
+		get(tt, headerCacheHit, "tarball v2")
+	})
+
+	t.Run("origin missing", func(tt *testing.T) {
+		apitest.New().
+			Handler(router).
+			Get("/artifacts/" + host + "/missing.tar.gz").
+			Expect(tt).
+			Status(http.StatusBadGateway).
+			End()
+	})
+
+	t.Run("host not allowed", func(tt *testing.T) {
+		apitest.New().
+			Handler(router).
+			Get("/artifacts/example.com/foo.tar.gz").
+			Expect(tt).
+			Status(http.StatusForbidden).
+			End()
+	})
+
+	t.Run("prune", func(tt *testing.T) {
+		name := proxy.artifacts.name("http://" + host + "/NixOS/nixpkgs/archive/abc.tar.gz")
+		idx, err := proxy.artifacts.index.GetIndex(name + ".caibx")
+		if err != nil {
+			tt.Fatal(err)
+		}
+		store := chunkFiles{proxy.localStore.(desync.LocalStore)}
+		if err := store.RemoveChunk(idx.Chunks[0].ID); err != nil {
+			tt.Fatal(err)
+		}
+
+		proxy.pruneArtifacts()
+		if _, err := os.Stat(proxy.artifacts.metaPath(name)); !os.IsNotExist(err) {
+			tt.Fatalf("expected the artifact to be pruned, got %v", err)
+		}
+	})
+}
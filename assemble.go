@@ -3,11 +3,41 @@ package main
 import (
 	"bytes"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/folbricht/desync"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
 	"github.com/pkg/errors"
 )
 
+// assemblerBufferSize is the initial capacity of pooled assembler buffers, 0
+// uses the maximum chunk size so a chunk never makes a buffer grow.
+var assemblerBufferSize uint64
+
+var assemblerBuffers = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, assemblerBufferCap()))
+	},
+}
+
+func assemblerBufferCap() uint64 {
+	if assemblerBufferSize > 0 {
+		return assemblerBufferSize
+	}
+	return chunkSizeMax()
+}
+
+// releaseAssemblerBuffer returns buf to the pool, unless an unusually large
+// chunk made it grow, so we don't keep that memory around.
+func releaseAssemblerBuffer(buf *bytes.Buffer) {
+	if uint64(buf.Cap()) > 2*assemblerBufferCap() {
+		return
+	}
+	buf.Reset()
+	assemblerBuffers.Put(buf)
+}
+
 type assembler struct {
 	store      desync.Store
 	index      desync.Index
@@ -15,13 +45,22 @@ type assembler struct {
 	data       *bytes.Buffer
 	readBytes  int64
 	wroteBytes int64
+	// bytes of the next chunk to skip after seeking into its middle.
+	skip int64
 }
 
 func newAssembler(store desync.Store, index desync.Index) *assembler {
-	return &assembler{store: store, index: index, data: &bytes.Buffer{}}
+	return &assembler{store: store, index: index, data: assemblerBuffers.Get().(*bytes.Buffer)}
 }
 
-func (a *assembler) Close() error { return nil }
+// Close returns the buffer to the pool, the assembler can't be used afterwards.
+func (a *assembler) Close() error {
+	if a.data != nil {
+		releaseAssemblerBuffer(a.data)
+		a.data = nil
+	}
+	return nil
+}
 
 func (a *assembler) Read(p []byte) (int, error) {
 	if a.data.Len() > 0 {
@@ -47,6 +86,8 @@ func (a *assembler) Read(p []byte) (int, error) {
 	} else {
 		readBytes, _ := a.data.Write(data)
 		a.readBytes += int64(readBytes)
+		a.wroteBytes += int64(len(a.data.Next(int(a.skip))))
+		a.skip = 0
 		writeBytes, _ := a.data.Read(p)
 		a.wroteBytes += int64(writeBytes)
 		a.idx++
@@ -54,7 +95,101 @@ func (a *assembler) Read(p []byte) (int, error) {
 	}
 }
 
-var _ = io.Reader(&assembler{})
+// Seek only moves to the chunk containing the new offset, which is fetched on
+// the next Read. This lets http.ServeContent answer range requests without
+// assembling the whole file.
+func (a *assembler) Seek(offset int64, whence int) (int64, error) {
+	length := a.index.Length()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += a.wroteBytes + a.skip
+	case io.SeekEnd:
+		offset += length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset > length {
+		offset = length
+	}
+
+	chunks := a.index.Chunks
+	a.idx = sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].Start+chunks[i].Size > uint64(offset)
+	})
+
+	start := length
+	if a.idx < len(chunks) {
+		start = int64(chunks[a.idx].Start)
+	}
+
+	a.data.Reset()
+	a.readBytes = start
+	a.wroteBytes = start
+	a.skip = offset - start
+
+	return offset, nil
+}
+
+// WriteTo writes the remaining chunks straight to w, without copying them
+// through the buffer first.
+func (a *assembler) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	if a.data.Len() > 0 {
+		n, err := a.data.WriteTo(w)
+		written += n
+		a.wroteBytes += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	for ; a.idx < len(a.index.Chunks); a.idx++ {
+		chunk, err := a.store.GetChunk(a.index.Chunks[a.idx].ID)
+		if err != nil {
+			return written, err
+		}
+
+		data, err := chunk.Data()
+		if err != nil {
+			return written, err
+		}
+		a.readBytes += int64(len(data))
+
+		if a.skip > int64(len(data)) {
+			return written, errors.New("seeked beyond chunk data")
+		}
+		data = data[a.skip:]
+		a.wroteBytes += a.skip
+		a.skip = 0
+
+		n, err := w.Write(data)
+		written += int64(n)
+		a.wroteBytes += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if a.wroteBytes != a.index.Length() {
+		return written, errors.New("written bytes don't match index length")
+	}
+	if a.wroteBytes != a.readBytes {
+		return written, errors.New("read and written bytes are different")
+	}
+
+	return written, nil
+}
+
+var (
+	_ = io.ReadSeeker(&assembler{})
+	_ = io.WriterTo(&assembler{})
+)
 
 // very simple implementation, mostly used for assembling narinfo which is
 // usually tiny to avoid overhead of creating files.
@@ -62,10 +197,11 @@ func assemble(store desync.Store, index desync.Index) io.ReadCloser {
 	return newAssembler(store, index)
 }
 
-func assembleNarinfo(store desync.Store, index desync.Index) (*Narinfo, error) {
+func assembleNarinfo(store desync.Store, index desync.Index) (*narinfo.Narinfo, error) {
 	buf := assemble(store, index)
+	defer buf.Close()
 
-	info := &Narinfo{}
+	info := &narinfo.Narinfo{}
 	err := info.Unmarshal(buf)
 	if err != nil {
 		return info, errors.WithMessage(err, "while unmarshaling narinfo")
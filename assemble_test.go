@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 
 	"github.com/folbricht/desync"
@@ -52,3 +53,148 @@ func TestAssemble(t *testing.T) {
 		a.So(buf.Bytes(), assertions.ShouldResemble, value)
 	}
 }
+
+func TestAssemblerSeek(t *testing.T) {
+	a := assertions.New(t)
+
+	var store desync.WriteStore
+	storeDir := filepath.Join(t.TempDir(), "store")
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		t.Fatal(err)
+	} else if store, err = desync.NewLocalStore(storeDir, defaultStoreOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte{}
+	for i := 0; i < 1000; i++ {
+		value = strconv.AppendInt(value, int64(i*i), 10)
+	}
+
+	chunker, err := desync.NewChunker(bytes.NewBuffer(value), 48, 192, 768)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := desync.ChunkStream(context.Background(), chunker, store, defaultThreads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.So(len(idx.Chunks), assertions.ShouldBeGreaterThan, 2)
+
+	asm := newAssembler(store, idx)
+	length := int64(len(value))
+
+	for _, offset := range []int64{1000, 0, int64(idx.Chunks[1].Start), length - 10, length} {
+		pos, err := asm.Seek(offset, io.SeekStart)
+		a.So(err, assertions.ShouldBeNil)
+		a.So(pos, assertions.ShouldEqual, offset)
+
+		rest, err := io.ReadAll(asm)
+		a.So(err, assertions.ShouldBeNil)
+		a.So(rest, assertions.ShouldResemble, value[offset:])
+	}
+
+	_, _ = asm.Seek(100, io.SeekStart)
+	part := make([]byte, 10)
+	_, err = io.ReadFull(asm, part)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(part, assertions.ShouldResemble, value[100:110])
+
+	pos, err := asm.Seek(5, io.SeekCurrent)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(pos, assertions.ShouldEqual, 115)
+
+	pos, err = asm.Seek(-20, io.SeekEnd)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(pos, assertions.ShouldEqual, length-20)
+
+	rest, err := io.ReadAll(asm)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(rest, assertions.ShouldResemble, value[length-20:])
+}
+
+func TestAssemblerBufferPool(t *testing.T) {
+	a := assertions.New(t)
+
+	var store desync.WriteStore
+	storeDir := filepath.Join(t.TempDir(), "store")
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		t.Fatal(err)
+	} else if store, err = desync.NewLocalStore(storeDir, defaultStoreOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range [][]byte{
+		bytes.Repeat([]byte("hello world"), 200),
+		bytes.Repeat([]byte("bye"), 10),
+	} {
+		chunker, err := desync.NewChunker(bytes.NewBuffer(value), 48, 192, 768)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := desync.ChunkStream(context.Background(), chunker, store, defaultThreads)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// buffers from the pool must not leak data of the previous assembler
+		asm := newAssembler(store, idx)
+		a.So(asm.data.Len(), assertions.ShouldEqual, 0)
+
+		buf := &bytes.Buffer{}
+		_, err = io.Copy(buf, asm)
+		a.So(err, assertions.ShouldBeNil)
+		a.So(buf.Bytes(), assertions.ShouldResemble, value)
+		a.So(asm.Close(), assertions.ShouldBeNil)
+	}
+}
+
+func TestAssemblerWriteTo(t *testing.T) {
+	a := assertions.New(t)
+
+	var store desync.WriteStore
+	storeDir := filepath.Join(t.TempDir(), "store")
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		t.Fatal(err)
+	} else if store, err = desync.NewLocalStore(storeDir, defaultStoreOptions); err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte{}
+	for i := 0; i < 1000; i++ {
+		value = strconv.AppendInt(value, int64(i*i), 10)
+	}
+
+	chunker, err := desync.NewChunker(bytes.NewBuffer(value), 48, 192, 768)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := desync.ChunkStream(context.Background(), chunker, store, defaultThreads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asm := newAssembler(store, idx)
+	defer asm.Close()
+
+	// start with a partially read chunk in the buffer
+	part := make([]byte, 10)
+	_, err = io.ReadFull(asm, part)
+	a.So(err, assertions.ShouldBeNil)
+
+	buf := &bytes.Buffer{}
+	n, err := asm.WriteTo(buf)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(n, assertions.ShouldEqual, len(value)-10)
+	a.So(buf.Bytes(), assertions.ShouldResemble, value[10:])
+
+	_, err = asm.Seek(1000, io.SeekStart)
+	a.So(err, assertions.ShouldBeNil)
+
+	buf.Reset()
+	_, err = asm.WriteTo(buf)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(buf.Bytes(), assertions.ShouldResemble, value[1000:])
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var (
+	metricAccessTimeFlushes = metrics.MustCounter("spongix_access_time_flushes", "Number of batches of chunk access times written")
+	metricAccessTimeChunks  = metrics.MustCounter("spongix_access_time_chunks", "Number of chunk access times written")
+)
+
+// accessTimes collects the chunks served from the local store and writes
+// their access time as mtime in batches, which is what the GC evicts by.
+// Touching each chunk while serving it would cost a syscall per chunk on
+// every request.
+type accessTimes struct {
+	mu      sync.Mutex
+	pending map[desync.ChunkID]time.Time
+	limit   int
+	full    chan struct{}
+}
+
+func newAccessTimes(limit uint64) *accessTimes {
+	return &accessTimes{
+		pending: map[desync.ChunkID]time.Time{},
+		limit:   int(limit),
+		full:    make(chan struct{}, 1),
+	}
+}
+
+func (proxy *Proxy) setupAccessTimes() {
+	if proxy.AccessTimeInterval == 0 {
+		return
+	}
+	proxy.accessTimes = newAccessTimes(proxy.AccessTimeBatch)
+}
+
+// touchChunks returns the function the local cache handler records served
+// chunks with, or nil if access times aren't tracked.
+func (proxy *Proxy) touchChunks() func(desync.Index) {
+	if proxy.accessTimes == nil {
+		return nil
+	}
+	return proxy.accessTimes.touch
+}
+
+func (a *accessTimes) touch(idx desync.Index) {
+	now := time.Now()
+
+	a.mu.Lock()
+	for _, chunk := range idx.Chunks {
+		a.pending[chunk.ID] = now
+	}
+	full := a.limit > 0 && len(a.pending) >= a.limit
+	a.mu.Unlock()
+
+	if full {
+		select {
+		case a.full <- yes:
+		default:
+		}
+	}
+}
+
+func (a *accessTimes) take() map[desync.ChunkID]time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pending := a.pending
+	a.pending = map[desync.ChunkID]time.Time{}
+	return pending
+}
+
+// chunkPath is where desync keeps a compressed chunk in the local store.
+func chunkPath(store desync.LocalStore, id desync.ChunkID) string {
+	sID := id.String()
+	return filepath.Join(store.Base, sID[0:4], sID+desync.CompressedChunkExt)
+}
+
+// flushAccessTimes writes the pending access times. Chunks removed since
+// they were served are skipped.
+func (proxy *Proxy) flushAccessTimes() {
+	store, ok := proxy.chunkDisk()
+	if !ok || proxy.accessTimes == nil {
+		return
+	}
+
+	pending := proxy.accessTimes.take()
+	if len(pending) == 0 {
+		return
+	}
+
+	for id, t := range pending {
+		if err := store.touch(id, t); err != nil && !os.IsNotExist(err) {
+			proxy.log.Error("updating chunk access time", zap.Error(err), zap.String("chunk", id.String()))
+		}
+	}
+
+	metricAccessTimeFlushes.Add(1)
+	metricAccessTimeChunks.Add(uint64(len(pending)))
+}
+
+// writeAccessTimes flushes the access times every AccessTimeInterval, or
+// earlier once AccessTimeBatch chunks are pending.
+func (proxy *Proxy) writeAccessTimes() {
+	if proxy.accessTimes == nil {
+		return
+	}
+
+	ticker := time.NewTicker(proxy.AccessTimeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-proxy.accessTimes.full:
+		}
+		proxy.flushAccessTimes()
+	}
+}
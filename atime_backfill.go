@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// BackfillCmd seeds the access times of chunks from old access logs.
+type BackfillCmd struct {
+	Format string   `arg:"--format" default:"spongix" help:"Format of the logs: spongix (JSON logs of spongix), combined (nginx or Apache) or s3 (S3 server access logs)"`
+	DryRun bool     `arg:"--dry-run" help:"Only print what would be changed"`
+	Logs   []string `arg:"positional,required" help:"Access logs to read, gzipped if they end in .gz, - for stdin"`
+}
+
+// accessLogIndexName finds the index name at the end of a request path or S3
+// key, after the query and compression extension were stripped.
+var accessLogIndexName = regexp.MustCompile(`(?:[0-9a-df-np-sv-z]{32}\.narinfo|nar/[0-9a-df-np-sv-z]{52}\.(?:nar|drv))$`)
+
+var (
+	// 127.0.0.1 - - [10/May/2022:12:00:00 +0000] "GET /nar/<hash>.nar.xz HTTP/1.1" 200 ...
+	combinedLogLine = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(?:GET|HEAD) (\S+)[^"]*" (\d{3}) `)
+	// <owner> <bucket> [10/May/2022:12:00:00 +0000] <ip> <requester> <id> REST.GET.OBJECT <key> "GET ..." 200 ...
+	s3LogLine = regexp.MustCompile(`^\S+ \S+ \[([^\]]+)\] \S+ \S+ \S+ REST\.(?:GET|HEAD)\.OBJECT (\S+) "[^"]*" (\d{3}) `)
+)
+
+const accessLogTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogName returns the index name a logged request path or S3 key refers
+// to, or an empty string.
+func accessLogName(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	path = strings.TrimSuffix(path, ".caibx")
+	if isCompressedNar(path) {
+		path = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	return accessLogIndexName.FindString(path)
+}
+
+// parseAccessLogLine returns the index name and time of a successful read,
+// ok is false for any other line.
+func parseAccessLogLine(format, line string) (name string, t time.Time, ok bool) {
+	var path, status string
+
+	switch format {
+	case "spongix":
+		entry := struct {
+			Msg    string  `json:"msg"`
+			TS     float64 `json:"ts"`
+			Method string  `json:"method"`
+			URL    string  `json:"url"`
+			Status int     `json:"status_code"`
+		}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Msg != "RES" {
+			return "", t, false
+		} else if entry.Method != "GET" && entry.Method != "HEAD" {
+			return "", t, false
+		}
+		sec, frac := math.Modf(entry.TS)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+		path, status = entry.URL, strconv.Itoa(entry.Status)
+	case "combined", "s3":
+		re := combinedLogLine
+		if format == "s3" {
+			re = s3LogLine
+		}
+		match := re.FindStringSubmatch(line)
+		if match == nil {
+			return "", t, false
+		}
+		var err error
+		if t, err = time.Parse(accessLogTimeLayout, match[1]); err != nil {
+			return "", t, false
+		}
+		path, status = match[2], match[3]
+	default:
+		return "", t, false
+	}
+
+	if status != "200" && status != "206" {
+		return "", t, false
+	}
+
+	name = accessLogName(path)
+	return name, t, name != ""
+}
+
+// readAccessLog adds the latest access of every index in the log to accessed.
+func readAccessLog(format string, rd io.Reader, accessed map[string]time.Time) (oldest time.Time, err error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		name, t, ok := parseAccessLogLine(format, scanner.Text())
+		if !ok {
+			continue
+		}
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+		if t.After(accessed[name]) {
+			accessed[name] = t
+		}
+	}
+
+	return oldest, scanner.Err()
+}
+
+func (proxy *Proxy) runBackfillAtime(cmd *BackfillCmd) error {
+	switch cmd.Format {
+	case "spongix", "combined", "s3":
+	default:
+		return errors.Errorf("unknown log format %q", cmd.Format)
+	}
+
+	accessed := map[string]time.Time{}
+	oldest := time.Time{}
+	for _, logPath := range cmd.Logs {
+		rd := io.Reader(os.Stdin)
+		if logPath != "-" {
+			fd, err := os.Open(logPath)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			rd = fd
+
+			// rotated logs are usually compressed.
+			if strings.HasSuffix(logPath, ".gz") {
+				zr, err := gzip.NewReader(fd)
+				if err != nil {
+					return errors.WithMessagef(err, "reading %s", logPath)
+				}
+				rd = zr
+			}
+		}
+
+		logOldest, err := readAccessLog(cmd.Format, rd, accessed)
+		if err != nil {
+			return errors.WithMessagef(err, "reading %s", logPath)
+		}
+		if oldest.IsZero() || (!logOldest.IsZero() && logOldest.Before(oldest)) {
+			oldest = logOldest
+		}
+	}
+
+	if len(accessed) == 0 {
+		return errors.New("found no successful narinfo or NAR requests in the logs")
+	}
+
+	if err := proxy.waitForGC(context.Background()); err != nil {
+		return err
+	}
+	lease, err := proxy.acquireGCLease()
+	if err != nil {
+		return err
+	}
+	defer lease.release()
+
+	touched, err := proxy.backfillAtime(accessed, oldest, cmd.DryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "set"
+	if cmd.DryRun {
+		verb = "would set"
+	}
+	fmt.Fprintf(os.Stdout, "%d paths found in the logs since %s, %s access times of %d chunks\n", len(accessed), oldest.Format(time.RFC3339), verb, touched)
+	return nil
+}
+
+// backfillAtime sets the mtime of every chunk to the latest logged access of
+// the indices using it. Chunks of indices that aren't in the logs get the time
+// of the oldest log line, so the GC evicts those first instead of whatever
+// happens to sort first among chunks with the same mtime.
+func (proxy *Proxy) backfillAtime(accessed map[string]time.Time, oldest time.Time, dryRun bool) (int, error) {
+	store, ok := proxy.chunkDisk()
+	if !ok {
+		return 0, errors.New("the local store doesn't keep access times")
+	}
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return 0, errors.New("the local index can't be listed")
+	}
+
+	times := map[desync.ChunkID]time.Time{}
+	err := filepath.WalkDir(indices.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		name, err := filepath.Rel(indices.Path, path)
+		if err != nil || !validIndexName(filepath.ToSlash(name)) {
+			return nil
+		}
+		name = filepath.ToSlash(name)
+
+		idx, err := indices.GetIndex(name)
+		if err != nil {
+			proxy.log.Warn("reading index", zap.String("name", name), zap.Error(err))
+			return nil
+		}
+
+		t, found := accessed[name]
+		if !found {
+			t = oldest
+		}
+		for _, chunk := range idx.Chunks {
+			if t.After(times[chunk.ID]) {
+				times[chunk.ID] = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	touched := 0
+	for id, t := range times {
+		if !dryRun {
+			if err := store.touch(id, t); err != nil {
+				if !os.IsNotExist(err) {
+					proxy.log.Error("updating chunk access time", zap.Error(err), zap.String("chunk", id.String()))
+				}
+				continue
+			}
+		}
+		touched++
+	}
+
+	return touched, nil
+}
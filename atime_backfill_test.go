@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAccessLogLine(t *testing.T) {
+	at := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		format, line, name string
+	}{
+		{"combined", `127.0.0.1 - - [10/May/2022:12:00:00 +0000] "GET ` + fNarXz + ` HTTP/1.1" 200 42 "-" "Nix/2.8.0"`, fNar[1:]},
+		{"combined", `127.0.0.1 - - [10/May/2022:12:00:00 +0000] "HEAD /cache` + fNarinfo + ` HTTP/1.1" 200 0 "-" "Nix/2.8.0"`, fNarinfo[1:]},
+		{"combined", `127.0.0.1 - - [10/May/2022:12:00:00 +0000] "GET ` + fNarinfo + ` HTTP/1.1" 404 9 "-" "Nix/2.8.0"`, ""},
+		{"combined", `127.0.0.1 - - [10/May/2022:12:00:00 +0000] "PUT ` + fNarinfo + ` HTTP/1.1" 200 3 "-" "curl"`, ""},
+		{"s3", `79a5 cache [10/May/2022:12:00:00 +0000] 10.0.0.1 arn:aws:iam::1:user/spongix 3E57 REST.GET.OBJECT index` + fNar + `.caibx "GET /cache/index` + fNar + `.caibx HTTP/1.1" 200 - 1024 1024 10 9 "-" "minio" -`, fNar[1:]},
+		{"spongix", `{"level":"info","ts":1652184000,"msg":"RES","ident":"cache","method":"GET","url":"` + fNarinfo + `","status_code":200}`, fNarinfo[1:]},
+		{"spongix", `{"level":"info","ts":1652184000,"msg":"REQ","ident":"cache","method":"GET","url":"` + fNarinfo + `"}`, ""},
+	} {
+		name, parsed, ok := parseAccessLogLine(tc.format, tc.line)
+		if name != tc.name || ok != (tc.name != "") {
+			t.Errorf("expected %q from %s line %s, got %q", tc.name, tc.format, tc.line, name)
+		} else if ok && !parsed.Equal(at) {
+			t.Errorf("expected %s from %s line, got %s", at, tc.format, parsed)
+		}
+	}
+}
+
+func TestBackfillAtime(t *testing.T) {
+	proxy := testProxy(t)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+
+	oldest := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	accessed := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	logLines := `127.0.0.1 - - [01/May/2022:00:00:00 +0000] "GET /nar/1111111111111111111111111111111111111111111111111111.nar HTTP/1.1" 200 1 "-" "Nix/2.8.0"
+127.0.0.1 - - [09/May/2022:00:00:00 +0000] "GET ` + fNarXz + ` HTTP/1.1" 200 42 "-" "Nix/2.8.0"
+127.0.0.1 - - [10/May/2022:12:00:00 +0000] "GET ` + fNarXz + ` HTTP/1.1" 200 42 "-" "Nix/2.8.0"
+`
+	if err := os.WriteFile(logPath, []byte(logLines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ := proxy.chunkDisk()
+	modTimes := func(name string) map[time.Time]int {
+		idx, err := proxy.localIndex.GetIndex(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		times := map[time.Time]int{}
+		for _, chunk := range idx.Chunks {
+			mtime, err := store.modTime(chunk.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			times[mtime.UTC()]++
+		}
+		return times
+	}
+
+	if err := proxy.runBackfillAtime(&BackfillCmd{Format: "combined", DryRun: true, Logs: []string{logPath}}); err != nil {
+		t.Fatal(err)
+	} else if times := modTimes(fNar[1:]); times[accessed] > 0 {
+		t.Fatalf("dry run changed access times: %v", times)
+	}
+
+	if err := proxy.runBackfillAtime(&BackfillCmd{Format: "combined", Logs: []string{logPath}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if times := modTimes(fNar[1:]); len(times) != 1 || times[accessed] == 0 {
+		t.Errorf("expected the NAR chunks accessed at %s, got %v", accessed, times)
+	}
+	if times := modTimes(fNarinfo[1:]); len(times) != 1 || times[oldest] == 0 {
+		t.Errorf("expected the narinfo chunks accessed at %s, got %v", oldest, times)
+	}
+
+	if err := proxy.runBackfillAtime(&BackfillCmd{Format: "s3", Logs: []string{logPath}}); err == nil {
+		t.Error("expected an error for logs without requests of the format")
+	}
+}
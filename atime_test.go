@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterAccessTimes(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.AccessTimeInterval = time.Minute
+	proxy.setupAccessTimes()
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	router := testRouter(proxy)
+
+	idx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNarinfo, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := proxy.localStore.(desync.LocalStore)
+	path := chunkPath(store, idx.Chunks[0].ID)
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime()
+	}
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	if !mtime().Equal(old) {
+		t.Fatal("access time was written while serving")
+	}
+
+	proxy.flushAccessTimes()
+
+	if time.Since(mtime()) > time.Minute {
+		t.Fatalf("access time wasn't written, mtime is %s", mtime())
+	}
+}
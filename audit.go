@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// number of audit events kept in memory for GET /audit.
+const auditRecentSize = 1000
+
+type auditEvent struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Size     int64         `json:"size"`
+	Client   string        `json:"client"`
+	User     string        `json:"user,omitempty"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"duration"`
+}
+
+// auditLog appends every mutation as a JSON line to a file, which is rotated
+// to <file>.1 once it grows beyond maxSize. Older files are shifted to
+// <file>.2 and so on, up to keep of them.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	fd      *os.File
+	size    int64
+	recent  []auditEvent
+}
+
+func newAuditLog(path string, maxSize int64, keep int) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, keep: keep}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the most recent events of the last run, so GET /audit doesn't
+// start out empty.
+func (a *auditLog) load() error {
+	for _, path := range []string{a.path, a.path + ".1"} {
+		events, err := readAuditEvents(path)
+		if err != nil {
+			return err
+		}
+
+		a.recent = append(events, a.recent...)
+		if len(a.recent) >= auditRecentSize {
+			a.recent = a.recent[len(a.recent)-auditRecentSize:]
+			break
+		}
+	}
+	return nil
+}
+
+// readAuditEvents returns up to auditRecentSize of the last events in the file.
+func readAuditEvents(path string) ([]auditEvent, error) {
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "reading audit log")
+	}
+	defer fd.Close()
+
+	events := []auditEvent{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		event := auditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// a line cut short by a crash.
+			continue
+		}
+
+		if events = append(events, event); len(events) > 2*auditRecentSize {
+			events = append(events[:0], events[len(events)-auditRecentSize:]...)
+		}
+	}
+
+	if len(events) > auditRecentSize {
+		events = events[len(events)-auditRecentSize:]
+	}
+	return events, errors.WithMessage(scanner.Err(), "reading audit log")
+}
+
+func (a *auditLog) open() error {
+	fd, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return errors.WithMessage(err, "opening audit log")
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	a.fd = fd
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLog) rotate() error {
+	if err := a.fd.Close(); err != nil {
+		return err
+	}
+
+	_ = os.Remove(a.path + "." + strconv.Itoa(a.keep))
+	for i := a.keep - 1; i > 0; i-- {
+		from := a.path + "." + strconv.Itoa(i)
+		if err := os.Rename(from, a.path+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.WithMessage(err, "rotating audit log")
+		}
+	}
+
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return errors.WithMessage(err, "rotating audit log")
+	}
+	return a.open()
+}
+
+func (a *auditLog) add(event auditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.recent = append(a.recent, event)
+	if len(a.recent) > auditRecentSize {
+		a.recent = a.recent[len(a.recent)-auditRecentSize:]
+	}
+
+	if a.maxSize > 0 && a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.fd.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// last returns up to n of the most recent events, newest first.
+func (a *auditLog) last(n int) []auditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n > len(a.recent) {
+		n = len(a.recent)
+	}
+
+	events := make([]auditEvent, 0, n)
+	for i := len(a.recent) - 1; i >= len(a.recent)-n; i-- {
+		events = append(events, a.recent[i])
+	}
+	return events
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (proxy *Proxy) setupAudit() {
+	if proxy.AuditLog == "" {
+		return
+	}
+
+	audit, err := newAuditLog(proxy.AuditLog, int64(proxy.AuditLogMaxSize)*1024*1024, int(proxy.AuditLogKeep))
+	if err != nil {
+		proxy.log.Fatal("failed setting up audit log", zap.Error(err), zap.String("path", proxy.AuditLog))
+	}
+	proxy.audit = audit
+}
+
+// withAudit records every request that may change the cache.
+func (proxy *Proxy) withAudit() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if proxy.audit == nil || r.Method == "GET" || r.Method == "HEAD" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+			record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+
+			h.ServeHTTP(record, r)
+
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			user, _, _ := r.BasicAuth()
+
+			if err := proxy.audit.add(auditEvent{
+				Time:     start,
+				Method:   r.Method,
+				URL:      r.URL.String(),
+				Size:     body.n,
+				Client:   client,
+				User:     user,
+				Status:   record.status,
+				Duration: time.Since(start),
+			}); err != nil {
+				proxy.log.Error("writing audit log", zap.Error(err))
+			}
+		})
+	}
+}
+
+// GET /audit?limit=<n>
+func (proxy *Proxy) auditEvents(w http.ResponseWriter, r *http.Request) {
+	if proxy.audit == nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 0 {
+			answer(w, http.StatusBadRequest, mimeText, "invalid limit parameter\n")
+			return
+		}
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(proxy.audit.last(limit)); err != nil {
+		proxy.log.Error("encoding audit events", zap.Error(err))
+	}
+}
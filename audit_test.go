@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterAudit(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.AuditLog = filepath.Join(t.TempDir(), "audit.jsonl")
+	proxy.setupAudit()
+	router := testRouter(proxy)
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		BasicAuth("alice", "secret").
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, testAdminRequest("GET", "/audit?limit=10", nil))
+
+	events := []auditEvent{}
+	if err := json.NewDecoder(res.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 {
+		t.Fatalf("expected one event, got %v", events)
+	}
+
+	event := events[0]
+	if event.Method != "PUT" || event.URL != fNar || event.User != "alice" ||
+		event.Status != http.StatusOK || event.Size != int64(len(testdata[fNar])) {
+		t.Fatalf("unexpected event: %v", event)
+	}
+
+	content, err := os.ReadFile(proxy.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(content), `"url":"`+fNar+`"`) {
+		t.Fatalf("event missing from audit log: %s", content)
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := newAuditLog(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every event is larger than the limit, so each one rotates.
+	for i := 0; i < 4; i++ {
+		if err := audit.add(auditEvent{URL: "/" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, url := range map[string]string{"": "/3", ".1": "/2", ".2": "/1"} {
+		if events, err := readAuditEvents(path + suffix); err != nil {
+			t.Fatal(err)
+		} else if len(events) != 1 || events[0].URL != url {
+			t.Fatalf("expected %s in audit.jsonl%s, got %v", url, suffix, events)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("expected only 2 rotated logs to be kept")
+	}
+
+	if audit, err = newAuditLog(path, 1, 2); err != nil {
+		t.Fatal(err)
+	} else if events := audit.last(10); len(events) != 2 || events[0].URL != "/3" || events[1].URL != "/2" {
+		t.Fatalf("expected the recent events to be loaded, got %v", events)
+	}
+}
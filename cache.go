@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"fmt"
@@ -8,12 +9,14 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/folbricht/desync"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
 	"github.com/jamespfennell/xz"
 	"github.com/pascaldekloe/metrics"
 	"github.com/pkg/errors"
@@ -31,7 +34,7 @@ const (
 
 func urlToMime(u string) string {
 	switch filepath.Ext(u) {
-	case ".nar", ".xz":
+	case ".nar", ".xz", ".zst", ".bz2", ".drv":
 		return mimeNar
 	case ".narinfo":
 		return mimeNarinfo
@@ -61,16 +64,27 @@ func urlToIndexName(url *url.URL) (string, error) {
 	if strings.HasPrefix(name, "/cache/") {
 		name = strings.Replace(name, "/cache/", "/", 1)
 	}
-	if strings.HasSuffix(name, ".nar.xz") {
-		name = strings.Replace(name, ".nar.xz", ".nar", 1)
+	if isCompressedNar(name) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
 	}
 	if name, err := filepath.Rel("/", name); err != nil {
 		return name, err
+	} else if !validIndexName(name) {
+		return name, errors.Errorf("invalid index name %q", name)
 	} else {
 		return name, nil
 	}
 }
 
+var indexNameRegexp = regexp.MustCompile(`\A(?:[0-9a-df-np-sv-z]{32}\.narinfo|nar/[0-9a-df-np-sv-z]{52}\.(?:nar|drv))\z`)
+
+// validIndexName reports whether name is a narinfo, uncompressed NAR or .drv
+// index, so names taken from requests, upstreams or other caches can't point
+// anywhere else in the index store.
+func validIndexName(name string) bool {
+	return indexNameRegexp.MatchString(name)
+}
+
 type cacheHandler struct {
 	log         *zap.Logger
 	handler     http.Handler
@@ -78,6 +92,12 @@ type cacheHandler struct {
 	index       desync.IndexWriteStore
 	trustedKeys map[string]ed25519.PublicKey
 	secretKeys  map[string]ed25519.PrivateKey
+	// announce the NAR and references of narinfos in Link headers.
+	prefetchLinks bool
+	// records that the chunks of an index were served, may be nil.
+	touch func(desync.Index)
+	// keeps compressed NARs so they aren't compressed again, may be nil.
+	compressed *compressedCache
 }
 
 func withCacheHandler(
@@ -86,6 +106,9 @@ func withCacheHandler(
 	index desync.IndexWriteStore,
 	trustedKeys map[string]ed25519.PublicKey,
 	secretKeys map[string]ed25519.PrivateKey,
+	prefetchLinks bool,
+	touch func(desync.Index),
+	compressed *compressedCache,
 ) func(http.Handler) http.Handler {
 	if store == nil || index == nil {
 		return func(h http.Handler) http.Handler {
@@ -95,11 +118,14 @@ func withCacheHandler(
 
 	return func(h http.Handler) http.Handler {
 		return &cacheHandler{handler: h,
-			log:         log,
-			store:       store,
-			index:       index,
-			trustedKeys: trustedKeys,
-			secretKeys:  secretKeys,
+			log:           log,
+			store:         store,
+			index:         index,
+			trustedKeys:   trustedKeys,
+			secretKeys:    secretKeys,
+			prefetchLinks: prefetchLinks,
+			touch:         touch,
+			compressed:    compressed,
 		}
 	}
 }
@@ -124,6 +150,10 @@ func (c cacheHandler) Head(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if serveNarinfoValidators(w, r, c.index, idx) {
+		return
+	}
+
 	w.Header().Set("Content-Length", strconv.FormatInt(idx.Length(), 10))
 	w.Header().Set(headerCache, headerCacheHit)
 	w.Header().Set(headerContentType, urlToMime(r.URL.String()))
@@ -137,29 +167,105 @@ func (c cacheHandler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if serveNarinfoValidators(w, r, c.index, idx) {
+		return
+	}
+
+	if c.prefetchLinks && strings.HasSuffix(r.URL.Path, ".narinfo") {
+		if info, err := assembleNarinfo(c.store, idx); err != nil {
+			c.log.Warn("reading narinfo for prefetch links", zap.Error(err))
+		} else {
+			setPrefetchLinks(w.Header(), r.URL.Path, info)
+		}
+	}
+
+	if c.touch != nil {
+		c.touch(idx)
+	}
+
+	asm := newAssembler(c.store, idx)
+	defer asm.Close()
+
 	wr := io.Writer(w)
-	if filepath.Ext(r.URL.String()) == ".xz" {
-		xzWr := xz.NewWriterLevel(w, xz.BestSpeed)
-		defer xzWr.Close()
-		wr = xzWr
+	if isCompressedNar(r.URL.Path) {
+		c.getCompressed(w, r, asm)
+		return
+	} else if r.Header.Get("Range") != "" {
+		// ServeContent takes care of range requests, and only fetches the
+		// chunks that are needed.
+		w.Header().Set(headerCache, headerCacheHit)
+		w.Header().Set(headerContentType, urlToMime(r.URL.String()))
+		http.ServeContent(w, r, "", time.Time{}, asm)
+		return
 	} else {
 		w.Header().Set("Content-Length", strconv.FormatInt(idx.Length(), 10))
 	}
 
 	w.Header().Set(headerCache, headerCacheHit)
 	w.Header().Set(headerContentType, urlToMime(r.URL.String()))
-	for _, indexChunk := range idx.Chunks {
-		if chunk, err := c.store.GetChunk(indexChunk.ID); err != nil {
-			c.log.Error("while getting chunk", zap.Error(err))
-			break
-		} else if data, err := chunk.Data(); err != nil {
-			c.log.Error("while reading chunk data", zap.Error(err))
-			break
-		} else if _, err := wr.Write(data); err != nil {
-			c.log.Error("while writing chunk data", zap.Error(err))
-			break
+	if _, err := asm.WriteTo(wr); err != nil {
+		c.log.Error("while writing chunk data", zap.Error(err))
+	}
+}
+
+// getCompressed compresses the NAR while it's sent, unless it's still cached
+// the way it was compressed before.
+func (c cacheHandler) getCompressed(w http.ResponseWriter, r *http.Request, asm *assembler) {
+	name, _ := urlToIndexName(r.URL)
+	name += filepath.Ext(r.URL.Path)
+
+	if c.compressed != nil {
+		if fd, size, ok := c.compressed.open(name); ok {
+			defer fd.Close()
+
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set(headerCache, headerCacheHit)
+			w.Header().Set(headerContentType, urlToMime(r.URL.String()))
+			if _, err := io.Copy(w, fd); err != nil {
+				c.log.Error("while writing compressed NAR", zap.Error(err))
+			}
+			return
 		}
 	}
+
+	wr := io.Writer(w)
+	var cached *compressedCacheFile
+	if c.compressed != nil {
+		if file, err := c.compressed.create(name); err != nil {
+			c.log.Warn("caching compressed NAR", zap.Error(err))
+		} else {
+			cached = file
+			wr = io.MultiWriter(w, file)
+		}
+	}
+
+	compressWr, err := compress(r.URL.Path, wr)
+	if err != nil {
+		if cached != nil {
+			cached.discard()
+		}
+		c.handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set(headerCache, headerCacheHit)
+	w.Header().Set(headerContentType, urlToMime(r.URL.String()))
+	_, err = asm.WriteTo(compressWr)
+	if err != nil {
+		c.log.Error("while writing chunk data", zap.Error(err))
+	}
+	if closeErr := compressWr.Close(); err == nil {
+		err = closeErr
+	}
+
+	// only keep what the client got in full.
+	if cached == nil {
+		return
+	} else if err != nil {
+		cached.discard()
+	} else if err := cached.commit(); err != nil {
+		c.log.Warn("caching compressed NAR", zap.Error(err))
+	}
 }
 
 func answer(w http.ResponseWriter, status int, mime, msg string) {
@@ -172,28 +278,79 @@ func (c cacheHandler) Put(w http.ResponseWriter, r *http.Request) {
 	urlExt := filepath.Ext(r.URL.String())
 	switch urlExt {
 	case ".narinfo":
-		info := &Narinfo{}
-		if err := info.Unmarshal(r.Body); err != nil {
+		info, err := uploadedNarinfo(r)
+		if err != nil {
 			c.log.Error("unmarshaling narinfo", zap.Error(err))
 			answer(w, http.StatusBadRequest, mimeText, err.Error())
+		} else if !strings.HasPrefix(info.URL, "nar/") {
+			// absolute URLs are only served, see narinfoPolicy.
+			answer(w, http.StatusBadRequest, mimeText, "URL must be relative to the cache, like nar/<hash>.nar\n")
 		} else if infoRd, err := info.PrepareForStorage(c.trustedKeys, c.secretKeys); err != nil {
 			c.log.Error("failed serializing narinfo", zap.Error(err))
 			answer(w, http.StatusInternalServerError, mimeText, "failed serializing narinfo")
 		} else {
 			c.putCommon(w, r, infoRd)
 		}
-	case ".nar":
-		c.putCommon(w, r, r.Body)
-	case ".xz":
-		xzRd := xz.NewReader(r.Body)
-		defer xzRd.Close()
-		c.putCommon(w, r, xzRd)
+	case ".drv":
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxDerivationSize+1))
+		if err != nil {
+			answer(w, http.StatusBadRequest, mimeText, "failed reading body\n")
+			return
+		} else if len(body) > maxDerivationSize {
+			answer(w, http.StatusRequestEntityTooLarge, mimeText, "derivation is too large\n")
+			return
+		} else if _, err := readDerivation(bytes.NewReader(body)); err != nil {
+			answer(w, http.StatusBadRequest, mimeText, "invalid derivation: "+err.Error()+"\n")
+			return
+		}
+		c.putCommon(w, r, bytes.NewReader(body))
+	case ".nar", ".xz", ".zst", ".bz2":
+		body, err := sniffNar(r.URL.Path, r.Body)
+		if err != nil {
+			answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+			return
+		}
+
+		rd, err := decompress(r.URL.Path, body)
+		if err != nil {
+			c.log.Error("decompressing body", zap.Error(err))
+			answer(w, http.StatusBadRequest, mimeText, err.Error())
+			return
+		}
+		defer rd.Close()
+		c.putCommon(w, r, rd)
 	default:
 		answer(w, http.StatusBadRequest, mimeText, "compression is not supported\n")
 	}
 }
 
+// rewriteNarinfo only accepts narinfos signed by one of our trusted keys and
+// adds our own signatures, so clients only need to trust spongix.
+// The URL is pointed at the uncompressed NAR we serve.
+func (proxy *Proxy) rewriteNarinfo(rd io.Reader) (io.Reader, error) {
+	info := &narinfo.Narinfo{}
+	if err := info.Unmarshal(rd); err != nil {
+		return nil, err
+	}
+
+	info.SanitizeNar()
+	info.SanitizeSignatures(proxy.trustedKeys)
+	if len(info.Sig) == 0 {
+		return nil, errors.New("no trusted signature found")
+	}
+
+	for name, key := range proxy.secretKeys {
+		info.Sign(name, key)
+	}
+
+	return info.ToReader()
+}
+
+// putCommon chunks the body while it's being received, so uploads with an
+// unknown length (chunked transfer encoding, `curl -T -`) are never buffered.
 func (c cacheHandler) putCommon(w http.ResponseWriter, r *http.Request, rd io.Reader) {
+	defer logSpan(r.Context(), c.log, "chunking", time.Now())
+
 	if chunker, err := desync.NewChunker(rd, chunkSizeMin(), chunkSizeAvg, chunkSizeMax()); err != nil {
 		c.log.Error("making chunker", zap.Error(err))
 		answer(w, http.StatusInternalServerError, mimeText, "making chunker")
@@ -204,46 +361,61 @@ func (c cacheHandler) putCommon(w http.ResponseWriter, r *http.Request, rd io.Re
 		c.log.Error("storing index", zap.Error(err))
 		answer(w, http.StatusInternalServerError, mimeText, "storing index")
 	} else {
+		name, _ := urlToIndexName(r.URL)
+		// the NAR may have been uploaded before with other content.
+		if c.compressed != nil && strings.HasSuffix(name, ".nar") {
+			c.compressed.removeNar(name)
+		}
+		if stored, ok := r.Context().Value(storedIndexKey{}).(*storedIndex); ok {
+			stored.name = name
+			stored.idx = idx
+		}
 		answer(w, http.StatusOK, mimeText, "ok\n")
 	}
 }
 
+type narinfoRewriter func(io.Reader) (io.Reader, error)
+
 type remoteHandler struct {
-	log          *zap.Logger
-	handler      http.Handler
-	substituters []*url.URL
-	exts         []string
-	cacheChan    chan string
+	log       *zap.Logger
+	handler   http.Handler
+	upstreams *upstreamHealth
+	exts      []string
+	cache     *cacheQueue
+	rewrite   narinfoRewriter
+	flights   *upstreamFlights
 }
 
-func withRemoteHandler(log *zap.Logger, substituters, exts []string, cacheChan chan string) func(http.Handler) http.Handler {
-	parsedSubstituters := []*url.URL{}
-	for _, raw := range substituters {
-		u, err := url.Parse(raw)
-		if err != nil {
-			panic(err)
-		}
-		parsedSubstituters = append(parsedSubstituters, u)
-	}
+// rewrite is applied to narinfo bodies of upstream responses, it may be nil.
+func withRemoteHandler(log *zap.Logger, upstreams *upstreamHealth, exts []string, cache *cacheQueue, rewrite narinfoRewriter) func(http.Handler) http.Handler {
+	// mux wraps the handler on every request, so this has to be shared.
+	flights := newUpstreamFlights()
 
 	return func(h http.Handler) http.Handler {
 		return &remoteHandler{
-			log:          log,
-			handler:      h,
-			exts:         exts,
-			substituters: parsedSubstituters,
-			cacheChan:    cacheChan,
+			log:       log,
+			handler:   h,
+			exts:      exts,
+			upstreams: upstreams,
+			cache:     cache,
+			rewrite:   rewrite,
+			flights:   flights,
 		}
 	}
 }
 
 func (h *remoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if localOnly, _ := r.Context().Value(localOnlyKey{}).(bool); localOnly {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
 	exts := h.exts
 	urlExt := filepath.Ext(r.URL.String())
 	timeout := 30 * time.Minute
 	switch urlExt {
 	case ".nar":
-	case ".xz":
+	case ".xz", ".zst", ".bz2", ".drv":
 		exts = []string{""}
 	case ".narinfo":
 		timeout = 10 * time.Second
@@ -253,14 +425,103 @@ func (h *remoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	hops, allowed := h.upstreams.hops(r)
+	if !allowed {
+		h.log.Warn("too many hops, not asking upstreams", zap.String("url", r.URL.String()), zap.Uint64("hops", hops-1))
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	substituters := h.upstreams.available()
+	if len(substituters) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := r.Method + " " + r.URL.Path
+	flight, leader := h.flights.join(key)
+	if !leader {
+		h.follow(w, r, flight, hops)
+		return
+	}
+	// followers are let go as soon as we know which upstream has it, not
+	// only once we're done sending it.
+	landed := false
+	land := func() {
+		if !landed {
+			landed = true
+			h.flights.land(key, flight)
+		}
+	}
+	defer land()
+
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	routines := len(h.substituters) * len(exts)
+	start := time.Now()
+	defer logSpan(r.Context(), h.log, "upstream", start, zap.Int("substituters", len(substituters)))
+
+	// ask as many substituters at once as allowed, failing over to the next
+	// ones on misses.
+	fanout := len(substituters)
+	if h.upstreams.policy != upstreamPolicyFastest {
+		fanout = 1
+	} else if h.upstreams.fanout > 0 && int(h.upstreams.fanout) < fanout {
+		fanout = int(h.upstreams.fanout)
+	}
+
+	var response *http.Response
+	for i := 0; i < len(substituters) && response == nil; i += fanout {
+		end := i + fanout
+		if end > len(substituters) {
+			end = len(substituters)
+		}
+		response = h.fetch(ctx, r, substituters[i:end], exts, hops)
+	}
+
+	if response == nil {
+		land()
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	defer response.Body.Close()
+
+	body, err := h.responseBody(r, response)
+	if err != nil {
+		h.log.Warn("rejecting upstream narinfo", zap.String("url", response.Request.URL.String()), zap.Error(err))
+		land()
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	upstreamURL := response.Request.URL.String()
+	flight.url = upstreamURL
+
+	h.cache.enqueue(upstreamURL)
+	// w.Header().Set("Content-Length", strconv.FormatInt(idx.Length(), 10))
+	h.setRemoteHeaders(w, upstreamURL)
+
+	// keep small bodies around for requests waiting for this flight.
+	shared := &bytes.Buffer{}
+	n, err := io.Copy(shared, io.LimitReader(body, maxSharedUpstreamBody+1))
+	if err == nil && n <= maxSharedUpstreamBody {
+		flight.body = shared.Bytes()
+		flight.buffered = true
+	}
+	land()
+
+	_, _ = w.Write(shared.Bytes())
+	_, _ = io.Copy(w, body)
+}
+
+// fetch asks all given substituters at once and returns the first successful
+// response, or nil if there was none.
+func (h *remoteHandler) fetch(ctx context.Context, r *http.Request, substituters []*url.URL, exts []string, hops uint64) *http.Response {
+	routines := len(substituters) * len(exts)
 	resChan := make(chan *http.Response, routines)
 	wg := &sync.WaitGroup{}
 
-	for _, substituter := range h.substituters {
+	for _, substituter := range substituters {
 		for _, ext := range exts {
 			u, err := substituter.Parse(r.URL.String() + ext)
 			if err != nil {
@@ -270,109 +531,279 @@ func (h *remoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			request, err := http.NewRequestWithContext(ctx, r.Method, u.String(), nil)
 			if err != nil {
-				h.log.Error("creating request", zap.String("url", request.URL.String()), zap.Error(err))
+				h.log.Error("creating request", zap.String("url", u.String()), zap.Error(err))
 				continue
 			}
+			span := propagateTrace(r.Context(), request)
+			request.Header.Set(headerHops, strconv.FormatUint(hops, 10))
 
 			wg.Add(1)
-			go func(request *http.Request) {
+			go func(substituter *url.URL, request *http.Request) {
 				defer wg.Done()
+				release, ok := h.upstreams.acquire(ctx, substituter)
+				if !ok {
+					return
+				}
+
+				start := time.Now()
 				res, err := http.DefaultClient.Do(request)
+				logUpstreamSpan(span, h.log, request, res, start)
 				if err != nil {
+					release()
 					if !errors.Is(err, context.Canceled) {
 						h.log.Error("fetching upstream", zap.String("url", request.URL.String()), zap.Error(err))
+						h.upstreams.markDown(substituter)
 					}
-				} else if res.StatusCode/100 == 2 {
-					select {
-					case resChan <- res:
-					case <-ctx.Done():
-					}
+					return
+				}
+
+				// the slot is taken until the body is read, not only until
+				// the headers arrived.
+				res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+				if res.StatusCode/100 != 2 {
+					res.Body.Close()
+					return
 				}
-			}(request)
+
+				select {
+				case resChan <- res:
+				case <-ctx.Done():
+					res.Body.Close()
+				}
+			}(substituter, request)
 		}
 	}
 
-	allDone := make(chan bool)
 	go func() {
 		wg.Wait()
-		select {
-		case allDone <- true:
-		case <-ctx.Done():
-		}
+		close(resChan)
 	}()
 
+	// responses that lost the race are closed, to free their upstream slots.
+	discard := func() {
+		for response := range resChan {
+			response.Body.Close()
+		}
+	}
+
 	select {
-	case <-allDone:
-		// got no good responses
+	case response, ok := <-resChan:
+		if !ok {
+			return nil
+		}
+		go discard()
+		return response
 	case <-ctx.Done():
 		// ran out of time
-	case response := <-resChan:
-		h.cacheChan <- response.Request.URL.String()
-		// w.Header().Set("Content-Length", strconv.FormatInt(idx.Length(), 10))
-		w.Header().Set(headerCache, headerCacheRemote)
-		w.Header().Set(headerContentType, urlToMime(response.Request.URL.String()))
-		w.Header().Set(headerCacheUpstream, response.Request.URL.String())
-
-		body := response.Body
-		if strings.HasSuffix(r.URL.String(), ".nar") && strings.HasSuffix(response.Request.URL.String(), ".xz") {
-			body = xz.NewReader(response.Body)
-		}
+		go discard()
+		return nil
+	}
+}
 
-		_, _ = io.Copy(w, body)
+// responseBody decompresses or rewrites the upstream response as requested.
+func (h *remoteHandler) responseBody(r *http.Request, response *http.Response) (io.Reader, error) {
+	if strings.HasSuffix(r.URL.String(), ".nar") && strings.HasSuffix(response.Request.URL.String(), ".xz") {
+		return xz.NewReader(response.Body), nil
+	} else if filepath.Ext(r.URL.String()) == ".narinfo" && r.Method == "GET" && h.rewrite != nil {
+		return h.rewrite(response.Body)
+	}
+	return response.Body, nil
+}
+
+func (h *remoteHandler) setRemoteHeaders(w http.ResponseWriter, upstreamURL string) {
+	w.Header().Set(headerCache, headerCacheRemote)
+	w.Header().Set(headerContentType, urlToMime(upstreamURL))
+	w.Header().Set(headerCacheUpstream, upstreamURL)
+}
+
+// follow waits for a concurrent request of the same URL to ask the upstreams
+// and answers with its result.
+func (h *remoteHandler) follow(w http.ResponseWriter, r *http.Request, flight *upstreamFlight, hops uint64) {
+	select {
+	case <-flight.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if flight.url == "" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if flight.buffered {
+		h.setRemoteHeaders(w, flight.url)
+		_, _ = w.Write(flight.body)
+		return
+	}
+
+	// too large to share, but we still know which upstream has it.
+	request, err := http.NewRequestWithContext(r.Context(), r.Method, flight.url, nil)
+	if err != nil {
+		h.log.Error("creating request", zap.String("url", flight.url), zap.Error(err))
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	span := propagateTrace(r.Context(), request)
+	request.Header.Set(headerHops, strconv.FormatUint(hops, 10))
+
+	// counts against the concurrency of the upstream like the leader's
+	// request, until the body is copied.
+	release, ok := h.upstreams.acquire(r.Context(), request.URL)
+	if !ok {
 		return
 	}
+	defer release()
 
-	h.handler.ServeHTTP(w, r)
+	start := time.Now()
+	response, err := http.DefaultClient.Do(request)
+	logUpstreamSpan(span, h.log, request, response, start)
+	if err != nil {
+		h.log.Error("fetching upstream", zap.String("url", flight.url), zap.Error(err))
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := h.responseBody(r, response)
+	if err != nil {
+		h.log.Warn("rejecting upstream narinfo", zap.String("url", flight.url), zap.Error(err))
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	h.setRemoteHeaders(w, flight.url)
+	_, _ = io.Copy(w, body)
+}
+
+// relativeNarinfo refuses narinfos whose NAR is on another host, we only
+// store narinfos pointing at NARs we have, so their URL is an index name.
+func relativeNarinfo(rd io.Reader) (io.Reader, error) {
+	raw, err := io.ReadAll(io.LimitReader(rd, maxNarinfoSize))
+	if err != nil {
+		return nil, errors.WithMessage(err, "reading narinfo")
+	}
+
+	info := &narinfo.Narinfo{}
+	if err := info.Unmarshal(bytes.NewReader(raw)); err != nil {
+		return nil, errors.WithMessage(err, "parsing narinfo")
+	} else if !strings.HasPrefix(info.URL, "nar/") {
+		return nil, errors.Errorf("not caching narinfo with absolute URL %q", info.URL)
+	}
+
+	return bytes.NewReader(raw), nil
 }
 
+// permanentError is a cacheUrl failure that retrying won't fix, because the
+// URL is gone or what it has is rejected.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
 func (proxy *Proxy) cacheUrl(urlStr string) error {
 	u, err := url.Parse(urlStr)
 	if err != nil {
 		return errors.WithMessage(err, "parsing URL")
 	}
 
-	response, err := http.Get(urlStr)
+	if name, err := urlToIndexName(u); err == nil && proxy.tombstoned(name) {
+		return permanentError{errors.Errorf("%s was deleted", name)}
+	}
+
+	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
-		return errors.WithMessage(err, "getting URL")
+		return errors.WithMessage(err, "creating request")
 	}
 
-	if response.StatusCode/100 != 2 {
-		return errors.WithMessagef(err, "received status %d", response.StatusCode)
+	// only ask for changes if we still have what we copied last time.
+	if _, err := getIndex(proxy.localIndex, u); err == nil {
+		proxy.validators.apply(urlStr, req)
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.WithMessage(err, "getting URL")
 	}
 
 	defer response.Body.Close()
 
-	if strings.HasSuffix(urlStr, ".nar") || strings.HasSuffix(urlStr, ".narinfo") {
-		if chunker, err := desync.NewChunker(response.Body, chunkSizeMin(), chunkSizeAvg, chunkSizeMax()); err != nil {
-			return errors.WithMessage(err, "making chunker")
-		} else if idx, err := desync.ChunkStream(context.Background(), chunker, proxy.localStore, defaultThreads); err != nil {
-			return errors.WithMessage(err, "chunking body")
-		} else if err := storeIndex(proxy.localIndex, u, idx); err != nil {
-			return errors.WithMessage(err, "storing index")
+	if response.StatusCode == http.StatusNotModified {
+		metricUpstreamNotModified.Add(1)
+		return nil
+	}
+
+	switch {
+	case response.StatusCode == http.StatusNotFound, response.StatusCode == http.StatusGone:
+		return permanentError{errors.Errorf("received status %d", response.StatusCode)}
+	case response.StatusCode/100 != 2:
+		return errors.Errorf("received status %d", response.StatusCode)
+	}
+
+	body := io.Reader(response.Body)
+	if strings.HasSuffix(urlStr, ".narinfo") {
+		if body, err = relativeNarinfo(body); err != nil {
+			return permanentError{err}
+		}
+		if proxy.RewriteUpstreamNarinfo {
+			if body, err = proxy.rewriteNarinfo(body); err != nil {
+				return errors.WithMessage(err, "rewriting narinfo")
+			}
+		}
+	}
+
+	if isCompressedNar(u.Path) {
+		rd, err := decompress(u.Path, body)
+		if err != nil {
+			return errors.WithMessage(err, "decompressing body")
 		}
-	} else if strings.HasSuffix(urlStr, ".nar.xz") {
-		xzRd := xz.NewReader(response.Body)
-		if chunker, err := desync.NewChunker(xzRd, chunkSizeMin(), chunkSizeAvg, chunkSizeMax()); err != nil {
-			return errors.WithMessage(err, "making chunker")
-		} else if idx, err := desync.ChunkStream(context.Background(), chunker, proxy.localStore, defaultThreads); err != nil {
-			return errors.WithMessage(err, "chunking body")
-		} else if err := storeIndex(proxy.localIndex, u, idx); err != nil {
-			return errors.WithMessage(err, "storing index")
+		defer rd.Close()
+		body = rd
+	}
+
+	if strings.HasSuffix(urlStr, ".nar") || strings.HasSuffix(urlStr, ".narinfo") || strings.HasSuffix(urlStr, ".drv") || isCompressedNar(u.Path) {
+		if name, err := urlToIndexName(u); err != nil {
+			return permanentError{errors.WithMessage(err, "getting index name")}
+		} else if err := proxy.storeLocal(name, body); err != nil {
+			return err
 		}
+		proxy.validators.record(urlStr, response)
 	} else {
-		return fmt.Errorf("unexpected extension in url: %s", urlStr)
+		return permanentError{fmt.Errorf("unexpected extension in url: %s", urlStr)}
 	}
 
 	return nil
 }
 
+// storeLocal chunks rd into the local store and writes its index as name.
+func (proxy *Proxy) storeLocal(name string, rd io.Reader) error {
+	if chunker, err := desync.NewChunker(rd, chunkSizeMin(), chunkSizeAvg, chunkSizeMax()); err != nil {
+		return errors.WithMessage(err, "making chunker")
+	} else if idx, err := desync.ChunkStream(context.Background(), chunker, proxy.localStore, defaultThreads); err != nil {
+		return errors.WithMessage(err, "chunking body")
+	} else if err := proxy.localIndex.StoreIndex(name, idx); err != nil {
+		return errors.WithMessage(err, "storing index")
+	} else {
+		proxy.dedup.add(name, idx)
+		proxy.enqueueSecondaries(name)
+	}
+	return nil
+}
+
 var (
 	metricRemoteCachedFail = metrics.MustCounter("spongix_remote_cache_fail", "Number of upstream cache entries failed to copy")
 	metricRemoteCachedOk   = metrics.MustCounter("spongix_remote_cache_ok", "Number of upstream cache entries copied")
 )
 
 func (proxy *Proxy) startCache() {
-	for urlStr := range proxy.cacheChan {
+	defer close(proxy.cacheQueue.done)
+
+	for urlStr := range proxy.cacheQueue.ch {
 		proxy.log.Info("Caching", zap.String("url", urlStr))
 		if err := proxy.cacheUrl(urlStr); err != nil {
 			metricRemoteCachedFail.Add(1)
@@ -381,5 +812,6 @@ func (proxy *Proxy) startCache() {
 			metricRemoteCachedOk.Add(1)
 			proxy.log.Info("Cached", zap.String("url", urlStr))
 		}
+		proxy.cacheQueue.finish(urlStr)
 	}
 }
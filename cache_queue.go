@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pascaldekloe/metrics"
+)
+
+var (
+	metricCacheQueued    = metrics.MustInteger("spongix_cache_queued", "Number of upstream responses waiting to be copied")
+	metricCacheCoalesced = metrics.MustCounter("spongix_cache_coalesced", "Number of upstream copies skipped because the URL was already queued")
+	metricCacheDropped   = metrics.MustCounter("spongix_cache_dropped", "Number of upstream copies dropped because the queue was full")
+)
+
+// cacheQueue holds upstream URLs that should be copied into the local store.
+// Copies are best effort, they'll be queued again on the next request, so
+// instead of blocking requests when the queue is full they are dropped.
+type cacheQueue struct {
+	ch      chan string
+	done    chan struct{}
+	mu      sync.Mutex
+	pending map[string]struct{}
+	closed  bool
+}
+
+func newCacheQueue(size int) *cacheQueue {
+	return &cacheQueue{
+		ch:      make(chan string, size),
+		done:    make(chan struct{}),
+		pending: map[string]struct{}{},
+	}
+}
+
+func (q *cacheQueue) enqueue(urlStr string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		metricCacheDropped.Add(1)
+		return
+	} else if _, found := q.pending[urlStr]; found {
+		metricCacheCoalesced.Add(1)
+		return
+	}
+
+	select {
+	case q.ch <- urlStr:
+		q.pending[urlStr] = yes
+		metricCacheQueued.Set(int64(len(q.pending)))
+	default:
+		metricCacheDropped.Add(1)
+	}
+}
+
+func (q *cacheQueue) finish(urlStr string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, urlStr)
+	metricCacheQueued.Set(int64(len(q.pending)))
+}
+
+// close stops accepting new URLs, the ones already queued are still copied.
+func (q *cacheQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+// drain waits until all queued URLs are copied or the timeout is reached and
+// returns the number of URLs that were left.
+func (q *cacheQueue) drain(timeout time.Duration) int {
+	q.close()
+
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
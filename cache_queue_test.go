@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheQueue(t *testing.T) {
+	queue := newCacheQueue(1)
+
+	queue.enqueue("http://example.com" + fNar)
+	queue.enqueue("http://example.com" + fNar)
+	queue.enqueue("http://example.com" + fNarinfo)
+
+	if len(queue.ch) != 1 || len(queue.pending) != 1 {
+		t.Fatalf("expected one queued URL, got %d", len(queue.ch))
+	}
+
+	go func() {
+		for urlStr := range queue.ch {
+			queue.finish(urlStr)
+		}
+		close(queue.done)
+	}()
+
+	if left := queue.drain(time.Second); left != 0 {
+		t.Fatalf("expected queue to be drained, %d left", left)
+	}
+
+	queue.enqueue("http://example.com" + fNarinfo)
+	if len(queue.pending) != 0 {
+		t.Fatal("closed queue accepted a URL")
+	}
+}
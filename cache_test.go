@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestCacheUrlConditional(t *testing.T) {
+	proxy := testProxy(t)
+	notModified := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(testdata[fNarinfo])
+	}))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := proxy.cacheUrl(srv.URL + fNarinfo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if notModified != 1 {
+		t.Fatalf("expected one conditional request, got %d", notModified)
+	}
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get(fNarinfo).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestCacheUrlAbsoluteNarinfo(t *testing.T) {
+	proxy := testProxy(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Replace(testdata[fNarinfo],
+			[]byte("URL: nar/"), []byte("URL: https://example.com/nar/"), 1))
+	}))
+	defer srv.Close()
+
+	if err := proxy.cacheUrl(srv.URL + fNarinfo); err == nil {
+		t.Fatal("expected an error for an absolute URL")
+	}
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/cache" + fNarinfo).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestRouterNarRange(t *testing.T) {
+	proxy := testProxy(t)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Method("GET").
+		URL(fNar).
+		Header("Range", "bytes=10-19").
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Header("Content-Range", "bytes 10-19/"+strconv.Itoa(len(testdata[fNar]))).
+		Body(string(testdata[fNar][10:20])).
+		Status(http.StatusPartialContent).
+		End()
+}
+
+func TestValidIndexName(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5.narinfo":                        true,
+		"nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar":    true,
+		"nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar.xz": false,
+		"8CKXC8BIQQFDWYHR0W70JGRCB4H7A4Y5.narinfo":                        false,
+		"../8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5.narinfo":                     false,
+		"nar/../8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5.narinfo":                 false,
+		"history/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5.1.narinfo":              false,
+		"": false,
+	} {
+		if actual := validIndexName(name); actual != expected {
+			t.Errorf("validIndexName(%q) = %v, expected %v", name, actual, expected)
+		}
+	}
+}
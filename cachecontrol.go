@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cacheControl returns the Cache-Control of a response with the given max age.
+// Nothing is cached for a max age of 0.
+func cacheControl(maxAge time.Duration, immutable bool) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+
+	value := "public, max-age=" + strconv.FormatInt(int64(maxAge.Seconds()), 10)
+	if immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       func(status int) string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", w.value(status))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheControlWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// withCacheControl tells CDNs and other shared caches in front of spongix how
+// long to keep responses. NARs are addressed by their hash and never change,
+// narinfos may be replaced, re-signed or deleted, and a missing narinfo may be
+// uploaded any moment. Errors are never cached.
+func (proxy *Proxy) withCacheControl(immutable bool) mux.MiddlewareFunc {
+	maxAge := proxy.NarinfoMaxAge
+	if immutable {
+		maxAge = proxy.NarMaxAge
+	}
+
+	found := cacheControl(maxAge, immutable)
+	missing := cacheControl(proxy.MissMaxAge, false)
+
+	value := func(status int) string {
+		switch status {
+		case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+			return found
+		case http.StatusNotFound:
+			return missing
+		default:
+			return "no-store"
+		}
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" && r.Method != "HEAD" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			h.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: value}, r)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouterCacheControl(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.Substituters = []string{}
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	router := testRouter(proxy)
+
+	for _, tc := range []struct {
+		method, url, expected string
+	}{
+		{"GET", fNarinfo, "public, max-age=60"},
+		{"HEAD", fNarinfo, "public, max-age=60"},
+		{"GET", fNar, "public, max-age=31536000, immutable"},
+		{"GET", fNarXz, "public, max-age=31536000, immutable"},
+		{"GET", "/00000000000000000000000000000000.narinfo", "no-cache"},
+		{"PUT", fNarinfo, ""},
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, bytes.NewReader(testdata[fNarinfo])))
+		if actual := rec.Header().Get("Cache-Control"); actual != tc.expected {
+			t.Errorf("%s %s: expected Cache-Control %q, got %q", tc.method, tc.url, tc.expected, actual)
+		}
+	}
+
+	if actual := cacheControl(0, true); actual != "no-cache" {
+		t.Errorf("expected no-cache for a max age of 0, got %q", actual)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var (
+	metricCanaryRequests   = metrics.MustCounter("spongix_canary_requests", "Number of reads routed to the canary store first")
+	metricCanaryCompared   = metrics.MustCounter("spongix_canary_compared", "Number of canary reads compared against the primary index")
+	metricCanaryDivergence = metrics.MustCounter("spongix_canary_divergence", "Number of canary reads where the stores disagreed")
+)
+
+// canaryComparisons limits how many canary reads are compared at once, reads
+// beyond that are served without being compared.
+const canaryComparisons = 4
+
+// canaryHandler serves a percentage of reads from the alternate store first,
+// while the remaining reads keep using the primary store order. Every read
+// routed through the canary is compared against the primary index to detect
+// diverging contents. Comparing happens in the background, so the read doesn't
+// wait for two more index lookups.
+type canaryHandler struct {
+	log       *zap.Logger
+	primary   http.Handler
+	alternate http.Handler
+	percent   uint64
+	index     desync.IndexStore
+	altIndex  desync.IndexStore
+	comparing chan struct{}
+}
+
+// withCanaryHandler replaces the local and S3 cache handlers. Without a
+// canary percentage it's equivalent to using them in sequence.
+func (proxy *Proxy) withCanaryHandler() mux.MiddlewareFunc {
+	// shared by every handler this wraps, or the limit wouldn't hold.
+	comparing := make(chan struct{}, canaryComparisons)
+
+	return func(h http.Handler) http.Handler {
+		tiers := proxy.indexTiers()
+		primary := proxy.withIndexTiers(tiers)(h)
+		if proxy.CanaryPercent == 0 || len(tiers) < 2 {
+			return primary
+		}
+
+		return &canaryHandler{
+			log:       proxy.log,
+			primary:   primary,
+			alternate: proxy.withIndexTiers([]indexTier{tiers[1], tiers[0]})(h),
+			percent:   proxy.CanaryPercent,
+			index:     tiers[0].index,
+			altIndex:  tiers[1].index,
+			comparing: comparing,
+		}
+	}
+}
+
+func (c *canaryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "HEAD", "GET":
+		if uint64(rand.Intn(100)) < c.percent {
+			metricCanaryRequests.Add(1)
+			select {
+			case c.comparing <- yes:
+				go func(u url.URL) {
+					defer func() { <-c.comparing }()
+					c.compare(&u)
+				}(*r.URL)
+			default:
+			}
+			c.alternate.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	c.primary.ServeHTTP(w, r)
+}
+
+func (c *canaryHandler) compare(u *url.URL) {
+	defer metricCanaryCompared.Add(1)
+
+	idx, err := getIndex(c.index, u)
+	altIdx, altErr := getIndex(c.altIndex, u)
+
+	diverged := false
+	switch {
+	case err != nil && altErr != nil:
+	case err != nil || altErr != nil:
+		diverged = true
+	case idx.Length() != altIdx.Length() || len(idx.Chunks) != len(altIdx.Chunks):
+		diverged = true
+	default:
+		for i, chunk := range idx.Chunks {
+			if chunk.ID != altIdx.Chunks[i].ID {
+				diverged = true
+				break
+			}
+		}
+	}
+
+	if diverged {
+		metricCanaryDivergence.Add(1)
+		c.log.Warn("canary diverged",
+			zap.String("url", u.String()),
+			zap.NamedError("primary", err),
+			zap.NamedError("alternate", altErr),
+		)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterCanary(t *testing.T) {
+	t.Run("serves from s3 first", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+		proxy.CanaryPercent = 100
+		insertFake(tt, proxy.s3Store, proxy.s3Index, fNarinfo)
+
+		requests := metricCanaryRequests.Get()
+		compared := metricCanaryCompared.Get()
+		divergence := metricCanaryDivergence.Get()
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Method("GET").
+			URL(fNarinfo).
+			Expect(tt).
+			Header(headerCache, headerCacheHit).
+			Header(headerContentType, mimeNarinfo).
+			Body(string(testdata[fNarinfo])).
+			Status(http.StatusOK).
+			End()
+
+		if metricCanaryRequests.Get() != requests+1 {
+			tt.Fatal("canary request wasn't counted")
+		}
+
+		for i := 0; metricCanaryCompared.Get() == compared; i++ {
+			if i > 100 {
+				tt.Fatal("canary read wasn't compared")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if metricCanaryDivergence.Get() != divergence+1 {
+			tt.Fatal("canary divergence wasn't counted")
+		}
+	})
+
+	t.Run("no divergence if both stores agree", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+		proxy.CanaryPercent = 100
+		insertFake(tt, proxy.localStore, proxy.localIndex, fNarinfo)
+		insertFake(tt, proxy.s3Store, proxy.s3Index, fNarinfo)
+
+		compared := metricCanaryCompared.Get()
+		divergence := metricCanaryDivergence.Get()
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Method("HEAD").
+			URL(fNarinfo).
+			Expect(tt).
+			Header(headerCache, headerCacheHit).
+			Status(http.StatusOK).
+			End()
+
+		for i := 0; metricCanaryCompared.Get() == compared; i++ {
+			if i > 100 {
+				tt.Fatal("canary read wasn't compared")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if metricCanaryDivergence.Get() != divergence {
+			tt.Fatal("canary divergence was counted")
+		}
+	})
+}
+
+func TestCanaryComparisonsShared(t *testing.T) {
+	proxy := withS3(testProxy(t))
+	proxy.CanaryPercent = 100
+
+	middleware := proxy.withCanaryHandler()
+	first := middleware(http.HandlerFunc(serveNotFound)).(*canaryHandler)
+	second := middleware(http.HandlerFunc(serveNotFound)).(*canaryHandler)
+	if first.comparing != second.comparing {
+		t.Fatal("expected the handlers to share the comparison limit")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// upper bound of entries returned by a single catalog request.
+const catalogLimit = 1000
+
+// how long the listing of narinfos is reused for following pages.
+const catalogListingTTL = time.Minute
+
+type catalogEntry struct {
+	Hash      string    `json:"hash"`
+	StorePath string    `json:"store_path"`
+	NarSize   int64     `json:"nar_size"`
+	FileSize  int64     `json:"file_size"`
+	Uploaded  time.Time `json:"uploaded"`
+}
+
+type catalogPage struct {
+	Entries []catalogEntry `json:"entries"`
+	Next    string         `json:"next,omitempty"`
+}
+
+type catalogFilter struct {
+	name          string
+	minSize       int64
+	maxSize       int64
+	uploadedAfter time.Time
+	after         string
+	limit         int
+}
+
+func parseCatalogFilter(query url.Values) (*catalogFilter, error) {
+	filter := &catalogFilter{
+		name:  query.Get("name"),
+		after: query.Get("after"),
+		limit: 100,
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > catalogLimit {
+			return nil, errors.Errorf("limit must be between 1 and %d", catalogLimit)
+		}
+		filter.limit = limit
+	}
+
+	for param, size := range map[string]*int64{"min_size": &filter.minSize, "max_size": &filter.maxSize} {
+		if raw := query.Get(param); raw != "" {
+			var err error
+			if *size, err = strconv.ParseInt(raw, 10, 64); err != nil || *size < 0 {
+				return nil, errors.Errorf("invalid %s parameter", param)
+			}
+		}
+	}
+
+	if raw := query.Get("uploaded_after"); raw != "" {
+		var err error
+		if filter.uploadedAfter, err = time.Parse(time.RFC3339, raw); err != nil {
+			return nil, errors.New("uploaded_after must be an RFC 3339 time")
+		}
+	}
+
+	return filter, nil
+}
+
+func (f *catalogFilter) match(entry catalogEntry) bool {
+	switch {
+	case f.name != "" && !strings.Contains(path.Base(entry.StorePath), f.name):
+		return false
+	case f.minSize > 0 && entry.NarSize < f.minSize:
+		return false
+	case f.maxSize > 0 && entry.NarSize > f.maxSize:
+		return false
+	case !f.uploadedAfter.IsZero() && !entry.Uploaded.After(f.uploadedAfter):
+		return false
+	}
+	return true
+}
+
+// catalogListing is the sorted list of local narinfos, kept for a while so
+// paging through the catalog doesn't walk the index for every page.
+type catalogListing struct {
+	mu       sync.Mutex
+	listed   time.Time
+	names    []string
+	modTimes map[string]time.Time
+}
+
+// get returns the cached listing, or lists the index again once it's too old.
+func (l *catalogListing) get(indices desync.LocalIndexStore) ([]string, map[string]time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.names != nil && time.Since(l.listed) < catalogListingTTL {
+		return l.names, l.modTimes, nil
+	}
+
+	names := []string{}
+	modTimes := map[string]time.Time{}
+	err := filepath.WalkDir(indices.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			if filepath.Clean(p) != filepath.Clean(indices.Path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Ext(p) != ".narinfo" {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		names = append(names, d.Name())
+		modTimes[d.Name()] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Strings(names)
+	l.names, l.modTimes, l.listed = names, modTimes, time.Now()
+	return names, modTimes, nil
+}
+
+// catalog lists the local narinfos matching the filter, ordered by hash. The
+// hash of the last entry is returned as Next if there may be more, and is
+// passed as after to get the next page.
+func (proxy *Proxy) catalog(filter *catalogFilter) (*catalogPage, error) {
+	page := &catalogPage{Entries: []catalogEntry{}}
+
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return page, nil
+	}
+
+	names, modTimes, err := proxy.catalogCache.get(indices)
+	if err != nil {
+		return nil, err
+	}
+
+	start := sort.Search(len(names), func(i int) bool {
+		return strings.TrimSuffix(names[i], ".narinfo") > filter.after
+	})
+
+	for _, name := range names[start:] {
+		if !filter.uploadedAfter.IsZero() && !modTimes[name].After(filter.uploadedAfter) {
+			continue
+		}
+
+		idx, err := indices.GetIndex(name)
+		if os.IsNotExist(errors.Cause(err)) {
+			// removed since it was listed.
+			continue
+		} else if err != nil {
+			proxy.log.Warn("reading narinfo index", zap.Error(err), zap.String("name", name))
+			continue
+		}
+
+		info, err := assembleNarinfo(proxy.localStore, idx)
+		if err != nil {
+			proxy.log.Warn("reading narinfo", zap.Error(err), zap.String("name", name))
+			continue
+		}
+
+		entry := catalogEntry{
+			Hash:      strings.TrimSuffix(name, ".narinfo"),
+			StorePath: info.StorePath,
+			NarSize:   info.NarSize,
+			FileSize:  info.FileSize,
+			Uploaded:  modTimes[name],
+		}
+		if !filter.match(entry) {
+			continue
+		}
+
+		if len(page.Entries) == filter.limit {
+			page.Next = page.Entries[len(page.Entries)-1].Hash
+			break
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+
+	return page, nil
+}
+
+// GET /catalog?name=<substring>&min_size=<bytes>&max_size=<bytes>&uploaded_after=<time>&limit=<n>&after=<hash>
+func (proxy *Proxy) catalogList(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseCatalogFilter(r.URL.Query())
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+		return
+	}
+
+	page, err := proxy.catalog(filter)
+	if err != nil {
+		proxy.log.Error("listing catalog", zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed listing catalog\n")
+		return
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		proxy.log.Error("encoding catalog", zap.Error(err))
+	}
+}
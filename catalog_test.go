@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterCatalog(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	if idx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNarinfo, "/")); err != nil {
+		t.Fatal(err)
+	} else if err := proxy.localIndex.StoreIndex("00000000000000000000000000000000.narinfo", idx); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := func(query string) catalogPage {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, testAdminRequest("GET", "/catalog?"+query, nil))
+		if res.Code != http.StatusOK {
+			t.Fatalf("GET /catalog?%s: status %d: %s", query, res.Code, res.Body)
+		}
+
+		page := catalogPage{}
+		if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	page := catalog("limit=1")
+	if len(page.Entries) != 1 || page.Entries[0].Hash != "00000000000000000000000000000000" || page.Next != page.Entries[0].Hash {
+		t.Fatalf("unexpected first page: %v", page)
+	}
+
+	page = catalog("limit=1&after=" + page.Next)
+	if len(page.Entries) != 1 || page.Next != "" {
+		t.Fatalf("unexpected second page: %v", page)
+	}
+	if entry := page.Entries[0]; entry.Hash != "8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5" ||
+		entry.StorePath != "/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10" ||
+		entry.NarSize != 1634360 || entry.Uploaded.IsZero() {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+
+	for query, expected := range map[string]int{
+		"name=libunistring": 2,
+		"name=hello":        0,
+		"min_size=1634360":  2,
+		"min_size=1634361":  0,
+		"max_size=1000":     0,
+		"uploaded_after=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339): 2,
+		"uploaded_after=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339):  0,
+	} {
+		if page := catalog(query); len(page.Entries) != expected {
+			t.Errorf("%s: got %d entries, expected %d", query, len(page.Entries), expected)
+		}
+	}
+
+	// pages reuse the listing, skipping narinfos removed since.
+	listed := proxy.catalogCache.listed
+	indexDir := proxy.localIndex.(desync.LocalIndexStore).Path
+	if err := os.Remove(filepath.Join(indexDir, "00000000000000000000000000000000.narinfo")); err != nil {
+		t.Fatal(err)
+	}
+	if page := catalog(""); len(page.Entries) != 1 || !proxy.catalogCache.listed.Equal(listed) {
+		t.Fatalf("expected one entry from the cached listing, got %v", page)
+	}
+
+	apitest.New().
+		Handler(router).
+		Get("/catalog").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Query("limit", "0").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+// chunkDisk is a local chunk store the GC, scrubbing and access times work
+// on. It's either desync's directories of chunk files, or packs.
+type chunkDisk interface {
+	desync.WriteStore
+	RemoveChunk(id desync.ChunkID) error
+	Verify(ctx context.Context, n int, repair bool, w io.Writer) error
+	// chunkDir returns the chunks whose ID starts with the given 16 bit
+	// prefix, desync spreads chunk files over directories named like that.
+	// It's false if there's no such directory.
+	chunkDir(prefix int) ([]chunkStat, bool, error)
+	// modTime is the time the chunk was stored or last accessed.
+	modTime(id desync.ChunkID) (time.Time, error)
+	touch(id desync.ChunkID, t time.Time) error
+}
+
+// chunkDisk returns the local store if it's on disk.
+func (proxy *Proxy) chunkDisk() (chunkDisk, bool) {
+	switch store := proxy.localStore.(type) {
+	case chunkDisk:
+		return store, true
+	case desync.LocalStore:
+		return chunkFiles{store}, true
+	default:
+		return nil, false
+	}
+}
+
+// chunkFiles stores every chunk in its own file.
+type chunkFiles struct {
+	desync.LocalStore
+}
+
+func (s chunkFiles) chunkDir(prefix int) ([]chunkStat, bool, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Base, fmt.Sprintf("%04x", prefix)))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	stats := []chunkStat{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".tmp") || filepath.Ext(name) != desync.CompressedChunkExt {
+			continue
+		}
+
+		id, err := desync.ChunkIDFromString(strings.TrimSuffix(name, desync.CompressedChunkExt))
+		if err != nil {
+			return nil, true, err
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, true, err
+		}
+
+		stats = append(stats, chunkStat{id: id, size: info.Size(), mtime: info.ModTime()})
+	}
+
+	return stats, true, nil
+}
+
+func (s chunkFiles) modTime(id desync.ChunkID) (time.Time, error) {
+	info, err := os.Stat(chunkPath(s.LocalStore, id))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s chunkFiles) touch(id desync.ChunkID, t time.Time) error {
+	return os.Chtimes(chunkPath(s.LocalStore, id), t, t)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// GET /index/<name>.caibx
+// Returns the desync index of a narinfo or NAR, so clients with desync can
+// fetch only the chunks they don't already have from /chunks.
+func (proxy *Proxy) serveChunkIndex(w http.ResponseWriter, r *http.Request) {
+	idx, _, err := proxy.resolveIndex(mux.Vars(r)["name"])
+	if err != nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := idx.WriteTo(buf); err != nil {
+		proxy.log.Error("encoding index", zap.String("name", mux.Vars(r)["name"]), zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed encoding index\n")
+		return
+	}
+
+	w.Header().Set(headerContentType, mimeOctetStream)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		_, _ = w.Write(buf.Bytes())
+	}
+}
+
+// GET /chunks/<id>
+// GET /chunks/<id[:4]>/<id>.cacnk
+// Returns a chunk, uncompressed or in the compressed layout of a desync chunk
+// store, so `desync extract -s http://.../chunks/` works against spongix.
+func (proxy *Proxy) serveChunk(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := desync.ChunkIDFromString(vars["id"])
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, "invalid chunk id\n")
+		return
+	} else if prefix, ok := vars["prefix"]; ok && prefix != vars["id"][:4] {
+		serveNotFound(w, r)
+		return
+	}
+
+	var chunk *desync.Chunk
+	for _, tier := range proxy.indexTiers() {
+		if chunk, err = tier.store.GetChunk(id); err == nil {
+			break
+		}
+	}
+	if chunk == nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	data, err := chunk.Data()
+	if err == nil && vars["prefix"] != "" {
+		data, err = desync.Compress(data)
+	}
+	if err != nil {
+		proxy.log.Error("reading chunk", zap.String("id", vars["id"]), zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed reading chunk\n")
+		return
+	}
+
+	w.Header().Set(headerContentType, mimeOctetStream)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	// chunks are addressed by their content and never change.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		_, _ = w.Write(data)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/folbricht/desync"
+)
+
+func TestRouterChunks(t *testing.T) {
+	proxy := testProxy(t)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	router := testRouter(proxy)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := get("/index" + fNar + ".caibx")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected index, got %d", rec.Code)
+	}
+
+	idx, err := desync.IndexFromReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, compressed := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, chunk := range idx.Chunks {
+		id := chunk.ID.String()
+
+		rec := get("/chunks/" + id)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected chunk %s, got %d", id, rec.Code)
+		}
+		plain.Write(rec.Body.Bytes())
+
+		rec = get("/chunks/" + id[:4] + "/" + id + ".cacnk")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected compressed chunk %s, got %d", id, rec.Code)
+		}
+		data, err := desync.Decompress(nil, rec.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed.Write(data)
+	}
+
+	if !bytes.Equal(plain.Bytes(), testdata[fNar]) {
+		t.Fatal("uncompressed chunks don't assemble into the NAR")
+	} else if !bytes.Equal(compressed.Bytes(), testdata[fNar]) {
+		t.Fatal("compressed chunks don't assemble into the NAR")
+	}
+
+	for path, status := range map[string]int{
+		"/index" + fNarXz + ".caibx":                           http.StatusNotFound,
+		"/chunks/" + strings.Repeat("0", 64):                   http.StatusNotFound,
+		"/chunks/ffff/" + idx.Chunks[0].ID.String() + ".cacnk": http.StatusNotFound,
+	} {
+		if rec := get(path); rec.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"container/list"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricCompressedHits  = metrics.MustCounter("spongix_compressed_cache_hits", "Number of compressed NARs served without compressing them again")
+	metricCompressedBytes = metrics.MustInteger("spongix_compressed_cache_bytes", "Size of the compressed NARs kept on disk")
+)
+
+type compressedCacheEntry struct {
+	name string
+	size int64
+}
+
+// compressedCache keeps NARs the way they were compressed for clients, named
+// like the compressed URL, e.g. nar/<hash>.nar.zst. An entry stays valid as
+// long as the uncompressed NAR is stored, callers check that before serving it
+// and remove the entries of NARs that are uploaded again or deleted. The least
+// recently served entries are removed once the cache grows beyond its limit.
+type compressedCache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+func newCompressedCache(dir string, limit int64) (*compressedCache, error) {
+	c := &compressedCache{
+		dir:     dir,
+		limit:   limit,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "nar"), 0o755); err != nil {
+		return nil, err
+	}
+
+	// pick up what the last run compressed, oldest first so they are
+	// evicted first.
+	type found struct {
+		compressedCacheEntry
+		mtime int64
+	}
+	files := []found{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		if !isCompressedNar(name) || !validIndexName(name[:len(name)-len(filepath.Ext(name))]) {
+			// left over from writes that didn't finish.
+			return os.Remove(path)
+		}
+
+		files = append(files, found{compressedCacheEntry{name, info.Size()}, info.ModTime().UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime < files[j].mtime })
+	for _, file := range files {
+		c.add(file.name, file.size)
+	}
+
+	return c, nil
+}
+
+func (proxy *Proxy) setupCompressedCache() {
+	if proxy.CompressedCacheSize == 0 {
+		return
+	}
+
+	c, err := newCompressedCache(filepath.Join(proxy.Dir, "compressed"), int64(proxy.CompressedCacheSize)*1024*1024)
+	if err != nil {
+		proxy.log.Fatal("failed to set up the compressed NAR cache", zap.Error(err))
+	}
+	proxy.compressed = c
+}
+
+func (c *compressedCache) path(name string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(name))
+}
+
+// open returns the cached file of name and its size.
+func (c *compressedCache) open(name string) (*os.File, int64, bool) {
+	c.mu.Lock()
+	elem, found := c.entries[name]
+	if found {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+
+	if !found {
+		return nil, 0, false
+	}
+
+	fd, err := os.Open(c.path(name))
+	if err != nil {
+		c.remove(name)
+		return nil, 0, false
+	}
+
+	metricCompressedHits.Add(1)
+	return fd, elem.Value.(*compressedCacheEntry).size, true
+}
+
+func (c *compressedCache) add(name string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[name]; found {
+		c.size -= elem.Value.(*compressedCacheEntry).size
+		c.lru.Remove(elem)
+	}
+
+	c.entries[name] = c.lru.PushFront(&compressedCacheEntry{name: name, size: size})
+	c.size += size
+
+	for c.size > c.limit && c.lru.Len() > 0 {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*compressedCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		_ = os.Remove(c.path(entry.name))
+	}
+
+	metricCompressedBytes.Set(c.size)
+}
+
+func (c *compressedCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[name]; found {
+		c.size -= elem.Value.(*compressedCacheEntry).size
+		c.lru.Remove(elem)
+		delete(c.entries, name)
+		metricCompressedBytes.Set(c.size)
+	}
+	_ = os.Remove(c.path(name))
+}
+
+// removeNar removes every compressed variant of the NAR with the given index
+// name.
+func (c *compressedCache) removeNar(name string) {
+	for ext := range compressionMagics {
+		c.remove(name + ext)
+	}
+}
+
+// create returns a file to write the compressed NAR into while it's sent, it
+// only becomes visible once committed.
+func (c *compressedCache) create(name string) (*compressedCacheFile, error) {
+	fd, err := os.CreateTemp(filepath.Dir(c.path(name)), ".tmp-*")
+	if err != nil {
+		return nil, errors.WithMessage(err, "creating compressed NAR file")
+	}
+	return &compressedCacheFile{cache: c, name: name, fd: fd}, nil
+}
+
+type compressedCacheFile struct {
+	cache *compressedCache
+	name  string
+	fd    *os.File
+	size  int64
+	err   error
+}
+
+// Write never fails, so a broken cache file doesn't break the response it's
+// written along with. The file is discarded on commit instead.
+func (f *compressedCacheFile) Write(p []byte) (int, error) {
+	if f.err == nil {
+		n, err := f.fd.Write(p)
+		f.size += int64(n)
+		f.err = err
+	}
+	return len(p), nil
+}
+
+func (f *compressedCacheFile) commit() error {
+	if f.err != nil {
+		f.discard()
+		return f.err
+	}
+
+	if err := f.fd.Close(); err != nil {
+		_ = os.Remove(f.fd.Name())
+		return err
+	}
+
+	if err := os.Rename(f.fd.Name(), f.cache.path(f.name)); err != nil {
+		_ = os.Remove(f.fd.Name())
+		return err
+	}
+
+	f.cache.add(f.name, f.size)
+	return nil
+}
+
+func (f *compressedCacheFile) discard() {
+	_ = f.fd.Close()
+	_ = os.Remove(f.fd.Name())
+}
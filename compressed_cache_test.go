@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/klauspost/compress/zstd"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterCompressedCache(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.ZstdResponses = true
+	proxy.CompressedCacheSize = 1
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	router := testRouter(proxy)
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.Code)
+		}
+
+		dec, err := zstd.NewReader(bytes.NewReader(res.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		if body, err := io.ReadAll(dec); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(body, testdata[fNar]) {
+			t.Fatal("decompressed body doesn't match")
+		}
+		return res
+	}
+
+	hits := metricCompressedHits.Get()
+
+	first := get(fNar+".zst", "")
+	if n := metricCompressedHits.Get() - hits; n != 0 {
+		t.Fatalf("expected no hits, got %d", n)
+	}
+
+	second := get(fNar+".zst", "")
+	if n := metricCompressedHits.Get() - hits; n != 1 {
+		t.Fatalf("expected one hit, got %d", n)
+	} else if second.Header().Get("Content-Length") != strconv.Itoa(first.Body.Len()) {
+		t.Fatalf("unexpected Content-Length %q", second.Header().Get("Content-Length"))
+	}
+
+	// the encoded NAR is the same as the .nar.zst.
+	encoded := get(fNar, "zstd")
+	if n := metricCompressedHits.Get() - hits; n != 2 {
+		t.Fatalf("expected two hits, got %d", n)
+	} else if encoded.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("expected zstd encoding, got %q", encoded.Header().Get("Content-Encoding"))
+	}
+
+	// uploading the NAR again drops what was compressed before.
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+	if _, _, ok := proxy.compressed.open(strings.TrimPrefix(fNar, "/") + ".zst"); ok {
+		t.Fatal("expected the compressed NAR to be removed")
+	}
+	get(fNar+".zst", "")
+	if n := metricCompressedHits.Get() - hits; n != 2 {
+		t.Fatalf("expected no further hits, got %d", n)
+	}
+
+	// nothing is served for NARs that are gone.
+	if err := os.Remove(filepath.Join(proxy.localIndex.(desync.LocalIndexStore).Path, strings.TrimPrefix(fNar, "/"))); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", fNar+".zst", nil)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", res.Code)
+	}
+}
+
+func TestCompressedCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newCompressedCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range []string{"0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz", "1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301"} {
+		file, err := c.create("nar/" + hash + ".nar.zst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = file.Write([]byte("123456"))
+		if err := file.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, ok := c.open("nar/0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz.nar.zst"); ok {
+		t.Fatal("expected the least recently used NAR to be evicted")
+	}
+
+	// a restart picks up what's left.
+	if c, err = newCompressedCache(dir, 10); err != nil {
+		t.Fatal(err)
+	} else if fd, size, ok := c.open("nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar.zst"); !ok || size != 6 {
+		t.Fatalf("expected the NAR to be kept, got %v %d", ok, size)
+	} else {
+		fd.Close()
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"compress/bzip2"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jamespfennell/xz"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// extensions of compressed NARs we can decompress, we always store the
+// uncompressed NAR.
+var narCompressionExts = []string{".xz", ".zst", ".bz2"}
+
+func isCompressedNar(name string) bool {
+	for _, ext := range narCompressionExts {
+		if strings.HasSuffix(name, ".nar"+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// decompress returns a reader of the uncompressed content based on the file
+// extension in name.
+func decompress(name string, rd io.Reader) (io.ReadCloser, error) {
+	switch filepath.Ext(name) {
+	case ".xz":
+		return xz.NewReader(rd), nil
+	case ".zst":
+		dec, err := zstd.NewReader(rd)
+		if err != nil {
+			return nil, errors.WithMessage(err, "creating zstd reader")
+		}
+		return dec.IOReadCloser(), nil
+	case ".bz2":
+		return io.NopCloser(bzip2.NewReader(rd)), nil
+	default:
+		return io.NopCloser(rd), nil
+	}
+}
+
+// compress returns a writer that compresses into wr based on the file
+// extension in name.
+func compress(name string, wr io.Writer) (io.WriteCloser, error) {
+	switch filepath.Ext(name) {
+	case ".xz":
+		return xz.NewWriterLevel(wr, xz.BestSpeed), nil
+	case ".zst":
+		return zstd.NewWriter(wr, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	default:
+		return nil, errors.Errorf("compression of %q is not supported", name)
+	}
+}
+
+type zstdResponseWriter struct {
+	http.ResponseWriter
+	log         *zap.Logger
+	enc         *zstd.Encoder
+	wroteHeader bool
+
+	// keeps the compressed NAR if the whole NAR was written, may be nil.
+	cache    *compressedCache
+	name     string
+	cached   *compressedCacheFile
+	expected int64
+	written  int64
+	err      error
+}
+
+func (w *zstdResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if status == http.StatusOK {
+		wr := io.Writer(w.ResponseWriter)
+		// only NARs from our stores have a known length to check against.
+		if w.cache != nil && w.Header().Get(headerCache) == headerCacheHit {
+			if length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+				if file, err := w.cache.create(w.name); err != nil {
+					w.log.Warn("caching compressed NAR", zap.Error(err))
+				} else {
+					w.cached, w.expected = file, length
+					wr = io.MultiWriter(w.ResponseWriter, file)
+				}
+			}
+		}
+
+		enc, err := zstd.NewWriter(wr, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			w.log.Error("creating zstd writer", zap.Error(err))
+		} else {
+			w.enc = enc
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *zstdResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.enc != nil {
+		n, err := w.enc.Write(p)
+		w.written += int64(n)
+		if err != nil {
+			w.err = err
+		}
+		return n, err
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *zstdResponseWriter) Close() error {
+	if w.enc == nil {
+		return nil
+	}
+
+	err := w.enc.Close()
+	if w.cached == nil {
+		return err
+	} else if err != nil || w.err != nil || w.written != w.expected {
+		w.cached.discard()
+	} else if err := w.cached.commit(); err != nil {
+		w.log.Warn("caching compressed NAR", zap.Error(err))
+	}
+	return err
+}
+
+// serveCachedZstd answers with the NAR the way it was compressed for an
+// earlier request, as long as one of the stores still has it.
+func (proxy *Proxy) serveCachedZstd(w http.ResponseWriter, r *http.Request) bool {
+	name, err := urlToIndexName(r.URL)
+	if err != nil {
+		return false
+	}
+
+	stored := false
+	for _, tier := range proxy.indexTiers() {
+		if idx, err := tier.index.GetIndex(name); err == nil {
+			if tier.touch != nil {
+				tier.touch(idx)
+			}
+			stored = true
+			break
+		}
+	}
+	if !stored {
+		return false
+	}
+
+	fd, size, ok := proxy.compressed.open(name + ".zst")
+	if !ok {
+		return false
+	}
+	defer fd.Close()
+
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Encoding", "zstd")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set(headerCache, headerCacheHit)
+	w.Header().Set(headerContentType, urlToMime(r.URL.String()))
+	if _, err := io.Copy(w, fd); err != nil {
+		proxy.log.Error("while writing compressed NAR", zap.Error(err))
+	}
+	return true
+}
+
+// withZstdResponses compresses uncompressed NARs on GET for clients that
+// accept zstd encoding. With a compressed cache they're compressed once and
+// shared with requests of the .nar.zst URL.
+func (proxy *Proxy) withZstdResponses() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if !proxy.ZstdResponses {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" ||
+				r.Header.Get("Range") != "" ||
+				!strings.HasSuffix(r.URL.Path, ".nar") ||
+				!strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if proxy.compressed != nil && proxy.serveCachedZstd(w, r) {
+				return
+			}
+
+			zw := &zstdResponseWriter{ResponseWriter: w, log: proxy.log}
+			if name, err := urlToIndexName(r.URL); err == nil && proxy.compressed != nil {
+				zw.cache, zw.name = proxy.compressed, name+".zst"
+			}
+			defer func() {
+				if err := zw.Close(); err != nil {
+					proxy.log.Error("closing zstd writer", zap.Error(err))
+				}
+			}()
+
+			h.ServeHTTP(zw, r)
+		})
+	}
+}
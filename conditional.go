@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+)
+
+var (
+	metricUpstreamNotModified = metrics.MustCounter("spongix_upstream_not_modified", "Number of upstream fetches answered with 304 Not Modified")
+	metricNarinfoNotModified  = metrics.MustCounter("spongix_narinfo_not_modified", "Number of narinfo requests answered with 304 Not Modified")
+)
+
+// upper bound of URLs we remember validators for, to keep memory in check.
+const maxUpstreamValidators = 100000
+
+type upstreamValidator struct {
+	etag         string
+	lastModified string
+}
+
+// upstreamValidators remembers the ETag and Last-Modified of upstream
+// responses we copied, so fetching them again can be made conditional.
+type upstreamValidators struct {
+	mu         sync.Mutex
+	validators map[string]upstreamValidator
+}
+
+func newUpstreamValidators() *upstreamValidators {
+	return &upstreamValidators{validators: map[string]upstreamValidator{}}
+}
+
+func (v *upstreamValidators) record(urlStr string, res *http.Response) {
+	validator := upstreamValidator{
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if validator.etag == "" && validator.lastModified == "" {
+		delete(v.validators, urlStr)
+		return
+	}
+
+	if len(v.validators) >= maxUpstreamValidators {
+		v.validators = map[string]upstreamValidator{}
+	}
+
+	v.validators[urlStr] = validator
+}
+
+// apply adds conditional headers for urlStr to req and reports whether any
+// were added.
+func (v *upstreamValidators) apply(urlStr string, req *http.Request) bool {
+	v.mu.Lock()
+	validator, found := v.validators[urlStr]
+	v.mu.Unlock()
+
+	if !found {
+		return false
+	}
+
+	if validator.etag != "" {
+		req.Header.Set("If-None-Match", validator.etag)
+	}
+	if validator.lastModified != "" {
+		req.Header.Set("If-Modified-Since", validator.lastModified)
+	}
+
+	return true
+}
+
+// indexETag identifies the content of an index by its chunk IDs, which are
+// hashes of the chunk data themselves.
+func indexETag(idx desync.Index) string {
+	h := sha256.New()
+	for _, chunk := range idx.Chunks {
+		_, _ = h.Write(chunk.ID[:])
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// indexModTime returns when the index was last written, or the zero time if
+// the store can't tell.
+func indexModTime(index desync.IndexStore, u *url.URL) time.Time {
+	local, ok := index.(desync.LocalIndexStore)
+	if !ok {
+		return time.Time{}
+	}
+
+	name, err := urlToIndexName(u)
+	if err != nil {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(local.Path + name)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveNarinfoValidators sets ETag and Last-Modified of a narinfo and answers
+// with 304 if the client already has it. It reports whether a response was
+// sent, so clients polling narinfos don't receive them over and over.
+func serveNarinfoValidators(w http.ResponseWriter, r *http.Request, index desync.IndexStore, idx desync.Index) bool {
+	if !strings.HasSuffix(r.URL.Path, ".narinfo") {
+		return false
+	}
+
+	etag := indexETag(idx)
+	modTime := indexModTime(index, r.URL)
+
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = etagMatches(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		if since, err := http.ParseTime(ims); err == nil {
+			notModified = !modTime.Truncate(time.Second).After(since)
+		}
+	}
+
+	if !notModified {
+		return false
+	}
+
+	metricNarinfoNotModified.Add(1)
+	w.Header().Set(headerCache, headerCacheHit)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
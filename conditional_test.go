@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterNarinfoConditional(t *testing.T) {
+	proxy := testProxy(t)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	router := testRouter(proxy)
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("GET", fNarinfo, nil))
+	etag := res.Header().Get("ETag")
+	lastModified := res.Header().Get("Last-Modified")
+	if res.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("expected validators, got %d %v", res.Code, res.Header())
+	}
+
+	apitest.New().
+		Handler(router).
+		Method("GET").
+		URL(fNarinfo).
+		Header("If-None-Match", etag).
+		Expect(t).
+		Header("ETag", etag).
+		Body("").
+		Status(http.StatusNotModified).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("GET").
+		URL(fNarinfo).
+		Header("If-None-Match", `"other"`).
+		Expect(t).
+		Body(string(testdata[fNarinfo])).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("HEAD").
+		URL(fNarinfo).
+		Header("If-Modified-Since", lastModified).
+		Expect(t).
+		Status(http.StatusNotModified).
+		End()
+}
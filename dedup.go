@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var (
+	metricDedupInflated = metrics.MustInteger("spongix_dedup_inflated_bytes", "Size of all indices written since startup if they were inflated")
+	metricDedupUnique   = metrics.MustInteger("spongix_dedup_unique_bytes", "Size of the unique chunks referenced by indices written since startup")
+	metricDedupChunks   = metrics.MustInteger("spongix_dedup_chunks", "Number of unique chunks remembered from indices written since startup")
+)
+
+const (
+	dedupHistoryInterval = 5 * time.Minute
+	dedupHistorySize     = 288
+	dedupMaxIndices      = 100_000
+	dedupMaxChunks       = 500_000
+)
+
+type dedupSample struct {
+	Time          time.Time `json:"time"`
+	InflatedBytes uint64    `json:"inflated_bytes"`
+	UniqueBytes   uint64    `json:"unique_bytes"`
+}
+
+type sharedChunk struct {
+	ID   string `json:"id"`
+	Refs uint64 `json:"refs"`
+	Size uint64 `json:"size"`
+}
+
+type dedupResponse struct {
+	InflatedBytes uint64        `json:"inflated_bytes"`
+	UniqueBytes   uint64        `json:"unique_bytes"`
+	Ratio         float64       `json:"ratio"`
+	Indices       int           `json:"indices"`
+	Chunks        int           `json:"chunks"`
+	Top           []sharedChunk `json:"top"`
+	History       []dedupSample `json:"history"`
+}
+
+// dedupStats is updated whenever an index is written, so we don't have to walk
+// the store to know how well chunks are shared. Indices written more than once
+// are only counted the first time.
+// Only the most recently written indices and chunks are remembered, ones that
+// were forgotten are counted again if they are written again.
+type dedupStats struct {
+	mu         sync.Mutex
+	indices    map[string]*list.Element
+	indexLRU   *list.List
+	chunks     map[desync.ChunkID]*list.Element
+	chunkLRU   *list.List
+	maxIndices int
+	maxChunks  int
+	inflated   uint64
+	unique     uint64
+	history    []dedupSample
+}
+
+type dedupChunk struct {
+	id   desync.ChunkID
+	refs uint64
+	size uint64
+}
+
+func newDedupStats() *dedupStats {
+	return &dedupStats{
+		indices:    map[string]*list.Element{},
+		indexLRU:   list.New(),
+		chunks:     map[desync.ChunkID]*list.Element{},
+		chunkLRU:   list.New(),
+		maxIndices: dedupMaxIndices,
+		maxChunks:  dedupMaxChunks,
+	}
+}
+
+func (d *dedupStats) add(name string, idx desync.Index) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if elem, found := d.indices[name]; found {
+		d.indexLRU.MoveToFront(elem)
+		return
+	}
+	d.indices[name] = d.indexLRU.PushFront(name)
+	if d.indexLRU.Len() > d.maxIndices {
+		delete(d.indices, d.indexLRU.Remove(d.indexLRU.Back()).(string))
+	}
+
+	for _, chunk := range idx.Chunks {
+		d.inflated += chunk.Size
+		if elem, found := d.chunks[chunk.ID]; found {
+			elem.Value.(*dedupChunk).refs++
+			d.chunkLRU.MoveToFront(elem)
+			continue
+		}
+
+		d.unique += chunk.Size
+		d.chunks[chunk.ID] = d.chunkLRU.PushFront(&dedupChunk{id: chunk.ID, refs: 1, size: chunk.Size})
+		if d.chunkLRU.Len() > d.maxChunks {
+			delete(d.chunks, d.chunkLRU.Remove(d.chunkLRU.Back()).(*dedupChunk).id)
+		}
+	}
+
+	metricDedupInflated.Set(int64(d.inflated))
+	metricDedupUnique.Set(int64(d.unique))
+	metricDedupChunks.Set(int64(len(d.chunks)))
+}
+
+func (d *dedupStats) sample() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.history = append(d.history, dedupSample{
+		Time:          time.Now(),
+		InflatedBytes: d.inflated,
+		UniqueBytes:   d.unique,
+	})
+
+	if len(d.history) > dedupHistorySize {
+		d.history = d.history[len(d.history)-dedupHistorySize:]
+	}
+}
+
+func (d *dedupStats) report(top int) dedupResponse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	shared := []sharedChunk{}
+	for _, elem := range d.chunks {
+		if chunk := elem.Value.(*dedupChunk); chunk.refs > 1 {
+			shared = append(shared, sharedChunk{ID: chunk.id.String(), Refs: chunk.refs, Size: chunk.size})
+		}
+	}
+
+	sort.Slice(shared, func(i, j int) bool {
+		if shared[i].Refs != shared[j].Refs {
+			return shared[i].Refs > shared[j].Refs
+		}
+		return shared[i].ID < shared[j].ID
+	})
+
+	if len(shared) > top {
+		shared = shared[:top]
+	}
+
+	ratio := float64(0)
+	if d.unique > 0 {
+		ratio = float64(d.inflated) / float64(d.unique)
+	}
+
+	return dedupResponse{
+		InflatedBytes: d.inflated,
+		UniqueBytes:   d.unique,
+		Ratio:         ratio,
+		Indices:       len(d.indices),
+		Chunks:        len(d.chunks),
+		Top:           shared,
+		History:       append([]dedupSample{}, d.history...),
+	}
+}
+
+func (proxy *Proxy) sampleDedup() {
+	ticker := time.NewTicker(dedupHistoryInterval)
+	for {
+		proxy.dedup.sample()
+		<-ticker.C
+	}
+}
+
+// storedIndex is filled in with the index written by an upload, so
+// middlewares don't have to read it again.
+type storedIndex struct {
+	name string
+	idx  desync.Index
+}
+
+type storedIndexKey struct{}
+
+// withDedupStats records the index of every successful upload.
+func (proxy *Proxy) withDedupStats() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+			stored := &storedIndex{}
+			h.ServeHTTP(record, r.WithContext(context.WithValue(r.Context(), storedIndexKey{}, stored)))
+
+			if record.status != http.StatusOK || stored.name == "" {
+				return
+			}
+
+			proxy.dedup.add(stored.name, stored.idx)
+		})
+	}
+}
+
+// GET /dedup?top=<n>
+func (proxy *Proxy) dedupReport(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if raw := r.URL.Query().Get("top"); raw != "" {
+		var err error
+		if top, err = strconv.Atoi(raw); err != nil || top < 0 {
+			answer(w, http.StatusBadRequest, mimeText, "invalid top parameter\n")
+			return
+		}
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(proxy.dedup.report(top)); err != nil {
+		proxy.log.Error("encoding dedup stats", zap.Error(err))
+	}
+}
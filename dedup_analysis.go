@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var metricDedupAnalysisTime = metrics.MustCounter("spongix_dedup_analysis_ms_sum", "Total milliseconds spent analysing deduplication")
+
+type dedupGroup struct {
+	Name          string  `json:"name,omitempty"`
+	Paths         int     `json:"paths"`
+	InflatedBytes uint64  `json:"inflated_bytes"`
+	UniqueBytes   uint64  `json:"unique_bytes"`
+	Ratio         float64 `json:"ratio"`
+
+	chunks map[desync.ChunkID]struct{}
+}
+
+func (g *dedupGroup) add(idx desync.Index) {
+	g.Paths++
+	for _, chunk := range idx.Chunks {
+		g.InflatedBytes += chunk.Size
+		if _, found := g.chunks[chunk.ID]; !found {
+			g.chunks[chunk.ID] = yes
+			g.UniqueBytes += chunk.Size
+		}
+	}
+
+	if g.UniqueBytes > 0 {
+		g.Ratio = float64(g.InflatedBytes) / float64(g.UniqueBytes)
+	}
+}
+
+type dedupAnalysis struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Total    *dedupGroup   `json:"total"`
+	Groups   []*dedupGroup `json:"groups"`
+}
+
+// dedupAnalyzer holds the result of the last walk over all local narinfos.
+// Unlike dedupStats it also covers NARs stored before startup.
+type dedupAnalyzer struct {
+	mu   sync.Mutex
+	last *dedupAnalysis
+}
+
+// packageName returns the name of a store path without hash and version,
+// following the convention of builtins.parseDrvName: the version starts at
+// the first dash followed by a digit.
+func packageName(storePath string) string {
+	name := path.Base(storePath)
+	if i := strings.IndexByte(name, '-'); i == 32 {
+		name = name[i+1:]
+	}
+
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '-' && name[i+1] >= '0' && name[i+1] <= '9' {
+			return name[:i]
+		}
+	}
+
+	return name
+}
+
+// narIndexName returns the index name of the NAR a narinfo points to. Stored
+// narinfos always have relative URLs, absolute ones are refused by uploads and
+// relativeNarinfo.
+func narIndexName(narURL string) string {
+	if isCompressedNar(narURL) {
+		return strings.TrimSuffix(narURL, path.Ext(narURL))
+	}
+	return narURL
+}
+
+// analyzeDedupOnce walks all local narinfos and estimates how well the chunks
+// of their NARs are shared, in total and per package name.
+func (proxy *Proxy) analyzeDedupOnce() {
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	total := &dedupGroup{chunks: map[desync.ChunkID]struct{}{}}
+	groups := map[string]*dedupGroup{}
+
+	err := filepath.WalkDir(indices.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			if filepath.Clean(p) != filepath.Clean(indices.Path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Ext(p) != ".narinfo" {
+			return nil
+		}
+
+		idx, err := indices.GetIndex(d.Name())
+		if err != nil {
+			proxy.log.Warn("reading narinfo index", zap.Error(err), zap.String("name", d.Name()))
+			return nil
+		}
+
+		info, err := assembleNarinfo(proxy.localStore, idx)
+		if err != nil {
+			proxy.log.Warn("reading narinfo", zap.Error(err), zap.String("name", d.Name()))
+			return nil
+		}
+
+		narIdx, err := indices.GetIndex(narIndexName(info.URL))
+		if err != nil {
+			return nil
+		}
+
+		name := packageName(info.StorePath)
+		group, found := groups[name]
+		if !found {
+			group = &dedupGroup{Name: name, chunks: map[desync.ChunkID]struct{}{}}
+			groups[name] = group
+		}
+
+		group.add(narIdx)
+		total.add(narIdx)
+		return nil
+	})
+
+	if err != nil {
+		proxy.log.Error("analysing dedup", zap.Error(err))
+		return
+	}
+
+	// the chunks are only needed for the totals, the analysis is kept until
+	// the next run.
+	total.chunks = nil
+	analysis := &dedupAnalysis{Time: start, Total: total, Groups: make([]*dedupGroup, 0, len(groups))}
+	for _, group := range groups {
+		group.chunks = nil
+		analysis.Groups = append(analysis.Groups, group)
+	}
+
+	sort.Slice(analysis.Groups, func(i, j int) bool {
+		if analysis.Groups[i].InflatedBytes != analysis.Groups[j].InflatedBytes {
+			return analysis.Groups[i].InflatedBytes > analysis.Groups[j].InflatedBytes
+		}
+		return analysis.Groups[i].Name < analysis.Groups[j].Name
+	})
+
+	analysis.Duration = time.Since(start)
+	metricDedupAnalysisTime.Add(uint64(analysis.Duration.Milliseconds()))
+
+	proxy.dedupAnalyzer.mu.Lock()
+	proxy.dedupAnalyzer.last = analysis
+	proxy.dedupAnalyzer.mu.Unlock()
+
+	proxy.log.Info("analysed dedup",
+		zap.Int("paths", total.Paths),
+		zap.Uint64("inflated", total.InflatedBytes),
+		zap.Uint64("unique", total.UniqueBytes),
+		zap.Duration("duration", analysis.Duration))
+}
+
+// GET /dedup/analysis?top=<n>
+func (proxy *Proxy) dedupAnalysisReport(w http.ResponseWriter, r *http.Request) {
+	top := 100
+	if raw := r.URL.Query().Get("top"); raw != "" {
+		var err error
+		if top, err = strconv.Atoi(raw); err != nil || top < 0 {
+			answer(w, http.StatusBadRequest, mimeText, "invalid top parameter\n")
+			return
+		}
+	}
+
+	proxy.dedupAnalyzer.mu.Lock()
+	last := proxy.dedupAnalyzer.last
+	proxy.dedupAnalyzer.mu.Unlock()
+
+	if last == nil {
+		answer(w, http.StatusNotFound, mimeText, "no dedup analysis has run yet\n")
+		return
+	}
+
+	report := *last
+	if len(report.Groups) > top {
+		report.Groups = report.Groups[:top]
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		proxy.log.Error("encoding dedup analysis", zap.Error(err))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterDedupAnalysis(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	apitest.New().
+		Handler(router).
+		Get("/dedup/analysis").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	if idx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNar, "/")); err != nil {
+		t.Fatal(err)
+	} else if err := proxy.localIndex.StoreIndex("nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar", idx); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.analyzeDedupOnce()
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, testAdminRequest("GET", "/dedup/analysis", nil))
+
+	analysis := dedupAnalysis{}
+	if err := json.NewDecoder(res.Body).Decode(&analysis); err != nil {
+		t.Fatal(err)
+	}
+
+	size := uint64(len(testdata[fNar]))
+	if analysis.Total.Paths != 1 || analysis.Total.InflatedBytes != size {
+		t.Fatalf("unexpected total: %v", analysis.Total)
+	}
+
+	if len(analysis.Groups) != 1 || analysis.Groups[0].Name != "libunistring" {
+		t.Fatalf("unexpected groups: %v", analysis.Groups)
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	for storePath, expected := range map[string]string{
+		"/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10": "libunistring",
+		"/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-python3.9-foo-1.0":   "python3.9-foo",
+		"/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-source":              "source",
+	} {
+		if actual := packageName(storePath); actual != expected {
+			t.Errorf("packageName(%q) = %q, expected %q", storePath, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestDedupStatsBounded(t *testing.T) {
+	d := newDedupStats()
+	d.maxIndices = 2
+	d.maxChunks = 2
+
+	chunk := func(b byte) desync.IndexChunk {
+		return desync.IndexChunk{ID: desync.ChunkID{b}, Size: 10}
+	}
+
+	d.add("a", desync.Index{Chunks: []desync.IndexChunk{chunk(1), chunk(2)}})
+	d.add("b", desync.Index{Chunks: []desync.IndexChunk{chunk(2), chunk(3)}})
+	d.add("c", desync.Index{Chunks: []desync.IndexChunk{chunk(1)}})
+
+	if len(d.indices) != 2 || len(d.chunks) != 2 {
+		t.Fatalf("expected 2 indices and chunks, got %d and %d", len(d.indices), len(d.chunks))
+	}
+
+	// chunk 1 was forgotten, so it counts as unique again.
+	if d.inflated != 50 || d.unique != 40 {
+		t.Fatalf("unexpected totals %d %d", d.inflated, d.unique)
+	}
+
+	if _, found := d.indices["a"]; found {
+		t.Fatal("expected the oldest index to be forgotten")
+	}
+}
+
+func TestRouterDedup(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	for url, body := range map[string][]byte{
+		fNar:              testdata[fNar],
+		"/cache" + fNarXz: testdata[fNarXz],
+		"/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar": testdata[fNar],
+	} {
+		apitest.New().
+			Handler(router).
+			Method("PUT").
+			URL(url).
+			Body(string(body)).
+			Expect(t).
+			Status(http.StatusOK).
+			End()
+	}
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, testAdminRequest("GET", "/dedup?top=1", nil))
+
+	report := dedupResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+
+	size := uint64(len(testdata[fNar]))
+	if report.Indices != 2 || report.InflatedBytes != 2*size || report.UniqueBytes != size {
+		t.Fatalf("unexpected report: %v", report)
+	}
+
+	if len(report.Top) != 1 || report.Top[0].Refs != 2 {
+		t.Fatalf("unexpected top chunks: %v", report.Top)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricDeletedIndices = metrics.MustCounter("spongix_deleted_indices", "Number of narinfos and NARs removed through the DELETE API")
+	metricOrphanedChunks = metrics.MustCounter("spongix_orphaned_chunks_removed", "Number of chunks of deleted narinfos and NARs removed because no other index used them")
+)
+
+// orphanCandidates are the chunks of deleted indices. The next GC removes
+// those no other index uses, instead of waiting until they're evicted. They
+// are saved to path, so a restart before the GC doesn't forget them.
+type orphanCandidates struct {
+	mu   sync.Mutex
+	ids  map[desync.ChunkID]struct{}
+	path string
+}
+
+func (proxy *Proxy) setupOrphans() {
+	proxy.orphans.path = filepath.Join(proxy.Dir, "orphans.json")
+	if err := proxy.orphans.load(); err != nil {
+		proxy.log.Error("loading orphaned chunks", zap.Error(err))
+	}
+}
+
+func (o *orphanCandidates) load() error {
+	content, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	names := []string{}
+	if err := json.Unmarshal(content, &names); err != nil {
+		return errors.WithMessage(err, "decoding "+o.path)
+	}
+
+	ids := map[desync.ChunkID]struct{}{}
+	for _, name := range names {
+		if id, err := desync.ChunkIDFromString(name); err == nil {
+			ids[id] = yes
+		}
+	}
+	o.restore(ids)
+	return nil
+}
+
+// save writes the candidates to path, the caller holds the lock.
+func (o *orphanCandidates) save() error {
+	if o.path == "" {
+		return nil
+	}
+
+	names := make([]string, 0, len(o.ids))
+	for id := range o.ids {
+		names = append(names, id.String())
+	}
+
+	content, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
+
+func (o *orphanCandidates) add(idx desync.Index) {
+	ids := map[desync.ChunkID]struct{}{}
+	for _, chunk := range idx.Chunks {
+		ids[chunk.ID] = yes
+	}
+	o.restore(ids)
+}
+
+func (o *orphanCandidates) restore(ids map[desync.ChunkID]struct{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.ids == nil {
+		o.ids = map[desync.ChunkID]struct{}{}
+	}
+	for id := range ids {
+		o.ids[id] = yes
+	}
+	_ = o.save()
+}
+
+// take hands the candidates to the GC. They stay saved until it calls done,
+// so they're checked again if it doesn't finish.
+func (o *orphanCandidates) take() map[desync.ChunkID]struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ids := o.ids
+	o.ids = nil
+	return ids
+}
+
+// done saves the candidates added or restored since take.
+func (o *orphanCandidates) done() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.save()
+}
+
+// indexRemover is implemented by index stores besides the local one that
+// support deleting.
+type indexRemover interface {
+	RemoveIndex(name string) error
+}
+
+// DELETE /<hash>.narinfo
+// DELETE /nar/<hash>.nar
+// Removes a bad narinfo or NAR right away from every tier, along with its
+// history and compressed copies. A tombstone keeps it from being copied from
+// the upstreams again until it's uploaded anew. It's part of the admin API,
+// so with AdminListen only local clients may delete.
+func (proxy *Proxy) deleteIndex(w http.ResponseWriter, r *http.Request) {
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		answer(w, http.StatusNotImplemented, mimeText, "the index store doesn't support deletion\n")
+		return
+	}
+
+	name, err := urlToIndexName(r.URL)
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+		return
+	}
+
+	deleted, err := proxy.removeIndex(indices, name)
+	if err != nil {
+		proxy.log.Error("deleting index", zap.String("name", name), zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed deleting\n")
+		return
+	} else if !deleted {
+		serveNotFound(w, r)
+		return
+	}
+
+	proxy.events.add(eventOpDelete, "/"+name)
+	answer(w, http.StatusOK, mimeText, "ok\n")
+}
+
+// removeIndex deletes name from the local and S3 index stores and leaves a
+// tombstone, so it isn't fetched again. It reports whether there was
+// anything to delete.
+func (proxy *Proxy) removeIndex(indices desync.LocalIndexStore, name string) (bool, error) {
+	deleted := false
+	if idx, err := indices.GetIndex(name); err == nil {
+		if err := os.Remove(filepath.Join(indices.Path, name)); err != nil && !os.IsNotExist(err) {
+			return false, err
+		} else if err == nil {
+			proxy.orphans.add(idx)
+			deleted = true
+		}
+	}
+
+	if remover, ok := proxy.s3Index.(indexRemover); ok && hasIndex(proxy.s3Index, name) {
+		if err := remover.RemoveIndex(name); err != nil {
+			return deleted, errors.WithMessage(err, "deleting index from S3")
+		}
+		deleted = true
+	}
+
+	if !deleted {
+		return false, nil
+	}
+
+	if err := proxy.addTombstone(name); err != nil {
+		proxy.log.Error("adding tombstone", zap.String("name", name), zap.Error(err))
+	}
+	if strings.HasSuffix(name, ".narinfo") {
+		proxy.removeNarinfoHistory(strings.TrimSuffix(name, ".narinfo"))
+	}
+	if proxy.compressed != nil {
+		proxy.compressed.removeNar(name)
+	}
+
+	proxy.narinfoCache.invalidate(name)
+	proxy.stream.publish(eventDelete, "/"+name)
+	metricDeletedIndices.Add(1)
+	proxy.log.Info("deleted index", zap.String("name", name))
+
+	return true, nil
+}
+
+func (proxy *Proxy) tombstonePath(name string) string {
+	return filepath.Join(proxy.Dir, "tombstones", filepath.FromSlash(name))
+}
+
+func (proxy *Proxy) addTombstone(name string) error {
+	path := proxy.tombstonePath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, nil, 0o644)
+}
+
+func (proxy *Proxy) tombstoned(name string) bool {
+	_, err := os.Stat(proxy.tombstonePath(name))
+	return err == nil
+}
+
+type localOnlyKey struct{}
+
+// withTombstones keeps deleted paths from being fetched from the upstreams,
+// and lifts the tombstone once they're uploaded again.
+func (proxy *Proxy) withTombstones() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, err := urlToIndexName(r.URL)
+			if err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			switch r.Method {
+			case "GET", "HEAD":
+				if proxy.tombstoned(name) {
+					r = r.WithContext(context.WithValue(r.Context(), localOnlyKey{}, true))
+				}
+				h.ServeHTTP(w, r)
+			case "PUT":
+				record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+				h.ServeHTTP(record, r)
+				if record.status/100 == 2 {
+					if err := os.Remove(proxy.tombstonePath(name)); err != nil && !os.IsNotExist(err) {
+						proxy.log.Error("removing tombstone", zap.String("name", name), zap.Error(err))
+					}
+				}
+			default:
+				h.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// localIndexDir is a local index store using the local chunk store, suffix
+// tells its indices apart from other files kept with them.
+type localIndexDir struct {
+	indices desync.LocalIndexStore
+	suffix  string
+}
+
+// localIndexDirs are all index stores with chunks in the local store, the
+// artifacts, proxy routes and narinfo history keep theirs apart from the cache.
+func (proxy *Proxy) localIndexDirs() []localIndexDir {
+	dirs := []localIndexDir{}
+	if indices, ok := proxy.localIndex.(desync.LocalIndexStore); ok {
+		dirs = append(dirs, localIndexDir{indices: indices})
+	}
+	if proxy.artifacts != nil {
+		dirs = append(dirs, localIndexDir{indices: proxy.artifacts.index, suffix: ".caibx"})
+	}
+	if proxy.history.Path != "" {
+		dirs = append(dirs, localIndexDir{indices: proxy.history, suffix: ".narinfo"})
+	}
+	return dirs
+}
+
+// removeOrphanedChunks removes the chunks of deleted indices that no remaining
+// index uses.
+func (proxy *Proxy) removeOrphanedChunks() {
+	candidates := proxy.orphans.take()
+	if len(candidates) == 0 {
+		return
+	}
+	defer func() {
+		if err := proxy.orphans.done(); err != nil {
+			proxy.log.Error("saving orphaned chunks", zap.Error(err))
+		}
+	}()
+
+	store, ok := proxy.chunkDisk()
+	if !ok {
+		return
+	}
+	dirs := proxy.localIndexDirs()
+	if len(dirs) == 0 {
+		return
+	}
+
+	walkStart := time.Now()
+	used := map[desync.ChunkID]struct{}{}
+	for _, dir := range dirs {
+		indices := dir.indices
+		err := filepath.Walk(indices.Path, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if info.IsDir() || !strings.HasSuffix(path, dir.suffix) {
+				return nil
+			}
+
+			// a chunk may only be removed if we know every index that uses it.
+			idx, err := indices.GetIndex(path[len(indices.Path):])
+			if err != nil {
+				return err
+			}
+
+			for _, chunk := range idx.Chunks {
+				if _, found := candidates[chunk.ID]; found {
+					used[chunk.ID] = yes
+				}
+			}
+			return nil
+		})
+
+		if err != nil {
+			proxy.log.Error("checking chunks of deleted indices, retrying on the next GC", zap.Error(err))
+			proxy.orphans.restore(candidates)
+			return
+		}
+	}
+
+	for _, dir := range dirs {
+		for id, chunk := range recentlyIndexedChunks(dir.indices, walkStart) {
+			used[id] = chunk
+		}
+	}
+
+	for id := range candidates {
+		if _, found := used[id]; found || chunkUsedSince(store, id, walkStart) {
+			continue
+		}
+
+		switch err := store.RemoveChunk(id); err.(type) {
+		case nil:
+			metricOrphanedChunks.Add(1)
+		case desync.ChunkMissing:
+		default:
+			proxy.log.Error("removing orphaned chunk", zap.Error(err), zap.String("chunk", id.String()))
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterDelete(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+
+	// another NAR sharing all chunks keeps them from being removed.
+	other := "nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar"
+	narIdx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNar, "/"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := proxy.localIndex.StoreIndex(other, narIdx); err != nil {
+		t.Fatal(err)
+	}
+
+	apitest.New().
+		Handler(router).
+		Delete(fNarinfo).
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Body("ok\n").
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Delete(fNarinfo).
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Delete(fNar).
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	chunkExists := func() bool {
+		_, err := proxy.localStore.GetChunk(narIdx.Chunks[0].ID)
+		return err == nil
+	}
+
+	proxy.removeOrphanedChunks()
+	if !chunkExists() {
+		t.Fatal("removed a chunk that's still used")
+	}
+
+	apitest.New().
+		Handler(router).
+		Delete("/"+other).
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	// an artifact sharing the chunks keeps them as well.
+	if err := proxy.artifacts.index.StoreIndex("artifact.caibx", narIdx); err != nil {
+		t.Fatal(err)
+	}
+	proxy.removeOrphanedChunks()
+	if !chunkExists() {
+		t.Fatal("removed a chunk an artifact uses")
+	}
+
+	// candidates are kept over a restart.
+	proxy.orphans.add(narIdx)
+	proxy.orphans = orphanCandidates{}
+	proxy.setupOrphans()
+	if err := os.Remove(filepath.Join(proxy.artifacts.dir, "artifact.caibx")); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.removeOrphanedChunks()
+	if chunkExists() {
+		t.Fatal("orphaned chunk wasn't removed")
+	}
+}
+
+func TestRouterDeleteTombstone(t *testing.T) {
+	requests := int32(0)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(testdata[fNarinfo])
+	}))
+	defer upstream.Close()
+
+	proxy := withS3(testProxy(t))
+	proxy.Substituters = []string{upstream.URL}
+	router := testRouter(proxy)
+	name := strings.TrimPrefix(fNarinfo, "/")
+	hash := strings.TrimSuffix(name, ".narinfo")
+
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.s3Store, proxy.s3Index, fNarinfo)
+	idx, err := proxy.localIndex.GetIndex(name)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := proxy.keepNarinfoVersion(hash, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	apitest.New().
+		Handler(router).
+		Delete(fNarinfo).
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	if hasIndex(proxy.s3Index, name) {
+		t.Fatal("expected the narinfo to be deleted from S3")
+	}
+	if versions, err := proxy.narinfoVersions(hash); err != nil || len(versions) != 0 {
+		t.Fatalf("expected the narinfo history to be deleted, got %v %v", versions, err)
+	}
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("expected no upstream requests, got %d", n)
+	}
+	if err := proxy.cacheUrl(upstream.URL + fNarinfo); err == nil {
+		t.Fatal("expected the cache queue to skip deleted paths")
+	}
+
+	apitest.New().
+		Handler(router).
+		Put(fNarinfo).
+		Body(string(testdata[fNarinfo])).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	if proxy.tombstoned(name) {
+		t.Fatal("expected the upload to lift the tombstone")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/derivation"
+	"github.com/numtide/go-nix/nar"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// derivations are small, anything bigger isn't worth parsing.
+const maxDerivationSize = 16 * 1024 * 1024
+
+// narMagic starts the NAR Nix wraps a substituted .drv in.
+var narMagic = []byte("\x0d\x00\x00\x00\x00\x00\x00\x00nix-archive-1")
+
+// derivationFile returns the ATerm of a stored .drv, which is either plain or
+// a NAR containing it as a single file.
+func derivationFile(rd io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(io.LimitReader(rd, maxDerivationSize))
+
+	if magic, err := buf.Peek(len(narMagic)); err != nil || !bytes.Equal(magic, narMagic) {
+		return buf, nil
+	}
+
+	archive := nar.NewReader(buf)
+	header, err := archive.Next()
+	if err != nil {
+		return nil, errors.WithMessage(err, "reading NAR")
+	} else if header.Type != nar.TypeRegular {
+		return nil, errors.Errorf("NAR contains a %s instead of a derivation", header.Type)
+	}
+	return archive, nil
+}
+
+func readDerivation(rd io.Reader) (*derivation.Derivation, error) {
+	file, err := derivationFile(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	drv := &derivation.Derivation{}
+	if err := drv.Unmarshal(file); err != nil {
+		return nil, err
+	}
+	return drv, nil
+}
+
+// GET /derivations/<hash>.drv
+// Returns the derivation stored at /nar/<hash>.drv as JSON, in the format of
+// `nix show-derivation`.
+func (proxy *Proxy) derivationJSON(w http.ResponseWriter, r *http.Request) {
+	name := "nar/" + mux.Vars(r)["hash"] + ".drv"
+
+	idx, store, err := proxy.resolveIndex(name)
+	if err != nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	drv, err := readDerivation(newChunkReader(store, idx))
+	if err != nil {
+		proxy.log.Warn("parsing derivation", zap.String("name", name), zap.Error(err))
+		answer(w, http.StatusUnprocessableEntity, mimeText, "invalid derivation: "+err.Error()+"\n")
+		return
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(drv); err != nil {
+		proxy.log.Error("encoding derivation", zap.Error(err))
+	}
+}
+
+// GET /derivations/by-output/<hash>
+// Returns the .drv file that built the store path with the given hash, found
+// through the Deriver of its narinfo. X-Derivation-Path is its store path.
+func (proxy *Proxy) derivationByOutput(w http.ResponseWriter, r *http.Request) {
+	info, err := proxy.resolveNarinfo(mux.Vars(r)["hash"])
+	if err != nil || info.Deriver == "" || info.Deriver == "unknown-deriver" {
+		serveNotFound(w, r)
+		return
+	}
+
+	drvInfo, err := proxy.resolveNarinfo(storePathHash(info.Deriver))
+	if err != nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	rd, err := proxy.narReader(drvInfo.URL)
+	if err != nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	file, err := derivationFile(rd)
+	if err != nil {
+		answer(w, http.StatusUnprocessableEntity, mimeText, "invalid derivation: "+err.Error()+"\n")
+		return
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		proxy.log.Error("reading derivation", zap.String("url", drvInfo.URL), zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed reading derivation\n")
+		return
+	} else if err := (&derivation.Derivation{}).Unmarshal(bytes.NewReader(content)); err != nil {
+		answer(w, http.StatusUnprocessableEntity, mimeText, "invalid derivation: "+err.Error()+"\n")
+		return
+	}
+
+	w.Header().Set("X-Derivation-Path", drvInfo.StorePath)
+	answer(w, http.StatusOK, mimeText, string(content))
+}
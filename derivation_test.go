@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/numtide/go-nix/wire"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterDerivation(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	drv := `Derive([("out","/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12","","")],[],[],"x86_64-linux","/bin/sh",["-c","echo hi > $out"],[("out","/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12")])`
+	archive := &bytes.Buffer{}
+	for _, token := range []string{"nix-archive-1", "(", "type", "regular", "contents", drv, ")"} {
+		_ = wire.WriteString(archive, token)
+	}
+
+	for name, body := range map[string]string{"nar": archive.String(), "plain": drv} {
+		t.Run(name, func(tt *testing.T) {
+			hash := "0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz"
+			if name == "plain" {
+				hash = "1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301"
+			}
+
+			apitest.New().
+				Handler(router).
+				Method("PUT").
+				URL("/nar/" + hash + ".drv").
+				Body(body).
+				Expect(tt).
+				Status(http.StatusOK).
+				End()
+
+			apitest.New().
+				Handler(router).
+				Method("GET").
+				URL("/nar/"+hash+".drv").
+				Expect(tt).
+				Header(headerContentType, mimeNar).
+				Header(headerCache, headerCacheHit).
+				Body(body).
+				Status(http.StatusOK).
+				End()
+
+			req := httptest.NewRequest("GET", "/derivations/"+hash+".drv", nil)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			if res.Code != http.StatusOK {
+				tt.Fatalf("status %d: %s", res.Code, res.Body)
+			}
+
+			parsed := map[string]interface{}{}
+			if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+				tt.Fatal(err)
+			} else if parsed["system"] != "x86_64-linux" || parsed["builder"] != "/bin/sh" {
+				tt.Fatalf("unexpected derivation: %v", parsed)
+			}
+		})
+	}
+
+	apitest.New().
+		Handler(router).
+		Method("GET").
+		URL("/derivations/0000000000000000000000000000000000000000000000000000.drv").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL("/nar/0000000000000000000000000000000000000000000000000000.drv").
+		Body("not a derivation").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestRouterDerivationByOutput(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	drv := `Derive([("out","/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12","","")],[],[],"x86_64-linux","/bin/sh",[],[])`
+	drvURL := "nar/0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz.drv"
+	narHash := "sha256:0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7"
+
+	for name, info := range map[string]*narinfo.Narinfo{
+		"g2m8kfw7kpgpph05v2fxcx4d5an09hl3.narinfo": {
+			StorePath:   "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12",
+			URL:         "nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar",
+			Compression: "none",
+			FileHash:    narHash,
+			FileSize:    1,
+			NarHash:     narHash,
+			NarSize:     1,
+			Deriver:     "r92m816zcm8v9zjr55lmgy4pdibjbyjp-hello-2.12.drv",
+		},
+		"r92m816zcm8v9zjr55lmgy4pdibjbyjp.narinfo": {
+			StorePath:   "/nix/store/r92m816zcm8v9zjr55lmgy4pdibjbyjp-hello-2.12.drv",
+			URL:         drvURL,
+			Compression: "none",
+			FileHash:    narHash,
+			FileSize:    1,
+			NarHash:     narHash,
+			NarSize:     int64(len(drv)),
+		},
+		"lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5.narinfo": {
+			StorePath:   "/nix/store/lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5-unknown",
+			URL:         "nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar",
+			Compression: "none",
+			FileHash:    narHash,
+			FileSize:    1,
+			NarHash:     narHash,
+			NarSize:     1,
+		},
+	} {
+		rd, err := info.ToReader()
+		if err != nil {
+			t.Fatal(err)
+		} else if err := proxy.storeLocal(name, rd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL("/" + drvURL).
+		Body(drv).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("GET").
+		URL("/derivations/by-output/g2m8kfw7kpgpph05v2fxcx4d5an09hl3").
+		Expect(t).
+		Header("X-Derivation-Path", "/nix/store/r92m816zcm8v9zjr55lmgy4pdibjbyjp-hello-2.12.drv").
+		Body(drv).
+		Status(http.StatusOK).
+		End()
+
+	for _, hash := range []string{"lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5", "00000000000000000000000000000000"} {
+		apitest.New().
+			Handler(router).
+			Method("GET").
+			URL("/derivations/by-output/" + hash).
+			Expect(t).
+			Status(http.StatusNotFound).
+			End()
+	}
+}
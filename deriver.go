@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var metricDeriverRejected = metrics.MustCounter("spongix_deriver_rejected", "Number of narinfo uploads rejected because their Deriver isn't allowed")
+
+// deriverAllowed reports whether the deriver matches one of the glob
+// patterns. Narinfos without a deriver are matched as an empty name.
+func deriverAllowed(deriver string, patterns []string) bool {
+	if deriver == "unknown-deriver" {
+		deriver = ""
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, deriver); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// withDeriverPolicy rejects narinfo uploads whose Deriver doesn't match any
+// of AllowedDerivers, so a curated cache only gets builds of known
+// derivations, like `*-release.drv`.
+func (proxy *Proxy) withDeriverPolicy() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if len(proxy.AllowedDerivers) == 0 {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			info, err := uploadedNarinfo(r)
+			if err != nil {
+				answer(w, http.StatusBadRequest, mimeText, err.Error())
+				return
+			}
+
+			if !deriverAllowed(info.Deriver, proxy.AllowedDerivers) {
+				metricDeriverRejected.Add(1)
+				proxy.log.Warn("rejecting narinfo with disallowed deriver",
+					zap.String("store_path", info.StorePath),
+					zap.String("deriver", info.Deriver))
+				answer(w, http.StatusForbidden, mimeText, "deriver "+info.Deriver+" isn't allowed\n")
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
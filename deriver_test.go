@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterDeriverPolicy(t *testing.T) {
+	for name, tc := range map[string]struct {
+		patterns []string
+		status   int
+	}{
+		"accepts matching":  {[]string{"*-release.drv", "*-libunistring-*.drv"}, http.StatusOK},
+		"rejects others":    {[]string{"*-release.drv"}, http.StatusForbidden},
+		"accepts any given": {[]string{"*"}, http.StatusOK},
+	} {
+		t.Run(name, func(tt *testing.T) {
+			proxy := testProxy(tt)
+			proxy.AllowedDerivers = tc.patterns
+
+			apitest.New().
+				Handler(testRouter(proxy)).
+				Method("PUT").
+				URL(fNarinfo).
+				Body(string(testdata[fNarinfo])).
+				Expect(tt).
+				Status(tc.status).
+				End()
+		})
+	}
+}
+
+func TestDeriverAllowed(t *testing.T) {
+	for deriver, expected := range map[string]bool{
+		"nq5zrwpzxs20qvl54ks3frj14qhfalqp-spongix-release.drv": true,
+		"nq5zrwpzxs20qvl54ks3frj14qhfalqp-spongix.drv":         false,
+		"":                false,
+		"unknown-deriver": false,
+	} {
+		if actual := deriverAllowed(deriver, []string{"*-release.drv"}); actual != expected {
+			t.Errorf("deriverAllowed(%q) = %v, expected %v", deriver, actual, expected)
+		}
+	}
+
+	if !deriverAllowed("unknown-deriver", []string{"*"}) {
+		t.Error("a pattern matching everything should accept narinfos without deriver")
+	}
+}
@@ -79,8 +79,10 @@ func newDockerHandler(
 	r.HandleFunc("/v2/", handler.ping)
 
 	prefix := "/v2/{name:(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/?){2}}/"
-	r.Methods("GET", "HEAD").Path(prefix + "manifests/{reference}").HandlerFunc(handler.manifestGet)
-	r.Methods("PUT").Path(prefix + "manifests/{reference}").HandlerFunc(handler.manifestPut)
+	// tags or digests, as defined by the distribution spec.
+	reference := "manifests/{reference:[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}|sha256:[a-f0-9]{64}}"
+	r.Methods("GET", "HEAD").Path(prefix + reference).HandlerFunc(handler.manifestGet)
+	r.Methods("PUT").Path(prefix + reference).HandlerFunc(handler.manifestPut)
 	r.Methods("GET").Path(prefix + "blobs/{digest:sha256:[a-z0-9]{64}}").HandlerFunc(handler.blobGet)
 	r.Methods("HEAD").Path(prefix + "blobs/{digest:sha256:[a-z0-9]{64}}").HandlerFunc(handler.blobHead)
 	r.Methods("POST").Path(prefix + "blobs/uploads/").HandlerFunc(handler.blobUploadPost)
@@ -49,7 +49,7 @@ func TestDocker(t *testing.T) {
 	proxy := testProxy(t)
 
 	apitest.New().
-		Handler(proxy.router()).
+		Handler(testRouter(proxy)).
 		Get("/v2/").
 		Expect(t).
 		Header(headerContentType, mimeJson).
@@ -60,7 +60,7 @@ func TestDocker(t *testing.T) {
 
 func TestDockerBlob(t *testing.T) {
 	proxy := testProxy(t)
-	router := proxy.router()
+	router := testRouter(proxy)
 
 	uploadResult := apitest.New().
 		Handler(router).
@@ -106,7 +106,7 @@ func TestDockerBlob(t *testing.T) {
 
 func TestDockerManifest(t *testing.T) {
 	proxy := testProxy(t)
-	router := proxy.router()
+	router := testRouter(proxy)
 
 	body, err := json.Marshal(&DockerManifest{})
 	if err != nil {
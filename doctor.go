@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/numtide/go-nix/nixbase32"
+	"github.com/numtide/go-nix/wire"
+	"github.com/pkg/errors"
+)
+
+// DoctorCmd checks a running spongix end to end and prints what's wrong.
+type DoctorCmd struct {
+	URL            string        `arg:"--url,required,env:SPONGIX_URL" help:"spongix to diagnose, like http://127.0.0.1:7745"`
+	AdminTokenFile string        `arg:"--admin-token-file,env:SPONGIX_ADMIN_TOKEN_FILE" help:"File with its admin token, for checking the jobs"`
+	Timeout        time.Duration `arg:"--timeout" default:"1m" help:"Time to wait for each check"`
+}
+
+type diagnosis struct {
+	check    string
+	duration time.Duration
+	detail   string
+	err      error
+}
+
+func (d diagnosis) String() string {
+	status, detail := "OK  ", d.detail
+	if d.err != nil {
+		status, detail = "FAIL", d.err.Error()
+	}
+	return fmt.Sprintf("%s %-16s %8s  %s", status, d.check, d.duration.Round(time.Millisecond), detail)
+}
+
+func (proxy *Proxy) runDoctor(cmd *DoctorCmd) error {
+	c, err := client.New(cmd.URL)
+	if err != nil {
+		return err
+	}
+
+	if cmd.AdminTokenFile != "" {
+		if c.Token, err = readTokenFile(cmd.AdminTokenFile); err != nil {
+			return errors.WithMessage(err, "reading admin token")
+		}
+	}
+
+	failed := 0
+	for _, d := range proxy.diagnose(c, cmd.Timeout) {
+		fmt.Fprintln(os.Stdout, d)
+		if d.err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// doctorCanary returns the same store path and NAR on every run, so uploading
+// them again doesn't leave anything behind.
+func doctorCanary() (string, []byte) {
+	sum := sha256.Sum256([]byte("spongix-doctor"))
+	storePath := storeDirPrefix + nixbase32.EncodeToString(sum[:20]) + "-spongix-doctor-canary"
+
+	nar := &bytes.Buffer{}
+	for _, token := range []string{"nix-archive-1", "(", "type", "regular", "contents"} {
+		_ = wire.WriteString(nar, token)
+	}
+	_ = wire.WriteString(nar, "spongix doctor canary\n")
+	_ = wire.WriteString(nar, ")")
+
+	return storePath, nar.Bytes()
+}
+
+// diagnose uploads and fetches a canary narinfo and NAR, checks our signature
+// on it and whether the background jobs run on schedule.
+func (proxy *Proxy) diagnose(c *client.Client, timeout time.Duration) []diagnosis {
+	diagnoses := []diagnosis{}
+	check := func(name string, f func(ctx context.Context) (string, error)) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		start := time.Now()
+		detail, err := f(ctx)
+		diagnoses = append(diagnoses, diagnosis{check: name, duration: time.Since(start), detail: detail, err: err})
+		return err == nil
+	}
+
+	check("nix-cache-info", func(ctx context.Context) (string, error) {
+		info, err := c.NixCacheInfo(ctx)
+		if err != nil {
+			return "", err
+		} else if info.StoreDir != "/nix/store" {
+			return "", errors.Errorf("unexpected StoreDir %q", info.StoreDir)
+		}
+		return fmt.Sprintf("priority %d, want mass query %v", info.Priority, info.WantMassQuery), nil
+	})
+
+	storePath, nar := doctorCanary()
+	hash := storePathHash(strings.TrimPrefix(storePath, storeDirPrefix))
+	narSum := sha256.Sum256(nar)
+	narHash := "sha256:" + nixbase32.EncodeToString(narSum[:])
+	narURL := "nar/" + strings.TrimPrefix(narHash, "sha256:") + ".nar"
+
+	// a read-only cache refuses the canary, and may not have it from before.
+	readOnly := false
+	uploaded := check("upload NAR", func(ctx context.Context) (string, error) {
+		err := c.PutNar(ctx, narURL, bytes.NewReader(nar))
+		if err == client.ErrReadOnly {
+			readOnly = true
+			return "skipped, cache is read-only", nil
+		}
+		return fmt.Sprintf("%d bytes", len(nar)), err
+	}) && !readOnly && check("upload narinfo", func(ctx context.Context) (string, error) {
+		return storePath, c.PutNarinfo(ctx, hash, &narinfo.Narinfo{
+			StorePath:   storePath,
+			URL:         narURL,
+			Compression: "none",
+			FileHash:    narHash,
+			FileSize:    int64(len(nar)),
+			NarHash:     narHash,
+			NarSize:     int64(len(nar)),
+		})
+	})
+
+	if uploaded {
+		var info *narinfo.Narinfo
+		check("fetch narinfo", func(ctx context.Context) (string, error) {
+			var err error
+			if info, err = c.GetNarinfo(ctx, hash); err != nil {
+				return "", err
+			} else if info.NarHash != narHash {
+				return "", errors.Errorf("got NarHash %s, expected %s", info.NarHash, narHash)
+			}
+			return info.URL, nil
+		})
+
+		if info != nil {
+			check("signature", func(ctx context.Context) (string, error) {
+				return verifyOwnSignature(info, proxy.secretKeys)
+			})
+		}
+
+		check("fetch NAR", func(ctx context.Context) (string, error) {
+			rd, err := c.GetNar(ctx, narURL)
+			if err != nil {
+				return "", err
+			}
+			defer rd.Close()
+
+			if content, err := io.ReadAll(rd); err != nil {
+				return "", err
+			} else if !bytes.Equal(content, nar) {
+				return "", errors.New("NAR differs from the uploaded one")
+			}
+			return fmt.Sprintf("%d bytes", len(nar)), nil
+		})
+	}
+
+	check("jobs", func(ctx context.Context) (string, error) {
+		return checkJobs(ctx, c)
+	})
+
+	return diagnoses
+}
+
+// verifyOwnSignature checks that the narinfo was signed with one of our keys.
+func verifyOwnSignature(info *narinfo.Narinfo, secretKeys map[string]ed25519.PrivateKey) (string, error) {
+	if len(secretKeys) == 0 {
+		return "skipped, no secret keys given", nil
+	}
+
+	publicKeys := map[string]ed25519.PublicKey{}
+	names := []string{}
+	for name, key := range secretKeys {
+		publicKeys[name] = key.Public().(ed25519.PublicKey)
+		names = append(names, name)
+	}
+
+	if valid, _ := info.ValidInvalidSignatures(publicKeys); len(valid) == 0 {
+		return "", errors.Errorf("no valid signature by %s among %v", strings.Join(names, ", "), info.Sig)
+	}
+	return "signed by " + strings.Join(names, ", "), nil
+}
+
+// checkJobs fails if a background job is overdue. The jobs API may be on a
+// separate admin listener or need the admin token, in which case this is
+// skipped.
+func checkJobs(ctx context.Context, c *client.Client) (string, error) {
+	u, err := c.URL.Parse("jobs")
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusForbidden {
+		return "skipped, the jobs API isn't on this listener", nil
+	} else if res.StatusCode == http.StatusUnauthorized && c.Token == "" {
+		return "skipped, the jobs API needs --admin-token-file", nil
+	} else if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("GET %s: status %d", u, res.StatusCode)
+	}
+
+	statuses := []jobStatus{}
+	if err := json.NewDecoder(res.Body).Decode(&statuses); err != nil {
+		return "", errors.WithMessage(err, "decoding jobs")
+	}
+
+	details := []string{}
+	for _, status := range statuses {
+		switch {
+		case status.Paused:
+			details = append(details, status.Name+" paused")
+		case status.Running:
+			details = append(details, status.Name+" running")
+		case status.LastStart.IsZero():
+			details = append(details, status.Name+" not run yet")
+		case time.Since(status.LastStart) > 2*status.Interval+status.LastDuration:
+			return "", errors.Errorf("%s last ran %s ago, but should run every %s", status.Name, time.Since(status.LastStart).Round(time.Second), status.Interval)
+		default:
+			details = append(details, status.Name+" ran "+time.Since(status.LastStart).Round(time.Second).String()+" ago")
+		}
+	}
+
+	return strings.Join(details, ", "), nil
+}
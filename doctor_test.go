@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/input-output-hk/spongix/pkg/client"
+	"github.com/numtide/go-nix/nar"
+)
+
+func TestDoctor(t *testing.T) {
+	proxy := testProxy(t)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.secretKeys = map[string]ed25519.PrivateKey{"test-1": key}
+
+	server := httptest.NewServer(testRouter(proxy))
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Token = testAdminToken
+
+	checks := []string{}
+	for _, d := range proxy.diagnose(c, time.Minute) {
+		if d.err != nil {
+			t.Errorf("%s", d)
+		}
+		checks = append(checks, d.check)
+	}
+
+	expected := "nix-cache-info,upload NAR,upload narinfo,fetch narinfo,signature,fetch NAR,jobs"
+	if actual := strings.Join(checks, ","); actual != expected {
+		t.Fatalf("expected checks %s, got %s", expected, actual)
+	}
+
+	// GC removes indices of NARs it can't read.
+	storePath, canary := doctorCanary()
+	if _, err := nar.NewReader(bytes.NewReader(canary)).Next(); err != nil {
+		t.Fatalf("canary isn't a valid NAR: %s", err)
+	}
+
+	// running again leaves no history or other NARs behind.
+	proxy.diagnose(c, time.Minute)
+	hash := storePathHash(strings.TrimPrefix(storePath, storeDirPrefix))
+	if versions, err := proxy.narinfoVersions(hash); err != nil || len(versions) != 0 {
+		t.Fatalf("expected no narinfo versions, got %v %v", versions, err)
+	}
+	if nars, err := os.ReadDir(filepath.Join(proxy.localIndex.(desync.LocalIndexStore).Path, "nar")); err != nil || len(nars) != 1 {
+		t.Fatalf("expected one NAR, got %d %v", len(nars), err)
+	}
+}
+
+func TestDoctorReadOnly(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.ReadOnly = true
+
+	server := httptest.NewServer(testRouter(proxy))
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Token = testAdminToken
+
+	checks := []string{}
+	for _, d := range proxy.diagnose(c, time.Minute) {
+		if d.err != nil {
+			t.Errorf("%s", d)
+		}
+		checks = append(checks, d.check)
+	}
+
+	expected := "nix-cache-info,upload NAR,jobs"
+	if actual := strings.Join(checks, ","); actual != expected {
+		t.Fatalf("expected checks %s, got %s", expected, actual)
+	}
+}
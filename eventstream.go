@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+)
+
+var (
+	metricEventSubscribers = metrics.MustInteger("spongix_event_subscribers", "Number of clients connected to GET /events")
+	metricEventsDropped    = metrics.MustCounter("spongix_events_dropped", "Number of events not sent to GET /events clients that didn't keep up")
+)
+
+const (
+	eventUpload = "upload"
+	eventFetch  = "fetch"
+	eventDelete = "delete"
+	eventGC     = "gc"
+)
+
+// events buffered for each client, further ones are dropped until it caught
+// up.
+const eventStreamBuffer = 256
+
+// sent as SSE comment while idle, so proxies don't close the connection.
+var eventStreamKeepalive = 15 * time.Second
+
+type cacheEvent struct {
+	Type string    `json:"type"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+// eventStream fans out uploads, upstream fetches and deletions to the clients
+// of GET /events. Unlike the eventLog used for replication nothing is kept,
+// clients only see what happens while they're connected.
+type eventStream struct {
+	mu          sync.Mutex
+	subscribers map[chan cacheEvent]struct{}
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subscribers: map[chan cacheEvent]struct{}{}}
+}
+
+func (s *eventStream) subscribe() (<-chan cacheEvent, func()) {
+	ch := make(chan cacheEvent, eventStreamBuffer)
+
+	s.mu.Lock()
+	s.subscribers[ch] = yes
+	metricEventSubscribers.Set(int64(len(s.subscribers)))
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		metricEventSubscribers.Set(int64(len(s.subscribers)))
+		s.mu.Unlock()
+	}
+}
+
+// publish never blocks, so a slow client can't hold up uploads or the GC.
+func (s *eventStream) publish(kind, path string) {
+	event := cacheEvent{Type: kind, Path: path, Time: time.Now()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+			metricEventsDropped.Add(1)
+		}
+	}
+}
+
+// withCacheEvents publishes successful uploads of narinfos and NARs, and
+// everything fetched from an upstream.
+func (proxy *Proxy) withCacheEvents() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" && r.Method != "GET" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(record, r)
+
+			if record.status != http.StatusOK {
+				return
+			}
+
+			switch {
+			case r.Method == "PUT":
+				if name, err := urlToIndexName(r.URL); err == nil {
+					proxy.stream.publish(eventUpload, "/"+name)
+				}
+			case w.Header().Get(headerCache) == headerCacheRemote:
+				proxy.stream.publish(eventFetch, r.URL.Path)
+			}
+		})
+	}
+}
+
+// GET /events?types=upload,fetch,delete,gc
+// Streams the events as server-sent events, all types unless given.
+func (proxy *Proxy) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		answer(w, http.StatusNotImplemented, mimeText, "streaming is not supported\n")
+		return
+	}
+
+	types := map[string]struct{}{}
+	if raw := r.URL.Query().Get("types"); raw != "" {
+		for _, kind := range strings.Split(raw, ",") {
+			switch kind {
+			case eventUpload, eventFetch, eventDelete, eventGC:
+				types[kind] = yes
+			default:
+				answer(w, http.StatusBadRequest, mimeText, fmt.Sprintf("unknown event type %q\n", kind))
+				return
+			}
+		}
+	}
+
+	events, unsubscribe := proxy.stream.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set(headerContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers responses otherwise.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			if _, found := types[event.Type]; len(types) > 0 && !found {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterEvents(t *testing.T) {
+	proxy := withS3(testProxy(t))
+
+	server := httptest.NewServer(testRouter(proxy))
+	defer server.Close()
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/events").
+		Query("types", "upload,bogus").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	res, err := http.Get(server.URL + "/events?types=upload,delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get(headerContentType); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	// not asked for.
+	proxy.stream.publish(eventGC, "/nar/0000000000000000000000000000000000000000000000000000.nar")
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		req, err := http.NewRequest(method, server.URL+fNarinfo, bytes.NewReader(testdata[fNarinfo]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		put, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		put.Body.Close()
+		if put.StatusCode != http.StatusOK {
+			t.Fatalf("%s answered %s", method, put.Status)
+		}
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	lines := []string{}
+	for len(lines) < 4 && scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	expected := []string{"event: upload", `"path":"` + fNarinfo + `"`, "event: delete", `"path":"` + fNarinfo + `"`}
+	for i, line := range lines {
+		if !strings.Contains(line, expected[i]) {
+			t.Fatalf("expected %q in line %d, got %q", expected[i], i, line)
+		}
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %v", len(expected), lines)
+	}
+}
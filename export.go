@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var metricExportedPaths = metrics.MustInteger("spongix_exported_paths", "Number of store paths served on the public listener")
+
+// exports is the allowlist of store paths served on the public listener. Each
+// exported path is a file in dir named after its hash, containing the index
+// name of its NAR.
+type exports struct {
+	mu   sync.RWMutex
+	dir  string
+	nars map[string]string
+}
+
+func newExports(dir string) (*exports, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	e := &exports{dir: dir, nars: map[string]string{}}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !validStorePathHash.MatchString(entry.Name()) {
+			continue
+		}
+
+		nar, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		e.nars[entry.Name()] = string(nar)
+	}
+
+	metricExportedPaths.Set(int64(len(e.nars)))
+	return e, nil
+}
+
+func (e *exports) add(hash, nar string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := os.WriteFile(filepath.Join(e.dir, hash), []byte(nar), 0o644); err != nil {
+		return err
+	}
+
+	e.nars[hash] = nar
+	metricExportedPaths.Set(int64(len(e.nars)))
+	return nil
+}
+
+func (e *exports) remove(hash string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, found := e.nars[hash]; !found {
+		return false, nil
+	}
+
+	if err := os.Remove(filepath.Join(e.dir, hash)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	delete(e.nars, hash)
+	metricExportedPaths.Set(int64(len(e.nars)))
+	return true, nil
+}
+
+func (e *exports) list() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	hashes := make([]string, 0, len(e.nars))
+	for hash := range e.nars {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// allowed reports whether the index with the given name belongs to an
+// exported store path.
+func (e *exports) allowed(name string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if hash := strings.TrimSuffix(name, ".narinfo"); hash != name {
+		_, found := e.nars[hash]
+		return found
+	}
+
+	for _, nar := range e.nars {
+		if nar == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) setupExports() {
+	e, err := newExports(filepath.Join(proxy.Dir, "exports"))
+	if err != nil {
+		proxy.log.Fatal("failed setting up exports", zap.Error(err))
+	}
+	proxy.exports = e
+}
+
+// GET /exports
+func (proxy *Proxy) exportsList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(proxy.exports.list()); err != nil {
+		proxy.log.Error("encoding exports", zap.Error(err))
+	}
+}
+
+// POST /exports
+// Exports the closures of the given store paths, which must be in the local
+// store. Accepts the same formats as query-missing.
+func (proxy *Proxy) exportsAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, queryMissingMaxBody+1))
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, err.Error())
+		return
+	} else if len(body) > queryMissingMaxBody {
+		answer(w, http.StatusRequestEntityTooLarge, mimeText, "too many store paths\n")
+		return
+	}
+
+	hashes, err := parseStorePathHashes(body)
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, err.Error())
+		return
+	} else if len(hashes) > queryMissingLimit {
+		answer(w, http.StatusRequestEntityTooLarge, mimeText, "too many store paths\n")
+		return
+	}
+
+	infos, err := proxy.closureNarinfos(hashes)
+	if err != nil {
+		answer(w, http.StatusNotFound, mimeText, err.Error())
+		return
+	}
+
+	exported := make([]string, 0, len(infos))
+	for hash, info := range infos {
+		if err := proxy.exports.add(hash, narIndexName(info.URL)); err != nil {
+			proxy.log.Error("exporting store path", zap.Error(err), zap.String("hash", hash))
+			answer(w, http.StatusInternalServerError, mimeText, errors.WithMessage(err, "exporting store path").Error())
+			return
+		}
+		exported = append(exported, hash)
+	}
+	sort.Strings(exported)
+
+	proxy.log.Info("exported store paths", zap.Strings("paths", hashes), zap.Int("closure", len(exported)))
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(exported); err != nil {
+		proxy.log.Error("encoding exports", zap.Error(err))
+	}
+}
+
+// DELETE /exports/{hash}
+// Only removes the given store path, not its closure, since other exports
+// may still refer to it.
+func (proxy *Proxy) exportsRemove(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if found, err := proxy.exports.remove(hash); err != nil {
+		answer(w, http.StatusInternalServerError, mimeText, err.Error())
+	} else if !found {
+		serveNotFound(w, r)
+	} else {
+		proxy.log.Info("unexported store path", zap.String("hash", hash))
+		answer(w, http.StatusOK, mimeText, "ok\n")
+	}
+}
+
+// withExportsOnly answers 404 for everything that isn't exported.
+func (proxy *Proxy) withExportsOnly() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if name, err := urlToIndexName(r.URL); err != nil || !proxy.exports.allowed(name) {
+				serveNotFound(w, r)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// publicRouter serves exported store paths without authentication. It never
+// accepts uploads and never goes upstream.
+func (proxy *Proxy) publicRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.NotFoundHandler = notFound{proxy.log}
+	r.MethodNotAllowedHandler = notAllowed{proxy.log}
+	r.Use(
+		withTracing(),
+		withHTTPLogging(proxy.log),
+		handlers.RecoveryHandler(handlers.PrintRecoveryStack(true)),
+	)
+
+	if proxy.exports == nil {
+		proxy.setupExports()
+	}
+
+	r.HandleFunc("/nix-cache-info", proxy.nixCacheInfo).Methods("GET")
+
+	narinfo := r.Path("/{hash:[0-9a-df-np-sv-z]{32}}.narinfo").Subrouter()
+	narinfo.Use(proxy.withExportsOnly(), proxy.withCanaryHandler())
+	narinfo.Methods("HEAD", "GET").HandlerFunc(serveNotFound)
+
+	nar := r.Path("/nar/{hash:[0-9a-df-np-sv-z]{52}}{ext:\\.nar(?:\\.xz|\\.zst|\\.bz2|)}").Subrouter()
+	nar.Use(proxy.withExportsOnly(), proxy.withZstdResponses(), proxy.withCanaryHandler())
+	nar.Methods("HEAD", "GET").HandlerFunc(serveNotFound)
+
+	return r
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterExports(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	public := proxy.publicRouter()
+	narURL := "/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar"
+
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	if idx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNar, "/")); err != nil {
+		t.Fatal(err)
+	} else if err := proxy.localIndex.StoreIndex(strings.TrimPrefix(narURL, "/"), idx); err != nil {
+		t.Fatal(err)
+	}
+
+	apitest.New().
+		Handler(public).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("POST").
+		URL("/exports").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Body("/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10\n").
+		Expect(t).
+		Body(`["8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5"]` + "\n").
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(public).
+		Get(fNarinfo).
+		Expect(t).
+		Body(string(testdata[fNarinfo])).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(public).
+		Get(narURL).
+		Expect(t).
+		Body(string(testdata[fNar])).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(public).
+		Get(fNar).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	// the allowlist survives restarts
+	if e, err := newExports(filepath.Join(proxy.Dir, "exports")); err != nil {
+		t.Fatal(err)
+	} else if !e.allowed("8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5.narinfo") {
+		t.Fatal("export wasn't persisted")
+	}
+
+	apitest.New().
+		Handler(router).
+		Method("DELETE").
+		URL("/exports/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(public).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
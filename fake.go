@@ -12,6 +12,7 @@ import (
 // fakeStore
 type fakeStore struct {
 	chunks map[desync.ChunkID][]byte
+	err    error
 }
 
 func (s fakeStore) Close() error   { return nil }
@@ -24,6 +25,9 @@ func newFakeStore() *fakeStore {
 }
 
 func (s fakeStore) GetChunk(id desync.ChunkID) (*desync.Chunk, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
 	found, ok := s.chunks[id]
 	if !ok {
 		return nil, desync.ChunkMissing{ID: id}
@@ -32,11 +36,17 @@ func (s fakeStore) GetChunk(id desync.ChunkID) (*desync.Chunk, error) {
 }
 
 func (s fakeStore) HasChunk(id desync.ChunkID) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
 	_, ok := s.chunks[id]
 	return ok, nil
 }
 
 func (s *fakeStore) StoreChunk(chunk *desync.Chunk) error {
+	if s.err != nil {
+		return s.err
+	}
 	data, err := chunk.Data()
 	if err != nil {
 		return err
@@ -79,6 +89,11 @@ func (s fakeIndex) GetIndex(id string) (i desync.Index, e error) {
 	return idx, err
 }
 
+func (s fakeIndex) RemoveIndex(id string) error {
+	delete(s.indices, id)
+	return nil
+}
+
 func (s fakeIndex) GetIndexReader(id string) (io.ReadCloser, error) {
 	idx, ok := s.indices[id]
 	if ok {
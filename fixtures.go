@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/numtide/go-nix/nixbase32"
+	"github.com/numtide/go-nix/wire"
+	"github.com/pkg/errors"
+)
+
+// GenFixturesCmd writes a small binary cache of synthetic store paths, signed
+// with the secret keys, for tests and demos.
+type GenFixturesCmd struct {
+	Out         string   `arg:"--out,required" help:"Directory the fixtures are written to, it can be used as a file:// substituter"`
+	Compression string   `arg:"--compression" default:"xz" help:"Compression of the NARs: none, xz or zst"`
+	Names       []string `arg:"positional" help:"Names of the store paths, each one references the one before it"`
+}
+
+// realisation is the JSON Nix stores at realisations/<id>.doi for the outputs
+// of content-addressed derivations.
+type realisation struct {
+	ID                    string            `json:"id"`
+	OutPath               string            `json:"outPath"`
+	Signatures            []string          `json:"signatures"`
+	DependentRealisations map[string]string `json:"dependentRealisations"`
+}
+
+// fingerprint is what Nix signs, the JSON without the signatures.
+func (r *realisation) fingerprint() []byte {
+	fp, _ := json.Marshal(map[string]interface{}{
+		"id":                    r.ID,
+		"outPath":               r.OutPath,
+		"dependentRealisations": r.DependentRealisations,
+	})
+	return fp
+}
+
+func (r *realisation) sign(name string, key ed25519.PrivateKey) {
+	r.Signatures = append(r.Signatures, name+":"+base64.StdEncoding.EncodeToString(ed25519.Sign(key, r.fingerprint())))
+}
+
+type fixture struct {
+	info        *narinfo.Narinfo
+	nar         []byte
+	realisation *realisation
+}
+
+var fixtureCompressionExts = map[string]string{"none": "", "xz": ".xz", "zst": ".zst"}
+
+// fixturePath returns a store path that's the same for the same name on every
+// run, so generated fixtures are stable.
+func fixturePath(name string) string {
+	sum := sha256.Sum256([]byte("spongix-fixture-" + name))
+	return storeDirPrefix + nixbase32.EncodeToString(sum[:20]) + "-" + name
+}
+
+// fixtureNar returns a NAR with a single file mentioning the references, so
+// scanning it finds them like in a real store path.
+func fixtureNar(name string, references []string) []byte {
+	contents := name + "\n"
+	for _, ref := range references {
+		contents += ref + "\n"
+	}
+
+	nar := &bytes.Buffer{}
+	for _, token := range []string{"nix-archive-1", "(", "type", "regular", "contents", contents, ")"} {
+		_ = wire.WriteString(nar, token)
+	}
+	return nar.Bytes()
+}
+
+// fixtures creates the narinfo, compressed NAR and realisation of every name,
+// signed with all secret keys.
+func (proxy *Proxy) fixtures(names []string, compression string) ([]fixture, error) {
+	ext, ok := fixtureCompressionExts[compression]
+	if !ok {
+		return nil, errors.Errorf("unknown compression %q", compression)
+	}
+
+	keyNames := []string{}
+	for name := range proxy.secretKeys {
+		keyNames = append(keyNames, name)
+	}
+	sort.Strings(keyNames)
+
+	fixtures := []fixture{}
+	previous := ""
+	for _, name := range names {
+		storePath := fixturePath(name)
+		references := []string{}
+		if previous != "" {
+			references = append(references, previous)
+		}
+		previous = storePath
+
+		nar := fixtureNar(name, references)
+		narSum := sha256.Sum256(nar)
+
+		file := nar
+		if ext != "" {
+			buf := &bytes.Buffer{}
+			wr, err := compress("fixture.nar"+ext, buf)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := wr.Write(nar); err != nil {
+				return nil, errors.WithMessage(err, "compressing NAR")
+			} else if err := wr.Close(); err != nil {
+				return nil, errors.WithMessage(err, "compressing NAR")
+			}
+			file = buf.Bytes()
+		}
+		fileSum := sha256.Sum256(file)
+
+		refs := []string{}
+		for _, ref := range references {
+			refs = append(refs, strings.TrimPrefix(ref, storeDirPrefix))
+		}
+
+		deriver := strings.TrimPrefix(fixturePath(name+".drv"), storeDirPrefix)
+		info := &narinfo.Narinfo{
+			StorePath:   storePath,
+			URL:         "nar/" + nixbase32.EncodeToString(fileSum[:]) + ".nar" + ext,
+			Compression: compression,
+			FileHash:    "sha256:" + nixbase32.EncodeToString(fileSum[:]),
+			FileSize:    int64(len(file)),
+			NarHash:     "sha256:" + nixbase32.EncodeToString(narSum[:]),
+			NarSize:     int64(len(nar)),
+			References:  refs,
+			Deriver:     deriver,
+		}
+
+		drvSum := sha256.Sum256([]byte(deriver))
+		rl := &realisation{
+			ID:                    "sha256:" + hex.EncodeToString(drvSum[:]) + "!out",
+			OutPath:               strings.TrimPrefix(storePath, storeDirPrefix),
+			Signatures:            []string{},
+			DependentRealisations: map[string]string{},
+		}
+
+		for _, keyName := range keyNames {
+			info.Sign(keyName, proxy.secretKeys[keyName])
+			rl.sign(keyName, proxy.secretKeys[keyName])
+		}
+
+		if err := info.Validate(); err != nil {
+			return nil, errors.WithMessagef(err, "generated invalid narinfo for %q", name)
+		}
+
+		fixtures = append(fixtures, fixture{info: info, nar: file, realisation: rl})
+	}
+
+	return fixtures, nil
+}
+
+func (proxy *Proxy) runGenFixtures(cmd *GenFixturesCmd) error {
+	names := cmd.Names
+	if len(names) == 0 {
+		names = []string{"hello", "greeting"}
+	}
+
+	fixtures, err := proxy.fixtures(names, cmd.Compression)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{"nar", "realisations"} {
+		if err := os.MkdirAll(filepath.Join(cmd.Out, dir), 0755); err != nil {
+			return errors.WithMessagef(err, "creating %q", dir)
+		}
+	}
+
+	files := map[string][]byte{
+		"nix-cache-info": []byte("StoreDir: /nix/store\nWantMassQuery: 1\nPriority: 50\n"),
+	}
+
+	for _, f := range fixtures {
+		info := &bytes.Buffer{}
+		if err := f.info.Marshal(info); err != nil {
+			return err
+		}
+		files[storePathHash(strings.TrimPrefix(f.info.StorePath, storeDirPrefix))+".narinfo"] = info.Bytes()
+		files[f.info.URL] = f.nar
+
+		doi, err := json.Marshal(f.realisation)
+		if err != nil {
+			return err
+		}
+		files["realisations/"+f.realisation.ID+".doi"] = doi
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(cmd.Out, name), content, 0644); err != nil {
+			return errors.WithMessagef(err, "writing %q", name)
+		}
+	}
+
+	for _, f := range fixtures {
+		fmt.Fprintln(os.Stdout, f.info.StorePath)
+	}
+	return nil
+}
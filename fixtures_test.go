@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+)
+
+func TestGenFixtures(t *testing.T) {
+	proxy := testProxy(t)
+	public, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.secretKeys = map[string]ed25519.PrivateKey{"test-1": key}
+	proxy.trustedKeys["test-1"] = public
+
+	out := t.TempDir()
+	if err := proxy.runGenFixtures(&GenFixturesCmd{Out: out, Compression: "xz", Names: []string{"lib", "app"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(testRouter(proxy))
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	narinfos, err := filepath.Glob(filepath.Join(out, "*.narinfo"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(narinfos) != 2 {
+		t.Fatalf("expected 2 narinfos, got %d", len(narinfos))
+	}
+
+	for _, path := range narinfos {
+		fd, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &narinfo.Narinfo{}
+		err = info.Unmarshal(fd)
+		fd.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+
+		nar, err := os.Open(filepath.Join(out, info.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.PutNar(ctx, info.URL, nar)
+		nar.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash := strings.TrimSuffix(filepath.Base(path), ".narinfo")
+		if err := c.PutNarinfo(ctx, hash, info); err != nil {
+			t.Fatal(err)
+		}
+
+		served, err := c.GetNarinfo(ctx, hash)
+		if err != nil {
+			t.Fatal(err)
+		} else if valid, _ := served.ValidInvalidSignatures(proxy.trustedKeys); len(valid) != 1 {
+			t.Fatalf("expected a valid signature on %s, got %v", served.StorePath, served.Sig)
+		}
+	}
+
+	realisations, err := filepath.Glob(filepath.Join(out, "realisations", "*.doi"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(realisations) != 2 {
+		t.Fatalf("expected 2 realisations, got %d", len(realisations))
+	}
+
+	content, err := os.ReadFile(realisations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := &realisation{}
+	if err := json.Unmarshal(content, rl); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(rl.Signatures[0], "test-1:"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !ed25519.Verify(public, rl.fingerprint(), sig) {
+		t.Fatalf("invalid signature on realisation %s", rl.ID)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pascaldekloe/metrics"
+)
+
+var metricUpstreamCoalesced = metrics.MustCounter("spongix_upstream_coalesced", "Number of cache misses that waited for a concurrent upstream fetch of the same URL")
+
+// upstream bodies up to this size are kept in memory for concurrent requests
+// of the same URL, larger ones are fetched again from the upstream that had
+// them.
+const maxSharedUpstreamBody = 1 << 20
+
+// upstreamFlight is the result of looking up a URL on the upstreams.
+type upstreamFlight struct {
+	done chan struct{}
+	// the upstream URL that answered, empty if none did.
+	url      string
+	body     []byte
+	buffered bool
+}
+
+// upstreamFlights makes sure concurrent cache misses for the same URL only
+// ask the upstreams once.
+type upstreamFlights struct {
+	mu      sync.Mutex
+	flights map[string]*upstreamFlight
+}
+
+func newUpstreamFlights() *upstreamFlights {
+	return &upstreamFlights{flights: map[string]*upstreamFlight{}}
+}
+
+// join returns the flight for key and whether the caller is the one who has
+// to fetch it.
+func (f *upstreamFlights) join(key string) (*upstreamFlight, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if flight, found := f.flights[key]; found {
+		metricUpstreamCoalesced.Add(1)
+		return flight, false
+	}
+
+	flight := &upstreamFlight{done: make(chan struct{})}
+	f.flights[key] = flight
+	return flight, true
+}
+
+// land publishes the result of the flight to everybody waiting for it.
+func (f *upstreamFlights) land(key string, flight *upstreamFlight) {
+	f.mu.Lock()
+	delete(f.flights, key)
+	f.mu.Unlock()
+
+	close(flight.done)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRouterUpstreamCoalescing(t *testing.T) {
+	requests := int32(0)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write(testdata[fNarinfo])
+	}))
+	defer upstream.Close()
+
+	proxy := testProxy(t)
+	proxy.Substituters = []string{upstream.URL}
+	router := testRouter(proxy)
+
+	const concurrent = 5
+	coalesced := metricUpstreamCoalesced.Get()
+	results := make(chan *httptest.ResponseRecorder, concurrent)
+	for i := 0; i < concurrent; i++ {
+		go func() {
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, httptest.NewRequest("GET", fNarinfo, nil))
+			results <- res
+		}()
+	}
+
+	for metricUpstreamCoalesced.Get() < coalesced+concurrent-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	for i := 0; i < concurrent; i++ {
+		res := <-results
+		if res.Code != http.StatusOK || res.Body.String() != string(testdata[fNarinfo]) {
+			t.Fatalf("unexpected response: %d %q", res.Code, res.Body.String())
+		} else if res.Header().Get(headerCacheUpstream) != upstream.URL+fNarinfo {
+			t.Fatalf("unexpected upstream: %v", res.Header())
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected one upstream request, got %d", n)
+	}
+}
+
+func TestRouterUpstreamCoalescingLarge(t *testing.T) {
+	large := bytes.Repeat([]byte{1}, maxSharedUpstreamBody+2)
+	requests := int32(0)
+	streaming := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".nar") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// the first request only sends the rest once released.
+			_, _ = w.Write(large[:maxSharedUpstreamBody+1])
+			w.(http.Flusher).Flush()
+			close(streaming)
+			<-release
+			_, _ = w.Write(large[maxSharedUpstreamBody+1:])
+			return
+		}
+		_, _ = w.Write(large)
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	proxy := testProxy(t)
+	proxy.Substituters = []string{upstream.URL}
+	router := testRouter(proxy)
+	url := "/nar/0000000000000000000000000000000000000000000000000000.nar"
+
+	go router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	<-streaming
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("GET", url, nil))
+	if res.Code != http.StatusOK || res.Body.Len() != len(large) {
+		t.Fatalf("unexpected response: %d with %d bytes", res.Code, res.Body.Len())
+	}
+}
+
+func TestRouterUpstreamCoalescingLargeConcurrency(t *testing.T) {
+	large := bytes.Repeat([]byte{1}, maxSharedUpstreamBody+2)
+	requests := int32(0)
+	streaming := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".nar") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(large[:maxSharedUpstreamBody+1])
+		w.(http.Flusher).Flush()
+		close(streaming)
+		<-release
+		_, _ = w.Write(large[maxSharedUpstreamBody+1:])
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	proxy := testProxy(t)
+	proxy.Substituters = []string{upstream.URL + "?concurrency=1"}
+	router := testRouter(proxy)
+	url := "/nar/0000000000000000000000000000000000000000000000000000.nar"
+
+	go router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	<-streaming
+
+	// the follower has to wait for the slot the leader is still holding.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("GET", url, nil).WithContext(ctx))
+	if res.Body.Len() != 0 {
+		t.Fatalf("unexpected response: %d with %d bytes", res.Code, res.Body.Len())
+	} else if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected one upstream request, got %d", n)
+	}
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -29,6 +29,7 @@ var (
 	metricChunkDirs    = metrics.MustInteger("spongix_chunk_dir_count", "Number of directories the chunks are stored in")
 
 	metricIndexCount   = metrics.MustInteger("spongix_index_count_local", "Number of indices")
+	metricDrvCount     = metrics.MustInteger("spongix_derivation_count_local", "Number of .drv indices")
 	metricIndexGcCount = metrics.MustCounter("spongix_index_gc_count_local", "Number of indices deleted by GC")
 	metricIndexWalk    = metrics.MustCounter("spongix_index_walk_local", "Total time spent walking the index in ms")
 
@@ -46,33 +47,13 @@ func measure(metric *metrics.Counter, f func()) {
 	metric.Add(uint64(time.Since(start).Milliseconds()))
 }
 
-func (proxy *Proxy) gc() {
-	proxy.log.Debug("Initializing GC", zap.Duration("interval", proxy.GcInterval))
-	cacheStat := map[string]*chunkStat{}
-	measure(metricGcTime, func() { proxy.gcOnce(cacheStat) })
-
-	ticker := time.NewTicker(proxy.GcInterval)
-	for {
-		<-ticker.C
-		measure(metricGcTime, func() { proxy.gcOnce(cacheStat) })
-	}
-}
-
-func (proxy *Proxy) verify() {
-	proxy.log.Debug("Initializing Verifier", zap.Duration("interval", proxy.VerifyInterval))
-	measure(metricVerifyTime, func() { proxy.verifyOnce() })
-
-	ticker := time.NewTicker(proxy.VerifyInterval)
-	for {
-		<-ticker.C
-		measure(metricVerifyTime, func() { proxy.verifyOnce() })
-	}
-}
-
 func (proxy *Proxy) verifyOnce() {
 	proxy.log.Info("store verify started")
-	store := proxy.localStore.(desync.LocalStore)
-	err := store.Verify(context.Background(), runtime.GOMAXPROCS(0), true, os.Stderr)
+	store, ok := proxy.chunkDisk()
+	if !ok {
+		return
+	}
+	err := store.Verify(context.Background(), int(proxy.VerifyThreads), true, os.Stderr)
 
 	if err != nil {
 		proxy.log.Error("store verify failed", zap.Error(err))
@@ -87,57 +68,116 @@ type chunkStat struct {
 	mtime time.Time
 }
 
-type chunkLRU struct {
-	live        []*chunkStat
-	liveSize    uint64
-	liveSizeMax uint64
-	dead        map[desync.ChunkID]struct{}
-	deadSize    uint64
-}
+const (
+	gcPhaseScan    = "scan"
+	gcPhaseSweep   = "sweep"
+	gcPhaseIndices = "indices"
+)
 
-func NewLRU(liveSizeMax uint64) *chunkLRU {
-	return &chunkLRU{
-		live:        []*chunkStat{},
-		liveSizeMax: liveSizeMax,
-		dead:        map[desync.ChunkID]struct{}{},
-	}
+// gcHistogramBucket is how precisely the GC evicts by access time, the chunks
+// of the oldest bucket that doesn't fit anymore are removed together.
+const gcHistogramBucket = time.Hour
+
+// gcState is the progress of a GC run. It's saved after every batch of
+// chunks, so a restarted spongix continues the run instead of walking the
+// whole store again. Instead of every chunk, it only holds their sizes by
+// access time to find out which ones to evict.
+type gcState struct {
+	Phase     string           `json:"phase"`
+	Started   time.Time        `json:"started"`
+	NextDir   int              `json:"next_dir"`
+	Sizes     map[int64]uint64 `json:"sizes"`
+	Cutoff    time.Time        `json:"cutoff"`
+	Dirs      int64            `json:"dirs"`
+	LiveCount uint64           `json:"live_count"`
+	LiveSize  uint64           `json:"live_size"`
+	DeadCount uint64           `json:"dead_count"`
+	DeadSize  uint64           `json:"dead_size"`
 }
 
-func (l *chunkLRU) AddDead(stat *chunkStat) {
-	l.dead[stat.id] = yes
-	l.deadSize += uint64(stat.size)
+func newGCState() *gcState {
+	return &gcState{Phase: gcPhaseScan, Started: time.Now(), Sizes: map[int64]uint64{}}
 }
 
-func (l *chunkLRU) Add(stat *chunkStat) {
-	isOlder := func(i int) bool { return l.live[i].mtime.Before(stat.mtime) }
-	i := sort.Search(len(l.live), isOlder)
-	l.insertAt(i, stat)
-	l.liveSize += uint64(stat.size)
-	for l.liveSize > l.liveSizeMax {
-		die := l.live[len(l.live)-1]
-		l.dead[die.id] = yes
-		l.live = l.live[:len(l.live)-1]
-		l.deadSize += uint64(die.size)
-		l.liveSize -= uint64(die.size)
+// loadGCState returns the state of an unfinished run, or nil.
+func loadGCState(path string) (*gcState, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
+
+	state := &gcState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, errors.WithMessage(err, "decoding "+path)
+	}
+	if state.Sizes == nil {
+		state.Sizes = map[int64]uint64{}
+	}
+	return state, nil
 }
 
-func (l *chunkLRU) insertAt(i int, v *chunkStat) {
-	if i == len(l.live) {
-		l.live = append(l.live, v)
-	} else {
-		l.live = append(l.live[:i+1], l.live[i:]...)
-		l.live[i] = v
+func (state *gcState) save(path string) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
 	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
-func (l *chunkLRU) IsDead(id desync.ChunkID) bool {
-	_, found := l.dead[id]
-	return found
+// gcCutoff returns the time before which chunks are evicted so the newer ones
+// fit into maxSize, or the zero time if all of them fit.
+func gcCutoff(sizes map[int64]uint64, maxSize uint64) time.Time {
+	buckets := make([]int64, 0, len(sizes))
+	for bucket := range sizes {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] > buckets[j] })
+
+	total := uint64(0)
+	for _, bucket := range buckets {
+		total += sizes[bucket]
+		if total > maxSize {
+			return time.Unix(bucket, 0).Add(gcHistogramBucket)
+		}
+	}
+	return time.Time{}
 }
 
-func (l *chunkLRU) Dead() map[desync.ChunkID]struct{} {
-	return l.dead
+// walkChunkDirs calls f for the chunks of every chunk directory from
+// state.NextDir on, and saves the state whenever GcBatchSize chunks were
+// handled.
+func (proxy *Proxy) walkChunkDirs(store chunkDisk, state *gcState, statePath string, f func(chunkStat)) error {
+	handled := uint64(0)
+	for state.NextDir <= 0xffff {
+		stats, found, err := store.chunkDir(state.NextDir)
+		if err != nil {
+			return err
+		} else if found && state.Phase == gcPhaseScan {
+			state.Dirs++
+		}
+
+		for _, stat := range stats {
+			f(stat)
+			handled++
+		}
+
+		state.NextDir++
+		if handled >= proxy.GcBatchSize {
+			if err := state.save(statePath); err != nil {
+				return errors.WithMessage(err, "saving GC progress")
+			}
+			handled = 0
+		}
+	}
+
+	return nil
 }
 
 // we assume every directory requires 4KB of size (one block) desync stores
@@ -152,6 +192,7 @@ type integrityCheck struct {
 
 func checkNarContents(store desync.Store, idx desync.Index) error {
 	buf := newAssembler(store, idx)
+	defer buf.Close()
 	narRd := nar.NewReader(buf)
 	none := true
 	for {
@@ -171,6 +212,14 @@ func checkNarContents(store desync.Store, idx desync.Index) error {
 	return nil
 }
 
+// checkDerivation makes sure a .drv index still assembles to a derivation.
+func checkDerivation(store desync.Store, idx desync.Index) error {
+	buf := newAssembler(store, idx)
+	defer buf.Close()
+	_, err := readDerivation(buf)
+	return err
+}
+
 /*
 Local GC strategies:
   Check every index file:
@@ -180,76 +229,98 @@ Local GC strategies:
     If index is missing, delete it.
   	If last access is too old, delete it.
 */
-func (proxy *Proxy) gcOnce(cacheStat map[string]*chunkStat) {
+func (proxy *Proxy) gcOnce() {
 	maxCacheSize := (uint64(math.Pow(2, 30)) * proxy.CacheSize) - maxCacheDirPortion
-	store := proxy.localStore.(desync.LocalStore)
+	store, ok := proxy.chunkDisk()
+	if !ok {
+		return
+	}
 	indices := proxy.localIndex.(desync.LocalIndexStore)
-	lru := NewLRU(maxCacheSize)
-	walkStoreStart := time.Now()
-	chunkDirs := int64(0)
+	statePath := filepath.Join(proxy.Dir, "gc-state.json")
 
 	metricMaxSize.Set(int64(maxCacheSize))
 
-	// filepath.Walk is faster for our usecase because we need the stat result anyway.
-	walkStoreErr := filepath.Walk(store.Base, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			if err == os.ErrNotExist {
-				return nil
-			} else {
-				return err
+	state, err := loadGCState(statePath)
+	if err != nil {
+		proxy.log.Error("loading GC progress, starting over", zap.Error(err))
+	}
+	if state == nil {
+		state = newGCState()
+	} else {
+		proxy.log.Info("resuming GC", zap.String("phase", state.Phase), zap.Int("next_dir", state.NextDir))
+	}
+
+	if state.Phase == gcPhaseScan {
+		walkStoreStart := time.Now()
+		walkStoreErr := proxy.walkChunkDirs(store, state, statePath, func(stat chunkStat) {
+			if _, err := store.GetChunk(stat.id); err != nil {
+				proxy.log.Error("getting chunk", zap.Error(err), zap.String("chunk", stat.id.String()))
+				if err := store.RemoveChunk(stat.id); err == nil {
+					state.DeadCount++
+					state.DeadSize += uint64(stat.size)
+				}
+				return
 			}
-		}
 
-		if info.IsDir() {
-			chunkDirs++
-			return nil
-		}
+			state.Sizes[stat.mtime.Truncate(gcHistogramBucket).Unix()] += uint64(stat.size)
+			state.LiveCount++
+			state.LiveSize += uint64(stat.size)
+		})
+		metricChunkWalk.Add(uint64(time.Since(walkStoreStart).Milliseconds()))
 
-		name := info.Name()
-		if strings.HasPrefix(name, ".tmp") {
-			return nil
+		if walkStoreErr != nil {
+			proxy.log.Error("While walking store", zap.Error(walkStoreErr))
+			return
 		}
 
-		ext := filepath.Ext(name)
-		if ext != desync.CompressedChunkExt {
-			return nil
+		state.Phase, state.NextDir = gcPhaseSweep, 0
+		state.Cutoff = gcCutoff(state.Sizes, maxCacheSize)
+		if err := state.save(statePath); err != nil {
+			proxy.log.Error("saving GC progress", zap.Error(err))
 		}
+	}
 
-		idstr := name[0 : len(name)-len(ext)]
-
-		id, err := desync.ChunkIDFromString(idstr)
-		if err != nil {
-			return err
-		}
+	metricChunkDirs.Set(state.Dirs)
 
-		stat := &chunkStat{id: id, size: info.Size(), mtime: info.ModTime()}
+	if state.Phase == gcPhaseSweep {
+		if !state.Cutoff.IsZero() {
+			// indices written since the run started may use chunks we'd evict.
+			recent := recentlyIndexedChunks(indices, state.Started)
+			err := proxy.walkChunkDirs(store, state, statePath, func(stat chunkStat) {
+				if !stat.mtime.Before(state.Cutoff) {
+					return
+				} else if _, found := recent[stat.id]; found {
+					return
+				}
 
-		if _, err := store.GetChunk(id); err != nil {
-			proxy.log.Error("getting chunk", zap.Error(err), zap.String("chunk", id.String()))
-			lru.AddDead(stat)
-		} else {
-			lru.Add(stat)
+				if err := store.RemoveChunk(stat.id); err != nil {
+					proxy.log.Error("Removing chunk", zap.Error(err), zap.String("id", stat.id.String()))
+					return
+				}
+				state.LiveCount--
+				state.LiveSize -= uint64(stat.size)
+				state.DeadCount++
+				state.DeadSize += uint64(stat.size)
+			})
+			if err != nil {
+				proxy.log.Error("While sweeping store", zap.Error(err))
+				return
+			}
 		}
 
-		return nil
-	})
-
-	metricChunkWalk.Add(uint64(time.Since(walkStoreStart).Milliseconds()))
-	metricChunkDirs.Set(chunkDirs)
-
-	if walkStoreErr != nil {
-		proxy.log.Error("While walking store", zap.Error(walkStoreErr))
-		return
+		state.Phase = gcPhaseIndices
+		if err := state.save(statePath); err != nil {
+			proxy.log.Error("saving GC progress", zap.Error(err))
+		}
 	}
 
-	metricChunkCount.Set(int64(len(lru.live)))
-	metricChunkGcCount.Add(uint64(len(lru.dead)))
-	metricChunkGcSize.Add(lru.deadSize)
-	metricChunkSize.Set(int64(lru.liveSize))
+	metricChunkCount.Set(int64(state.LiveCount))
+	metricChunkSize.Set(int64(state.LiveSize))
 
 	deadIndices := &sync.Map{}
 	walkIndicesStart := time.Now()
 	indicesCount := int64(0)
+	drvCount := int64(0)
 	inflatedSize := int64(0)
 	ignoreBeforeTime := time.Now().Add(10 * time.Minute)
 
@@ -279,6 +350,11 @@ func (proxy *Proxy) gcOnce(cacheStat map[string]*chunkStat) {
 							proxy.log.Error("checking narinfo", zap.Error(err), zap.String("path", check.path))
 							deadIndices.Store(check.path, yes)
 						}
+					case ".drv":
+						if err := checkDerivation(store, check.index); err != nil {
+							proxy.log.Error("checking derivation", zap.Error(err), zap.String("path", check.path))
+							deadIndices.Store(check.path, yes)
+						}
 					}
 				}
 			}
@@ -295,6 +371,9 @@ func (proxy *Proxy) gcOnce(cacheStat map[string]*chunkStat) {
 		ext := filepath.Ext(path)
 		isNar := ext == ".nar"
 		isNarinfo := ext == ".narinfo"
+		if ext == ".drv" {
+			drvCount++
+		}
 
 		if !(isNar || isNarinfo || isOld) {
 			return nil
@@ -317,7 +396,7 @@ func (proxy *Proxy) gcOnce(cacheStat map[string]*chunkStat) {
 			deadIndices.Store(path, yes)
 		} else {
 			for _, indexChunk := range index.Chunks {
-				if lru.IsDead(indexChunk.ID) {
+				if found, _ := store.HasChunk(indexChunk.ID); !found {
 					proxy.log.Debug("some chunks are dead", zap.String("path", path))
 					deadIndices.Store(path, yes)
 					break
@@ -332,6 +411,7 @@ func (proxy *Proxy) gcOnce(cacheStat map[string]*chunkStat) {
 	close(integrity)
 
 	metricIndexCount.Set(indicesCount)
+	metricDrvCount.Set(drvCount)
 	metricIndexWalk.Add(uint64(time.Since(walkIndicesStart).Milliseconds()))
 	metricInflated.Set(inflatedSize)
 
@@ -343,30 +423,33 @@ func (proxy *Proxy) gcOnce(cacheStat map[string]*chunkStat) {
 	// time.Sleep(10 * time.Minute)
 	deadIndices.Range(func(key, value interface{}) bool {
 		path := key.(string)
+		// rewritten while we walked, it's not the index we checked.
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Before(walkIndicesStart) {
+			return true
+		}
 		proxy.log.Debug("moving index to trash", zap.String("path", path))
-		_ = os.Remove(path)
+		if err := os.Remove(path); err == nil {
+			proxy.stream.publish(eventGC, "/"+filepath.ToSlash(strings.TrimPrefix(path[len(indices.Path):], "/")))
+		}
 		deadIndexCount++
 		return true
 	})
 
 	metricIndexGcCount.Add(deadIndexCount)
+	metricChunkGcCount.Add(state.DeadCount)
+	metricChunkGcSize.Add(state.DeadSize)
 
-	// we don't use store.Prune because it does another filepath.Walk and no
-	// added benefit for us.
-
-	for id := range lru.Dead() {
-		if err := store.RemoveChunk(id); err != nil {
-			proxy.log.Error("Removing chunk", zap.Error(err), zap.String("id", id.String()))
-		}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		proxy.log.Error("removing GC progress", zap.Error(err))
 	}
 
 	proxy.log.Debug(
 		"GC stats",
-		zap.Uint64("live_bytes", lru.liveSize),
-		zap.Uint64("live_max_bytes", lru.liveSizeMax),
-		zap.Int("live_chunk_count", len(lru.live)),
-		zap.Uint64("dead_bytes", lru.deadSize),
-		zap.Int("dead_chunk_count", len(lru.dead)),
+		zap.Uint64("live_bytes", state.LiveSize),
+		zap.Uint64("live_max_bytes", maxCacheSize),
+		zap.Uint64("live_chunk_count", state.LiveCount),
+		zap.Uint64("dead_bytes", state.DeadSize),
+		zap.Uint64("dead_chunk_count", state.DeadCount),
 		zap.Uint64("dead_index_count", deadIndexCount),
 		zap.Duration("walk_indices_time", time.Since(walkIndicesStart)),
 	)
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+func TestGCCutoff(t *testing.T) {
+	hour := func(h int64) int64 { return h * int64(gcHistogramBucket.Seconds()) }
+	sizes := map[int64]uint64{hour(1): 10, hour(2): 10, hour(3): 10}
+
+	if cutoff := gcCutoff(sizes, 25); !cutoff.Equal(time.Unix(hour(2), 0)) {
+		t.Fatalf("expected to evict the oldest hour, got cutoff %s", cutoff)
+	} else if cutoff := gcCutoff(sizes, 30); !cutoff.IsZero() {
+		t.Fatalf("expected everything to fit, got cutoff %s", cutoff)
+	}
+}
+
+func TestGCResume(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.CacheSize = 1
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	store := chunkFiles{proxy.localStore.(desync.LocalStore)}
+	statePath := filepath.Join(proxy.Dir, "gc-state.json")
+
+	idx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNar, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("batches", func(tt *testing.T) {
+		proxy.GcBatchSize = 1
+		state := newGCState()
+		chunks := 0
+		if err := proxy.walkChunkDirs(store, state, statePath, func(chunkStat) { chunks++ }); err != nil {
+			tt.Fatal(err)
+		} else if chunks != len(idx.Chunks) {
+			tt.Fatalf("expected %d chunks, got %d", len(idx.Chunks), chunks)
+		}
+
+		saved, err := loadGCState(statePath)
+		if err != nil {
+			tt.Fatal(err)
+		} else if saved == nil || saved.NextDir == 0 {
+			tt.Fatalf("expected saved progress, got %#v", saved)
+		}
+	})
+
+	// pretend a previous run scanned a full cache before it was restarted,
+	// and our chunks are older than what fits.
+	old := time.Now().Add(-3 * time.Hour)
+	for _, chunk := range idx.Chunks {
+		if err := store.touch(chunk.ID, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := newGCState()
+	state.Started = time.Now().Add(time.Second)
+	state.NextDir = 0x10000
+	state.Sizes[time.Now().Add(-2*time.Hour).Truncate(gcHistogramBucket).Unix()] = 2 << 30
+	if err := state.save(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.gcOnce()
+
+	for _, chunk := range idx.Chunks {
+		if found, _ := store.HasChunk(chunk.ID); found {
+			t.Fatalf("expected chunk %s to be evicted", chunk.ID)
+		}
+	}
+	if hasIndex(proxy.localIndex, strings.TrimPrefix(fNar, "/")) {
+		t.Fatal("expected the index of evicted chunks to be removed")
+	} else if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("expected the finished run to remove its progress, got %v", err)
+	}
+}
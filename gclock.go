@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var metricGcSkipped = metrics.MustCounter("spongix_gc_skipped", "Number of GC runs skipped because another process held the GC lock")
+
+// a lock file whose heartbeat is older than this was left behind by a process
+// that died during GC.
+const gcLeaseTTL = time.Minute
+
+// gcLease is held while removing chunks and indices, so other processes using
+// the same directory, like another spongix or `seed apply`, don't insert into
+// it or collect it at the same time.
+type gcLease struct {
+	path string
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (proxy *Proxy) gcLeasePath() string {
+	return filepath.Join(proxy.Dir, "gc.lock")
+}
+
+// gcLeaseHolder returns who holds the GC lock if its heartbeat is fresh.
+func (proxy *Proxy) gcLeaseHolder() (string, bool) {
+	info, err := os.Stat(proxy.gcLeasePath())
+	if err != nil || time.Since(info.ModTime()) > gcLeaseTTL {
+		return "", false
+	}
+	holder, _ := os.ReadFile(proxy.gcLeasePath())
+	return strings.TrimSpace(string(holder)), true
+}
+
+// acquireGCLease takes the GC lock, or takes it over if its holder stopped
+// sending heartbeats.
+func (proxy *Proxy) acquireGCLease() (*gcLease, error) {
+	path := proxy.gcLeasePath()
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d", host, os.Getpid())
+
+	for attempt := 0; attempt < 2; attempt++ {
+		fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintln(fd, owner)
+			if closeErr := fd.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return nil, errors.WithMessage(err, "writing GC lock")
+			}
+
+			lease := &gcLease{path: path, done: make(chan struct{})}
+			lease.wg.Add(1)
+			go lease.heartbeat(proxy.log)
+			return lease, nil
+		} else if !os.IsExist(err) {
+			return nil, errors.WithMessage(err, "creating GC lock")
+		}
+
+		if holder, held := proxy.gcLeaseHolder(); held {
+			return nil, errors.Errorf("GC lock is held by %s", holder)
+		}
+
+		proxy.log.Warn("taking over stale GC lock", zap.String("path", path))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.WithMessage(err, "removing stale GC lock")
+		}
+	}
+
+	return nil, errors.New("GC lock was taken by another process")
+}
+
+func (lease *gcLease) heartbeat(log *zap.Logger) {
+	defer lease.wg.Done()
+
+	ticker := time.NewTicker(gcLeaseTTL / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lease.done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(lease.path, now, now); err != nil {
+				log.Error("refreshing GC lock", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (lease *gcLease) release() {
+	close(lease.done)
+	lease.wg.Wait()
+	_ = os.Remove(lease.path)
+}
+
+// waitForGC blocks until no other process collects garbage, commands that
+// insert into the directory call it before they start.
+func (proxy *Proxy) waitForGC(ctx context.Context) error {
+	for {
+		holder, held := proxy.gcLeaseHolder()
+		if !held {
+			return nil
+		}
+
+		proxy.log.Info("waiting for GC to finish", zap.String("holder", holder))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// recentlyIndexedChunks returns the chunks of indices written since the given
+// time. The GC keeps them, as it decided on removing them before those indices
+// existed.
+func recentlyIndexedChunks(indices desync.LocalIndexStore, since time.Time) map[desync.ChunkID]struct{} {
+	chunks := map[desync.ChunkID]struct{}{}
+	_ = filepath.Walk(indices.Path, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.ModTime().Before(since) {
+			return nil
+		}
+
+		idx, err := indices.GetIndex(path[len(indices.Path):])
+		if err != nil {
+			return nil
+		}
+		for _, chunk := range idx.Chunks {
+			chunks[chunk.ID] = yes
+		}
+		return nil
+	})
+	return chunks
+}
+
+// chunkUsedSince is true if the chunk was stored, or its access time written,
+// after the given time.
+func chunkUsedSince(store chunkDisk, id desync.ChunkID, since time.Time) bool {
+	mtime, err := store.modTime(id)
+	return err == nil && !mtime.Before(since)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+func TestGCLease(t *testing.T) {
+	proxy := testProxy(t)
+
+	lease, err := proxy.acquireGCLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := proxy.acquireGCLease(); err == nil {
+		t.Fatal("expected the held lock to be refused")
+	} else if holder, held := proxy.gcLeaseHolder(); !held || !strings.HasSuffix(holder, ":"+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("expected to hold the lock, got %q", holder)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := proxy.waitForGC(ctx); err == nil {
+		t.Fatal("expected waiting for GC to time out")
+	}
+
+	lease.release()
+	if err := proxy.waitForGC(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("stale", func(tt *testing.T) {
+		if err := os.WriteFile(proxy.gcLeasePath(), []byte("gone:1\n"), 0644); err != nil {
+			tt.Fatal(err)
+		}
+		old := time.Now().Add(-2 * gcLeaseTTL)
+		if err := os.Chtimes(proxy.gcLeasePath(), old, old); err != nil {
+			tt.Fatal(err)
+		}
+
+		lease, err := proxy.acquireGCLease()
+		if err != nil {
+			tt.Fatal(err)
+		}
+		lease.release()
+	})
+
+	t.Run("recent indices", func(tt *testing.T) {
+		start := time.Now().Add(-time.Second)
+		insertFake(tt, proxy.localStore, proxy.localIndex, fNar)
+		indices := proxy.localIndex.(desync.LocalIndexStore)
+
+		idx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNar, "/"))
+		if err != nil {
+			tt.Fatal(err)
+		}
+
+		recent := recentlyIndexedChunks(indices, start)
+		if _, found := recent[idx.Chunks[0].ID]; !found {
+			tt.Fatal("expected chunks of the new index")
+		} else if !chunkUsedSince(chunkFiles{proxy.localStore.(desync.LocalStore)}, idx.Chunks[0].ID, start) {
+			tt.Fatal("expected the new chunk to count as used")
+		} else if len(recentlyIndexedChunks(indices, time.Now().Add(time.Minute))) != 0 {
+			tt.Fatal("expected no chunks of indices written later")
+		}
+	})
+}
@@ -9,7 +9,7 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/go-uuid v1.0.1
 	github.com/jamespfennell/xz v0.1.3-0.20210418231708-010343b46672
-	github.com/kr/pretty v0.3.0
+	github.com/klauspost/compress v1.11.4
 	github.com/minio/minio-go/v6 v6.0.57
 	github.com/numtide/go-nix v0.0.0-20211215191921-37a8ad2f9e4f
 	github.com/pascaldekloe/metrics v1.3.0
@@ -17,6 +17,7 @@ require (
 	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d
 	github.com/steinfletcher/apitest v1.5.11
 	go.uber.org/zap v1.10.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
 
 require (
@@ -36,10 +37,9 @@ require (
 	github.com/hanwen/go-fuse/v2 v2.0.3 // indirect
 	github.com/json-iterator/go v1.1.9 // indirect
 	github.com/jstemmer/go-junit-report v0.9.1 // indirect
-	github.com/klauspost/compress v1.11.4 // indirect
 	github.com/klauspost/cpuid v1.2.3 // indirect
 	github.com/kr/fs v0.1.0 // indirect
-	github.com/kr/text v0.2.0 // indirect
+	github.com/kr/pretty v0.3.0 // indirect
 	github.com/minio/md5-simd v1.1.0 // indirect
 	github.com/minio/sha256-simd v0.1.1 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
@@ -48,13 +48,11 @@ require (
 	github.com/pkg/sftp v1.12.0 // indirect
 	github.com/pkg/xattr v0.4.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/rogpeppe/go-internal v1.6.1 // indirect
 	github.com/sirupsen/logrus v1.7.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	go.opencensus.io v0.22.5 // indirect
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad // indirect
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
 	golang.org/x/mod v0.3.0 // indirect
 	golang.org/x/net v0.0.0-20201031054903-ff519b6c9102 // indirect
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/minio/minio-go/v6"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var metricUnhealthy = metrics.MustCounter("spongix_unhealthy", "Number of failed health checks of the stores")
+
+// used to probe index stores, it's not expected to exist.
+const healthIndexName = "spongix-health-check"
+
+// a readiness check taking longer than this counts as failed, so a hanging S3
+// endpoint doesn't hang the probe as well.
+const readyTimeout = 5 * time.Second
+
+func checkStore(store desync.Store) error {
+	_, err := store.HasChunk(desync.ChunkID{})
+	return err
+}
+
+func checkIndex(index desync.IndexStore) error {
+	if _, err := index.GetIndex(healthIndexName); err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkIndexListable makes sure the GC and catalog can walk the local index.
+func checkIndexListable(index desync.IndexStore) error {
+	local, ok := index.(desync.LocalIndexStore)
+	if !ok {
+		return nil
+	}
+	_, err := os.ReadDir(local.Path)
+	return err
+}
+
+func isNotExist(err error) bool {
+	cause := errors.Cause(err)
+	return os.IsNotExist(cause) || minio.ToErrorResponse(cause).Code == "NoSuchKey"
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// healthChecks probe every configured store and index.
+func (proxy *Proxy) healthChecks() []healthCheck {
+	checks := []healthCheck{
+		{"local store", func() error { return checkStore(proxy.localStore) }},
+		{"local index", func() error { return checkIndex(proxy.localIndex) }},
+		{"local index listing", func() error { return checkIndexListable(proxy.localIndex) }},
+	}
+
+	if proxy.s3Store != nil {
+		checks = append(checks, healthCheck{"s3 store", func() error { return checkStore(proxy.s3Store) }})
+	}
+	if proxy.s3Index != nil {
+		checks = append(checks, healthCheck{"s3 index", func() error { return checkIndex(proxy.s3Index) }})
+	}
+
+	for _, s := range proxy.secondaries {
+		if target, ok := s.target.(*s3Secondary); ok {
+			checks = append(checks, healthCheck{"secondary " + s.name, func() error { return checkStore(target.store) }})
+		}
+	}
+
+	return checks
+}
+
+// checkHealth returns the first error encountered while probing the stores
+// and indices that are configured.
+func (proxy *Proxy) checkHealth() error {
+	for _, c := range proxy.healthChecks() {
+		if err := c.check(); err != nil {
+			metricUnhealthy.Add(1)
+			return errors.WithMessage(err, c.name)
+		}
+	}
+
+	return nil
+}
+
+// healthMemo remembers the last health check, so every nix-cache-info
+// request of a large fleet doesn't probe S3.
+type healthMemo struct {
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+}
+
+// checkHealthCached is checkHealth, repeated at most once per
+// HealthCacheTTL.
+func (proxy *Proxy) checkHealthCached() error {
+	memo := &proxy.health
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	if memo.checked.IsZero() || time.Since(memo.checked) >= proxy.HealthCacheTTL {
+		memo.err = proxy.checkHealth()
+		memo.checked = time.Now()
+	}
+	return memo.err
+}
+
+type readyCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+type healthReport struct {
+	Status string       `json:"status"`
+	Checks []readyCheck `json:"checks,omitempty"`
+}
+
+// GET /healthz
+// Answers as long as the process serves requests, restarting won't fix a
+// store being unreachable.
+func (proxy *Proxy) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	proxy.serveHealthReport(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// readyMemo remembers the last readiness report, so probes of every load
+// balancer and anyone else who can reach /readyz don't hit S3 each time.
+type readyMemo struct {
+	mu      sync.Mutex
+	status  int
+	report  healthReport
+	checked time.Time
+}
+
+// GET /readyz
+// Answers 503 if any of the health checks failed, so load balancers stop
+// sending traffic here. The checks are repeated at most once per
+// HealthCacheTTL.
+func (proxy *Proxy) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	memo := &proxy.ready
+	memo.mu.Lock()
+	if memo.checked.IsZero() || time.Since(memo.checked) >= proxy.HealthCacheTTL {
+		memo.status, memo.report = proxy.checkReady()
+		memo.checked = time.Now()
+	}
+	status, report := memo.status, memo.report
+	memo.mu.Unlock()
+
+	proxy.serveHealthReport(w, status, report)
+}
+
+// checkReady runs all health checks concurrently, each within readyTimeout.
+func (proxy *Proxy) checkReady() (int, healthReport) {
+	checks := proxy.healthChecks()
+	report := healthReport{Status: "ok", Checks: make([]readyCheck, len(checks))}
+	for i, c := range checks {
+		report.Checks[i] = readyCheck{Name: c.name, Error: "timed out", Duration: readyTimeout.Milliseconds()}
+	}
+
+	type result struct {
+		i     int
+		check readyCheck
+	}
+	results := make(chan result, len(checks))
+	for i, c := range checks {
+		go func(i int, c healthCheck) {
+			start := time.Now()
+			err := c.check()
+			check := readyCheck{Name: c.name, OK: err == nil, Duration: time.Since(start).Milliseconds()}
+			if err != nil {
+				check.Error = err.Error()
+			}
+			results <- result{i, check}
+		}(i, c)
+	}
+
+	timeout := time.After(readyTimeout)
+collect:
+	for range checks {
+		select {
+		case res := <-results:
+			report.Checks[res.i] = res.check
+		case <-timeout:
+			break collect
+		}
+	}
+
+	status := http.StatusOK
+	for _, c := range report.Checks {
+		if !c.OK {
+			status = http.StatusServiceUnavailable
+			report.Status = "unavailable"
+			metricUnhealthy.Add(1)
+			proxy.log.Warn("readiness check failed", zap.String("check", c.Name), zap.String("error", c.Error))
+		}
+	}
+
+	return status, report
+}
+
+func (proxy *Proxy) serveHealthReport(w http.ResponseWriter, status int, report healthReport) {
+	w.Header().Set(headerContentType, mimeJson)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		proxy.log.Error("encoding health report", zap.Error(err))
+	}
+}
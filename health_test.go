@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterHealthz(t *testing.T) {
+	proxy := withS3(testProxy(t))
+	proxy.s3Store.(*fakeStore).err = errors.New("connection refused")
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/healthz").
+		Expect(t).
+		Header(headerContentType, mimeJson).
+		Body(`{"status":"ok"}`).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestRouterReadyz(t *testing.T) {
+	ready := func(tt *testing.T, proxy *Proxy) (int, healthReport) {
+		res := httptest.NewRecorder()
+		testRouter(proxy).ServeHTTP(res, httptest.NewRequest("GET", "/readyz", nil))
+		report := healthReport{}
+		if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+			tt.Fatal(err)
+		}
+		return res.Code, report
+	}
+
+	t.Run("ready", func(tt *testing.T) {
+		status, report := ready(tt, withS3(testProxy(tt)))
+		if status != http.StatusOK || report.Status != "ok" {
+			tt.Fatalf("expected ready, got %d %#v", status, report)
+		} else if len(report.Checks) != 5 {
+			tt.Fatalf("expected 5 checks, got %#v", report.Checks)
+		} else if c := report.Checks[3]; c.Name != "s3 store" || !c.OK {
+			tt.Fatalf("expected the s3 store check to pass, got %#v", c)
+		}
+	})
+
+	t.Run("s3 unreachable", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+		proxy.s3Store.(*fakeStore).err = errors.New("connection refused")
+
+		status, report := ready(tt, proxy)
+		if status != http.StatusServiceUnavailable || report.Status != "unavailable" {
+			tt.Fatalf("expected unavailable, got %d %#v", status, report)
+		} else if !report.Checks[0].OK {
+			tt.Fatalf("expected the local store check to pass, got %#v", report.Checks[0])
+		} else if c := report.Checks[3]; c.OK || c.Error != "connection refused" {
+			tt.Fatalf("expected the s3 store check to fail, got %#v", c)
+		}
+	})
+
+	t.Run("memoized", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+		proxy.HealthCacheTTL = time.Hour
+
+		if status, _ := ready(tt, proxy); status != http.StatusOK {
+			tt.Fatalf("expected ready, got %d", status)
+		}
+
+		proxy.s3Store.(*fakeStore).err = errors.New("connection refused")
+		if status, _ := ready(tt, proxy); status != http.StatusOK {
+			tt.Fatalf("expected the readiness report to be remembered, got %d", status)
+		}
+
+		proxy.HealthCacheTTL = 0
+		if status, _ := ready(tt, proxy); status != http.StatusServiceUnavailable {
+			tt.Fatalf("expected the checks to be repeated, got %d", status)
+		}
+	})
+
+	t.Run("index not listable", func(tt *testing.T) {
+		proxy := testProxy(tt)
+		if err := os.RemoveAll(proxy.localIndex.(desync.LocalIndexStore).Path); err != nil {
+			tt.Fatal(err)
+		}
+
+		status, report := ready(tt, proxy)
+		if status != http.StatusServiceUnavailable {
+			tt.Fatalf("expected unavailable, got %d", status)
+		} else if c := report.Checks[2]; c.Name != "local index listing" || c.OK {
+			tt.Fatalf("expected the index listing check to fail, got %#v", c)
+		}
+	})
+}
+
+func TestRouterNixCacheInfoHealthMemo(t *testing.T) {
+	proxy := withS3(testProxy(t))
+	proxy.HealthCacheTTL = time.Hour
+	router := testRouter(proxy)
+
+	priority := func() string {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("GET", "/nix-cache-info", nil))
+		return res.Body.String()[strings.LastIndex(res.Body.String(), " ")+1:]
+	}
+
+	if got := priority(); got != "50" {
+		t.Fatalf("expected priority 50, got %s", got)
+	}
+
+	proxy.s3Store.(*fakeStore).err = errors.New("connection refused")
+	if got := priority(); got != "50" {
+		t.Fatalf("expected the health check to be remembered, got priority %s", got)
+	}
+
+	proxy.HealthCacheTTL = 0
+	if got := priority(); got != "1000" {
+		t.Fatalf("expected the health check to be repeated, got priority %s", got)
+	}
+}
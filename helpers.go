@@ -6,14 +6,9 @@ import (
 	"os"
 	"strings"
 
-	"github.com/kr/pretty"
 	"github.com/pkg/errors"
 )
 
-func pp(v ...interface{}) {
-	pretty.Println(v...)
-}
-
 func loadNixPublicKeys(rawKeys []string) (map[string]ed25519.PublicKey, error) {
 	keys := map[string]ed25519.PublicKey{}
 	for _, rawKey := range rawKeys {
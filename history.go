@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var metricNarinfoHistoryPruned = metrics.MustCounter("spongix_narinfo_history_pruned", "Number of previous narinfo versions removed for their age or missing chunks")
+
+// directory in the cache where previous narinfo versions are kept. It's apart
+// from the index, so the GC, catalog and replication don't take them for
+// narinfos that are served.
+const historyDir = "history"
+
+type narinfoVersion struct {
+	Version int64     `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+func historyIndexName(hash string, version int64) string {
+	return hash + "." + strconv.FormatInt(version, 10) + ".narinfo"
+}
+
+func (proxy *Proxy) setupNarinfoHistory() {
+	if proxy.NarinfoHistory == 0 {
+		return
+	}
+
+	dir := filepath.Join(proxy.Dir, historyDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		proxy.log.Fatal("failed creating narinfo history", zap.Error(err), zap.String("dir", dir))
+	}
+
+	history, err := desync.NewLocalIndexStore(dir)
+	if err != nil {
+		proxy.log.Fatal("failed creating narinfo history", zap.Error(err), zap.String("dir", dir))
+	}
+	proxy.history = history
+}
+
+// narinfoVersions returns the versions kept for hash, oldest first. Versions
+// count up from 1 with every overwrite, the time is when it was overwritten.
+func (proxy *Proxy) narinfoVersions(hash string) ([]narinfoVersion, error) {
+	if proxy.history.Path == "" {
+		return nil, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(proxy.history.Path, hash+".*.narinfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []narinfoVersion{}
+	for _, match := range matches {
+		raw := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), hash+"."), ".narinfo")
+		version, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, narinfoVersion{Version: version, Time: info.ModTime().UTC()})
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	return versions, nil
+}
+
+// keepNarinfoVersion stores idx as the previous version of hash and drops
+// versions exceeding the configured limit.
+func (proxy *Proxy) keepNarinfoVersion(hash string, idx desync.Index) error {
+	if proxy.history.Path == "" {
+		return errors.New("narinfo history is disabled")
+	}
+
+	versions, err := proxy.narinfoVersions(hash)
+	if err != nil {
+		return err
+	}
+
+	next := int64(1)
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+
+	if err := proxy.history.StoreIndex(historyIndexName(hash, next), idx); err != nil {
+		return errors.WithMessage(err, "storing previous version")
+	}
+	versions = append(versions, narinfoVersion{Version: next})
+
+	for len(versions) > int(proxy.NarinfoHistory) {
+		if err := os.Remove(filepath.Join(proxy.history.Path, historyIndexName(hash, versions[0].Version))); err != nil {
+			return errors.WithMessage(err, "removing old version")
+		}
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+// removeNarinfoHistory removes all versions kept for hash.
+func (proxy *Proxy) removeNarinfoHistory(hash string) {
+	versions, err := proxy.narinfoVersions(hash)
+	if err != nil {
+		proxy.log.Error("listing narinfo versions", zap.String("hash", hash), zap.Error(err))
+		return
+	}
+
+	for _, version := range versions {
+		if err := os.Remove(filepath.Join(proxy.history.Path, historyIndexName(hash, version.Version))); err != nil {
+			proxy.log.Error("removing narinfo version", zap.String("hash", hash), zap.Error(err))
+		}
+	}
+}
+
+// pruneNarinfoHistory removes versions older than NarinfoHistoryMaxAge and
+// those the GC evicted chunks of, they can't be served anymore.
+func (proxy *Proxy) pruneNarinfoHistory() {
+	if proxy.history.Path == "" {
+		return
+	}
+
+	entries, err := os.ReadDir(proxy.history.Path)
+	if err != nil {
+		proxy.log.Error("listing narinfo history", zap.Error(err))
+		return
+	}
+
+	pruned := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".narinfo") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		expired := proxy.NarinfoHistoryMaxAge > 0 && time.Since(info.ModTime()) > proxy.NarinfoHistoryMaxAge
+		if !expired {
+			idx, err := proxy.history.GetIndex(entry.Name())
+			if err == nil && hasChunks(proxy.localStore, idx) {
+				continue
+			}
+		}
+
+		if err := os.Remove(filepath.Join(proxy.history.Path, entry.Name())); err != nil {
+			proxy.log.Error("removing narinfo version", zap.String("name", entry.Name()), zap.Error(err))
+			continue
+		}
+		pruned++
+	}
+
+	metricNarinfoHistoryPruned.Add(uint64(pruned))
+}
+
+func hasChunks(store desync.Store, idx desync.Index) bool {
+	for _, chunk := range idx.Chunks {
+		if found, _ := store.HasChunk(chunk.ID); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// withNarinfoHistory keeps the previous version of overwritten narinfos and
+// serves them on GET with `?version=<version>`, `?history` lists the versions.
+// To restore a version, PUT it again.
+func (proxy *Proxy) withNarinfoHistory() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if proxy.NarinfoHistory == 0 {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hash := mux.Vars(r)["hash"]
+
+			switch r.Method {
+			case "GET":
+				query := r.URL.Query()
+				if _, ok := query["history"]; ok {
+					proxy.serveNarinfoVersions(w, hash)
+				} else if raw := query.Get("version"); raw != "" {
+					proxy.serveNarinfoVersion(w, r, hash, raw)
+				} else {
+					h.ServeHTTP(w, r)
+				}
+			case "PUT":
+				previous, err := proxy.localIndex.GetIndex(hash + ".narinfo")
+				if err != nil {
+					h.ServeHTTP(w, r)
+					return
+				}
+
+				record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+				h.ServeHTTP(record, r)
+
+				// re-uploading the same narinfo isn't a new version.
+				if record.status == http.StatusOK && !proxy.narinfoUnchanged(hash, previous) {
+					if err := proxy.keepNarinfoVersion(hash, previous); err != nil {
+						proxy.log.Error("keeping previous narinfo", zap.String("hash", hash), zap.Error(err))
+					}
+				}
+			default:
+				h.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func (proxy *Proxy) narinfoUnchanged(hash string, previous desync.Index) bool {
+	current, err := proxy.localIndex.GetIndex(hash + ".narinfo")
+	if err != nil || len(current.Chunks) != len(previous.Chunks) {
+		return false
+	}
+
+	for i, chunk := range current.Chunks {
+		if chunk.ID != previous.Chunks[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+func (proxy *Proxy) serveNarinfoVersions(w http.ResponseWriter, hash string) {
+	versions, err := proxy.narinfoVersions(hash)
+	if err != nil {
+		proxy.log.Error("listing narinfo versions", zap.String("hash", hash), zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed listing versions\n")
+		return
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(versions); err != nil {
+		proxy.log.Error("encoding narinfo versions", zap.Error(err))
+	}
+}
+
+func (proxy *Proxy) serveNarinfoVersion(w http.ResponseWriter, r *http.Request, hash, raw string) {
+	version, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, "invalid version parameter\n")
+		return
+	}
+
+	idx, err := proxy.history.GetIndex(historyIndexName(hash, version))
+	if err != nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	rd := newChunkReader(proxy.localStore, idx)
+	w.Header().Set(headerContentType, mimeNarinfo)
+	w.Header().Set("Content-Length", strconv.FormatInt(idx.Length(), 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, rd); err != nil {
+		proxy.log.Error("writing narinfo version", zap.Error(err))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterNarinfoHistory(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.NarinfoHistory = 10
+	router := testRouter(proxy)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("GET", url, nil))
+		return res
+	}
+
+	original := string(testdata[fNarinfo])
+	changed := strings.Replace(original, "Deriver: nq5zrwpzxs20qvl54ks3frj14qhfalqp", "Deriver: 0c7c5s9ccz4wdd9ckdwfkblslj4m4lgg", 1)
+
+	for _, body := range []string{original, changed} {
+		apitest.New().
+			Handler(router).
+			Method("PUT").
+			URL(fNarinfo).
+			Body(body).
+			Expect(t).
+			Status(http.StatusOK).
+			End()
+	}
+
+	versions := []narinfoVersion{}
+	if err := json.NewDecoder(get(fNarinfo + "?history").Body).Decode(&versions); err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 1 || versions[0].Version != 1 {
+		t.Fatalf("expected one previous version, got %v", versions)
+	}
+
+	indices := proxy.localIndex.(desync.LocalIndexStore)
+	if _, err := os.Stat(filepath.Join(indices.Path, historyDir)); !os.IsNotExist(err) {
+		t.Fatalf("expected the history to be kept apart from the index, got %v", err)
+	}
+
+	previous := get(fNarinfo + "?version=" + strconv.FormatInt(versions[0].Version, 10)).Body.String()
+	if !strings.Contains(previous, "Deriver: nq5zrwpzxs20qvl54ks3frj14qhfalqp") {
+		t.Fatalf("unexpected previous version: %s", previous)
+	}
+
+	if current := get(fNarinfo).Body.String(); !strings.Contains(current, "Deriver: 0c7c5s9ccz4wdd9ckdwfkblslj4m4lgg") {
+		t.Fatalf("unexpected current version: %s", current)
+	}
+}
+
+func TestNarinfoHistoryRetention(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.NarinfoHistory = 2
+	testRouter(proxy)
+
+	hash := strings.TrimSuffix(strings.TrimPrefix(fNarinfo, "/"), ".narinfo")
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	idx, err := proxy.localIndex.GetIndex(hash + ".narinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := proxy.keepNarinfoVersion(hash, idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := proxy.narinfoVersions(hash)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 {
+		t.Fatalf("expected versions 2 and 3, got %v", versions)
+	}
+
+	t.Run("max age", func(tt *testing.T) {
+		proxy.NarinfoHistoryMaxAge = time.Hour
+		old := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(filepath.Join(proxy.history.Path, historyIndexName(hash, 2)), old, old); err != nil {
+			tt.Fatal(err)
+		}
+
+		proxy.pruneNarinfoHistory()
+		if versions, _ := proxy.narinfoVersions(hash); len(versions) != 1 || versions[0].Version != 3 {
+			tt.Fatalf("expected only version 3, got %v", versions)
+		}
+	})
+
+	t.Run("evicted chunks", func(tt *testing.T) {
+		for _, chunk := range idx.Chunks {
+			if err := proxy.localStore.(desync.LocalStore).RemoveChunk(chunk.ID); err != nil {
+				tt.Fatal(err)
+			}
+		}
+
+		proxy.pruneNarinfoHistory()
+		if versions, _ := proxy.narinfoVersions(hash); len(versions) != 0 {
+			tt.Fatalf("expected no versions, got %v", versions)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	minio "github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricHydraImported       = metrics.MustCounter("spongix_hydra_imported", "Number of narinfos imported from the hydra bucket")
+	metricHydraImportFailures = metrics.MustCounter("spongix_hydra_import_failures", "Number of narinfos that failed to import from the hydra bucket")
+)
+
+// hydraBucket is a binary cache in the layout hydra's queue runner uploads,
+// with narinfos at the top and NARs below nar/.
+type hydraBucket interface {
+	narinfos() ([]string, error)
+	get(key string) (io.ReadCloser, error)
+}
+
+type s3HydraBucket struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	budget *s3Budget
+}
+
+// newS3HydraBucket takes the same s3+http(s)://host/bucket/prefix URLs as
+// --bucket-url.
+func newS3HydraBucket(u *url.URL, region string, budget *s3Budget) (*s3HydraBucket, error) {
+	client, bucket, prefix, err := newS3Client(u, region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3HydraBucket{client: client, bucket: bucket, prefix: prefix, budget: budget}, nil
+}
+
+// newS3Client returns a client for s3+http(s)://host/bucket/prefix URLs, along
+// with the bucket and the prefix of keys, which is empty or ends in a slash.
+func newS3Client(u *url.URL, region string) (*minio.Client, string, string, error) {
+	if !strings.HasPrefix(u.Scheme, "s3+http") {
+		return nil, "", "", errors.Errorf("invalid scheme %q, expected s3+http or s3+https", u.Scheme)
+	}
+
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, "", "", errors.New("missing bucket name")
+	}
+
+	prefix := ""
+	if len(parts) > 1 && parts[1] != "" {
+		prefix = parts[1] + "/"
+	}
+
+	client, err := minio.NewWithOptions(u.Host, &minio.Options{
+		Creds: credentials.NewChainCredentials(
+			[]credentials.Provider{
+				&credentials.EnvMinio{},
+				&credentials.EnvAWS{},
+			},
+		),
+		Secure:       u.Scheme == "s3+https",
+		Region:       region,
+		BucketLookup: minio.BucketLookupAuto,
+	})
+	if err != nil {
+		return nil, "", "", errors.WithMessage(err, "creating s3 client")
+	}
+
+	return client, parts[0], prefix, nil
+}
+
+func (b *s3HydraBucket) narinfos() ([]string, error) {
+	objects, err := listS3(minio.Core{Client: b.client}, b.bucket, b.prefix, b.budget)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, key := range objects {
+		if strings.HasSuffix(key, ".narinfo") {
+			keys = append(keys, strings.TrimPrefix(key, b.prefix))
+		}
+	}
+
+	return keys, nil
+}
+
+func (b *s3HydraBucket) get(key string) (io.ReadCloser, error) {
+	if err := b.budget.take("get"); err != nil {
+		return nil, err
+	}
+	obj, err := b.client.GetObject(b.bucket, b.prefix+key, minio.GetObjectOptions{})
+	return obj, countS3Error(err)
+}
+
+func (proxy *Proxy) setupHydra() {
+	if proxy.HydraBucketURL == "" {
+		return
+	}
+
+	u, err := url.Parse(proxy.HydraBucketURL)
+	if err != nil {
+		proxy.log.Fatal("couldn't parse hydra bucket url", zap.Error(err))
+	}
+
+	bucket, err := newS3HydraBucket(u, proxy.BucketRegion, proxy.s3Budget)
+	if err != nil {
+		proxy.log.Fatal("failed setting up hydra bucket", zap.Error(err), zap.String("url", u.Host+u.Path))
+	}
+	proxy.hydra = bucket
+}
+
+// hydraSeen remembers the narinfos already imported from the hydra bucket, so
+// we don't import them again after GC evicted them. Names are appended to a
+// file, one per line, to survive restarts.
+type hydraSeen struct {
+	path  string
+	names map[string]struct{}
+}
+
+func loadHydraSeen(path string) (*hydraSeen, error) {
+	seen := &hydraSeen{path: path, names: map[string]struct{}{}}
+
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return seen, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			seen.names[name] = yes
+		}
+	}
+
+	return seen, scanner.Err()
+}
+
+func (s *hydraSeen) has(name string) bool {
+	_, found := s.names[name]
+	return found
+}
+
+func (s *hydraSeen) add(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	fd, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		s.names[name] = yes
+	}
+
+	if _, err := fd.WriteString(strings.Join(names, "\n") + "\n"); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// importHydraOnce copies every narinfo of the hydra bucket that we haven't
+// seen yet, together with its NAR. It stops early when another job waits, and
+// continues on the next run.
+func (proxy *Proxy) importHydraOnce() {
+	if proxy.hydraSeen == nil {
+		seen, err := loadHydraSeen(filepath.Join(proxy.Dir, "hydra-seen"))
+		if err != nil {
+			proxy.log.Error("loading imported hydra narinfos", zap.Error(err))
+			return
+		}
+		proxy.hydraSeen = seen
+	}
+
+	names, err := proxy.hydra.narinfos()
+	if err != nil {
+		proxy.log.Error("listing hydra bucket", zap.Error(err))
+		return
+	}
+
+	imported := 0
+	seen := []string{}
+	defer func() {
+		if err := proxy.hydraSeen.add(seen); err != nil {
+			proxy.log.Error("storing imported hydra narinfos", zap.Error(err))
+		}
+	}()
+
+	for _, name := range names {
+		if proxy.hydraSeen.has(name) {
+			continue
+		}
+
+		if !validIndexName(name) {
+			proxy.log.Warn("skipping invalid hydra narinfo name", zap.String("name", name))
+			continue
+		}
+
+		if hasIndex(proxy.localIndex, name) {
+			seen = append(seen, name)
+			continue
+		}
+
+		if proxy.jobs.waiting() {
+			proxy.log.Info("pausing hydra import for other jobs")
+			break
+		}
+
+		if err := proxy.importHydraNarinfo(name); errors.Cause(err) == errS3BudgetExhausted {
+			proxy.log.Warn("stopping hydra import until the next run", zap.Error(err))
+			break
+		} else if err != nil {
+			metricHydraImportFailures.Add(1)
+			proxy.log.Warn("importing from hydra", zap.Error(err), zap.String("name", name))
+			continue
+		}
+
+		metricHydraImported.Add(1)
+		imported++
+		seen = append(seen, name)
+	}
+
+	proxy.log.Info("imported from hydra", zap.Int("narinfos", len(names)), zap.Int("imported", imported))
+}
+
+// importHydraNarinfo stores the NAR before the narinfo, so we never serve a
+// narinfo without its NAR.
+func (proxy *Proxy) importHydraNarinfo(name string) error {
+	rd, err := proxy.hydra.get(name)
+	if err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		return errors.WithMessage(err, "getting narinfo")
+	}
+
+	info := &narinfo.Narinfo{}
+	if err := info.Unmarshal(bytes.NewReader(raw)); err != nil {
+		return errors.WithMessage(err, "parsing narinfo")
+	}
+
+	narName := narIndexName(info.URL)
+	if !validIndexName(narName) {
+		return errors.Errorf("invalid NAR URL %q", info.URL)
+	}
+
+	if !hasIndex(proxy.localIndex, narName) {
+		if err := proxy.importHydraNar(info.URL, narName); err != nil {
+			return err
+		}
+	}
+
+	body := io.Reader(bytes.NewReader(raw))
+	if proxy.RewriteUpstreamNarinfo {
+		if body, err = proxy.rewriteNarinfo(body); err != nil {
+			return errors.WithMessage(err, "rewriting narinfo")
+		}
+	}
+
+	return proxy.storeLocal(name, body)
+}
+
+func (proxy *Proxy) importHydraNar(key, name string) error {
+	rd, err := proxy.hydra.get(key)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	body := io.Reader(rd)
+	if isCompressedNar(key) {
+		decompressed, err := decompress(key, rd)
+		if err != nil {
+			return errors.WithMessage(err, "decompressing NAR")
+		}
+		defer decompressed.Close()
+		body = decompressed
+	}
+
+	return errors.WithMessage(proxy.storeLocal(name, body), "storing NAR")
+}
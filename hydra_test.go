@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+type fakeHydraBucket map[string][]byte
+
+func (b fakeHydraBucket) narinfos() ([]string, error) {
+	keys := []string{}
+	for key := range b {
+		if strings.HasSuffix(key, ".narinfo") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (b fakeHydraBucket) get(key string) (io.ReadCloser, error) {
+	if content, found := b[key]; found {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestHydraImport(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.hydra = fakeHydraBucket{
+		strings.TrimPrefix(fNarinfo, "/"):                              testdata[fNarinfo],
+		"nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar": testdata[fNar],
+	}
+
+	imported := metricHydraImported.Get()
+	proxy.importHydraOnce()
+	proxy.importHydraOnce()
+
+	if n := metricHydraImported.Get() - imported; n != 1 {
+		t.Fatalf("expected one import, got %d", n)
+	}
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar").
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Body(string(testdata[fNar])).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get(fNarinfo).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Body(string(testdata[fNarinfo])).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestHydraImportSkipsEvicted(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.hydra = fakeHydraBucket{
+		strings.TrimPrefix(fNarinfo, "/"):                              testdata[fNarinfo],
+		"nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar": testdata[fNar],
+	}
+
+	imported := metricHydraImported.Get()
+	proxy.importHydraOnce()
+
+	indexDir := proxy.localIndex.(desync.LocalIndexStore).Path
+	if err := os.Remove(filepath.Join(indexDir, strings.TrimPrefix(fNarinfo, "/"))); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.hydraSeen = nil
+	proxy.importHydraOnce()
+
+	if n := metricHydraImported.Get() - imported; n != 1 {
+		t.Fatalf("expected one import, got %d", n)
+	}
+}
+
+func TestHydraImportInvalidNames(t *testing.T) {
+	proxy := testProxy(t)
+	narinfo := strings.Replace(string(testdata[fNarinfo]),
+		"URL: nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar",
+		"URL: nar/../../escaped.nar", 1)
+	proxy.hydra = fakeHydraBucket{
+		strings.TrimPrefix(fNarinfo, "/"): []byte(narinfo),
+		"../escaped.narinfo":              testdata[fNarinfo],
+		"nar/../../escaped.nar":           testdata[fNar],
+	}
+
+	failures := metricHydraImportFailures.Get()
+	imported := metricHydraImported.Get()
+	proxy.importHydraOnce()
+
+	if n := metricHydraImported.Get() - imported; n != 0 {
+		t.Fatalf("expected no imports, got %d", n)
+	}
+	if n := metricHydraImportFailures.Get() - failures; n != 1 {
+		t.Fatalf("expected one failed import, got %d", n)
+	}
+}
+
+func TestS3List(t *testing.T) {
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set(headerContentType, "application/xml")
+
+		if r.URL.Query().Get("continuation-token") == "" {
+			_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult><Name>cache</Name><Prefix>hydra/</Prefix><KeyCount>2</KeyCount><MaxKeys>2</MaxKeys><IsTruncated>true</IsTruncated><NextContinuationToken>page2</NextContinuationToken>
+<Contents><Key>hydra/a.narinfo</Key><Size>1</Size></Contents><Contents><Key>hydra/nar/a.nar</Key><Size>1</Size></Contents></ListBucketResult>`)
+			return
+		}
+
+		_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult><Name>cache</Name><Prefix>hydra/</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><IsTruncated>false</IsTruncated>
+<Contents><Key>hydra/b.narinfo</Key><Size>1</Size></Contents></ListBucketResult>`)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse("s3+" + server.URL + "/cache/hydra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := newS3HydraBucket(u, "us-east-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, objects := metricS3ListPages.Get(), metricS3ListObjects.Get()
+	names, err := bucket.narinfos()
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Join(names, ",") != "a.narinfo,b.narinfo" {
+		t.Fatalf("unexpected narinfos %v", names)
+	} else if n := metricS3ListPages.Get() - pages; n != 2 {
+		t.Fatalf("expected 2 pages, got %d", n)
+	} else if n := metricS3ListObjects.Get() - objects; n != 3 {
+		t.Fatalf("expected 3 objects, got %d", n)
+	}
+
+	bucket.budget = newS3Budget(1)
+	atomic.StoreInt32(&requests, 0)
+	if _, err := bucket.narinfos(); err != errS3BudgetExhausted {
+		t.Fatalf("expected the budget to stop listing, got %v", err)
+	} else if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected one LIST request, got %d", n)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricIdempotentReplays = metrics.MustCounter("spongix_idempotent_replays", "Number of uploads answered with the recorded result of an earlier upload with the same Idempotency-Key")
+	metricIdempotentExpired = metrics.MustCounter("spongix_idempotent_expired", "Number of recorded Idempotency-Key results removed after their TTL")
+)
+
+const headerIdempotencyKey = "Idempotency-Key"
+
+// upper bound of the response body recorded for replays, ours are short.
+const idempotencyBodyLimit = 64 * 1024
+
+type idempotencyRecord struct {
+	Path        string    `json:"path"`
+	Digest      string    `json:"digest"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        string    `json:"body"`
+	Time        time.Time `json:"time"`
+}
+
+// idempotencyKeys records the result of uploads with an Idempotency-Key on
+// disk, so a client retrying after losing the response gets the same result
+// without the upload being chunked and stored again.
+type idempotencyKeys struct {
+	dir   string
+	ttl   time.Duration
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// keyLock is dropped once nobody holds or waits for it, there's no bound on
+// the number of keys.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newIdempotencyKeys(dir string, ttl time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{dir: dir, ttl: ttl, locks: map[string]*keyLock{}}
+}
+
+func (proxy *Proxy) setupIdempotencyKeys() {
+	proxy.idempotency = newIdempotencyKeys(filepath.Join(proxy.Dir, "idempotency"), proxy.IdempotencyTTL)
+}
+
+// name hashes the key, it's chosen by the client and may contain anything.
+func (k *idempotencyKeys) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *idempotencyKeys) lock(name string) func() {
+	k.mu.Lock()
+	l, found := k.locks[name]
+	if !found {
+		l = &keyLock{}
+		k.locks[name] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, name)
+		}
+		k.mu.Unlock()
+	}
+}
+
+func (k *idempotencyKeys) get(name string) (*idempotencyRecord, error) {
+	content, err := os.ReadFile(filepath.Join(k.dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := &idempotencyRecord{}
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, err
+	}
+
+	if time.Since(record.Time) > k.ttl {
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (k *idempotencyKeys) put(name string, record *idempotencyRecord) error {
+	if err := os.MkdirAll(k.dir, 0o755); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(k.dir, ".tmp"+name)
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(k.dir, name+".json"))
+}
+
+// expire removes records older than the TTL.
+func (k *idempotencyKeys) expire() error {
+	entries, err := os.ReadDir(k.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		unlock := k.lock(name)
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > k.ttl {
+			if err := os.Remove(filepath.Join(k.dir, entry.Name())); err == nil {
+				metricIdempotentExpired.Add(1)
+			}
+		}
+		unlock()
+	}
+
+	return nil
+}
+
+func (proxy *Proxy) expireIdempotencyKeys() {
+	if proxy.IdempotencyTTL == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(proxy.IdempotencyTTL / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := proxy.idempotency.expire(); err != nil {
+			proxy.log.Error("expiring idempotency keys", zap.Error(err))
+		}
+	}
+}
+
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(p []byte) (int, error) {
+	if r.body.Len()+len(p) <= idempotencyBodyLimit {
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+var errSpoolTooLarge = errors.New("body too large")
+
+// spoolBody copies the request body to a temporary file and returns it with
+// the digest of its content. Bodies over IdempotencyMaxSize are refused, they
+// would fill the disk before being stored.
+func (proxy *Proxy) spoolBody(r *http.Request) (*os.File, string, error) {
+	dir := filepath.Join(proxy.Dir, "tmp")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, "", err
+	}
+
+	fd, err := os.CreateTemp(dir, "idempotency")
+	if err != nil {
+		return nil, "", err
+	}
+
+	limit := int64(proxy.IdempotencyMaxSize) * 1024 * 1024
+	hash := sha256.New()
+	if n, err := io.Copy(io.MultiWriter(fd, hash), io.LimitReader(r.Body, limit+1)); err != nil || n > limit {
+		fd.Close()
+		os.Remove(fd.Name())
+		if err == nil {
+			err = errSpoolTooLarge
+		}
+		return nil, "", err
+	}
+
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, "", err
+	}
+
+	return fd, "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// withIdempotencyKeys answers a PUT with an Idempotency-Key that was already
+// used for the same path and body with the recorded result. Reusing a key for
+// a different upload is rejected with a 422. Uploads with the same key are
+// processed one after another, so a retry racing the original waits for its
+// result. Server errors aren't recorded, retrying them should try again.
+func (proxy *Proxy) withIdempotencyKeys() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if proxy.IdempotencyTTL == 0 {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(headerIdempotencyKey)
+			if r.Method != "PUT" || key == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			keys := proxy.idempotency
+			name := keys.name(key)
+			unlock := keys.lock(name)
+			defer unlock()
+
+			fd, digest, err := proxy.spoolBody(r)
+			if err == errSpoolTooLarge {
+				answer(w, http.StatusRequestEntityTooLarge, mimeText, "upload too large for an Idempotency-Key\n")
+				return
+			} else if err != nil {
+				answer(w, http.StatusBadRequest, mimeText, "failed reading body\n")
+				return
+			}
+			defer os.Remove(fd.Name())
+			defer fd.Close()
+
+			record, err := keys.get(name)
+			if err != nil {
+				proxy.log.Error("reading idempotency key", zap.Error(err))
+			}
+
+			if record != nil {
+				if record.Path != r.URL.Path || record.Digest != digest {
+					answer(w, http.StatusUnprocessableEntity, mimeText, "Idempotency-Key was already used for a different upload\n")
+					return
+				}
+
+				metricIdempotentReplays.Add(1)
+				w.Header().Set("Idempotent-Replayed", "true")
+				answer(w, record.Status, record.ContentType, record.Body)
+				return
+			}
+
+			r.Body = fd
+			recorder := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(recorder, r)
+
+			if recorder.status >= 500 {
+				return
+			}
+
+			if err := keys.put(name, &idempotencyRecord{
+				Path:        r.URL.Path,
+				Digest:      digest,
+				Status:      recorder.status,
+				ContentType: w.Header().Get(headerContentType),
+				Body:        recorder.body.String(),
+				Time:        time.Now(),
+			}); err != nil {
+				proxy.log.Error("recording idempotency key", zap.Error(err))
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterIdempotencyKeys(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	replays := metricIdempotentReplays.Get()
+
+	put := func(url, body, key string) *apitest.Response {
+		return apitest.New().
+			Handler(router).
+			Method("PUT").
+			URL(url).
+			Header(headerIdempotencyKey, key).
+			Body(body).
+			Expect(t)
+	}
+
+	put(fNar, string(testdata[fNar]), "upload-1").
+		Body("ok\n").
+		Status(http.StatusOK).
+		End()
+
+	// a replay must not store the NAR again.
+	stored := filepath.Join(proxy.localIndex.(desync.LocalIndexStore).Path, fNar)
+	if err := os.Remove(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	put(fNar, string(testdata[fNar]), "upload-1").
+		Header("Idempotent-Replayed", "true").
+		Body("ok\n").
+		Status(http.StatusOK).
+		End()
+
+	if _, err := os.Stat(stored); !os.IsNotExist(err) {
+		t.Fatal("replayed upload was stored again")
+	}
+
+	if replayed := metricIdempotentReplays.Get() - replays; replayed != 1 {
+		t.Fatalf("expected 1 replay, got %d", replayed)
+	}
+
+	put(fNar, "something else", "upload-1").
+		Status(http.StatusUnprocessableEntity).
+		End()
+
+	put(fNarXz, string(testdata[fNar]), "upload-1").
+		Status(http.StatusUnprocessableEntity).
+		End()
+
+	put(fNar, string(testdata[fNar]), "upload-2").
+		Assert(func(res *http.Response, _ *http.Request) error {
+			if res.Header.Get("Idempotent-Replayed") != "" {
+				return errors.New("upload with a new key was replayed")
+			}
+			return nil
+		}).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestRouterIdempotencyKeysTooLarge(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.IdempotencyMaxSize = 0
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Method("PUT").
+		URL(fNar).
+		Header(headerIdempotencyKey, "upload-1").
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Status(http.StatusRequestEntityTooLarge).
+		End()
+
+	if spooled, err := os.ReadDir(filepath.Join(proxy.Dir, "tmp")); err != nil || len(spooled) != 0 {
+		t.Fatalf("expected no spooled bodies, got %v %v", spooled, err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var metricJobRunning = metrics.Must1LabelInteger("spongix_job_running", "job")
+
+func init() {
+	metrics.MustHelp("spongix_job_running", "Whether the background job is currently running")
+}
+
+// job is a background task like GC or verification that runs periodically.
+type job struct {
+	name     string
+	interval time.Duration
+	run      func()
+
+	mu           sync.Mutex
+	paused       bool
+	waiting      bool
+	running      bool
+	lastStart    time.Time
+	lastDuration time.Duration
+}
+
+type jobStatus struct {
+	Name         string        `json:"name"`
+	Interval     time.Duration `json:"interval"`
+	Paused       bool          `json:"paused"`
+	Running      bool          `json:"running"`
+	LastStart    time.Time     `json:"last_start"`
+	LastDuration time.Duration `json:"last_duration"`
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return jobStatus{
+		Name:         j.name,
+		Interval:     j.interval,
+		Paused:       j.paused,
+		Running:      j.running,
+		LastStart:    j.lastStart,
+		LastDuration: j.lastDuration,
+	}
+}
+
+func (j *job) setPaused(paused bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.paused = paused
+}
+
+// jobs runs background jobs on their own schedule, but never more of them at
+// once than allowed, so they don't compete for I/O with each other.
+type jobs struct {
+	log  *zap.Logger
+	sem  chan struct{}
+	jobs map[string]*job
+}
+
+func newJobs(log *zap.Logger, concurrency uint64) *jobs {
+	if concurrency == 0 {
+		concurrency = 1
+	}
+
+	return &jobs{
+		log:  log,
+		sem:  make(chan struct{}, concurrency),
+		jobs: map[string]*job{},
+	}
+}
+
+// add schedules a job, an interval of 0 disables it.
+func (js *jobs) add(name string, interval time.Duration, run func()) {
+	if interval == 0 {
+		js.log.Info("job disabled", zap.String("job", name))
+		return
+	}
+
+	js.jobs[name] = &job{name: name, interval: interval, run: run}
+}
+
+func (js *jobs) start() {
+	for _, j := range js.jobs {
+		go js.loop(j)
+	}
+}
+
+func (js *jobs) loop(j *job) {
+	js.log.Debug("Initializing job", zap.String("job", j.name), zap.Duration("interval", j.interval))
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		js.runOnce(j)
+		<-ticker.C
+	}
+}
+
+func (js *jobs) runOnce(j *job) {
+	j.mu.Lock()
+	paused := j.paused
+	j.mu.Unlock()
+
+	if paused {
+		js.log.Debug("job is paused", zap.String("job", j.name))
+		return
+	}
+
+	j.mu.Lock()
+	j.waiting = true
+	j.mu.Unlock()
+
+	js.sem <- struct{}{}
+	defer func() { <-js.sem }()
+
+	j.mu.Lock()
+	j.waiting = false
+	j.running = true
+	j.lastStart = time.Now()
+	j.mu.Unlock()
+	metricJobRunning(j.name).Set(1)
+
+	j.run()
+
+	j.mu.Lock()
+	j.running = false
+	j.lastDuration = time.Since(j.lastStart)
+	j.mu.Unlock()
+	metricJobRunning(j.name).Set(0)
+}
+
+// waiting tells long running jobs to stop early, so they don't keep other jobs
+// like GC from running when MaxJobs is reached.
+func (js *jobs) waiting() bool {
+	if js == nil {
+		return false
+	}
+
+	for _, j := range js.jobs {
+		j.mu.Lock()
+		waiting := j.waiting
+		j.mu.Unlock()
+		if waiting {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) setupJobs() {
+	proxy.jobs = newJobs(proxy.log, proxy.MaxJobs)
+
+	proxy.jobs.add("gc", proxy.GcInterval, func() {
+		lease, err := proxy.acquireGCLease()
+		if err != nil {
+			proxy.log.Warn("skipping GC", zap.Error(err))
+			metricGcSkipped.Add(1)
+			return
+		}
+		defer lease.release()
+
+		measure(metricGcTime, func() {
+			proxy.flushAccessTimes()
+			proxy.removeOrphanedChunks()
+			proxy.gcOnce()
+			proxy.pruneNarinfoHistory()
+			proxy.compactPacks()
+			proxy.pruneArtifacts()
+		})
+	})
+	proxy.jobs.add("verify", proxy.VerifyInterval, func() {
+		measure(metricVerifyTime, func() { proxy.verifyOnce() })
+	})
+	scrubSince := time.Time{}
+	proxy.jobs.add("scrub", proxy.ScrubInterval, func() {
+		start := time.Now()
+		scrubSince = proxy.scrubOnce(scrubSince)
+		metricScrubTime.Set(metricScrubTime.Get() + time.Since(start).Seconds())
+	})
+	proxy.jobs.add("dedup", proxy.DedupAnalysisInterval, proxy.analyzeDedupOnce)
+	if proxy.hydra != nil {
+		proxy.jobs.add("hydra", proxy.HydraImportInterval, proxy.importHydraOnce)
+	}
+	if proxy.MirrorList != "" || proxy.MirrorHydraEval != "" {
+		proxy.jobs.add("mirror", proxy.MirrorInterval, proxy.mirrorOnce)
+	}
+}
+
+// GET /jobs
+func (proxy *Proxy) jobsStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := []jobStatus{}
+	for _, j := range proxy.jobs.jobs {
+		statuses = append(statuses, j.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		proxy.log.Error("encoding job status", zap.Error(err))
+	}
+}
+
+// POST /jobs/{name}/pause and POST /jobs/{name}/resume
+// A running job finishes its current run when paused.
+func (proxy *Proxy) jobsPause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		j, found := proxy.jobs.jobs[mux.Vars(r)["name"]]
+		if !found {
+			serveNotFound(w, r)
+			return
+		}
+
+		j.setPaused(paused)
+		proxy.log.Info("job paused", zap.String("job", j.name), zap.Bool("paused", paused))
+		answer(w, http.StatusOK, mimeText, "ok\n")
+	}
+}
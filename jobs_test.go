@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterJobs(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.GcInterval = time.Hour
+	proxy.VerifyInterval = 0
+	proxy.DedupAnalysisInterval = 0
+	proxy.ScrubInterval = 0
+	router := testRouter(proxy)
+
+	apitest.New().
+		Handler(router).
+		Method("POST").
+		URL("/jobs/gc/pause").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("POST").
+		URL("/jobs/verify/pause").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, testAdminRequest("GET", "/jobs", nil))
+
+	statuses := []jobStatus{}
+	if err := json.NewDecoder(res.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	} else if len(statuses) != 1 || statuses[0].Name != "gc" || !statuses[0].Paused {
+		t.Fatalf("unexpected job status: %v", statuses)
+	}
+
+	// paused jobs are skipped
+	proxy.jobs.runOnce(proxy.jobs.jobs["gc"])
+	if !proxy.jobs.jobs["gc"].status().LastStart.IsZero() {
+		t.Fatal("paused job was run")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+)
+
+// routes under this prefix are only kept for older clients.
+const legacyPrefix = "/cache"
+
+var metricLegacyRequests = metrics.Must1LabelCounter("spongix_legacy_requests", "method")
+
+func init() {
+	metrics.MustHelp("spongix_legacy_requests", "Number of requests to the deprecated /cache routes")
+}
+
+// withLegacyRoutes marks responses of the /cache routes as deprecated and
+// points clients at the route they should use instead, so we know when it's
+// safe to remove them.
+func withLegacyRoutes() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, legacyPrefix+"/") {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			metricLegacyRequests(r.Method).Add(1)
+
+			successor := strings.TrimPrefix(r.URL.Path, legacyPrefix)
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
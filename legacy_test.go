@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterLegacyRoutes(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	apitest.New().
+		Handler(router).
+		Get("/cache/nix-cache-info").
+		Expect(t).
+		Header("Deprecation", "true").
+		Header("Link", `</nix-cache-info>; rel="successor-version"`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get("/nix-cache-info").
+		Expect(t).
+		HeaderNotPresent("Deprecation").
+		Status(http.StatusOK).
+		End()
+}
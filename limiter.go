@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+)
+
+var (
+	metricUploadActive   = metrics.MustInteger("spongix_upload_active", "Number of uploads currently being processed")
+	metricUploadQueued   = metrics.MustInteger("spongix_upload_queued", "Number of uploads waiting for a free slot")
+	metricUploadRejected = metrics.MustCounter("spongix_upload_rejected", "Number of uploads rejected because all slots were taken")
+)
+
+// uploadLimiter is a semaphore around PUT requests. Uploads wait up to
+// `wait` for a free slot before they're turned away with a 429.
+type uploadLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func newUploadLimiter(max uint64, wait time.Duration) *uploadLimiter {
+	return &uploadLimiter{slots: make(chan struct{}, max), wait: wait}
+}
+
+func (l *uploadLimiter) acquire() bool {
+	select {
+	case l.slots <- yes:
+		return true
+	default:
+	}
+
+	metricUploadQueued.Add(1)
+	defer metricUploadQueued.Add(-1)
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- yes:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *uploadLimiter) release() {
+	<-l.slots
+}
+
+func (proxy *Proxy) withUploadLimiter() mux.MiddlewareFunc {
+	if proxy.MaxUploads == 0 {
+		return func(h http.Handler) http.Handler { return h }
+	}
+
+	if proxy.uploadLimiter == nil {
+		proxy.uploadLimiter = newUploadLimiter(proxy.MaxUploads, proxy.UploadWait)
+	}
+	limiter := proxy.uploadLimiter
+
+	retryAfter := strconv.FormatInt(int64(proxy.UploadWait.Seconds())+1, 10)
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if !limiter.acquire() {
+				metricUploadRejected.Add(1)
+				w.Header().Set("Retry-After", retryAfter)
+				answer(w, http.StatusTooManyRequests, mimeText, "too many concurrent uploads\n")
+				return
+			}
+			defer limiter.release()
+
+			metricUploadActive.Add(1)
+			defer metricUploadActive.Add(-1)
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterUploadLimit(t *testing.T) {
+	proxy := withS3(testProxy(t))
+	proxy.MaxUploads = 1
+	proxy.UploadWait = time.Millisecond
+	router := testRouter(proxy)
+
+	if !proxy.uploadLimiter.acquire() {
+		t.Fatal("couldn't acquire upload slot")
+	}
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Header(headerContentType, mimeText).
+		Header("Retry-After", "1").
+		Body("too many concurrent uploads\n").
+		Status(http.StatusTooManyRequests).
+		End()
+
+	proxy.uploadLimiter.release()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Body("ok\n").
+		Status(http.StatusOK).
+		End()
+}
@@ -17,6 +17,13 @@ func (r *LogRecord) Write(p []byte) (int, error) {
 	return r.ResponseWriter.Write(p)
 }
 
+// Flush passes on flushes of streaming responses like GET /events.
+func (r *LogRecord) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // WriteHeader overrides ResponseWriter.WriteHeader to keep track of the response code
 func (r *LogRecord) WriteHeader(status int) {
 	r.status = status
@@ -31,11 +38,11 @@ func withHTTPLogging(log *zap.Logger) func(http.Handler) http.Handler {
 			isMetric := url == "/metrics"
 
 			if !isMetric {
-				log.Info("REQ",
+				log.Info("REQ", append([]zap.Field{
 					zap.String("ident", r.Host),
 					zap.String("method", r.Method),
 					zap.String("url", url),
-				)
+				}, traceFields(r.Context())...)...)
 			}
 
 			start := time.Now()
@@ -51,13 +58,13 @@ func withHTTPLogging(log *zap.Logger) func(http.Handler) http.Handler {
 			}
 
 			if !(isMetric && record.status == 200) {
-				level("RES",
+				level("RES", append([]zap.Field{
 					zap.String("ident", r.Host),
 					zap.String("method", r.Method),
 					zap.String("url", url),
 					zap.Int("status_code", record.status),
 					zap.Duration("duration", time.Since(start)),
-				)
+				}, traceFields(r.Context())...)...)
 			}
 		})
 	}
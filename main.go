@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"crypto/ed25519"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
@@ -41,15 +44,131 @@ func main() {
 
 	arg.MustParse(proxy)
 	chunkSizeAvg = proxy.AverageChunkSize
+	assemblerBufferSize = proxy.AssemblerBufferSize
 
 	proxy.setupLogger()
+
+	if proxy.Seed != nil {
+		proxy.setupDesync()
+		proxy.setupKeys()
+		if err := proxy.runSeed(proxy.Seed); err != nil {
+			proxy.log.Fatal("seed failed", zap.Error(err))
+		}
+		return
+	}
+
+	if proxy.Backfill != nil {
+		proxy.setupDesync()
+		if err := proxy.runBackfillAtime(proxy.Backfill); err != nil {
+			proxy.log.Fatal("back-filling access times failed", zap.Error(err))
+		}
+		return
+	}
+
+	if proxy.Push != nil {
+		proxy.setupKeys()
+		if err := proxy.runPush(proxy.Push); err != nil {
+			proxy.log.Fatal("push failed", zap.Error(err))
+		}
+		return
+	}
+
+	if proxy.UploadHook != nil {
+		proxy.setupKeys()
+		if err := proxy.runUploadHook(proxy.UploadHook); err != nil {
+			proxy.log.Fatal("upload hook failed", zap.Error(err))
+		}
+		return
+	}
+
+	if proxy.Mirror != nil {
+		proxy.setupDesync()
+		proxy.setupKeys()
+		proxy.setupUpstreams()
+		if err := proxy.runMirror(proxy.Mirror); err != nil {
+			proxy.log.Fatal("mirror failed", zap.Error(err))
+		}
+		return
+	}
+
+	if proxy.Doctor != nil {
+		proxy.setupKeys()
+		if err := proxy.runDoctor(proxy.Doctor); err != nil {
+			proxy.log.Fatal("doctor found problems", zap.Error(err))
+		}
+		return
+	}
+
+	if proxy.Top != nil {
+		if err := proxy.runTop(proxy.Top); err != nil {
+			proxy.log.Fatal("top failed", zap.Error(err))
+		}
+		return
+	}
+
+	if proxy.GenFixtures != nil {
+		proxy.requireKeys()
+		proxy.setupKeys()
+		if err := proxy.runGenFixtures(proxy.GenFixtures); err != nil {
+			proxy.log.Fatal("generating fixtures failed", zap.Error(err))
+		}
+		return
+	}
+
+	proxy.requireKeys()
+
+	if proxy.UnknownUploadStatus != http.StatusForbidden && proxy.UnknownUploadStatus != http.StatusNotFound {
+		proxy.log.Fatal("unknown upload status must be 403 or 404", zap.Int("status", proxy.UnknownUploadStatus))
+	}
+
+	if proxy.CanaryPercent > 100 {
+		proxy.log.Fatal("canary percent must be between 0 and 100", zap.Uint64("percent", proxy.CanaryPercent))
+	}
+
+	if !proxy.SkipPreflight {
+		proxy.preflight()
+	}
+
 	proxy.setupDesync()
 	proxy.setupKeys()
+	proxy.setupS3Budget()
 	proxy.setupS3()
+	if proxy.CanaryPercent > 0 && proxy.s3Index == nil {
+		proxy.log.Fatal("canary percent requires an S3 index store, but none is configured")
+	}
+	proxy.setupSecondaries()
+	proxy.setupAccessTimes()
+	proxy.setupAudit()
+	proxy.setupHydra()
+	proxy.setupTLS()
+	proxy.setupMetricsToken()
+	proxy.setupAdminToken()
+	proxy.setupHandlers()
+
+	if proxy.AdminListen != "" && !isLoopbackAddress(proxy.AdminListen) {
+		proxy.log.Fatal("admin listener must be bound to localhost", zap.String("listen", proxy.AdminListen))
+	}
 
 	go proxy.startCache()
-	go proxy.gc()
-	go proxy.verify()
+	proxy.startPrefetch()
+	go proxy.checkUpstreams()
+	proxy.jobs.start()
+	go proxy.sampleDedup()
+	proxy.startSecondaries()
+	go proxy.expireStagedUploads()
+	go proxy.expireIdempotencyKeys()
+	go proxy.writeAccessTimes()
+	go proxy.saveStats()
+
+	if proxy.ReconcileOnStart {
+		go proxy.reconcileOnStart()
+	}
+
+	if proxy.LeaderURL != "" {
+		proxy.setupLeaderToken()
+		proxy.standby = 1
+		go proxy.replicate()
+	}
 
 	go func() {
 		t := time.Tick(5 * time.Second)
@@ -83,9 +202,43 @@ func main() {
 		syscall.SIGTERM,
 	)
 
+	var publicSrv *http.Server
+	if proxy.PublicListen != "" {
+		publicSrv = &http.Server{
+			Handler:      proxy.publicRouter(),
+			Addr:         proxy.PublicListen,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		}
+
+		go func() {
+			proxy.log.Info("Public server starting", zap.String("listen", proxy.PublicListen))
+			if err := proxy.serve(publicSrv); err != http.ErrServerClosed {
+				proxy.log.Fatal("error bringing up public listener", zap.Error(err))
+			}
+		}()
+	}
+
+	var adminSrv *http.Server
+	if proxy.AdminListen != "" {
+		adminSrv = &http.Server{
+			Handler:      proxy.adminRouter(),
+			Addr:         proxy.AdminListen,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		}
+
+		go func() {
+			proxy.log.Info("Admin server starting", zap.String("listen", proxy.AdminListen))
+			if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+				proxy.log.Fatal("error bringing up admin listener", zap.Error(err))
+			}
+		}()
+	}
+
 	go func() {
-		proxy.log.Info("Server starting", zap.String("listen", proxy.Listen))
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		proxy.log.Info("Server starting", zap.String("listen", proxy.Listen), zap.Bool("tls", proxy.tlsConfig != nil))
+		if err := proxy.serve(srv); err != http.ErrServerClosed {
 			// Only log an error if it's not due to shutdown or close
 			proxy.log.Fatal("error bringing up listener", zap.Error(err))
 		}
@@ -98,28 +251,140 @@ func main() {
 	ctxShutDown, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	if publicSrv != nil {
+		if err := publicSrv.Shutdown(ctxShutDown); err != nil {
+			proxy.log.Fatal("public server shutdown failed", zap.Error(err))
+		}
+	}
+
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctxShutDown); err != nil {
+			proxy.log.Fatal("admin server shutdown failed", zap.Error(err))
+		}
+	}
+
 	if err := srv.Shutdown(ctxShutDown); err != nil {
 		proxy.log.Fatal("server shutdown failed", zap.Error(err))
 	}
 
+	if left := proxy.cacheQueue.drain(timeout); left > 0 {
+		proxy.log.Warn("shutting down before all upstream responses were cached", zap.Int("left", left))
+	}
+
 	proxy.log.Info("server shutdown gracefully")
 }
 
 type Proxy struct {
-	BucketURL         string        `arg:"--bucket-url,env:BUCKET_URL" help:"Bucket URL like s3+http://127.0.0.1:9000/ncp"`
-	BucketRegion      string        `arg:"--bucket-region,env:BUCKET_REGION" help:"Region the bucket is in"`
-	Dir               string        `arg:"--dir,env:CACHE_DIR" help:"directory for the cache"`
-	Listen            string        `arg:"--listen,env:LISTEN_ADDR" help:"Listen on this address"`
-	SecretKeyFiles    []string      `arg:"--secret-key-files,required,env:NIX_SECRET_KEY_FILES" help:"Files containing your private nix signing keys"`
-	Substituters      []string      `arg:"--substituters,env:NIX_SUBSTITUTERS"`
-	TrustedPublicKeys []string      `arg:"--trusted-public-keys,env:NIX_TRUSTED_PUBLIC_KEYS"`
-	CacheInfoPriority uint64        `arg:"--cache-info-priority,env:CACHE_INFO_PRIORITY" help:"Priority in nix-cache-info"`
-	AverageChunkSize  uint64        `arg:"--average-chunk-size,env:AVERAGE_CHUNK_SIZE" help:"Chunk size will be between /4 and *4 of this value"`
-	CacheSize         uint64        `arg:"--cache-size,env:CACHE_SIZE" help:"Number of gigabytes to keep in the disk cache"`
-	VerifyInterval    time.Duration `arg:"--verify-interval,env:VERIFY_INTERVAL" help:"Time between verification runs"`
-	GcInterval        time.Duration `arg:"--gc-interval,env:GC_INTERVAL" help:"Time between store garbage collection runs"`
-	LogLevel          string        `arg:"--log-level,env:LOG_LEVEL" help:"One of debug, info, warn, error, dpanic, panic, fatal"`
-	LogMode           string        `arg:"--log-mode,env:LOG_MODE" help:"development or production"`
+	BucketURL              string          `arg:"--bucket-url,env:BUCKET_URL" help:"Bucket URL like s3+http://127.0.0.1:9000/ncp"`
+	BucketRegion           string          `arg:"--bucket-region,env:BUCKET_REGION" help:"Region the bucket is in"`
+	S3Concurrency          uint64          `arg:"--s3-concurrency,env:S3_CONCURRENCY" help:"Number of concurrent operations on S3 stores"`
+	S3Timeout              time.Duration   `arg:"--s3-timeout,env:S3_TIMEOUT" help:"Time to wait for S3 objects, negative waits forever"`
+	S3ErrorRetry           uint64          `arg:"--s3-error-retry,env:S3_ERROR_RETRY" help:"Number of times failed S3 requests are retried"`
+	S3ErrorRetryInterval   time.Duration   `arg:"--s3-error-retry-interval,env:S3_ERROR_RETRY_INTERVAL" help:"Time to wait before the first retry, multiplied by the attempt for later ones"`
+	S3Uncompressed         bool            `arg:"--s3-uncompressed,env:S3_UNCOMPRESSED" help:"Store chunks uncompressed in S3"`
+	S3SkipVerify           bool            `arg:"--s3-skip-verify,env:S3_SKIP_VERIFY" help:"Skip verifying chunks read from S3"`
+	S3RequestBudget        uint64          `arg:"--s3-request-budget,env:S3_REQUEST_BUDGET" help:"Number of S3 requests per hour background jobs may use, including those serving clients, 0 disables the limit"`
+	HydraBucketURL         string          `arg:"--hydra-bucket-url,env:HYDRA_BUCKET_URL" help:"Continuously import narinfos and NARs from this hydra binary cache bucket"`
+	HydraImportInterval    time.Duration   `arg:"--hydra-import-interval,env:HYDRA_IMPORT_INTERVAL" help:"Time between imports from the hydra bucket"`
+	MirrorList             string          `arg:"--mirror-list,env:MIRROR_LIST" help:"File or http(s) URL listing store paths whose closures are copied from the substituters on a schedule"`
+	MirrorHydraEval        string          `arg:"--mirror-hydra-eval,env:MIRROR_HYDRA_EVAL" help:"URL of a hydra evaluation whose successful build outputs are copied from the substituters on a schedule"`
+	MirrorInterval         time.Duration   `arg:"--mirror-interval,env:MIRROR_INTERVAL" help:"Time between mirror runs"`
+	MirrorWithSources      bool            `arg:"--mirror-with-sources,env:MIRROR_WITH_SOURCES" help:"Also mirror the .drv files and fixed-output sources needed to rebuild"`
+	Dir                    string          `arg:"--dir,env:CACHE_DIR" help:"directory for the cache"`
+	Listen                 string          `arg:"--listen,env:LISTEN_ADDR" help:"Listen on this address"`
+	PublicListen           string          `arg:"--public-listen,env:PUBLIC_LISTEN" help:"Serve exported store paths without authentication on this address"`
+	AdminListen            string          `arg:"--admin-listen,env:ADMIN_LISTEN" help:"Serve metrics and the admin API only on this localhost address instead of the cache listener"`
+	TLSCert                string          `arg:"--tls-cert,env:TLS_CERT" help:"Certificate file to serve HTTPS with"`
+	TLSKey                 string          `arg:"--tls-key,env:TLS_KEY" help:"Key file of the TLS certificate"`
+	MetricsTokenFile       string          `arg:"--metrics-token-file,env:METRICS_TOKEN_FILE" help:"Require the bearer token in this file to read /metrics"`
+	AdminTokenFile         string          `arg:"--admin-token-file,env:ADMIN_TOKEN_FILE" help:"Allow admin requests on the cache listener with the bearer token in this file"`
+	ACMEDomains            []string        `arg:"--acme-domains,env:ACME_DOMAINS" help:"Obtain certificates for these domains from Let's Encrypt"`
+	ACMEEmail              string          `arg:"--acme-email,env:ACME_EMAIL" help:"Contact address for the ACME account"`
+	ACMECacheDir           string          `arg:"--acme-cache-dir,env:ACME_CACHE_DIR" help:"Directory for ACME certificates, defaults to acme in the cache directory"`
+	SecretKeyFiles         []string        `arg:"--secret-key-files,env:NIX_SECRET_KEY_FILES" help:"Files containing your private nix signing keys, required to serve and generate fixtures"`
+	Substituters           []string        `arg:"--substituters,env:NIX_SUBSTITUTERS"`
+	TrustedPublicKeys      []string        `arg:"--trusted-public-keys,env:NIX_TRUSTED_PUBLIC_KEYS"`
+	RewriteUpstreamNarinfo bool            `arg:"--rewrite-upstream-narinfo,env:REWRITE_UPSTREAM_NARINFO" help:"Only serve upstream narinfo with trusted signatures and sign them with our keys"`
+	CacheInfoPriority      uint64          `arg:"--cache-info-priority,env:CACHE_INFO_PRIORITY" help:"Priority in nix-cache-info"`
+	WantMassQuery          bool            `arg:"--want-mass-query,env:WANT_MASS_QUERY" help:"Advertise WantMassQuery in nix-cache-info"`
+	UnhealthyPriority      uint64          `arg:"--unhealthy-priority,env:UNHEALTHY_PRIORITY" help:"Priority in nix-cache-info while a store is unhealthy"`
+	UnhealthyUnavailable   bool            `arg:"--unhealthy-unavailable,env:UNHEALTHY_UNAVAILABLE" help:"Respond to nix-cache-info with 503 while a store is unhealthy"`
+	HealthCacheTTL         time.Duration   `arg:"--health-cache-ttl,env:HEALTH_CACHE_TTL" help:"Time the store health in /readyz and nix-cache-info is reused before the stores are probed again"`
+	AverageChunkSize       uint64          `arg:"--average-chunk-size,env:AVERAGE_CHUNK_SIZE" help:"Chunk size will be between /4 and *4 of this value"`
+	AssemblerBufferSize    uint64          `arg:"--assembler-buffer-size,env:ASSEMBLER_BUFFER_SIZE" help:"Initial capacity in bytes of the pooled buffers files are assembled from chunks in, 0 uses the maximum chunk size"`
+	UnknownUploadStatus    int             `arg:"--unknown-upload-status,env:UNKNOWN_UPLOAD_STATUS" help:"Status of uploads to paths that take none, 403 or 404"`
+	NarMaxAge              time.Duration   `arg:"--nar-max-age,env:NAR_MAX_AGE" help:"Time CDNs may cache NARs for, they're immutable"`
+	NarinfoMaxAge          time.Duration   `arg:"--narinfo-max-age,env:NARINFO_MAX_AGE" help:"Time CDNs may cache narinfos for"`
+	MissMaxAge             time.Duration   `arg:"--miss-max-age,env:MISS_MAX_AGE" help:"Time CDNs may cache missing narinfos and NARs for"`
+	NarinfoCompression     string          `arg:"--narinfo-compression,env:NARINFO_COMPRESSION" help:"Advertise NARs compressed with xz or zstd in served narinfos, they're compressed while being sent"`
+	NarinfoURLRewrites     []string        `arg:"--narinfo-url-rewrites,env:NARINFO_URL_REWRITES" help:"Rewrite URL prefixes of served narinfos, like nar/=https://cdn.example.com/nar/"`
+	NarinfoStripDeriver    bool            `arg:"--narinfo-strip-deriver,env:NARINFO_STRIP_DERIVER" help:"Remove the Deriver from served narinfos"`
+	ZstdResponses          bool            `arg:"--zstd-responses,env:ZSTD_RESPONSES" help:"Compress NARs with zstd for clients accepting that encoding"`
+	CompressedCacheSize    uint64          `arg:"--compressed-cache-size,env:COMPRESSED_CACHE_SIZE" help:"Number of megabytes of NARs compressed for clients kept on disk, so they aren't compressed again, 0 disables"`
+	PrefetchLinks          bool            `arg:"--prefetch-links,env:PREFETCH_LINKS" help:"Announce the NAR and references of narinfos in Link rel=prefetch headers"`
+	PrefetchWorkers        int             `arg:"--prefetch-workers,env:PREFETCH_WORKERS" help:"Number of workers copying the references of served narinfos from the substituters before they're requested, 0 disables"`
+	StrictReferences       bool            `arg:"--strict-references,env:STRICT_REFERENCES" help:"Reject narinfo uploads whose NAR references store paths missing from References"`
+	AllowedDerivers        []string        `arg:"--allowed-derivers,env:ALLOWED_DERIVERS" help:"Only accept narinfo uploads whose Deriver matches one of these glob patterns"`
+	ReconcileOnStart       bool            `arg:"--reconcile-on-start,env:RECONCILE_ON_START" help:"Check the local store for inconsistent indices after startup and move them to the trash"`
+	VerifyNarHash          bool            `arg:"--verify-nar-hash,env:VERIFY_NAR_HASH" help:"Check that the NAR of uploaded narinfos matches their NarHash and NarSize"`
+	NarHashSyncLimit       uint64          `arg:"--nar-hash-sync-limit,env:NAR_HASH_SYNC_LIMIT" help:"NARs up to this many bytes are verified before storing their narinfo, larger ones afterwards"`
+	NarinfoHistory         uint64          `arg:"--narinfo-history,env:NARINFO_HISTORY" help:"Number of previous versions kept for each overwritten narinfo, 0 disables"`
+	NarinfoHistoryMaxAge   time.Duration   `arg:"--narinfo-history-max-age,env:NARINFO_HISTORY_MAX_AGE" help:"Time after which previous narinfo versions are removed by the GC, 0 keeps them"`
+	CacheSize              uint64          `arg:"--cache-size,env:CACHE_SIZE" help:"Number of gigabytes to keep in the disk cache"`
+	VerifyInterval         time.Duration   `arg:"--verify-interval,env:VERIFY_INTERVAL" help:"Time between verification runs, 0 disables verification"`
+	ScrubInterval          time.Duration   `arg:"--scrub-interval,env:SCRUB_INTERVAL" help:"Time between verifications of recently written chunks, 0 disables them"`
+	ScrubWindow            time.Duration   `arg:"--scrub-window,env:SCRUB_WINDOW" help:"Only writes within this time are verified by scrubbing"`
+	GcInterval             time.Duration   `arg:"--gc-interval,env:GC_INTERVAL" help:"Time between store garbage collection runs, 0 disables GC"`
+	GcBatchSize            uint64          `arg:"--gc-batch-size,env:GC_BATCH_SIZE" help:"Number of chunks the GC handles between saving its progress, so a restart resumes the run"`
+	PackChunks             bool            `arg:"--pack-chunks,env:PACK_CHUNKS" help:"Store local chunks in append-only pack files instead of a file per chunk"`
+	AccessTimeInterval     time.Duration   `arg:"--access-time-interval,env:ACCESS_TIME_INTERVAL" help:"Time between writes of chunk access times the GC evicts by, 0 disables tracking them"`
+	AccessTimeBatch        uint64          `arg:"--access-time-batch,env:ACCESS_TIME_BATCH" help:"Write chunk access times early once this many are pending"`
+	DedupAnalysisInterval  time.Duration   `arg:"--dedup-analysis-interval,env:DEDUP_ANALYSIS_INTERVAL" help:"Time between analyses of chunk deduplication per package, 0 disables them"`
+	VerifyThreads          uint64          `arg:"--verify-threads,env:VERIFY_THREADS" help:"Number of threads verifying the local store, defaults to the number of CPUs"`
+	MaxJobs                uint64          `arg:"--max-jobs,env:MAX_JOBS" help:"Maximum number of background jobs like GC and verification running at once"`
+	CanaryPercent          uint64          `arg:"--canary-percent,env:CANARY_PERCENT" help:"Percentage of reads served from the S3 store before the local store"`
+	MaxUploads             uint64          `arg:"--max-uploads,env:MAX_UPLOADS" help:"Maximum number of concurrent uploads, 0 is unlimited"`
+	UploadWait             time.Duration   `arg:"--upload-wait,env:UPLOAD_WAIT" help:"Time an upload may wait for a free slot before it's rejected"`
+	GetRateLimit           uint64          `arg:"--get-rate-limit,env:GET_RATE_LIMIT" help:"Downloads per second each client may make, 0 is unlimited"`
+	GetByteRateLimit       uint64          `arg:"--get-byte-rate-limit,env:GET_BYTE_RATE_LIMIT" help:"Bytes per second each client may download, 0 is unlimited"`
+	PutRateLimit           uint64          `arg:"--put-rate-limit,env:PUT_RATE_LIMIT" help:"Uploads per second each client may make, 0 is unlimited"`
+	PutByteRateLimit       uint64          `arg:"--put-byte-rate-limit,env:PUT_BYTE_RATE_LIMIT" help:"Bytes per second each client may upload, 0 is unlimited"`
+	UploadStagingTTL       time.Duration   `arg:"--upload-staging-ttl,env:UPLOAD_STAGING_TTL" help:"Time after which partial NAR uploads are removed"`
+	IdempotencyTTL         time.Duration   `arg:"--idempotency-ttl,env:IDEMPOTENCY_TTL" help:"Time the results of uploads with an Idempotency-Key are kept for retries, 0 disables them"`
+	IdempotencyMaxSize     uint64          `arg:"--idempotency-max-size,env:IDEMPOTENCY_MAX_SIZE" help:"Size in megabytes of the largest upload with an Idempotency-Key, which is kept on disk until it's stored"`
+	NarinfoCacheSize       int             `arg:"--narinfo-cache-size,env:NARINFO_CACHE_SIZE" help:"Number of narinfo responses kept in memory, 0 disables the cache"`
+	NarinfoCacheTTL        time.Duration   `arg:"--narinfo-cache-ttl,env:NARINFO_CACHE_TTL" help:"Time narinfo responses are kept in memory"`
+	ArtifactHosts          []string        `arg:"--artifact-hosts,env:ARTIFACT_HOSTS" help:"Hosts whose files are cached below /artifacts/<host>/, like github.com for flake inputs"`
+	ArtifactTTL            time.Duration   `arg:"--artifact-ttl,env:ARTIFACT_TTL" help:"Time after which cached artifacts are revalidated with their origin"`
+	ArtifactStreamSize     uint64          `arg:"--artifact-stream-size,env:ARTIFACT_STREAM_SIZE" help:"Artifacts of at least this many bytes are streamed into the bucket as a whole instead of being chunked, 0 disables"`
+	ProxyRoutes            []string        `arg:"--proxy-routes,env:PROXY_ROUTES" help:"name=URL pairs cached below /proxy/<name>/, like go=https://proxy.golang.org?immutable=@v/"`
+	UpstreamCheckInterval  time.Duration   `arg:"--upstream-check-interval,env:UPSTREAM_CHECK_INTERVAL" help:"Time between health checks of the substituters"`
+	UpstreamCooldown       time.Duration   `arg:"--upstream-cooldown,env:UPSTREAM_COOLDOWN" help:"Time a failing substituter is skipped"`
+	UpstreamPolicy         string          `arg:"--upstream-policy,env:UPSTREAM_POLICY" help:"How substituters are asked on a cache miss: fastest, priority or round-robin"`
+	UpstreamFanout         uint64          `arg:"--upstream-fanout,env:UPSTREAM_FANOUT" help:"Number of substituters the fastest policy asks at once before trying the next ones, 0 asks all"`
+	UpstreamConcurrency    uint64          `arg:"--upstream-concurrency,env:UPSTREAM_CONCURRENCY" help:"Number of requests in flight to each substituter, 0 for no limit, overridden by its concurrency parameter"`
+	MaxHops                uint64          `arg:"--max-hops,env:MAX_HOPS" help:"Maximum number of spongix instances a cache miss may pass through, 0 is unlimited"`
+	LeaderURL              string          `arg:"--leader-url,env:LEADER_URL" help:"Run as standby replicating uploads from the spongix at this URL"`
+	LeaderAdminURL         string          `arg:"--leader-admin-url,env:LEADER_ADMIN_URL" help:"Admin listener of the leader, if it has one, for its upload events"`
+	LeaderTokenFile        string          `arg:"--leader-token-file,env:LEADER_TOKEN_FILE" help:"File with the admin token of the leader, sent as bearer token for its upload events"`
+	ReplicationInterval    time.Duration   `arg:"--replication-interval,env:REPLICATION_INTERVAL" help:"Time between polls for new uploads on the leader"`
+	Secondaries            []string        `arg:"--secondaries,env:SECONDARIES" help:"spongix or s3+http(s) URLs every upload is copied to"`
+	ReadOnly               bool            `arg:"--read-only,env:READ_ONLY" help:"Reject uploads, only serve and cache downloads"`
+	AuditLog               string          `arg:"--audit-log,env:AUDIT_LOG" help:"File every mutation is appended to as JSON line"`
+	AuditLogMaxSize        uint64          `arg:"--audit-log-max-size,env:AUDIT_LOG_MAX_SIZE" help:"Size in megabytes after which the audit log is rotated"`
+	AuditLogKeep           uint64          `arg:"--audit-log-keep,env:AUDIT_LOG_KEEP" help:"Number of rotated audit logs kept"`
+	StatsRetention         time.Duration   `arg:"--stats-retention,env:STATS_RETENTION" help:"Time hourly and daily request rollups are kept for GET /stats, 0 disables them"`
+	LogLevel               string          `arg:"--log-level,env:LOG_LEVEL" help:"One of debug, info, warn, error, dpanic, panic, fatal"`
+	LogMode                string          `arg:"--log-mode,env:LOG_MODE" help:"development or production"`
+	SkipPreflight          bool            `arg:"--skip-preflight,env:SKIP_PREFLIGHT" help:"Start without checking directories, keys, ports and buckets first"`
+	Seed                   *SeedCmd        `arg:"subcommand:seed" help:"Create or apply seed files"`
+	Backfill               *BackfillCmd    `arg:"subcommand:backfill-atime" help:"Set chunk access times from old access logs, before the first GC after upgrading"`
+	Push                   *PushCmd        `arg:"subcommand:push" help:"Upload the closures of local store paths"`
+	UploadHook             *UploadHookCmd  `arg:"subcommand:upload-hook" help:"Push the closures of $OUT_PATHS, for use as nix post-build-hook"`
+	Mirror                 *MirrorCmd      `arg:"subcommand:mirror" help:"Copy closures from the substituters into the local store"`
+	Doctor                 *DoctorCmd      `arg:"subcommand:doctor" help:"Check a running spongix end to end"`
+	Top                    *TopCmd         `arg:"subcommand:top" help:"Watch hit rate, GC, the largest paths and recent uploads of a running spongix"`
+	GenFixtures            *GenFixturesCmd `arg:"subcommand:gen-fixtures" help:"Write signed narinfos, NARs and realisations of synthetic store paths"`
 
 	// derived from the above
 	secretKeys  map[string]ed25519.PrivateKey
@@ -129,9 +394,50 @@ type Proxy struct {
 	localStore desync.WriteStore
 
 	s3Index    desync.IndexWriteStore
+	s3Budget   *s3Budget
 	localIndex desync.IndexWriteStore
 
-	cacheChan chan string
+	cacheQueue *cacheQueue
+	prefetch   *prefetchQueue
+	compressed *compressedCache
+
+	uploadLimiter *uploadLimiter
+	rateLimiter   *rateLimiter
+	upstreams     *upstreamHealth
+	events        *eventLog
+	stream        *eventStream
+	dedup         *dedupStats
+	dedupAnalyzer *dedupAnalyzer
+	exports       *exports
+	catalogCache  *catalogListing
+	hydra         hydraBucket
+	hydraSeen     *hydraSeen
+	mirrored      mirrorStatus
+	secondaries   []*secondary
+	staged        *stagedUploads
+	idempotency   *idempotencyKeys
+	narinfoCache  *narinfoCache
+	narinfoPolicy *narinfoPolicy
+	artifacts     *artifacts
+	proxyRoutes   map[string]*proxyRoute
+	history       desync.LocalIndexStore
+	health        healthMemo
+	ready         readyMemo
+	orphans       orphanCandidates
+	metricsToken  string
+	adminToken    string
+	leaderToken   string
+	accessTimes   *accessTimes
+	reconciler    reconciler
+	validators    *upstreamValidators
+	instance      string
+	jobs          *jobs
+	audit         *auditLog
+	stats         *statsRollups
+	tlsConfig     *tls.Config
+
+	// set to 1 while replicating from a leader
+	standby int32
 
 	log *zap.Logger
 }
@@ -143,19 +449,61 @@ func NewProxy() *Proxy {
 	}
 
 	return &Proxy{
-		Dir:               "./cache",
-		Listen:            ":7745",
-		SecretKeyFiles:    []string{},
-		TrustedPublicKeys: []string{},
-		Substituters:      []string{},
-		CacheInfoPriority: 50,
-		AverageChunkSize:  chunkSizeAvg,
-		VerifyInterval:    time.Hour,
-		GcInterval:        time.Hour,
-		cacheChan:         make(chan string, 10000),
-		log:               devLog,
-		LogLevel:          "debug",
-		LogMode:           "production",
+		Dir:                   "./cache",
+		Listen:                ":7745",
+		CacheInfoPriority:     50,
+		WantMassQuery:         true,
+		UnhealthyPriority:     1000,
+		HealthCacheTTL:        10 * time.Second,
+		AverageChunkSize:      chunkSizeAvg,
+		VerifyInterval:        time.Hour,
+		AccessTimeInterval:    30 * time.Second,
+		AccessTimeBatch:       100000,
+		NarHashSyncLimit:      64 * 1024 * 1024,
+		ScrubInterval:         10 * time.Minute,
+		ScrubWindow:           6 * time.Hour,
+		GcInterval:            time.Hour,
+		GcBatchSize:           100000,
+		DedupAnalysisInterval: 24 * time.Hour,
+		HydraImportInterval:   time.Minute,
+		MirrorInterval:        6 * time.Hour,
+		VerifyThreads:         uint64(runtime.GOMAXPROCS(0)),
+		MaxJobs:               1,
+		AuditLogMaxSize:       100,
+		AuditLogKeep:          5,
+		StatsRetention:        30 * 24 * time.Hour,
+		UploadWait:            5 * time.Second,
+		UploadStagingTTL:      time.Hour,
+		IdempotencyTTL:        24 * time.Hour,
+		IdempotencyMaxSize:    1024,
+		NarinfoCacheSize:      10000,
+		NarinfoCacheTTL:       10 * time.Second,
+		NarinfoHistory:        10,
+		NarinfoHistoryMaxAge:  30 * 24 * time.Hour,
+		NarMaxAge:             365 * 24 * time.Hour,
+		UnknownUploadStatus:   http.StatusNotFound,
+		NarinfoMaxAge:         time.Minute,
+		ArtifactTTL:           time.Hour,
+		MaxHops:               3,
+		UpstreamCheckInterval: time.Minute,
+		UpstreamCooldown:      time.Minute,
+		UpstreamPolicy:        upstreamPolicyFastest,
+		S3Concurrency:         1,
+		S3Timeout:             time.Second,
+		S3ErrorRetryInterval:  time.Second,
+		ReplicationInterval:   time.Second,
+		events:                newEventLog(),
+		stream:                newEventStream(),
+		dedup:                 newDedupStats(),
+		dedupAnalyzer:         &dedupAnalyzer{},
+		catalogCache:          &catalogListing{},
+		validators:            newUpstreamValidators(),
+		instance:              randomHex(8),
+		cacheQueue:            newCacheQueue(10000),
+		prefetch:              newPrefetchQueue(prefetchQueueSize),
+		log:                   devLog,
+		LogLevel:              "debug",
+		LogMode:               "production",
 	}
 }
 
@@ -168,6 +516,24 @@ func (proxy *Proxy) Version() string {
 	return buildVersion + " (" + buildCommit + ")"
 }
 
+// setupHandlers prepares everything the routes are served from, so router and
+// adminRouter only have to register them.
+func (proxy *Proxy) setupHandlers() {
+	proxy.setupUpstreams()
+	proxy.setupStagedUploads()
+	proxy.setupIdempotencyKeys()
+	proxy.setupNarinfoCache()
+	proxy.setupNarinfoPolicy()
+	proxy.setupNarinfoHistory()
+	proxy.setupCompressedCache()
+	proxy.setupArtifacts()
+	proxy.setupProxyRoutes()
+	proxy.setupStats()
+	proxy.setupExports()
+	proxy.setupOrphans()
+	proxy.setupJobs()
+}
+
 func (proxy *Proxy) setupDir(path string) {
 	dir := filepath.Join(proxy.Dir, path)
 	if _, err := os.Stat(dir); err != nil {
@@ -200,14 +566,7 @@ func (proxy *Proxy) setupS3() {
 		},
 	)
 
-	store, err := desync.NewS3Store(s3Url, creds, proxy.BucketRegion,
-		desync.StoreOptions{
-			N:            1,
-			Timeout:      1 * time.Second,
-			ErrorRetry:   0,
-			Uncompressed: false,
-			SkipVerify:   false,
-		}, minio.BucketLookupAuto)
+	store, err := desync.NewS3Store(s3Url, creds, proxy.BucketRegion, proxy.s3StoreOptions(), minio.BucketLookupAuto)
 	if err != nil {
 		proxy.log.Fatal("failed creating s3 store",
 			zap.Error(err),
@@ -216,7 +575,67 @@ func (proxy *Proxy) setupS3() {
 		)
 	}
 
-	proxy.s3Store = store
+	proxy.s3Store = budgetedStore{store, proxy.s3Budget}
+
+	// indices go below /index, next to the chunk directories.
+	indexURL := *s3Url
+	indexURL.Path = strings.TrimSuffix(s3Url.Path, "/") + "/index"
+	index, err := newS3IndexStore(&indexURL, creds, proxy.BucketRegion, proxy.s3StoreOptions())
+	if err != nil {
+		proxy.log.Fatal("failed creating s3 index store",
+			zap.Error(err),
+			zap.String("url", indexURL.String()),
+			zap.String("region", proxy.BucketRegion),
+		)
+	}
+
+	proxy.s3Index = budgetedIndex{index, proxy.s3Budget}
+}
+
+// s3IndexStore adds deleting indices to the S3 index store of desync.
+type s3IndexStore struct {
+	desync.S3IndexStore
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3IndexStore(u *url.URL, creds *credentials.Credentials, region string, opts desync.StoreOptions) (s3IndexStore, error) {
+	index, err := desync.NewS3IndexStore(u, creds, region, opts, minio.BucketLookupAuto)
+	if err != nil {
+		return s3IndexStore{}, err
+	}
+
+	client, bucket, prefix, err := newS3Client(u, region)
+	if err != nil {
+		return s3IndexStore{}, err
+	}
+
+	return s3IndexStore{S3IndexStore: index, client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s s3IndexStore) RemoveIndex(name string) error {
+	return s.client.RemoveObject(s.bucket, s.prefix+name)
+}
+
+// s3StoreOptions are used for the S3 bucket and S3 secondaries.
+func (proxy *Proxy) s3StoreOptions() desync.StoreOptions {
+	return desync.StoreOptions{
+		N:                      int(proxy.S3Concurrency),
+		Timeout:                proxy.S3Timeout,
+		ErrorRetry:             int(proxy.S3ErrorRetry),
+		ErrorRetryBaseInterval: proxy.S3ErrorRetryInterval,
+		Uncompressed:           proxy.S3Uncompressed,
+		SkipVerify:             proxy.S3SkipVerify,
+	}
+}
+
+// requireKeys fails unless secret keys were given, only subcommands that
+// don't have to sign can do without.
+func (proxy *Proxy) requireKeys() {
+	if len(proxy.SecretKeyFiles) == 0 {
+		proxy.log.Fatal("--secret-key-files is required")
+	}
 }
 
 func (proxy *Proxy) setupKeys() {
@@ -250,12 +669,22 @@ func (proxy *Proxy) setupDesync() {
 		proxy.setupDir(name)
 	}
 
-	storeDir := filepath.Join(proxy.Dir, "store")
-	narStore, err := desync.NewLocalStore(storeDir, defaultStoreOptions)
-	if err != nil {
-		proxy.log.Fatal("failed creating local store", zap.Error(err), zap.String("dir", storeDir))
+	if proxy.PackChunks {
+		packDir := filepath.Join(proxy.Dir, "packs")
+		packs, err := newPackStore(packDir, packMaxSize)
+		if err != nil {
+			proxy.log.Fatal("failed opening pack store", zap.Error(err), zap.String("dir", packDir))
+		}
+		proxy.localStore = packs
+	} else {
+		storeDir := filepath.Join(proxy.Dir, "store")
+		narStore, err := desync.NewLocalStore(storeDir, defaultStoreOptions)
+		if err != nil {
+			proxy.log.Fatal("failed creating local store", zap.Error(err), zap.String("dir", storeDir))
+		}
+		narStore.UpdateTimes = true
+		proxy.localStore = narStore
 	}
-	narStore.UpdateTimes = true
 
 	indexDir := filepath.Join(proxy.Dir, "index")
 	narIndex, err := desync.NewLocalIndexStore(indexDir)
@@ -263,7 +692,6 @@ func (proxy *Proxy) setupDesync() {
 		proxy.log.Fatal("failed creating local index", zap.Error(err), zap.String("dir", indexDir))
 	}
 
-	proxy.localStore = narStore
 	proxy.localIndex = narIndex
 }
 
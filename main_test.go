@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestS3StoreOptions(t *testing.T) {
+	proxy := testProxy(t)
+
+	opts := proxy.s3StoreOptions()
+	if opts.N != 1 || opts.Timeout != time.Second || opts.ErrorRetry != 0 || opts.Uncompressed {
+		t.Fatalf("unexpected default options %+v", opts)
+	}
+
+	proxy.S3Concurrency = 4
+	proxy.S3ErrorRetry = 3
+	proxy.S3ErrorRetryInterval = 2 * time.Second
+	proxy.S3Uncompressed = true
+	proxy.S3SkipVerify = true
+
+	opts = proxy.s3StoreOptions()
+	if opts.N != 4 || opts.ErrorRetry != 3 || opts.ErrorRetryBaseInterval != 2*time.Second || !opts.Uncompressed || !opts.SkipVerify {
+		t.Fatalf("options not applied: %+v", opts)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+func readTokenFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", errors.Errorf("token file %q is empty", path)
+	}
+	return token, nil
+}
+
+func (proxy *Proxy) setupMetricsToken() {
+	if proxy.MetricsTokenFile == "" {
+		return
+	}
+
+	token, err := readTokenFile(proxy.MetricsTokenFile)
+	if err != nil {
+		proxy.log.Fatal("reading metrics token", zap.Error(err))
+	}
+	proxy.metricsToken = token
+}
+
+// GET /metrics
+// Requires the bearer token from MetricsTokenFile if one is set.
+func (proxy *Proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if proxy.metricsToken != "" {
+		if !hasBearerToken(r, proxy.metricsToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			answer(w, http.StatusUnauthorized, mimeText, "missing or invalid metrics token\n")
+			return
+		}
+	}
+
+	metrics.ServeHTTP(w, r)
+}
+
+// hasBearerToken reports whether the request is authorized with token.
+func hasBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterMetricsToken(t *testing.T) {
+	proxy := testProxy(t)
+	tokenFile := filepath.Join(proxy.Dir, "metrics-token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	proxy.MetricsTokenFile = tokenFile
+	proxy.setupMetricsToken()
+	router := testRouter(proxy)
+
+	apitest.New().
+		Handler(router).
+		Get("/metrics").
+		Expect(t).
+		Header("WWW-Authenticate", `Bearer realm="metrics"`).
+		Status(http.StatusUnauthorized).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get("/metrics").
+		Header("Authorization", "Bearer wrong").
+		Expect(t).
+		Status(http.StatusUnauthorized).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get("/metrics").
+		Header("Authorization", "Bearer s3cret").
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricMirrorFailed   = metrics.MustInteger("spongix_mirror_failed", "Number of store paths the last mirror run couldn't copy")
+	metricMirrorDiverged = metrics.MustInteger("spongix_mirror_diverged", "Number of mirrored store paths whose NarHash differs from the substituters'")
+)
+
+// MirrorCmd copies closures from the substituters into the local store, so
+// they can be served without the substituters, e.g. on an air-gapped site.
+type MirrorCmd struct {
+	WithSources bool     `arg:"--with-sources" help:"Also copy the .drv files and fixed-output sources needed to rebuild the closures"`
+	StorePaths  []string `arg:"positional,required" help:"Store paths or hashes whose closures are copied"`
+}
+
+// mirrorItem is a store path to copy. Only the closures asked for are
+// required, derivations and sources are copied if the substituters have them.
+type mirrorItem struct {
+	hash     string
+	required bool
+}
+
+type mirrorResult struct {
+	Copied          int      `json:"copied"`
+	Skipped         int      `json:"skipped"`
+	MissingOptional int      `json:"missing_optional"`
+	Failed          []string `json:"failed"`
+}
+
+func (proxy *Proxy) runMirror(cmd *MirrorCmd) error {
+	if err := proxy.waitForGC(context.Background()); err != nil {
+		return err
+	}
+
+	result := proxy.mirror(context.Background(), cmd.StorePaths, cmd.WithSources)
+	if len(result.Failed) > 0 {
+		return errors.Errorf("failed mirroring %d store paths", len(result.Failed))
+	}
+	return nil
+}
+
+// mirror copies the closures of the store paths that aren't stored yet. With
+// sources it follows the Deriver of every store path to its .drv, the input
+// derivations and sources of those, and the outputs of fixed-output
+// derivations, which are the source archives a rebuild would download.
+func (proxy *Proxy) mirror(ctx context.Context, storePaths []string, withSources bool) *mirrorResult {
+	queue := []mirrorItem{}
+	for _, storePath := range storePaths {
+		queue = append(queue, mirrorItem{hash: storePathHash(strings.TrimPrefix(storePath, storeDirPrefix)), required: true})
+	}
+
+	seen := map[string]bool{}
+	result := &mirrorResult{Failed: []string{}}
+	enqueue := func(storePath string, required bool) {
+		hash := storePathHash(strings.TrimPrefix(storePath, storeDirPrefix))
+		if validStorePathHash.MatchString(hash) {
+			queue = append(queue, mirrorItem{hash: hash, required: required})
+		}
+	}
+
+	for len(queue) > 0 {
+		item := queue[0]
+		queue = queue[1:]
+
+		// a required path may have been queued as optional before.
+		if required, found := seen[item.hash]; found && (required || !item.required) {
+			continue
+		}
+		seen[item.hash] = item.required
+
+		info, copied, err := proxy.mirrorPath(ctx, item.hash)
+		switch {
+		case err != nil && item.required:
+			proxy.log.Error("mirroring store path", zap.String("hash", item.hash), zap.Error(err))
+			result.Failed = append(result.Failed, item.hash)
+			continue
+		case err != nil:
+			proxy.log.Warn("substituters lack optional store path", zap.String("hash", item.hash), zap.Error(err))
+			result.MissingOptional++
+			continue
+		case copied:
+			result.Copied++
+		default:
+			result.Skipped++
+		}
+
+		for _, ref := range info.References {
+			enqueue(ref, item.required)
+		}
+
+		if !withSources {
+			continue
+		}
+
+		if info.Deriver != "" && info.Deriver != "unknown-deriver" {
+			enqueue(info.Deriver, false)
+		}
+
+		if !strings.HasSuffix(info.StorePath, ".drv") {
+			continue
+		}
+
+		rd, err := proxy.narReader(info.URL)
+		if err != nil {
+			proxy.log.Warn("reading mirrored derivation", zap.String("store_path", info.StorePath), zap.Error(err))
+			continue
+		}
+
+		drv, err := readDerivation(rd)
+		if err != nil {
+			proxy.log.Warn("parsing mirrored derivation", zap.String("store_path", info.StorePath), zap.Error(err))
+			continue
+		}
+
+		for inputDrv := range drv.InputDrvs {
+			enqueue(inputDrv, false)
+		}
+		for _, inputSrc := range drv.InputSrcs {
+			enqueue(inputSrc, false)
+		}
+		for _, output := range drv.Outputs {
+			if output.Hash != "" && output.Path != "" {
+				enqueue(output.Path, false)
+			}
+		}
+	}
+
+	proxy.log.Info("mirrored closures",
+		zap.Int("copied", result.Copied),
+		zap.Int("skipped", result.Skipped),
+		zap.Int("failed", len(result.Failed)),
+		zap.Int("missing_optional", result.MissingOptional))
+
+	return result
+}
+
+// mirrorPath returns the narinfo of the store path, copying it and its NAR
+// from the first substituter that has it unless it's already stored.
+func (proxy *Proxy) mirrorPath(ctx context.Context, hash string) (*narinfo.Narinfo, bool, error) {
+	name := hash + ".narinfo"
+	if info, err := proxy.resolveNarinfo(hash); err == nil && proxy.indexExists(narIndexName(info.URL)) {
+		return info, false, nil
+	}
+
+	substituters := proxy.upstreams.available()
+	if len(substituters) == 0 {
+		return nil, false, errors.New("no substituters available")
+	}
+
+	var lastErr error
+	for _, substituter := range substituters {
+		info, err := proxy.mirrorFrom(ctx, substituter, name)
+		if err == nil {
+			return info, true, nil
+		}
+		lastErr = err
+	}
+	return nil, false, lastErr
+}
+
+// mirrorFrom stores the NAR before the narinfo, so we never serve a narinfo
+// without its NAR.
+func (proxy *Proxy) mirrorFrom(ctx context.Context, substituter *url.URL, name string) (*narinfo.Narinfo, error) {
+	raw, err := mirrorGet(ctx, substituter, name, func(rd io.Reader) ([]byte, error) { return io.ReadAll(rd) })
+	if err != nil {
+		return nil, err
+	}
+
+	info := &narinfo.Narinfo{}
+	if err := info.Unmarshal(bytes.NewReader(raw)); err != nil {
+		return nil, errors.WithMessagef(err, "parsing %s", name)
+	}
+
+	narName := narIndexName(info.URL)
+	if !validIndexName(narName) {
+		return nil, errors.Errorf("invalid NAR URL %q", info.URL)
+	}
+
+	if !proxy.indexExists(narName) {
+		_, err := mirrorGet(ctx, substituter, info.URL, func(rd io.Reader) ([]byte, error) {
+			if isCompressedNar(info.URL) {
+				decompressed, err := decompress(info.URL, rd)
+				if err != nil {
+					return nil, errors.WithMessage(err, "decompressing NAR")
+				}
+				defer decompressed.Close()
+				rd = decompressed
+			}
+			return nil, errors.WithMessage(proxy.storeLocal(narName, rd), "storing NAR")
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body := io.Reader(bytes.NewReader(raw))
+	if proxy.RewriteUpstreamNarinfo {
+		if body, err = proxy.rewriteNarinfo(body); err != nil {
+			return nil, errors.WithMessage(err, "rewriting narinfo")
+		}
+	}
+
+	if err := proxy.storeLocal(name, body); err != nil {
+		return nil, err
+	}
+
+	return proxy.resolveNarinfo(strings.TrimSuffix(name, ".narinfo"))
+}
+
+func mirrorGet(ctx context.Context, substituter *url.URL, path string, read func(io.Reader) ([]byte, error)) ([]byte, error) {
+	u, err := substituter.Parse("/" + path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "parsing URL of %s", path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "creating request")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "getting %s", u)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return nil, errors.Errorf("getting %s: status %d", u, res.StatusCode)
+	}
+
+	return read(res.Body)
+}
+
+// mirrorReport is the outcome of the last scheduled mirror run.
+type mirrorReport struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Roots    int           `json:"roots"`
+	*mirrorResult
+	// store paths whose narinfo on the substituters changed since we copied
+	// it, or which we got from elsewhere.
+	Diverged []string `json:"diverged"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type mirrorStatus struct {
+	mu   sync.Mutex
+	last *mirrorReport
+}
+
+// mirrorOnce copies the closures listed by MirrorList and MirrorHydraEval and
+// checks the listed store paths for divergence from the substituters.
+func (proxy *Proxy) mirrorOnce() {
+	ctx := context.Background()
+	report := &mirrorReport{Time: time.Now(), mirrorResult: &mirrorResult{Failed: []string{}}, Diverged: []string{}}
+
+	roots, err := proxy.mirrorRoots(ctx)
+	if err != nil {
+		proxy.log.Error("listing store paths to mirror", zap.Error(err))
+		report.Error = err.Error()
+	} else {
+		report.Roots = len(roots)
+		report.mirrorResult = proxy.mirror(ctx, roots, proxy.MirrorWithSources)
+		report.Diverged = proxy.mirrorDivergence(ctx, roots)
+	}
+	report.Duration = time.Since(report.Time)
+
+	metricMirrorFailed.Set(int64(len(report.Failed)))
+	metricMirrorDiverged.Set(int64(len(report.Diverged)))
+
+	proxy.mirrored.mu.Lock()
+	proxy.mirrored.last = report
+	proxy.mirrored.mu.Unlock()
+}
+
+func (proxy *Proxy) mirrorRoots(ctx context.Context) ([]string, error) {
+	roots := []string{}
+
+	if proxy.MirrorList != "" {
+		listed, err := readMirrorList(ctx, proxy.MirrorList)
+		if err != nil {
+			return nil, errors.WithMessage(err, "reading mirror list")
+		}
+		roots = append(roots, listed...)
+	}
+
+	if proxy.MirrorHydraEval != "" {
+		outputs, err := hydraEvalOutputs(ctx, proxy.MirrorHydraEval)
+		if err != nil {
+			return nil, errors.WithMessage(err, "getting hydra evaluation")
+		}
+		roots = append(roots, outputs...)
+	}
+
+	return roots, nil
+}
+
+// readMirrorList reads store paths from a file or http(s) URL, one per line.
+// Empty lines and lines starting with # are skipped.
+func readMirrorList(ctx context.Context, source string) ([]string, error) {
+	var rd io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("getting %s: status %d", source, res.StatusCode)
+		}
+		rd = res.Body
+	} else {
+		fd, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		rd = fd
+	}
+
+	paths := []string{}
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+type hydraBuild struct {
+	Finished     int  `json:"finished"`
+	BuildStatus  *int `json:"buildstatus"`
+	BuildOutputs map[string]struct {
+		Path string `json:"path"`
+	} `json:"buildoutputs"`
+}
+
+// hydraEvalOutputs returns the outputs of the successful builds of a hydra
+// evaluation, given by its URL like https://hydra.example.com/eval/123
+func hydraEvalOutputs(ctx context.Context, evalURL string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(evalURL, "/")+"/builds", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mimeJson)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("getting %s: status %d", req.URL, res.StatusCode)
+	}
+
+	builds := []hydraBuild{}
+	if err := json.NewDecoder(res.Body).Decode(&builds); err != nil {
+		return nil, errors.WithMessage(err, "decoding builds")
+	}
+
+	outputs := []string{}
+	for _, build := range builds {
+		if build.Finished != 1 || build.BuildStatus == nil || *build.BuildStatus != 0 {
+			continue
+		}
+		for _, output := range build.BuildOutputs {
+			outputs = append(outputs, output.Path)
+		}
+	}
+	return outputs, nil
+}
+
+// mirrorDivergence returns the hashes of the store paths whose NarHash
+// differs from the one of the first substituter that has them.
+func (proxy *Proxy) mirrorDivergence(ctx context.Context, storePaths []string) []string {
+	diverged := []string{}
+	for _, storePath := range storePaths {
+		hash := storePathHash(strings.TrimPrefix(storePath, storeDirPrefix))
+		local, err := proxy.resolveNarinfo(hash)
+		if err != nil {
+			continue
+		}
+
+		for _, substituter := range proxy.upstreams.available() {
+			raw, err := mirrorGet(ctx, substituter, hash+".narinfo", func(rd io.Reader) ([]byte, error) { return io.ReadAll(rd) })
+			if err != nil {
+				continue
+			}
+
+			upstream := &narinfo.Narinfo{}
+			if err := upstream.Unmarshal(bytes.NewReader(raw)); err != nil {
+				continue
+			}
+
+			if upstream.NarHash != local.NarHash {
+				proxy.log.Warn("mirrored store path diverged",
+					zap.String("store_path", local.StorePath),
+					zap.String("nar_hash", local.NarHash),
+					zap.String("upstream_nar_hash", upstream.NarHash),
+					zap.String("upstream", substituter.String()))
+				diverged = append(diverged, hash)
+			}
+			break
+		}
+	}
+	return diverged
+}
+
+// GET /mirror
+// Returns the report of the last scheduled mirror run.
+func (proxy *Proxy) mirrorReport(w http.ResponseWriter, r *http.Request) {
+	proxy.mirrored.mu.Lock()
+	report := proxy.mirrored.last
+	proxy.mirrored.mu.Unlock()
+
+	if report == nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		proxy.log.Error("encoding mirror report", zap.Error(err))
+	}
+}
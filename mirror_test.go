@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/numtide/go-nix/wire"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestMirror(t *testing.T) {
+	narHash := "sha256:0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7"
+	drvNar := func(drv string) []byte {
+		archive := &bytes.Buffer{}
+		for _, token := range []string{"nix-archive-1", "(", "type", "regular", "contents", drv, ")"} {
+			_ = wire.WriteString(archive, token)
+		}
+		return archive.Bytes()
+	}
+
+	files := map[string][]byte{
+		"/nar/0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz.nar": []byte("hello"),
+		"/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar": drvNar(`Derive([("out","/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello","","")],[("/nix/store/lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5-src.drv",["out"])],["/nix/store/9krlzvny65gdc8s7kpb6lkx8cd02c25b-builder.sh"],"x86_64-linux","/bin/sh",[],[])`),
+		"/nar/0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7.nar": drvNar(`Derive([("out","/nix/store/sbldylj3clbkc0aqvjjzfa6slp4zdvlj-src.tar.gz","sha256","8d99142afd92576f30b0cd7cb42a8dc6809998bc5d607d88761f512e26c7db20")],[],[],"builtin","builtin:fetchurl",[],[])`),
+		"/nar/1111111111111111111111111111111111111111111111111111.nar": []byte("source"),
+	}
+
+	for storePath, info := range map[string]*narinfo.Narinfo{
+		"g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello": {
+			URL:        "nar/0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz.nar",
+			References: []string{"g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello"},
+			Deriver:    "r92m816zcm8v9zjr55lmgy4pdibjbyjp-hello.drv",
+		},
+		"r92m816zcm8v9zjr55lmgy4pdibjbyjp-hello.drv": {
+			URL:        "nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar",
+			References: []string{"lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5-src.drv", "9krlzvny65gdc8s7kpb6lkx8cd02c25b-builder.sh"},
+		},
+		"lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5-src.drv": {
+			URL: "nar/0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7.nar",
+		},
+		"sbldylj3clbkc0aqvjjzfa6slp4zdvlj-src.tar.gz": {
+			URL:     "nar/1111111111111111111111111111111111111111111111111111.nar",
+			Deriver: "lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5-src.drv",
+		},
+	} {
+		info.StorePath = "/nix/store/" + storePath
+		info.Compression = "none"
+		info.FileHash, info.FileSize = narHash, 1
+		info.NarHash, info.NarSize = narHash, 1
+
+		buf := &bytes.Buffer{}
+		if err := info.Marshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		files["/"+storePathHash(storePath)+".narinfo"] = buf.Bytes()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if content, ok := files[r.URL.Path]; ok {
+			_, _ = w.Write(content)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	mirrorProxy := func(t *testing.T) *Proxy {
+		proxy := testProxy(t)
+		proxy.Substituters = []string{srv.URL}
+		proxy.setupUpstreams()
+		return proxy
+	}
+
+	t.Run("closure", func(tt *testing.T) {
+		proxy := mirrorProxy(tt)
+		if result := proxy.mirror(context.Background(), []string{"/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello"}, false); len(result.Failed) != 0 {
+			tt.Fatalf("unexpected result: %+v", result)
+		}
+
+		if !hasIndex(proxy.localIndex, "g2m8kfw7kpgpph05v2fxcx4d5an09hl3.narinfo") ||
+			!hasIndex(proxy.localIndex, "nar/0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz.nar") {
+			tt.Fatal("closure wasn't mirrored")
+		}
+		if hasIndex(proxy.localIndex, "r92m816zcm8v9zjr55lmgy4pdibjbyjp.narinfo") {
+			tt.Fatal("derivation was mirrored without sources")
+		}
+	})
+
+	t.Run("with sources", func(tt *testing.T) {
+		proxy := mirrorProxy(tt)
+		if result := proxy.mirror(context.Background(), []string{"g2m8kfw7kpgpph05v2fxcx4d5an09hl3"}, true); len(result.Failed) != 0 || result.Copied != 4 || result.MissingOptional != 1 {
+			tt.Fatalf("unexpected result: %+v", result)
+		}
+
+		for _, name := range []string{
+			"r92m816zcm8v9zjr55lmgy4pdibjbyjp.narinfo",
+			"lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5.narinfo",
+			"sbldylj3clbkc0aqvjjzfa6slp4zdvlj.narinfo",
+			"nar/1111111111111111111111111111111111111111111111111111.nar",
+		} {
+			if !hasIndex(proxy.localIndex, name) {
+				tt.Fatalf("%s wasn't mirrored", name)
+			}
+		}
+	})
+
+	t.Run("scheduled", func(tt *testing.T) {
+		proxy := mirrorProxy(tt)
+		router := testRouter(proxy)
+
+		proxy.MirrorList = filepath.Join(tt.TempDir(), "mirror-list")
+		if err := os.WriteFile(proxy.MirrorList, []byte("# hello\n/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello\n\n"), 0o644); err != nil {
+			tt.Fatal(err)
+		}
+		proxy.MirrorHydraEval = srv.URL + "/eval/1"
+		files["/eval/1/builds"] = []byte(`[
+			{"finished":1,"buildstatus":0,"buildoutputs":{"out":{"path":"/nix/store/sbldylj3clbkc0aqvjjzfa6slp4zdvlj-src.tar.gz"}}},
+			{"finished":1,"buildstatus":1,"buildoutputs":{"out":{"path":"/nix/store/9krlzvny65gdc8s7kpb6lkx8cd02c25b-builder.sh"}}}
+		]`)
+
+		report := func() mirrorReport {
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, testAdminRequest("GET", "/mirror", nil))
+			if res.Code != http.StatusOK {
+				tt.Fatalf("status %d: %s", res.Code, res.Body)
+			}
+
+			report := mirrorReport{mirrorResult: &mirrorResult{}}
+			if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+				tt.Fatal(err)
+			}
+			return report
+		}
+
+		apitest.New().
+			Handler(router).
+			Get("/mirror").
+			Header("Authorization", "Bearer "+testAdminToken).
+			Expect(tt).
+			Status(http.StatusNotFound).
+			End()
+
+		proxy.mirrorOnce()
+		if r := report(); r.Roots != 2 || r.Copied != 2 || len(r.Failed) != 0 || len(r.Diverged) != 0 || r.Error != "" {
+			tt.Fatalf("unexpected report: %+v", r)
+		}
+
+		// the substituter rebuilt hello with a different result.
+		hello := files["/g2m8kfw7kpgpph05v2fxcx4d5an09hl3.narinfo"]
+		defer func() { files["/g2m8kfw7kpgpph05v2fxcx4d5an09hl3.narinfo"] = hello }()
+		files["/g2m8kfw7kpgpph05v2fxcx4d5an09hl3.narinfo"] = bytes.Replace(hello,
+			[]byte("NarHash: sha256:0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7"),
+			[]byte("NarHash: sha256:1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301"), 1)
+
+		proxy.mirrorOnce()
+		if r := report(); r.Skipped != 2 || len(r.Diverged) != 1 || r.Diverged[0] != "g2m8kfw7kpgpph05v2fxcx4d5an09hl3" {
+			tt.Fatalf("unexpected report: %+v", r)
+		}
+	})
+
+	t.Run("missing", func(tt *testing.T) {
+		proxy := mirrorProxy(tt)
+		if result := proxy.mirror(context.Background(), []string{"9krlzvny65gdc8s7kpb6lkx8cd02c25b"}, true); len(result.Failed) != 1 {
+			tt.Fatalf("expected the missing closure to fail: %+v", result)
+		}
+	})
+}
@@ -19,7 +19,10 @@ in {
       bucketURL = lib.mkOption {
         type = lib.types.nullOr lib.types.str;
         default = null;
-        description = "URL of the S3 Bucket.";
+        description = ''
+          URL of the S3 Bucket. Chunks are kept below it, and indices
+          below index/, where they're looked for after the local ones.
+        '';
         example = "s3+http://127.0.0.1:7745/spongix";
       };
 
@@ -29,6 +32,100 @@ in {
         description = "Region of the S3 bucket. (Also required for Minio)";
       };
 
+      s3Concurrency = lib.mkOption {
+        type = lib.types.ints.positive;
+        default = 1;
+        description = "Number of concurrent operations on S3 stores";
+      };
+
+      s3Timeout = lib.mkOption {
+        type = lib.types.str;
+        default = "1s";
+        description = "Time to wait for S3 objects, negative waits forever";
+      };
+
+      s3ErrorRetry = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = "Number of times failed S3 requests are retried";
+      };
+
+      s3ErrorRetryInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "1s";
+        description = "Time to wait before the first retry of a failed S3 request, multiplied by the attempt for later ones";
+      };
+
+      s3Uncompressed = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = "Store chunks uncompressed in S3";
+      };
+
+      s3SkipVerify = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = "Skip verifying chunks read from S3";
+      };
+
+      s3RequestBudget = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = "Number of S3 requests per hour that background jobs like the hydra import may use up. Requests serving clients are never refused but count towards it. 0 means no limit";
+      };
+
+      hydraBucketURL = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        example = "s3+https://s3.amazonaws.com/hydra-cache";
+        description = ''
+          Bucket hydra uploads its binary cache to. New narinfos and their NARs
+          are imported from it periodically.
+        '';
+      };
+
+      hydraImportInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "1m";
+        description = "Time between imports from the hydra bucket.";
+      };
+
+      mirrorList = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        example = "/etc/spongix/mirror-list";
+        description = ''
+          File or http(s) URL listing store paths, one per line. Their
+          closures are copied from the substituters on a schedule, so they're
+          available when the substituters aren't.
+        '';
+      };
+
+      mirrorHydraEval = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        example = "https://hydra.example.com/eval/123";
+        description = ''
+          Hydra evaluation whose successful build outputs are mirrored like
+          the paths of <option>mirrorList</option>.
+        '';
+      };
+
+      mirrorInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "6h";
+        description = "Time between mirror runs.";
+      };
+
+      mirrorWithSources = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Also mirror the derivations and fixed-output sources of the mirrored
+          closures, to rebuild paths whose binaries are missing.
+        '';
+      };
+
       cacheDir = lib.mkOption {
         type = lib.types.str;
         default = "/var/lib/spongix";
@@ -53,6 +150,73 @@ in {
         '';
       };
 
+      publicListen = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        example = "0.0.0.0:7746";
+        description = ''
+          Serve store paths exported through /exports on this address. Only
+          exported narinfos and their NARs are available there.
+        '';
+      };
+
+      adminListen = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        example = "127.0.0.1:7747";
+        description = ''
+          Serve /metrics and the admin API (jobs, audit, dedup, exports and
+          promotion) only on this localhost address instead of the main port.
+        '';
+      };
+
+      tlsCert = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = "Certificate file to serve HTTPS with";
+      };
+
+      tlsKey = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = "Key file of the TLS certificate";
+      };
+
+      metricsTokenFile = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = ''
+          File containing a token that has to be sent as bearer token to
+          read /metrics.
+        '';
+      };
+
+      adminTokenFile = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = ''
+          File containing a token that has to be sent as bearer token for
+          admin requests on the cache listener, like deletions, seeding,
+          promotion or reading the catalog. Without it they are only
+          available on the admin listener.
+        '';
+      };
+
+      acmeDomains = lib.mkOption {
+        type = lib.types.listOf lib.types.str;
+        default = [];
+        description = ''
+          Obtain certificates for these domains from Let's Encrypt using the
+          TLS-ALPN challenge on the main port. Can't be combined with tlsCert.
+        '';
+      };
+
+      acmeEmail = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = "Contact address for the ACME account";
+      };
+
       secretKeyFiles = lib.mkOption {
         type = lib.types.attrsOf lib.types.str;
         default = {};
@@ -68,8 +232,11 @@ in {
       substituters = lib.mkOption {
         type = lib.types.listOf lib.types.str;
         default = ["https://cache.nixos.org"];
+        example = ["https://mirror.example.com?priority=10&weight=3&concurrency=8" "https://cache.nixos.org"];
         description = ''
-          Remote Nix caches
+          Remote Nix caches. The priority query parameter overrides the one
+          the cache advertises, weight is used by the round-robin policy and
+          concurrency limits the requests in flight to the cache.
         '';
       };
 
@@ -84,6 +251,16 @@ in {
         '';
       };
 
+      rewriteUpstreamNarinfo = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Only serve narinfo from substituters if they are signed by one of the
+          trustedPublicKeys, and sign them with the spongix keys. This way
+          clients only need to trust the spongix keys.
+        '';
+      };
+
       cacheInfoPriority = lib.mkOption {
         type = lib.types.ints.unsigned;
         default = 50;
@@ -92,6 +269,40 @@ in {
         '';
       };
 
+      wantMassQuery = lib.mkOption {
+        type = lib.types.bool;
+        default = true;
+        description = ''
+          Advertise WantMassQuery in /nix-cache-info
+        '';
+      };
+
+      unhealthyPriority = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 1000;
+        description = ''
+          Priority in /nix-cache-info while one of the stores is unhealthy.
+        '';
+      };
+
+      unhealthyUnavailable = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Respond to /nix-cache-info with 503 instead of a low priority while
+          one of the stores is unhealthy.
+        '';
+      };
+
+      healthCacheTTL = lib.mkOption {
+        type = lib.types.str;
+        default = "10s";
+        description = ''
+          Time the store health reported by /readyz and advertised in
+          /nix-cache-info is reused before the stores are probed again.
+        '';
+      };
+
       averageChunkSize = lib.mkOption {
         type = lib.types.ints.between 48 4294967296;
         default = 65536;
@@ -100,6 +311,115 @@ in {
         '';
       };
 
+      assemblerBufferSize = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Initial capacity in bytes of the pooled buffers files are assembled
+          from chunks in. 0 uses the maximum chunk size.
+        '';
+      };
+
+      zstdResponses = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Compress NARs with zstd when the client sends
+          `Accept-Encoding: zstd`.
+        '';
+      };
+
+      compressedCacheSize = lib.mkOption {
+        type = lib.types.int;
+        default = 0;
+        description = ''
+          Number of megabytes of NARs compressed for clients kept on disk, so
+          repeated requests aren't compressed again. 0 disables the cache.
+        '';
+      };
+
+      unknownUploadStatus = lib.mkOption {
+        type = lib.types.enum [ 403 404 ];
+        default = 404;
+        description = ''
+          Status of uploads to paths that take none, answered with a JSON
+          body listing where uploads go.
+        '';
+      };
+
+      narMaxAge = lib.mkOption {
+        type = lib.types.str;
+        default = "8760h";
+        description = ''
+          Max age in the Cache-Control of NARs, which are also marked
+          immutable. 0 sends no-cache.
+        '';
+      };
+
+      narinfoMaxAge = lib.mkOption {
+        type = lib.types.str;
+        default = "1m";
+        description = ''
+          Max age in the Cache-Control of narinfos, they can be replaced or
+          deleted. 0 sends no-cache.
+        '';
+      };
+
+      missMaxAge = lib.mkOption {
+        type = lib.types.str;
+        default = "0";
+        description = ''
+          Max age in the Cache-Control of missing narinfos and NARs. They may
+          be uploaded any moment, so 0 sends no-cache.
+        '';
+      };
+
+      narinfoCompression = lib.mkOption {
+        type = lib.types.nullOr (lib.types.enum [ "xz" "zstd" ]);
+        default = null;
+        description = ''
+          Advertise NARs compressed with this in served narinfos. They're
+          stored uncompressed and compressed while being sent.
+        '';
+      };
+
+      narinfoURLRewrites = lib.mkOption {
+        type = lib.types.listOf lib.types.str;
+        default = [ ];
+        example = [ "nar/=https://cdn.example.com/nar/" ];
+        description = ''
+          prefix=replacement pairs applied to the URL of served narinfos, the
+          first matching prefix wins. Use it to point clients at a CDN.
+        '';
+      };
+
+      narinfoStripDeriver = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Remove the Deriver from served narinfos, it stays stored for
+          /derivations/by-output.
+        '';
+      };
+
+      prefetchLinks = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Announce the NAR and the narinfos of references in
+          `Link: rel=prefetch` headers of narinfo responses.
+        '';
+      };
+
+      prefetchWorkers = lib.mkOption {
+        type = lib.types.int;
+        default = 0;
+        description = ''
+          Number of workers copying the references of served narinfos from
+          the substituters before they're requested, 0 disables prefetching.
+        '';
+      };
+
       cacheSize = lib.mkOption {
         type = lib.types.ints.positive;
         default = 10;
@@ -116,6 +436,21 @@ in {
         '';
       };
 
+      scrubInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "10m";
+        description = ''
+          Time between verifications of chunks written since the last one
+          (fast, only covers recent writes)
+        '';
+      };
+
+      scrubWindow = lib.mkOption {
+        type = lib.types.str;
+        default = "6h";
+        description = "Only writes within this time are verified by scrubbing";
+      };
+
       gcInterval = lib.mkOption {
         type = lib.types.str;
         default = "1h";
@@ -124,6 +459,428 @@ in {
         '';
       };
 
+      gcBatchSize = lib.mkOption {
+        type = lib.types.ints.positive;
+        default = 100000;
+        description = ''
+          Number of chunks the GC walks between saving its progress to
+          gc-state.json. A GC interrupted by a restart continues from there.
+        '';
+      };
+
+      packChunks = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Store local chunks in append-only pack files below packs/ instead of
+          a file per chunk. Packs are compacted after GC.
+        '';
+      };
+
+      accessTimeInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "30s";
+        description = ''
+          Time between writes of the access times of served chunks, which
+          garbage collection evicts the least recently used chunks by.
+          "0" disables tracking them, chunks are evicted by write time then.
+        '';
+      };
+
+      accessTimeBatch = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 100000;
+        description = ''
+          Write access times early once this many chunks are pending.
+        '';
+      };
+
+      dedupAnalysisInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "24h";
+        description = ''
+          Time between analyses of how well chunks are shared per package,
+          available on /dedup/analysis. "0" disables them.
+        '';
+      };
+
+      canaryPercent = lib.mkOption {
+        type = lib.types.ints.between 0 100;
+        default = 0;
+        description = ''
+          Percentage of reads served from the S3 store before the local store.
+          Reads routed this way are compared against the local store and
+          divergences are reported in the metrics. Requires an S3 index
+          store, spongix refuses to start without one.
+        '';
+      };
+
+      maxUploads = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Maximum number of concurrent uploads, 0 means unlimited.
+          Uploads exceeding this limit are rejected with HTTP 429.
+        '';
+      };
+
+      uploadWait = lib.mkOption {
+        type = lib.types.str;
+        default = "5s";
+        description = ''
+          Time an upload may wait for a free slot before it's rejected.
+        '';
+      };
+
+      getRateLimit = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Downloads per second each client may make, 0 means unlimited.
+          Clients are told apart by their token, user or IP, and turned
+          away with HTTP 429 once they exceed the limit.
+        '';
+      };
+
+      getByteRateLimit = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Bytes per second each client may download, 0 means unlimited.
+        '';
+      };
+
+      putRateLimit = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Uploads per second each client may make, 0 means unlimited.
+        '';
+      };
+
+      putByteRateLimit = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Bytes per second each client may upload, 0 means unlimited.
+        '';
+      };
+
+      narinfoCacheSize = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 10000;
+        description = ''
+          Number of narinfo responses kept in memory. Uploads and deletions
+          drop them, "0" disables the cache.
+        '';
+      };
+
+      narinfoCacheTTL = lib.mkOption {
+        type = lib.types.str;
+        default = "10s";
+        description = ''
+          Time narinfo responses are kept in memory.
+        '';
+      };
+
+      artifactHosts = lib.mkOption {
+        type = lib.types.listOf lib.types.str;
+        default = [ ];
+        example = [ "github.com" "codeload.github.com" ];
+        description = ''
+          Hosts whose files are cached below /artifacts/<host>/<path>, for
+          example the tarballs of flake inputs.
+        '';
+      };
+
+      artifactTTL = lib.mkOption {
+        type = lib.types.str;
+        default = "1h";
+        description = ''
+          Time after which a cached artifact is revalidated with its origin.
+        '';
+      };
+
+      artifactStreamSize = lib.mkOption {
+        type = lib.types.int;
+        default = 0;
+        description = ''
+          Artifacts of at least this many bytes are streamed into the bucket as
+          a whole instead of being chunked. Needs bucketURL, 0 disables.
+        '';
+      };
+
+      proxyRoutes = lib.mkOption {
+        type = lib.types.listOf lib.types.str;
+        default = [ ];
+        example = [ "go=https://proxy.golang.org?immutable=@v/.*%5C.(zip|mod|info)$" ];
+        description = ''
+          name=URL pairs whose files are cached below /proxy/<name>/. Paths
+          matching the immutable query parameter are never revalidated, the
+          others after artifactTTL or the ttl query parameter.
+        '';
+      };
+
+      idempotencyTTL = lib.mkOption {
+        type = lib.types.str;
+        default = "24h";
+        description = ''
+          Time the result of an upload with an Idempotency-Key header is
+          kept. Retries with the same key and body get that result instead
+          of storing the upload again. "0" disables this.
+        '';
+      };
+
+      idempotencyMaxSize = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 1024;
+        description = ''
+          Size in megabytes of the largest upload with an Idempotency-Key
+          header. Its body is kept on disk until it's stored, larger ones
+          are rejected with 413.
+        '';
+      };
+
+      upstreamCheckInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "1m";
+        description = ''
+          Time between health checks of the substituters.
+        '';
+      };
+
+      upstreamCooldown = lib.mkOption {
+        type = lib.types.str;
+        default = "1m";
+        description = ''
+          Time a failing substituter is skipped before it's tried again.
+        '';
+      };
+
+      upstreamPolicy = lib.mkOption {
+        type = lib.types.enum ["fastest" "priority" "round-robin"];
+        default = "fastest";
+        description = ''
+          How substituters are asked on a cache miss. fastest asks all of them
+          at once, priority asks them one after the other by priority,
+          round-robin also does but starts with a different one each time.
+        '';
+      };
+
+      upstreamFanout = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Number of substituters the fastest policy asks at once, the next
+          ones are only asked if those miss. 0 asks all of them.
+        '';
+      };
+
+      upstreamConcurrency = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 0;
+        description = ''
+          Number of requests in flight to each substituter, 0 for no limit.
+          The concurrency query parameter of a substituter overrides it.
+        '';
+      };
+
+      leaderURL = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = ''
+          Run as standby that replicates all uploads of the spongix at this
+          URL. Uploads are rejected until the standby is promoted with
+          `POST /replication/promote`.
+        '';
+        example = "http://10.0.0.1:7745";
+      };
+
+      leaderAdminURL = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = ''
+          Admin listener of the leader, if it has one. The upload events used
+          for replication are admin routes.
+        '';
+        example = "http://127.0.0.1:7747";
+      };
+
+      leaderTokenFile = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        description = ''
+          File containing the admin token of the leader, sent as bearer token
+          for its upload events.
+        '';
+      };
+
+      replicationInterval = lib.mkOption {
+        type = lib.types.str;
+        default = "1s";
+        description = ''
+          Time between polls for new uploads on the leader.
+        '';
+      };
+
+      strictReferences = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Reject narinfo uploads if the NAR they point to contains store
+          paths that are not listed in their References.
+        '';
+      };
+
+      allowedDerivers = lib.mkOption {
+        type = lib.types.listOf lib.types.str;
+        default = [];
+        example = ["*-release.drv"];
+        description = ''
+          Only accept narinfo uploads whose Deriver matches one of these glob
+          patterns. Narinfos without a Deriver are matched as an empty name,
+          so they're only accepted by a pattern like "*". Empty accepts all.
+        '';
+      };
+
+      reconcileOnStart = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          After startup, check that narinfos, NARs and chunks of the local
+          store are consistent and move broken indices to the trash, e.g.
+          after a crash.
+        '';
+      };
+
+      verifyNarHash = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Check that the NAR of uploaded narinfos matches their NarHash and
+          NarSize. Mismatches are rejected, or moved to the trash after the
+          upload for NARs larger than narHashSyncLimit.
+        '';
+      };
+
+      narHashSyncLimit = lib.mkOption {
+        type = lib.types.ints.unsigned;
+        default = 64 * 1024 * 1024;
+        description = "NARs up to this many bytes are verified before their narinfo is stored";
+      };
+
+      narinfoHistory = lib.mkOption {
+        type = lib.types.int;
+        default = 10;
+        description = ''
+          Number of previous versions kept for each overwritten narinfo.
+          Set to 0 to disable.
+        '';
+      };
+
+      narinfoHistoryMaxAge = lib.mkOption {
+        type = lib.types.str;
+        default = "720h";
+        description = ''
+          Time after which previous narinfo versions are removed by the GC,
+          "0" keeps them until they exceed narinfoHistory.
+        '';
+      };
+
+      secondaries = lib.mkOption {
+        type = lib.types.listOf lib.types.str;
+        default = [];
+        description = ''
+          URLs of other spongix instances or S3 buckets (s3+https://...) that
+          every stored file is copied to. Pending copies survive restarts.
+        '';
+      };
+
+      readOnly = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Reject all uploads and other requests besides GET and HEAD with
+          405 while still serving and caching downloads, e.g. during a
+          migration or for a public mirror. Only POST /query-missing and
+          POST /verify are still answered.
+        '';
+      };
+
+      uploadStagingTTL = lib.mkOption {
+        type = lib.types.str;
+        default = "1h";
+        description = ''
+          Time after which partial NAR uploads (PUT with Content-Range) that
+          weren't continued are removed.
+        '';
+      };
+
+      maxHops = lib.mkOption {
+        type = lib.types.int;
+        default = 3;
+        description = ''
+          Maximum number of spongix instances a cache miss may pass through
+          before substituters aren't asked anymore, to prevent request loops.
+          Set to 0 to disable.
+        '';
+      };
+
+      verifyThreads = lib.mkOption {
+        type = lib.types.nullOr lib.types.int;
+        default = null;
+        description = ''
+          Number of threads verifying the local store, defaults to the number
+          of CPUs.
+        '';
+      };
+
+      maxJobs = lib.mkOption {
+        type = lib.types.int;
+        default = 1;
+        description = ''
+          Maximum number of background jobs (GC, verification) running at the
+          same time. Setting gcInterval or verifyInterval to "0" disables
+          that job.
+        '';
+      };
+
+      auditLog = lib.mkOption {
+        type = lib.types.nullOr lib.types.str;
+        default = null;
+        example = "/var/lib/spongix/audit.jsonl";
+        description = ''
+          File every upload and other mutation is appended to as JSON line.
+        '';
+      };
+
+      auditLogMaxSize = lib.mkOption {
+        type = lib.types.int;
+        default = 100;
+        description = ''
+          Size in megabytes after which the audit log is rotated to
+          <filename>auditLog.1</filename>.
+        '';
+      };
+
+      auditLogKeep = lib.mkOption {
+        type = lib.types.ints.positive;
+        default = 5;
+        description = ''
+          Number of rotated audit logs kept, older ones are shifted to
+          <filename>auditLog.2</filename> and so on.
+        '';
+      };
+
+      statsRetention = lib.mkOption {
+        type = lib.types.str;
+        default = "720h";
+        description = ''
+          How long the hourly and daily request rollups served at
+          <literal>/stats</literal> are kept. Set to "0" to disable them.
+        '';
+      };
+
       logLevel = lib.mkOption {
         type = lib.types.enum [
           "debug"
@@ -145,6 +902,15 @@ in {
           human readable.
         '';
       };
+
+      skipPreflight = lib.mkOption {
+        type = lib.types.bool;
+        default = false;
+        description = ''
+          Start without first checking that the cache directory, keys, listen
+          addresses and buckets are usable.
+        '';
+      };
     };
   };
 
@@ -157,17 +923,104 @@ in {
       environment = {
         BUCKET_URL = cfg.bucketURL;
         BUCKET_REGION = cfg.bucketRegion;
+        S3_CONCURRENCY = toString cfg.s3Concurrency;
+        S3_TIMEOUT = cfg.s3Timeout;
+        S3_ERROR_RETRY = toString cfg.s3ErrorRetry;
+        S3_ERROR_RETRY_INTERVAL = cfg.s3ErrorRetryInterval;
+        S3_UNCOMPRESSED = lib.boolToString cfg.s3Uncompressed;
+        S3_SKIP_VERIFY = lib.boolToString cfg.s3SkipVerify;
+        S3_REQUEST_BUDGET = toString cfg.s3RequestBudget;
+        HYDRA_BUCKET_URL = cfg.hydraBucketURL;
+        HYDRA_IMPORT_INTERVAL = cfg.hydraImportInterval;
+        MIRROR_LIST = cfg.mirrorList;
+        MIRROR_HYDRA_EVAL = cfg.mirrorHydraEval;
+        MIRROR_INTERVAL = cfg.mirrorInterval;
+        MIRROR_WITH_SOURCES = lib.boolToString cfg.mirrorWithSources;
         CACHE_DIR = cfg.cacheDir;
         LISTEN_ADDR = "${cfg.host}:${toString cfg.port}";
+        PUBLIC_LISTEN = cfg.publicListen;
+        ADMIN_LISTEN = cfg.adminListen;
+        TLS_CERT = cfg.tlsCert;
+        TLS_KEY = cfg.tlsKey;
+        METRICS_TOKEN_FILE = cfg.metricsTokenFile;
+        ADMIN_TOKEN_FILE = cfg.adminTokenFile;
+        ACME_DOMAINS = join cfg.acmeDomains;
+        ACME_EMAIL = cfg.acmeEmail;
         NIX_SUBSTITUTERS = join cfg.substituters;
         NIX_TRUSTED_PUBLIC_KEYS = join cfg.trustedPublicKeys;
+        REWRITE_UPSTREAM_NARINFO = lib.boolToString cfg.rewriteUpstreamNarinfo;
         CACHE_INFO_PRIORITY = toString cfg.cacheInfoPriority;
+        WANT_MASS_QUERY = lib.boolToString cfg.wantMassQuery;
+        UNHEALTHY_PRIORITY = toString cfg.unhealthyPriority;
+        UNHEALTHY_UNAVAILABLE = lib.boolToString cfg.unhealthyUnavailable;
+        HEALTH_CACHE_TTL = cfg.healthCacheTTL;
         AVERAGE_CHUNK_SIZE = toString cfg.averageChunkSize;
+        ASSEMBLER_BUFFER_SIZE = toString cfg.assemblerBufferSize;
+        ZSTD_RESPONSES = lib.boolToString cfg.zstdResponses;
+        COMPRESSED_CACHE_SIZE = toString cfg.compressedCacheSize;
+        UNKNOWN_UPLOAD_STATUS = toString cfg.unknownUploadStatus;
+        NAR_MAX_AGE = cfg.narMaxAge;
+        NARINFO_MAX_AGE = cfg.narinfoMaxAge;
+        MISS_MAX_AGE = cfg.missMaxAge;
+        NARINFO_COMPRESSION = cfg.narinfoCompression;
+        NARINFO_URL_REWRITES = join cfg.narinfoURLRewrites;
+        NARINFO_STRIP_DERIVER = lib.boolToString cfg.narinfoStripDeriver;
+        PREFETCH_LINKS = lib.boolToString cfg.prefetchLinks;
+        PREFETCH_WORKERS = toString cfg.prefetchWorkers;
+        STRICT_REFERENCES = lib.boolToString cfg.strictReferences;
+        ALLOWED_DERIVERS = join cfg.allowedDerivers;
+        RECONCILE_ON_START = lib.boolToString cfg.reconcileOnStart;
+        VERIFY_NAR_HASH = lib.boolToString cfg.verifyNarHash;
+        NAR_HASH_SYNC_LIMIT = toString cfg.narHashSyncLimit;
+        NARINFO_HISTORY = toString cfg.narinfoHistory;
+        NARINFO_HISTORY_MAX_AGE = cfg.narinfoHistoryMaxAge;
         CACHE_SIZE = toString cfg.cacheSize;
         VERIFY_INTERVAL = cfg.verifyInterval;
+        SCRUB_INTERVAL = cfg.scrubInterval;
+        SCRUB_WINDOW = cfg.scrubWindow;
         GC_INTERVAL = cfg.gcInterval;
+        GC_BATCH_SIZE = toString cfg.gcBatchSize;
+        PACK_CHUNKS = lib.boolToString cfg.packChunks;
+        ACCESS_TIME_INTERVAL = cfg.accessTimeInterval;
+        ACCESS_TIME_BATCH = toString cfg.accessTimeBatch;
+        DEDUP_ANALYSIS_INTERVAL = cfg.dedupAnalysisInterval;
+        CANARY_PERCENT = toString cfg.canaryPercent;
+        MAX_UPLOADS = toString cfg.maxUploads;
+        UPLOAD_WAIT = cfg.uploadWait;
+        IDEMPOTENCY_TTL = cfg.idempotencyTTL;
+        IDEMPOTENCY_MAX_SIZE = toString cfg.idempotencyMaxSize;
+        NARINFO_CACHE_SIZE = toString cfg.narinfoCacheSize;
+        NARINFO_CACHE_TTL = cfg.narinfoCacheTTL;
+        ARTIFACT_HOSTS = join cfg.artifactHosts;
+        ARTIFACT_TTL = cfg.artifactTTL;
+        ARTIFACT_STREAM_SIZE = toString cfg.artifactStreamSize;
+        PROXY_ROUTES = join cfg.proxyRoutes;
+        GET_RATE_LIMIT = toString cfg.getRateLimit;
+        GET_BYTE_RATE_LIMIT = toString cfg.getByteRateLimit;
+        PUT_RATE_LIMIT = toString cfg.putRateLimit;
+        PUT_BYTE_RATE_LIMIT = toString cfg.putByteRateLimit;
+        UPSTREAM_CHECK_INTERVAL = cfg.upstreamCheckInterval;
+        UPSTREAM_COOLDOWN = cfg.upstreamCooldown;
+        UPSTREAM_POLICY = cfg.upstreamPolicy;
+        UPSTREAM_FANOUT = toString cfg.upstreamFanout;
+        UPSTREAM_CONCURRENCY = toString cfg.upstreamConcurrency;
+        LEADER_URL = cfg.leaderURL;
+        LEADER_ADMIN_URL = cfg.leaderAdminURL;
+        LEADER_TOKEN_FILE = cfg.leaderTokenFile;
+        REPLICATION_INTERVAL = cfg.replicationInterval;
+        SECONDARIES = join cfg.secondaries;
+        READ_ONLY = lib.boolToString cfg.readOnly;
+        UPLOAD_STAGING_TTL = cfg.uploadStagingTTL;
+        MAX_HOPS = toString cfg.maxHops;
+        VERIFY_THREADS = lib.mapNullable toString cfg.verifyThreads;
+        MAX_JOBS = toString cfg.maxJobs;
+        AUDIT_LOG = cfg.auditLog;
+        AUDIT_LOG_MAX_SIZE = toString cfg.auditLogMaxSize;
+        AUDIT_LOG_KEEP = toString cfg.auditLogKeep;
+        STATS_RETENTION = cfg.statsRetention;
         LOG_LEVEL = cfg.logLevel;
         LOG_MODE = cfg.logMode;
+        SKIP_PREFLIGHT = lib.boolToString cfg.skipPreflight;
       };
 
       script = ''
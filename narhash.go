@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/numtide/go-nix/nixbase32"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricNarHashMismatch    = metrics.MustCounter("spongix_nar_hash_mismatch", "Number of narinfo uploads whose NAR doesn't match NarHash or NarSize")
+	metricNarHashQuarantined = metrics.MustCounter("spongix_nar_hash_quarantined", "Number of narinfos moved to the trash after their NAR failed verification")
+)
+
+// verifyNarHash checks that the NAR has the size and hash the narinfo claims.
+func verifyNarHash(info *narinfo.Narinfo, nar io.Reader) error {
+	hash := sha256.New()
+	size, err := io.Copy(hash, nar)
+	if err != nil {
+		return err
+	}
+
+	if size != info.NarSize {
+		return errors.Errorf("NAR is %d bytes, but NarSize is %d", size, info.NarSize)
+	}
+
+	if actual := "sha256:" + nixbase32.EncodeToString(hash.Sum(nil)); actual != info.NarHash {
+		return errors.Errorf("NAR hash is %s, but NarHash is %s", actual, info.NarHash)
+	}
+
+	return nil
+}
+
+// withNarHashVerification checks the NAR of uploaded narinfos against their
+// NarHash. NARs up to NarHashSyncLimit bytes are verified before the narinfo
+// is stored and mismatches are rejected. Larger ones are verified afterwards,
+// and the narinfo is moved to the trash if they don't match, so it isn't
+// served anymore.
+func (proxy *Proxy) withNarHashVerification() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if !proxy.VerifyNarHash {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			info, err := uploadedNarinfo(r)
+			if err != nil {
+				answer(w, http.StatusBadRequest, mimeText, err.Error())
+				return
+			}
+
+			nar, err := proxy.narReader(info.URL)
+			if err != nil {
+				metricNarHashMismatch.Add(1)
+				answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+				return
+			}
+
+			if info.NarSize > int64(proxy.NarHashSyncLimit) {
+				record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+				h.ServeHTTP(record, r)
+				if record.status/100 == 2 {
+					go proxy.verifyNarHashAsync(mux.Vars(r)["hash"]+".narinfo", info, nar)
+				}
+				return
+			}
+
+			if err := verifyNarHash(info, nar); err != nil {
+				metricNarHashMismatch.Add(1)
+				proxy.log.Warn("rejecting narinfo with mismatching NAR",
+					zap.String("store_path", info.StorePath),
+					zap.Error(err))
+				answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (proxy *Proxy) verifyNarHashAsync(name string, info *narinfo.Narinfo, nar io.Reader) {
+	err := verifyNarHash(info, nar)
+	if err == nil {
+		return
+	}
+
+	metricNarHashMismatch.Add(1)
+	proxy.log.Error("uploaded NAR doesn't match its narinfo",
+		zap.String("store_path", info.StorePath),
+		zap.Error(err))
+
+	if err := proxy.quarantineIndex(name); err != nil {
+		proxy.log.Error("moving narinfo to the trash", zap.String("name", name), zap.Error(err))
+		return
+	}
+	metricNarHashQuarantined.Add(1)
+}
+
+// quarantineIndex moves a local index to the trash, where it can still be
+// inspected.
+func (proxy *Proxy) quarantineIndex(name string) error {
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return errors.New("local index isn't on disk")
+	}
+
+	trash := filepath.Join(proxy.Dir, "trash", "index", filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(trash), 0o755); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(indices.Path, strings.TrimPrefix(name, "/")), trash)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterVerifyNarHash(t *testing.T) {
+	narinfo := strings.NewReplacer(
+		"URL: nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar", "URL: nar/0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz.nar",
+		"NarHash: sha256:1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301", "NarHash: sha256:0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz",
+		"NarSize: 1634360", "NarSize: 120",
+	).Replace(string(testdata[fNarinfo]))
+	// keeps the NAR magic, so the upload isn't rejected before hashing.
+	mismatched := string(narMagic) + strings.ToUpper(string(testdata[fNar][len(narMagic):]))
+
+	for name, tc := range map[string]struct {
+		nar    string
+		status int
+	}{
+		"accepts matching":   {string(testdata[fNar]), http.StatusOK},
+		"rejects mismatched": {mismatched, http.StatusBadRequest},
+	} {
+		t.Run(name, func(tt *testing.T) {
+			proxy := testProxy(tt)
+			proxy.VerifyNarHash = true
+			router := testRouter(proxy)
+
+			apitest.New().
+				Handler(router).
+				Method("PUT").
+				URL(fNar).
+				Body(tc.nar).
+				Expect(tt).
+				Status(http.StatusOK).
+				End()
+
+			apitest.New().
+				Handler(router).
+				Method("PUT").
+				URL(fNarinfo).
+				Body(narinfo).
+				Expect(tt).
+				Status(tc.status).
+				End()
+		})
+	}
+
+	t.Run("quarantines large mismatches", func(tt *testing.T) {
+		proxy := testProxy(tt)
+		proxy.VerifyNarHash = true
+		proxy.NarHashSyncLimit = 0
+		router := testRouter(proxy)
+
+		apitest.New().
+			Handler(router).
+			Method("PUT").
+			URL(fNar).
+			Body(mismatched).
+			Expect(tt).
+			Status(http.StatusOK).
+			End()
+
+		quarantined := metricNarHashQuarantined.Get()
+
+		apitest.New().
+			Handler(router).
+			Method("PUT").
+			URL(fNarinfo).
+			Body(narinfo).
+			Expect(tt).
+			Status(http.StatusOK).
+			End()
+
+		for i := 0; metricNarHashQuarantined.Get() == quarantined; i++ {
+			if i > 100 {
+				tt.Fatal("narinfo wasn't quarantined")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if hasIndex(proxy.localIndex, strings.TrimPrefix(fNarinfo, "/")) {
+			tt.Fatal("expected narinfo to be moved to the trash")
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+)
+
+var (
+	metricNarinfoCacheHits    = metrics.MustCounter("spongix_narinfo_cache_hits", "Number of narinfo requests answered from memory")
+	metricNarinfoCacheMisses  = metrics.MustCounter("spongix_narinfo_cache_misses", "Number of narinfo requests that had to look up the index")
+	metricNarinfoCacheEntries = metrics.MustInteger("spongix_narinfo_cache_entries", "Number of narinfos kept in memory")
+)
+
+// narinfos are a few hundred bytes, anything larger isn't worth keeping.
+const maxCachedNarinfo = 64 * 1024
+
+type narinfoCacheEntry struct {
+	name    string
+	status  int
+	header  http.Header
+	body    []byte
+	hasBody bool
+	expires time.Time
+}
+
+// narinfoCache keeps the responses of recently requested narinfos in memory,
+// so a CI fleet asking for the same stdenv doesn't look up the local and S3
+// indices every time. Only narinfos we have are kept, uploads and deletions
+// drop them, and everything else that changes indices, like the GC, relies on
+// the TTL.
+type narinfoCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newNarinfoCache(max int, ttl time.Duration) *narinfoCache {
+	if max == 0 || ttl == 0 {
+		return nil
+	}
+
+	return &narinfoCache{
+		ttl:     ttl,
+		max:     max,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (proxy *Proxy) setupNarinfoCache() {
+	proxy.narinfoCache = newNarinfoCache(proxy.NarinfoCacheSize, proxy.NarinfoCacheTTL)
+}
+
+func (c *narinfoCache) get(name string, withBody bool) *narinfoCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[name]
+	if !found {
+		return nil
+	}
+
+	entry := elem.Value.(*narinfoCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil
+	} else if withBody && !entry.hasBody {
+		return nil
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *narinfoCache) put(entry *narinfoCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[entry.name]; found {
+		// a HEAD shouldn't replace the body of an earlier GET.
+		if old := elem.Value.(*narinfoCacheEntry); old.hasBody && !entry.hasBody {
+			return
+		}
+		c.remove(elem)
+	}
+
+	c.entries[entry.name] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+	metricNarinfoCacheEntries.Set(int64(c.lru.Len()))
+}
+
+// invalidate drops the narinfo, the name is like the index name.
+func (c *narinfoCache) invalidate(name string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[name]; found {
+		c.remove(elem)
+	}
+}
+
+func (c *narinfoCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*narinfoCacheEntry).name)
+	metricNarinfoCacheEntries.Set(int64(c.lru.Len()))
+}
+
+type narinfoCacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *narinfoCacheRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *narinfoCacheRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.body.Len() <= maxCachedNarinfo {
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (e *narinfoCacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	for key, values := range e.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(e.status)
+	if r.Method == "GET" {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// withNarinfoCache answers GET and HEAD of narinfos from memory. Concurrent
+// misses that go upstream are already coalesced by upstreamFlights.
+// Conditional requests are passed on, the cache handlers answer those.
+func (proxy *Proxy) withNarinfoCache() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		c := proxy.narinfoCache
+		if c == nil {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, err := urlToIndexName(r.URL)
+			if err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			switch r.Method {
+			case "HEAD", "GET":
+			case "PUT":
+				c.invalidate(name)
+				h.ServeHTTP(w, r)
+				c.invalidate(name)
+				return
+			default:
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			withBody := r.Method == "GET"
+			if entry := c.get(name, withBody); entry != nil {
+				metricNarinfoCacheHits.Add(1)
+				entry.serve(w, r)
+				return
+			}
+
+			metricNarinfoCacheMisses.Add(1)
+			before := w.Header().Clone()
+			rec := &narinfoCacheRecorder{ResponseWriter: w}
+			h.ServeHTTP(rec, r)
+
+			// upstream responses are cached by storing them locally.
+			if rec.status != http.StatusOK || w.Header().Get(headerCache) != headerCacheHit || rec.body.Len() > maxCachedNarinfo {
+				return
+			}
+
+			// only the headers of the response, outer handlers set theirs on
+			// every request.
+			header := http.Header{}
+			for key, values := range w.Header() {
+				if !equalStrings(before[key], values) {
+					header[key] = values
+				}
+			}
+
+			c.put(&narinfoCacheEntry{
+				name:    name,
+				status:  rec.status,
+				header:  header,
+				body:    rec.body.Bytes(),
+				hasBody: withBody,
+				expires: time.Now().Add(c.ttl),
+			})
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
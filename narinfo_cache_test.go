@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterNarinfoCache(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	indexPath := filepath.Join(proxy.localIndex.(desync.LocalIndexStore).Path, strings.TrimPrefix(fNarinfo, "/"))
+
+	get := func(tt *testing.T, method string, status int) {
+		apitest.New().
+			Handler(router).
+			Method(method).
+			URL(fNarinfo).
+			Expect(tt).
+			Status(status).
+			End()
+	}
+
+	t.Run("hit", func(tt *testing.T) {
+		hits := metricNarinfoCacheHits.Get()
+		get(tt, "GET", http.StatusOK)
+
+		// only the cache still has it now.
+		if err := os.Remove(indexPath); err != nil {
+			tt.Fatal(err)
+		}
+
+		apitest.New().
+			Handler(router).
+			Get(fNarinfo).
+			Expect(tt).
+			Header(headerCache, headerCacheHit).
+			Header(headerContentType, mimeNarinfo).
+			Body(string(testdata[fNarinfo])).
+			Status(http.StatusOK).
+			End()
+		get(tt, "HEAD", http.StatusOK)
+
+		if got := metricNarinfoCacheHits.Get() - hits; got != 2 {
+			tt.Fatalf("expected 2 hits, got %d", got)
+		}
+	})
+
+	t.Run("put invalidates", func(tt *testing.T) {
+		apitest.New().
+			Handler(router).
+			Put(fNarinfo).
+			Body(string(testdata[fNarinfo])).
+			Expect(tt).
+			Status(http.StatusOK).
+			End()
+
+		hits := metricNarinfoCacheHits.Get()
+		get(tt, "GET", http.StatusOK)
+		if metricNarinfoCacheHits.Get() != hits {
+			tt.Fatal("expected the upload to drop the cached narinfo")
+		}
+	})
+
+	t.Run("delete invalidates", func(tt *testing.T) {
+		apitest.New().
+			Handler(router).
+			Delete(fNarinfo).
+			Header("Authorization", "Bearer "+testAdminToken).
+			Expect(tt).
+			Status(http.StatusOK).
+			End()
+
+		get(tt, "GET", http.StatusNotFound)
+		get(tt, "HEAD", http.StatusNotFound)
+	})
+
+	t.Run("expiry and eviction", func(tt *testing.T) {
+		c := newNarinfoCache(1, time.Minute)
+		c.put(&narinfoCacheEntry{name: "a", hasBody: true, expires: time.Now().Add(-time.Second)})
+		if c.get("a", true) != nil {
+			tt.Fatal("expected an expired entry to be dropped")
+		}
+
+		c.put(&narinfoCacheEntry{name: "a", hasBody: true, expires: time.Now().Add(time.Minute)})
+		c.put(&narinfoCacheEntry{name: "b", expires: time.Now().Add(time.Minute)})
+		if c.get("a", false) != nil {
+			tt.Fatal("expected the least recently used entry to be evicted")
+		} else if c.get("b", false) == nil {
+			tt.Fatal("expected the HEAD result to be kept")
+		} else if c.get("b", true) != nil {
+			tt.Fatal("expected no body for a HEAD result")
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// extensions of the compressions we can advertise, NARs are compressed while
+// they're served.
+var narinfoCompressionExts = map[string]string{
+	"xz":   ".xz",
+	"zstd": ".zst",
+}
+
+type narinfoURLRewrite struct {
+	from, to string
+}
+
+// narinfoPolicy rewrites narinfos as they're served. Stored narinfos keep
+// pointing at the uncompressed NAR with a relative URL and keep their Deriver,
+// so the GC, catalog and derivation lookups work the same with any policy, and
+// changing it applies to everything stored before.
+type narinfoPolicy struct {
+	compression  string
+	urlRewrites  []narinfoURLRewrite
+	stripDeriver bool
+}
+
+func newNarinfoPolicy(compression string, urlRewrites []string, stripDeriver bool) (*narinfoPolicy, error) {
+	if compression != "" {
+		if _, ok := narinfoCompressionExts[compression]; !ok {
+			return nil, errors.Errorf("unsupported narinfo compression %q, use xz or zstd", compression)
+		}
+	}
+
+	policy := &narinfoPolicy{compression: compression, stripDeriver: stripDeriver}
+	for _, raw := range urlRewrites {
+		from, to, ok := strings.Cut(raw, "=")
+		if !ok || from == "" || to == "" {
+			return nil, errors.Errorf("expected <prefix>=<replacement>, got %q", raw)
+		}
+		policy.urlRewrites = append(policy.urlRewrites, narinfoURLRewrite{from: from, to: to})
+	}
+
+	if policy.compression == "" && len(policy.urlRewrites) == 0 && !policy.stripDeriver {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+func (proxy *Proxy) setupNarinfoPolicy() {
+	policy, err := newNarinfoPolicy(proxy.NarinfoCompression, proxy.NarinfoURLRewrites, proxy.NarinfoStripDeriver)
+	if err != nil {
+		proxy.log.Fatal("invalid narinfo policy", zap.Error(err))
+	}
+	proxy.narinfoPolicy = policy
+}
+
+// apply changes the narinfo for clients, signatures stay valid as they only
+// cover the store path, NAR hash, size and references.
+func (p *narinfoPolicy) apply(info *narinfo.Narinfo) {
+	// FileHash and FileSize keep describing the uncompressed NAR, Nix only
+	// checks the NarHash of what it downloaded.
+	if p.compression != "" && info.Compression == "none" && strings.HasSuffix(info.URL, ".nar") {
+		info.URL += narinfoCompressionExts[p.compression]
+		info.Compression = p.compression
+	}
+
+	for _, rewrite := range p.urlRewrites {
+		if strings.HasPrefix(info.URL, rewrite.from) {
+			info.URL = rewrite.to + strings.TrimPrefix(info.URL, rewrite.from)
+			break
+		}
+	}
+
+	if p.stripDeriver {
+		info.Deriver = ""
+	}
+}
+
+// narinfoPolicyRecorder holds back the response, narinfos are small.
+type narinfoPolicyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *narinfoPolicyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *narinfoPolicyRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(p)
+}
+
+// withNarinfoPolicy applies the narinfo policy to every narinfo served, no
+// matter whether it was uploaded or cached from an upstream.
+func (proxy *Proxy) withNarinfoPolicy() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		policy := proxy.narinfoPolicy
+		if policy == nil {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &narinfoPolicyRecorder{ResponseWriter: w}
+			h.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			body := rec.body.Bytes()
+			info := &narinfo.Narinfo{}
+			if rec.status == http.StatusOK && info.Unmarshal(bytes.NewReader(body)) == nil {
+				policy.apply(info)
+				if rd, err := info.ToReader(); err != nil {
+					proxy.log.Error("serializing narinfo", zap.Error(err))
+				} else {
+					buf := &bytes.Buffer{}
+					_, _ = buf.ReadFrom(rd)
+					body = buf.Bytes()
+				}
+			}
+
+			if rec.status == http.StatusOK {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			w.WriteHeader(rec.status)
+			_, _ = w.Write(body)
+		})
+	}
+}
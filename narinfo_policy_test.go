@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterNarinfoPolicy(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.NarinfoCompression = "zstd"
+	proxy.NarinfoURLRewrites = []string{"nar/=https://cdn.example.com/nar/"}
+	proxy.NarinfoStripDeriver = true
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	router := testRouter(proxy)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", fNarinfo, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	} else if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+		t.Fatalf("expected Content-Length %d, got %s", rec.Body.Len(), rec.Header().Get("Content-Length"))
+	}
+
+	info := &narinfo.Narinfo{}
+	if err := info.Unmarshal(rec.Body); err != nil {
+		t.Fatal(err)
+	} else if info.URL != "https://cdn.example.com/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar.zst" {
+		t.Errorf("unexpected URL %q", info.URL)
+	} else if info.Compression != "zstd" {
+		t.Errorf("unexpected Compression %q", info.Compression)
+	} else if info.Deriver != "" {
+		t.Errorf("expected no Deriver, got %q", info.Deriver)
+	} else if valid, _ := info.ValidInvalidSignatures(proxy.trustedKeys); len(valid) != 1 {
+		t.Errorf("expected the signature to stay valid, got %v", info.Sig)
+	}
+
+	// the stored narinfo is unchanged.
+	idx, err := proxy.localIndex.GetIndex(fNarinfo[1:])
+	if err != nil {
+		t.Fatal(err)
+	} else if stored, err := assembleNarinfo(proxy.localStore, idx); err != nil {
+		t.Fatal(err)
+	} else if stored.Deriver == "" || stored.URL != "nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar" {
+		t.Errorf("expected the stored narinfo unchanged, got %+v", stored)
+	}
+
+	// the advertised compression is served.
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", fNar+".zst", nil))
+	dec, err := zstd.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	if nar, err := io.ReadAll(dec); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(nar, testdata[fNar]) {
+		t.Error("expected the zstd compressed NAR")
+	}
+
+	// uploads can't point elsewhere.
+	absolute := strings.Replace(string(testdata[fNarinfo]), "URL: nar/", "URL: https://cdn.example.com/nar/", 1)
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNarinfo).
+		Body(absolute).
+		Expect(t).
+		Body("URL must be relative to the cache, like nar/<hash>.nar\n").
+		Status(http.StatusBadRequest).
+		End()
+
+	if _, err := newNarinfoPolicy("br", nil, false); err == nil {
+		t.Error("expected an error for an unsupported compression")
+	} else if _, err := newNarinfoPolicy("", []string{"nar/"}, false); err == nil {
+		t.Error("expected an error for a rewrite without replacement")
+	} else if policy, err := newNarinfoPolicy("", nil, false); err != nil || policy != nil {
+		t.Errorf("expected no policy without rules, got %v, %v", policy, err)
+	}
+}
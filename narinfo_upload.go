@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+)
+
+// narinfos list their references, but even the biggest closures stay far
+// below this.
+const maxNarinfoSize = 4 * 1024 * 1024
+
+type uploadedNarinfoKey struct{}
+
+// withUploadedNarinfo reads and parses an uploaded narinfo once, so the
+// upload policies and the handler don't have to read the body again.
+func withUploadedNarinfo() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNarinfoSize))
+			if err != nil && len(body) >= maxNarinfoSize {
+				answer(w, http.StatusRequestEntityTooLarge, mimeText, "narinfo is too large\n")
+				return
+			} else if err != nil {
+				answer(w, http.StatusBadRequest, mimeText, "failed reading body\n")
+				return
+			}
+
+			sniffed, err := sniffNarinfo(bytes.NewReader(body))
+			if err != nil {
+				answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+				return
+			}
+
+			info := &narinfo.Narinfo{}
+			if err := info.Unmarshal(sniffed); err != nil {
+				answer(w, http.StatusBadRequest, mimeText, err.Error())
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploadedNarinfoKey{}, info)))
+		})
+	}
+}
+
+// uploadedNarinfo returns the narinfo parsed by withUploadedNarinfo, or
+// parses the body if the request didn't pass it.
+func uploadedNarinfo(r *http.Request) (*narinfo.Narinfo, error) {
+	if info, ok := r.Context().Value(uploadedNarinfoKey{}).(*narinfo.Narinfo); ok {
+		return info, nil
+	}
+
+	return parseNarinfoUpload(io.LimitReader(r.Body, maxNarinfoSize))
+}
+
+func parseNarinfoUpload(rd io.Reader) (*narinfo.Narinfo, error) {
+	body, err := sniffNarinfo(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &narinfo.Narinfo{}
+	if err := info.Unmarshal(body); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
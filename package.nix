@@ -17,26 +17,153 @@
 
       src = inclusive ./. [
         ./testdata
+        ./pkg
         ./go.mod
         ./go.sum
 
+        ./admin_auth.go
+        ./admin_auth_test.go
+        ./artifact.go
+        ./artifact_object.go
+        ./artifact_object_test.go
+        ./artifact_test.go
         ./assemble.go
         ./assemble_test.go
+        ./atime.go
+        ./atime_backfill.go
+        ./atime_backfill_test.go
+        ./atime_test.go
+        ./audit.go
+        ./audit_test.go
         ./blob_manager.go
         ./cache.go
+        ./cache_queue.go
+        ./cache_queue_test.go
+        ./cache_test.go
+        ./cachecontrol.go
+        ./cachecontrol_test.go
+        ./canary.go
+        ./canary_test.go
+        ./catalog.go
+        ./catalog_test.go
+        ./chunkdisk.go
+        ./chunks.go
+        ./chunks_test.go
+        ./compressed_cache.go
+        ./compressed_cache_test.go
+        ./compression.go
+        ./conditional.go
+        ./conditional_test.go
+        ./dedup.go
+        ./dedup_analysis.go
+        ./dedup_analysis_test.go
+        ./dedup_test.go
+        ./delete.go
+        ./delete_test.go
+        ./derivation.go
+        ./derivation_test.go
+        ./deriver.go
+        ./deriver_test.go
         ./docker.go
         ./docker_test.go
+        ./doctor.go
+        ./doctor_test.go
+        ./eventstream.go
+        ./eventstream_test.go
+        ./export.go
+        ./export_test.go
         ./fake.go
+        ./fixtures.go
+        ./fixtures_test.go
+        ./flight.go
+        ./flight_test.go
         ./gc.go
+        ./gc_test.go
+        ./gclock.go
+        ./gclock_test.go
+        ./health.go
+        ./health_test.go
         ./helpers.go
+        ./history.go
+        ./history_test.go
+        ./hydra.go
+        ./hydra_test.go
+        ./idempotency.go
+        ./idempotency_test.go
+        ./jobs.go
+        ./jobs_test.go
+        ./legacy.go
+        ./legacy_test.go
+        ./limiter.go
+        ./limiter_test.go
         ./log_record.go
         ./main.go
+        ./main_test.go
         ./manifest_manager.go
-        ./narinfo.go
-        ./narinfo_test.go
+        ./metrics_auth.go
+        ./metrics_auth_test.go
+        ./mirror.go
+        ./mirror_test.go
+        ./narhash.go
+        ./narhash_test.go
+        ./narinfo_cache.go
+        ./narinfo_cache_test.go
+        ./narinfo_policy.go
+        ./narinfo_policy_test.go
+        ./narinfo_upload.go
+        ./packstore.go
+        ./packstore_test.go
+        ./prefetch.go
+        ./prefetch_test.go
+        ./preflight.go
+        ./preflight_test.go
+        ./proxyroute.go
+        ./proxyroute_test.go
+        ./push.go
+        ./push_test.go
+        ./query.go
+        ./query_test.go
+        ./ratelimit.go
+        ./ratelimit_test.go
+        ./readonly.go
+        ./readonly_test.go
+        ./reconcile.go
+        ./reconcile_test.go
+        ./references.go
+        ./references_test.go
+        ./replication.go
+        ./replication_test.go
+        ./resolve.go
+        ./resolve_test.go
+        ./resumable.go
+        ./resumable_test.go
         ./router.go
         ./router_test.go
+        ./s3budget.go
+        ./s3budget_test.go
+        ./scrub.go
+        ./scrub_test.go
+        ./secondary.go
+        ./secondary_test.go
+        ./seed.go
+        ./seed_test.go
+        ./sniff.go
+        ./sniff_test.go
+        ./stats.go
+        ./stats_test.go
+        ./tls.go
+        ./tls_test.go
+        ./top.go
+        ./top_test.go
+        ./tracing.go
+        ./tracing_test.go
         ./upload_manager.go
+        ./uploadhook.go
+        ./uploadhook_test.go
+        ./upstream.go
+        ./upstream_test.go
+        ./verify.go
+        ./verify_test.go
       ];
 
       proxyVendor = true;
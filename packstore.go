@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricPackCount     = metrics.MustInteger("spongix_pack_count", "Number of pack files the local chunks are stored in")
+	metricPackDeadBytes = metrics.MustInteger("spongix_pack_dead_bytes", "Size of removed chunks and other garbage in pack files")
+	metricPackCompacted = metrics.MustCounter("spongix_pack_compacted", "Number of pack files rewritten by compaction")
+)
+
+// a full pack is sealed and the next one started.
+const packMaxSize = 256 * 1024 * 1024
+
+// packs with more garbage than this portion are compacted after GC.
+const packCompactRatio = 0.5
+
+const (
+	packRecordChunk  = 'c'
+	packRecordRemove = 'r'
+	packRecordTouch  = 't'
+
+	// kind, chunk ID, mtime in unix nanoseconds and data length.
+	packHeaderSize = 1 + 32 + 8 + 4
+)
+
+type packEntry struct {
+	pack   uint32
+	offset int64
+	size   uint32
+	mtime  int64
+}
+
+// packRecord is a record without the chunk data, data is only kept for
+// removals.
+type packRecord struct {
+	kind   byte
+	id     desync.ChunkID
+	mtime  int64
+	size   uint32
+	data   []byte
+	offset int64
+}
+
+// packStore keeps the local chunks in append-only pack files instead of a
+// file per chunk, which runs out of inodes with millions of chunks. A record
+// is either a chunk with its compressed data, the removal of a chunk with the
+// number of the pack holding it as data, or a new access time. A sealed pack
+// gets an index of its records without the chunk data, so starting only has
+// to read the active pack.
+type packStore struct {
+	dir     string
+	maxSize int64
+
+	mu     sync.RWMutex
+	chunks [0x10000]map[desync.ChunkID]packEntry
+	files  map[uint32]*os.File
+	sizes  map[uint32]int64
+	dead   map[uint32]int64
+	active uint32
+	// records of the active pack, written to its index once it's sealed.
+	records []packRecord
+}
+
+func chunkPrefix(id desync.ChunkID) int {
+	return int(id[0])<<8 | int(id[1])
+}
+
+func newPackStore(dir string, maxSize int64) (*packStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &packStore{
+		dir:     dir,
+		maxSize: maxSize,
+		files:   map[uint32]*os.File{},
+		sizes:   map[uint32]int64{},
+		dead:    map[uint32]int64{},
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+
+	packs := []uint32{}
+	for _, match := range matches {
+		n, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(match), ".pack"), 10, 32)
+		if err != nil {
+			continue
+		}
+		packs = append(packs, uint32(n))
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i] < packs[j] })
+
+	for i, pack := range packs {
+		fd, err := os.OpenFile(s.packPath(pack), os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		s.files[pack] = fd
+
+		records, err := s.readIndex(pack)
+		if err != nil {
+			if records, err = s.scan(pack); err != nil {
+				return nil, errors.WithMessagef(err, "loading %s", s.packPath(pack))
+			}
+			// sealed before packs had indices.
+			if i < len(packs)-1 {
+				if err := s.writeIndex(pack, records); err != nil {
+					return nil, errors.WithMessagef(err, "indexing %s", s.packPath(pack))
+				}
+			}
+		}
+
+		for _, record := range records {
+			s.apply(pack, record)
+		}
+		s.active = pack
+		s.records = records
+	}
+
+	if len(packs) == 0 {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.updateMetrics()
+	return s, nil
+}
+
+func (s *packStore) packPath(pack uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.pack", pack))
+}
+
+func (s *packStore) indexPath(pack uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.idx", pack))
+}
+
+// scan reads the records of a pack, skipping the chunk data. A record cut
+// short by a crash is truncated.
+func (s *packStore) scan(pack uint32) ([]packRecord, error) {
+	fd := s.files[pack]
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	rd := bufio.NewReader(fd)
+	header := make([]byte, packHeaderSize)
+	records := []packRecord{}
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(rd, header); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return records, s.truncate(pack, offset)
+		} else if err != nil {
+			return nil, err
+		}
+
+		record := parsePackHeader(header)
+		record.offset = offset + packHeaderSize
+
+		var err error
+		if record.kind == packRecordRemove {
+			record.data = make([]byte, record.size)
+			_, err = io.ReadFull(rd, record.data)
+		} else {
+			_, err = rd.Discard(int(record.size))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, s.truncate(pack, offset)
+		} else if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+		offset = record.offset + int64(record.size)
+	}
+
+	s.sizes[pack] = offset
+	return records, nil
+}
+
+// writeIndex saves the records of a sealed pack next to it, followed by the
+// size of the pack. The pack is synced first, so the index never lists
+// records that aren't on disk.
+func (s *packStore) writeIndex(pack uint32, records []packRecord) error {
+	if err := s.files[pack].Sync(); err != nil {
+		return errors.WithMessage(err, "syncing pack")
+	}
+
+	content := make([]byte, 0, len(records)*packHeaderSize+8)
+	for _, record := range records {
+		content = append(content, record.header()...)
+		if record.kind == packRecordRemove {
+			content = append(content, record.data...)
+		}
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(s.sizes[pack]))
+	content = append(content, size...)
+
+	tmp := s.indexPath(pack) + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(content); err != nil {
+		fd.Close()
+		return err
+	} else if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	} else if err := fd.Close(); err != nil {
+		return err
+	} else if err := os.Rename(tmp, s.indexPath(pack)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// readIndex returns the records of a sealed pack from its index. It fails if
+// there is none, or it doesn't match the pack.
+func (s *packStore) readIndex(pack uint32) ([]packRecord, error) {
+	content, err := os.ReadFile(s.indexPath(pack))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.files[pack].Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) < 8 || int64(binary.BigEndian.Uint64(content[len(content)-8:])) != info.Size() {
+		return nil, errors.New("index doesn't match the pack")
+	}
+	content = content[:len(content)-8]
+
+	records := []packRecord{}
+	offset := int64(0)
+	for len(content) > 0 {
+		if len(content) < packHeaderSize {
+			return nil, errors.New("index is cut short")
+		}
+		record := parsePackHeader(content)
+		record.offset = offset + packHeaderSize
+		content = content[packHeaderSize:]
+
+		if record.kind == packRecordRemove {
+			if len(content) < int(record.size) {
+				return nil, errors.New("index is cut short")
+			}
+			record.data = content[:record.size]
+			content = content[record.size:]
+		}
+
+		records = append(records, record)
+		offset = record.offset + int64(record.size)
+	}
+
+	if offset != info.Size() {
+		return nil, errors.New("index doesn't match the pack")
+	}
+
+	s.sizes[pack] = offset
+	return records, nil
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+func (s *packStore) truncate(pack uint32, offset int64) error {
+	s.sizes[pack] = offset
+	return s.files[pack].Truncate(offset)
+}
+
+func parsePackHeader(header []byte) packRecord {
+	record := packRecord{
+		kind:  header[0],
+		mtime: int64(binary.BigEndian.Uint64(header[33:41])),
+		size:  binary.BigEndian.Uint32(header[41:45]),
+	}
+	copy(record.id[:], header[1:33])
+	return record
+}
+
+func (r packRecord) header() []byte {
+	header := make([]byte, packHeaderSize)
+	header[0] = r.kind
+	copy(header[1:33], r.id[:])
+	binary.BigEndian.PutUint64(header[33:41], uint64(r.mtime))
+	binary.BigEndian.PutUint32(header[41:45], r.size)
+	return header
+}
+
+// apply updates the entries with a record, the caller holds the write lock.
+func (s *packStore) apply(pack uint32, record packRecord) {
+	id := record.id
+	chunks := s.chunks[chunkPrefix(id)]
+	if chunks == nil {
+		chunks = map[desync.ChunkID]packEntry{}
+		s.chunks[chunkPrefix(id)] = chunks
+	}
+	entry, found := chunks[id]
+
+	switch record.kind {
+	case packRecordChunk:
+		if found {
+			s.dead[entry.pack] += packHeaderSize + int64(entry.size)
+		}
+		chunks[id] = packEntry{pack: pack, offset: record.offset, size: record.size, mtime: record.mtime}
+		return
+	case packRecordRemove:
+		if found && len(record.data) == 4 && entry.pack == binary.BigEndian.Uint32(record.data) {
+			s.dead[entry.pack] += packHeaderSize + int64(entry.size)
+			delete(chunks, id)
+		}
+	case packRecordTouch:
+		if found {
+			entry.mtime = record.mtime
+			chunks[id] = entry
+		}
+	}
+
+	s.dead[pack] += packHeaderSize + int64(record.size)
+}
+
+// rotate seals the active pack and starts the next one.
+func (s *packStore) rotate() error {
+	if s.files[s.active] != nil {
+		if err := s.writeIndex(s.active, s.records); err != nil {
+			return errors.WithMessage(err, "indexing pack")
+		}
+	}
+
+	next := s.active + 1
+	fd, err := os.OpenFile(s.packPath(next), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	s.files[next] = fd
+	s.sizes[next] = 0
+	s.active = next
+	s.records = nil
+	return nil
+}
+
+// append writes a record to the active pack and applies it, the caller holds
+// the write lock.
+func (s *packStore) append(kind byte, id desync.ChunkID, mtime time.Time, data []byte) error {
+	size := int64(packHeaderSize + len(data))
+	if s.sizes[s.active] > 0 && s.sizes[s.active]+size > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return errors.WithMessage(err, "starting pack")
+		}
+	}
+
+	offset := s.sizes[s.active]
+	record := packRecord{kind: kind, id: id, mtime: mtime.UnixNano(), size: uint32(len(data)), offset: offset + packHeaderSize}
+	if _, err := s.files[s.active].WriteAt(append(record.header(), data...), offset); err != nil {
+		return errors.WithMessage(err, "writing pack")
+	}
+	s.sizes[s.active] += size
+
+	if kind == packRecordRemove {
+		record.data = data
+	}
+	s.apply(s.active, record)
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *packStore) lookup(id desync.ChunkID) (packEntry, bool) {
+	entry, found := s.chunks[chunkPrefix(id)][id]
+	return entry, found
+}
+
+func (s *packStore) GetChunk(id desync.ChunkID) (*desync.Chunk, error) {
+	s.mu.RLock()
+	entry, found := s.lookup(id)
+	if !found {
+		s.mu.RUnlock()
+		return nil, desync.ChunkMissing{ID: id}
+	}
+	compressed := make([]byte, entry.size)
+	_, err := s.files[entry.pack].ReadAt(compressed, entry.offset)
+	s.mu.RUnlock()
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "reading pack")
+	}
+
+	data, err := desync.Decompress(nil, compressed)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "decompressing chunk %s", id)
+	}
+	return desync.NewChunkWithID(id, data, false)
+}
+
+func (s *packStore) HasChunk(id desync.ChunkID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, found := s.lookup(id)
+	return found, nil
+}
+
+func (s *packStore) StoreChunk(chunk *desync.Chunk) error {
+	data, err := chunk.Data()
+	if err != nil {
+		return err
+	}
+	compressed, err := desync.Compress(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.lookup(chunk.ID()); found {
+		return nil
+	}
+	return s.append(packRecordChunk, chunk.ID(), time.Now(), compressed)
+}
+
+func (s *packStore) RemoveChunk(id desync.ChunkID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, found := s.lookup(id)
+	if !found {
+		return desync.ChunkMissing{ID: id}
+	}
+
+	pack := make([]byte, 4)
+	binary.BigEndian.PutUint32(pack, entry.pack)
+	return s.append(packRecordRemove, id, time.Now(), pack)
+}
+
+func (s *packStore) touch(id desync.ChunkID, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.lookup(id); !found {
+		return os.ErrNotExist
+	}
+	return s.append(packRecordTouch, id, t, nil)
+}
+
+func (s *packStore) modTime(id desync.ChunkID) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, found := s.lookup(id)
+	if !found {
+		return time.Time{}, os.ErrNotExist
+	}
+	return time.Unix(0, entry.mtime), nil
+}
+
+func (s *packStore) chunkDir(prefix int) ([]chunkStat, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chunks := s.chunks[prefix]
+	if len(chunks) == 0 {
+		return nil, false, nil
+	}
+
+	stats := make([]chunkStat, 0, len(chunks))
+	for id, entry := range chunks {
+		stats = append(stats, chunkStat{id: id, size: int64(entry.size), mtime: time.Unix(0, entry.mtime)})
+	}
+	return stats, true, nil
+}
+
+// Verify reads every chunk, and removes invalid ones with repair. Chunks are
+// read one at a time, n is only there to match desync.LocalStore.
+func (s *packStore) Verify(ctx context.Context, n int, repair bool, w io.Writer) error {
+	for prefix := 0; prefix <= 0xffff; prefix++ {
+		stats, _, _ := s.chunkDir(prefix)
+		for _, stat := range stats {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if _, err := s.GetChunk(stat.id); err != nil {
+				fmt.Fprintf(w, "chunk %s invalid: %s\n", stat.id, err)
+				if repair {
+					if err := s.RemoveChunk(stat.id); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// compact rewrites the live chunks of sealed packs that are mostly garbage
+// into the active pack and removes them.
+func (s *packStore) compact() (int, error) {
+	s.mu.RLock()
+	candidates := []uint32{}
+	for pack, size := range s.sizes {
+		if pack != s.active && float64(s.dead[pack]) > float64(size)*packCompactRatio {
+			candidates = append(candidates, pack)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	for i, pack := range candidates {
+		if err := s.compactPack(pack); err != nil {
+			return i, errors.WithMessagef(err, "compacting %s", s.packPath(pack))
+		}
+	}
+
+	s.updateMetrics()
+	return len(candidates), nil
+}
+
+// compactPack holds the write lock while copying, packs are small enough for
+// that to take about a second.
+func (s *packStore) compactPack(pack uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fd := s.files[pack]
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(io.LimitReader(fd, s.sizes[pack]))
+	header := make([]byte, packHeaderSize)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(rd, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		record := parsePackHeader(header)
+		data := make([]byte, record.size)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return err
+		}
+		dataOffset := offset + packHeaderSize
+		offset = dataOffset + int64(record.size)
+
+		switch record.kind {
+		case packRecordChunk:
+			entry, found := s.lookup(record.id)
+			if !found || entry.pack != pack || entry.offset != dataOffset {
+				continue
+			}
+			if err := s.append(packRecordChunk, record.id, time.Unix(0, entry.mtime), data); err != nil {
+				return err
+			}
+		case packRecordRemove:
+			// still needed while the pack with the removed chunk exists.
+			if target := binary.BigEndian.Uint32(data); target != pack && s.files[target] != nil {
+				if err := s.append(packRecordRemove, record.id, time.Unix(0, record.mtime), data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// the copies have to be on disk before the originals are gone.
+	if err := s.files[s.active].Sync(); err != nil {
+		return err
+	}
+
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	delete(s.files, pack)
+	delete(s.sizes, pack)
+	delete(s.dead, pack)
+	metricPackCompacted.Add(1)
+	if err := os.Remove(s.indexPath(pack)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.packPath(pack)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func (s *packStore) updateMetrics() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dead := int64(0)
+	for _, size := range s.dead {
+		dead += size
+	}
+	metricPackCount.Set(int64(len(s.files)))
+	metricPackDeadBytes.Set(dead)
+}
+
+func (s *packStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, fd := range s.files {
+		if err := fd.Sync(); err != nil {
+			return err
+		} else if err := fd.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *packStore) String() string {
+	return s.dir
+}
+
+// compactPacks runs after the GC removed chunks.
+func (proxy *Proxy) compactPacks() {
+	store, ok := proxy.localStore.(*packStore)
+	if !ok {
+		return
+	}
+
+	compacted, err := store.compact()
+	if err != nil {
+		proxy.log.Error("compacting packs", zap.Error(err))
+	}
+	if compacted > 0 {
+		proxy.log.Info("compacted packs", zap.Int("packs", compacted))
+	}
+}
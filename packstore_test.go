@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+func TestPackStore(t *testing.T) {
+	proxy := testProxy(t)
+	dir := filepath.Join(t.TempDir(), "packs")
+	store, err := newPackStore(dir, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.localStore = store
+
+	// random chunks don't compress, so they fill several packs.
+	chunks := []*desync.Chunk{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 1000)
+		rng.Read(data)
+		chunk := desync.NewChunk(data)
+		if err := store.StoreChunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	t.Run("get", func(tt *testing.T) {
+		for _, chunk := range chunks {
+			if c, err := store.GetChunk(chunk.ID()); err != nil {
+				tt.Fatal(err)
+			} else if data, _ := c.Data(); len(data) != 1000 {
+				tt.Fatalf("expected 1000 bytes, got %d", len(data))
+			}
+		}
+		if _, err := store.GetChunk(desync.ChunkID{}); !errors.As(err, &desync.ChunkMissing{}) {
+			tt.Fatalf("expected a missing chunk, got %v", err)
+		}
+	})
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	removed := chunks[0].ID()
+	kept := chunks[len(chunks)-1].ID()
+
+	t.Run("touch and remove", func(tt *testing.T) {
+		if err := store.touch(kept, old); err != nil {
+			tt.Fatal(err)
+		} else if mtime, _ := store.modTime(kept); !mtime.Equal(old) {
+			tt.Fatalf("expected mtime %s, got %s", old, mtime)
+		} else if err := store.RemoveChunk(removed); err != nil {
+			tt.Fatal(err)
+		} else if found, _ := store.HasChunk(removed); found {
+			tt.Fatal("expected the chunk to be removed")
+		}
+	})
+
+	t.Run("reopen", func(tt *testing.T) {
+		if err := store.Close(); err != nil {
+			tt.Fatal(err)
+		}
+		store, err = newPackStore(dir, 4096)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		proxy.localStore = store
+
+		if found, _ := store.HasChunk(removed); found {
+			tt.Fatal("expected the removal to survive a restart")
+		} else if mtime, _ := store.modTime(kept); !mtime.Equal(old) {
+			tt.Fatalf("expected mtime %s after a restart, got %s", old, mtime)
+		}
+	})
+
+	t.Run("indices", func(tt *testing.T) {
+		packs, _ := filepath.Glob(filepath.Join(dir, "*.pack"))
+		indices, _ := filepath.Glob(filepath.Join(dir, "*.idx"))
+		if len(indices) != len(packs)-1 {
+			tt.Fatalf("expected an index for each of the %d sealed packs, got %d", len(packs)-1, len(indices))
+		}
+
+		// an index that doesn't match its pack is ignored.
+		if err := os.WriteFile(indices[0], []byte("garbage"), 0o644); err != nil {
+			tt.Fatal(err)
+		}
+		store.Close()
+		store, err = newPackStore(dir, 4096)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		proxy.localStore = store
+
+		for _, chunk := range chunks[1:] {
+			if found, _ := store.HasChunk(chunk.ID()); !found {
+				tt.Fatalf("expected chunk %s after a restart", chunk.ID())
+			}
+		}
+		if records, err := store.readIndex(1); err != nil || len(records) == 0 {
+			tt.Fatalf("expected the index to be written again, got %v %v", records, err)
+		}
+	})
+
+	t.Run("compact", func(tt *testing.T) {
+		for _, chunk := range chunks[1 : len(chunks)-1] {
+			if err := store.RemoveChunk(chunk.ID()); err != nil {
+				tt.Fatal(err)
+			}
+		}
+		packs, _ := filepath.Glob(filepath.Join(dir, "*.pack"))
+
+		if compacted, err := store.compact(); err != nil {
+			tt.Fatal(err)
+		} else if compacted == 0 {
+			tt.Fatal("expected packs to be compacted")
+		} else if after, _ := filepath.Glob(filepath.Join(dir, "*.pack")); len(after) >= len(packs) {
+			tt.Fatalf("expected fewer than %d packs, got %d", len(packs), len(after))
+		}
+
+		if _, err := store.GetChunk(kept); err != nil {
+			tt.Fatal(err)
+		} else if mtime, _ := store.modTime(kept); !mtime.Equal(old) {
+			tt.Fatalf("expected compaction to keep mtime %s, got %s", old, mtime)
+		}
+
+		store.Close()
+		store, err = newPackStore(dir, 4096)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		proxy.localStore = store
+		if found, _ := store.HasChunk(kept); !found {
+			tt.Fatal("expected the live chunk to survive compaction and a restart")
+		} else if found, _ := store.HasChunk(removed); found {
+			tt.Fatal("expected removed chunks to stay removed")
+		}
+	})
+
+	t.Run("gc", func(tt *testing.T) {
+		// as in TestGCResume, a resumed run already saw a full cache.
+		proxy.CacheSize = 1
+		if err := store.touch(kept, time.Now().Add(-3*time.Hour)); err != nil {
+			tt.Fatal(err)
+		}
+		state := newGCState()
+		state.Started = time.Now().Add(time.Second)
+		state.NextDir = 0x10000
+		state.Sizes[time.Now().Add(-2*time.Hour).Truncate(gcHistogramBucket).Unix()] = 2 << 30
+		if err := state.save(filepath.Join(proxy.Dir, "gc-state.json")); err != nil {
+			tt.Fatal(err)
+		}
+
+		proxy.gcOnce()
+		if found, _ := store.HasChunk(kept); found {
+			tt.Fatal("expected the GC to evict chunks from packs")
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/derivation"
+	"github.com/pkg/errors"
+)
+
+type CatalogEntry struct {
+	Hash      string    `json:"hash"`
+	StorePath string    `json:"store_path"`
+	NarSize   int64     `json:"nar_size"`
+	FileSize  int64     `json:"file_size"`
+	Uploaded  time.Time `json:"uploaded"`
+}
+
+type CatalogPage struct {
+	Entries []CatalogEntry `json:"entries"`
+	// pass as CatalogQuery.After to get the following page, empty on the last.
+	Next string `json:"next,omitempty"`
+}
+
+// CatalogQuery filters the catalog, zero values don't filter.
+type CatalogQuery struct {
+	Name          string
+	MinSize       int64
+	MaxSize       int64
+	UploadedAfter time.Time
+	After         string
+	Limit         int
+}
+
+type StatsRollup struct {
+	Period   string    `json:"period"`
+	Start    time.Time `json:"start"`
+	Kind     string    `json:"kind"`
+	Requests uint64    `json:"requests"`
+	Hits     uint64    `json:"hits"`
+	Remote   uint64    `json:"remote"`
+	Misses   uint64    `json:"misses"`
+	Uploads  uint64    `json:"uploads"`
+	Errors   uint64    `json:"errors"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+}
+
+type Job struct {
+	Name         string        `json:"name"`
+	Interval     time.Duration `json:"interval"`
+	Paused       bool          `json:"paused"`
+	Running      bool          `json:"running"`
+	LastStart    time.Time     `json:"last_start"`
+	LastDuration time.Duration `json:"last_duration"`
+}
+
+type UploadEvent struct {
+	Seq uint64 `json:"seq"`
+	// "upload", or "delete" for deletions.
+	Op   string    `json:"op"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+type Events struct {
+	// pass as since to get the following events.
+	Seq uint64 `json:"seq"`
+	// whether events after since were already dropped.
+	Truncated bool          `json:"truncated"`
+	Events    []UploadEvent `json:"events"`
+}
+
+// Catalog lists a page of the stored narinfos.
+func (c *Client) Catalog(ctx context.Context, q CatalogQuery) (*CatalogPage, error) {
+	params := url.Values{}
+	if q.Name != "" {
+		params.Set("name", q.Name)
+	}
+	if q.MinSize > 0 {
+		params.Set("min_size", strconv.FormatInt(q.MinSize, 10))
+	}
+	if q.MaxSize > 0 {
+		params.Set("max_size", strconv.FormatInt(q.MaxSize, 10))
+	}
+	if !q.UploadedAfter.IsZero() {
+		params.Set("uploaded_after", q.UploadedAfter.Format(time.RFC3339))
+	}
+	if q.After != "" {
+		params.Set("after", q.After)
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	page := &CatalogPage{}
+	if err := c.getJSON(ctx, "catalog?"+params.Encode(), page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Stats returns the hourly or daily request rollups since the given time.
+// An empty kind returns those of narinfos, NARs and OCI objects.
+func (c *Client) Stats(ctx context.Context, period, kind string, since time.Time) ([]StatsRollup, error) {
+	params := url.Values{"period": {period}}
+	if kind != "" {
+		params.Set("kind", kind)
+	}
+	if !since.IsZero() {
+		params.Set("since", since.Format(time.RFC3339))
+	}
+
+	rollups := []StatsRollup{}
+	if err := c.getJSON(ctx, "stats?"+params.Encode(), &rollups); err != nil {
+		return nil, err
+	}
+	return rollups, nil
+}
+
+// Jobs returns the status of the background jobs, ordered by name.
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	jobs := []Job{}
+	if err := c.getJSON(ctx, "jobs", &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// UploadEvents returns the uploads and deletions after the given sequence
+// number, only the most recent ones are kept. It's an admin route.
+func (c *Client) UploadEvents(ctx context.Context, since uint64) (*Events, error) {
+	events := &Events{}
+	if err := c.getJSON(ctx, "replication/events?since="+strconv.FormatUint(since, 10), events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// DeleteNarinfo removes the narinfo of the given store path hash.
+func (c *Client) DeleteNarinfo(ctx context.Context, hash string) error {
+	res, err := c.do(ctx, "DELETE", hash+".narinfo", nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// DeleteNar removes the NAR at the URL given in a narinfo. Its chunks are
+// removed on the next GC unless other NARs use them.
+func (c *Client) DeleteNar(ctx context.Context, narURL string) error {
+	res, err := c.do(ctx, "DELETE", narURL, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Derivation fetches the parsed derivation at the URL given in a narinfo,
+// e.g. nar/<hash>.drv
+func (c *Client) Derivation(ctx context.Context, drvURL string) (*derivation.Derivation, error) {
+	if !strings.HasPrefix(drvURL, "nar/") || !strings.HasSuffix(drvURL, ".drv") {
+		return nil, errors.Errorf("%q isn't the URL of a derivation", drvURL)
+	}
+
+	drv := &derivation.Derivation{}
+	if err := c.getJSON(ctx, "derivations/"+strings.TrimPrefix(drvURL, "nar/"), drv); err != nil {
+		return nil, err
+	}
+	return drv, nil
+}
+
+// DerivationByOutput returns the store path and contents of the .drv that
+// built the store path with the given hash.
+func (c *Client) DerivationByOutput(ctx context.Context, hash string) (string, []byte, error) {
+	res, err := c.do(ctx, "GET", "derivations/by-output/"+hash, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "reading derivation")
+	}
+	return res.Header.Get("X-Derivation-Path"), content, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	res, err := c.do(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return errors.WithMessagef(json.NewDecoder(res.Body).Decode(v), "decoding %s", path)
+}
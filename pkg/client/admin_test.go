@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/assertions"
+)
+
+func TestClientCatalog(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+
+	files["/catalog"] = []byte(`{"entries":[{"hash":"00000000000000000000000000000000","store_path":"/nix/store/00000000000000000000000000000000-some","nar_size":1}],"next":"00000000000000000000000000000000"}`)
+
+	page, err := c.Catalog(context.Background(), CatalogQuery{Name: "some", Limit: 1})
+	a.So(err, assertions.ShouldBeNil)
+	a.So(len(page.Entries), assertions.ShouldEqual, 1)
+	a.So(page.Entries[0].StorePath, assertions.ShouldEqual, "/nix/store/00000000000000000000000000000000-some")
+	a.So(page.Next, assertions.ShouldEqual, "00000000000000000000000000000000")
+}
+
+func TestClientStats(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+	ctx := context.Background()
+
+	_, err := c.Stats(ctx, "day", "", time.Time{})
+	a.So(err, assertions.ShouldEqual, ErrNotFound)
+
+	files["/stats"] = []byte(`[{"period":"day","start":"2022-05-10T00:00:00Z","kind":"nar","requests":3,"hits":2,"misses":1}]`)
+
+	rollups, err := c.Stats(ctx, "day", "nar", time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	a.So(err, assertions.ShouldBeNil)
+	a.So(rollups, assertions.ShouldResemble, []StatsRollup{{
+		Period:   "day",
+		Start:    time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC),
+		Kind:     "nar",
+		Requests: 3,
+		Hits:     2,
+		Misses:   1,
+	}})
+}
+
+func TestClientJobs(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+
+	files["/jobs"] = []byte(`[{"name":"gc","interval":3600000000000,"running":true,"last_start":"2022-05-10T00:00:00Z"}]`)
+
+	jobs, err := c.Jobs(context.Background())
+	a.So(err, assertions.ShouldBeNil)
+	a.So(jobs, assertions.ShouldResemble, []Job{{
+		Name:      "gc",
+		Interval:  time.Hour,
+		Running:   true,
+		LastStart: time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC),
+	}})
+}
+
+func TestClientUploadEvents(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+
+	files["/replication/events"] = []byte(`{"seq":2,"events":[{"seq":2,"path":"/nix/store/00000000000000000000000000000000-some","time":"2022-05-10T00:00:00Z"}]}`)
+
+	events, err := c.UploadEvents(context.Background(), 1)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(events.Seq, assertions.ShouldEqual, 2)
+	a.So(len(events.Events), assertions.ShouldEqual, 1)
+	a.So(events.Events[0].Path, assertions.ShouldEqual, "/nix/store/00000000000000000000000000000000-some")
+}
+
+func TestClientDelete(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+	ctx := context.Background()
+	hash := "00000000000000000000000000000000"
+	narURL := "nar/0000000000000000000000000000000000000000000000000000.nar"
+
+	files["/"+hash+".narinfo"] = []byte(testNarinfo)
+	files["/"+narURL] = []byte("nar")
+
+	a.So(c.DeleteNarinfo(ctx, hash), assertions.ShouldBeNil)
+	a.So(c.DeleteNar(ctx, narURL), assertions.ShouldBeNil)
+	a.So(len(files), assertions.ShouldEqual, 0)
+	a.So(c.DeleteNar(ctx, narURL), assertions.ShouldEqual, ErrNotFound)
+}
+
+func TestClientDerivation(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+	ctx := context.Background()
+	drvURL := "nar/0000000000000000000000000000000000000000000000000000.drv"
+
+	files["/derivations/0000000000000000000000000000000000000000000000000000.drv"] = []byte(`{"outputs":{"out":{"path":"/nix/store/00000000000000000000000000000000-some"}},"system":"x86_64-linux"}`)
+
+	drv, err := c.Derivation(ctx, drvURL)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(drv.System, assertions.ShouldEqual, "x86_64-linux")
+	a.So(drv.Outputs["out"].Path, assertions.ShouldEqual, "/nix/store/00000000000000000000000000000000-some")
+
+	_, err = c.Derivation(ctx, "nar/0000000000000000000000000000000000000000000000000000.nar")
+	a.So(err, assertions.ShouldNotBeNil)
+
+	files["/derivations/by-output/00000000000000000000000000000000"] = []byte("Derive(...)")
+
+	_, content, err := c.DerivationByOutput(ctx, "00000000000000000000000000000000")
+	a.So(err, assertions.ShouldBeNil)
+	a.So(string(content), assertions.ShouldEqual, "Derive(...)")
+}
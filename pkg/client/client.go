@@ -0,0 +1,184 @@
+// Package client talks to the HTTP API of a spongix instance.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when the requested path isn't in the cache.
+var ErrNotFound = errors.New("not found")
+
+// ErrReadOnly is returned when uploading to a read-only cache.
+var ErrReadOnly = errors.New("cache is read-only")
+
+type Client struct {
+	URL        *url.URL
+	HTTPClient *http.Client
+
+	// Token is sent as bearer token if set, otherwise Username and Password
+	// are used for basic auth if set.
+	Token    string
+	Username string
+	Password string
+}
+
+type CacheInfo struct {
+	StoreDir      string
+	WantMassQuery bool
+	Priority      uint64
+}
+
+// New creates a Client for the spongix instance at rawURL, e.g.
+// http://127.0.0.1:7745
+func New(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parsing URL")
+	}
+
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	return &Client{URL: u, HTTPClient: http.DefaultClient}, nil
+}
+
+func (c *Client) NixCacheInfo(ctx context.Context) (*CacheInfo, error) {
+	res, err := c.do(ctx, "GET", "nix-cache-info", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	info := &CacheInfo{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "StoreDir":
+			info.StoreDir = parts[1]
+		case "WantMassQuery":
+			info.WantMassQuery = parts[1] == "1"
+		case "Priority":
+			if info.Priority, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+				return nil, errors.WithMessage(err, "parsing Priority")
+			}
+		}
+	}
+
+	return info, errors.WithMessage(scanner.Err(), "reading nix-cache-info")
+}
+
+// HasNarinfo checks for the narinfo of the given store path hash.
+func (c *Client) HasNarinfo(ctx context.Context, hash string) (bool, error) {
+	res, err := c.do(ctx, "HEAD", hash+".narinfo", nil)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return true, nil
+}
+
+// GetNarinfo fetches and parses the narinfo of the given store path hash.
+func (c *Client) GetNarinfo(ctx context.Context, hash string) (*narinfo.Narinfo, error) {
+	res, err := c.do(ctx, "GET", hash+".narinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	info := &narinfo.Narinfo{}
+	if err := info.Unmarshal(res.Body); err != nil {
+		return nil, errors.WithMessage(err, "parsing narinfo")
+	}
+
+	return info, nil
+}
+
+// PutNarinfo uploads the narinfo for the given store path hash.
+func (c *Client) PutNarinfo(ctx context.Context, hash string, info *narinfo.Narinfo) error {
+	buf := &bytes.Buffer{}
+	if err := info.Marshal(buf); err != nil {
+		return errors.WithMessage(err, "marshaling narinfo")
+	}
+
+	res, err := c.do(ctx, "PUT", hash+".narinfo", buf)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// GetNar returns the NAR at the URL given in a narinfo, e.g. nar/<hash>.nar
+// The caller has to close the returned body.
+func (c *Client) GetNar(ctx context.Context, narURL string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, "GET", narURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// PutNar streams the NAR to the URL given in a narinfo. The body isn't
+// buffered, so it can be of unknown length.
+func (c *Client) PutNar(ctx context.Context, narURL string, body io.Reader) error {
+	res, err := c.do(ctx, "PUT", narURL, body)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	u, err := c.URL.Parse(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, errors.WithMessagef(err, "parsing path %q", path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errors.WithMessage(err, "creating request")
+	}
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "%s %s", method, u)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	case res.StatusCode == http.StatusMethodNotAllowed && (method == "PUT" || method == "DELETE"):
+		res.Body.Close()
+		return nil, ErrReadOnly
+	case res.StatusCode/100 != 2:
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, errors.Errorf("%s %s: status %d: %s", method, u, res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smartystreets/assertions"
+)
+
+const testNarinfo = `StorePath: /nix/store/00000000000000000000000000000000-some
+URL: nar/0000000000000000000000000000000000000000000000000000.nar
+Compression: none
+FileHash: sha256:0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7
+FileSize: 1
+NarHash: sha256:0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7
+NarSize: 1
+`
+
+func testServer(t *testing.T) (*Client, map[string][]byte) {
+	files := map[string][]byte{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+			if r.URL.Path == "/nix-cache-info" {
+				_, _ = w.Write([]byte("StoreDir: /nix/store\nWantMassQuery: 1\nPriority: 50"))
+			} else if content, ok := files[r.URL.Path]; ok {
+				_, _ = w.Write(content)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "PUT":
+			content, _ := io.ReadAll(r.Body)
+			files[r.URL.Path] = content
+		case "DELETE":
+			if _, ok := files[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			delete(files, r.URL.Path)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Token = "secret"
+
+	return c, files
+}
+
+func TestClientNixCacheInfo(t *testing.T) {
+	a := assertions.New(t)
+	c, _ := testServer(t)
+
+	info, err := c.NixCacheInfo(context.Background())
+	a.So(err, assertions.ShouldBeNil)
+	a.So(info, assertions.ShouldResemble, &CacheInfo{StoreDir: "/nix/store", WantMassQuery: true, Priority: 50})
+}
+
+func TestClientNarinfo(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+	ctx := context.Background()
+	hash := "00000000000000000000000000000000"
+
+	found, err := c.HasNarinfo(ctx, hash)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(found, assertions.ShouldBeFalse)
+
+	_, err = c.GetNarinfo(ctx, hash)
+	a.So(err, assertions.ShouldEqual, ErrNotFound)
+
+	files["/"+hash+".narinfo"] = []byte(testNarinfo)
+
+	info, err := c.GetNarinfo(ctx, hash)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(info.StorePath, assertions.ShouldEqual, "/nix/store/00000000000000000000000000000000-some")
+
+	info.Deriver = "r92m816zcm8v9zjr55lmgy4pdibjbyjp-foo.drv"
+	a.So(c.PutNarinfo(ctx, hash, info), assertions.ShouldBeNil)
+	a.So(string(files["/"+hash+".narinfo"]), assertions.ShouldContainSubstring, "Deriver: "+info.Deriver)
+}
+
+func TestClientNar(t *testing.T) {
+	a := assertions.New(t)
+	c, files := testServer(t)
+	ctx := context.Background()
+	narURL := "nar/0000000000000000000000000000000000000000000000000000.nar"
+
+	a.So(c.PutNar(ctx, narURL, io.MultiReader(bytes.NewBufferString("nar"))), assertions.ShouldBeNil)
+	a.So(string(files["/"+narURL]), assertions.ShouldEqual, "nar")
+
+	body, err := c.GetNar(ctx, narURL)
+	a.So(err, assertions.ShouldBeNil)
+	content, err := io.ReadAll(body)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(body.Close(), assertions.ShouldBeNil)
+	a.So(string(content), assertions.ShouldEqual, "nar")
+
+	c.Token = ""
+	_, err = c.GetNar(ctx, narURL)
+	a.So(err, assertions.ShouldNotBeNil)
+}
@@ -0,0 +1,259 @@
+// Package derivation parses the ATerm encoding of Nix .drv files.
+package derivation
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Derivation uses the field names of `nix show-derivation`, so tooling can
+// consume both the same way.
+type Derivation struct {
+	Outputs   map[string]Output   `json:"outputs"`
+	InputDrvs map[string][]string `json:"inputDrvs"`
+	InputSrcs []string            `json:"inputSrcs"`
+	System    string              `json:"system"`
+	Builder   string              `json:"builder"`
+	Args      []string            `json:"args"`
+	Env       map[string]string   `json:"env"`
+}
+
+// Output is empty except for the name for content-addressed derivations that
+// weren't built yet.
+type Output struct {
+	Path     string `json:"path"`
+	HashAlgo string `json:"hashAlgo,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+type parser struct {
+	rd *bufio.Reader
+}
+
+// Unmarshal parses a derivation of the form
+// Derive([outputs],[inputDrvs],[inputSrcs],"system","builder",[args],[env]).
+func (drv *Derivation) Unmarshal(rd io.Reader) error {
+	p := &parser{rd: bufio.NewReader(rd)}
+
+	*drv = Derivation{
+		Outputs:   map[string]Output{},
+		InputDrvs: map[string][]string{},
+		InputSrcs: []string{},
+		Args:      []string{},
+		Env:       map[string]string{},
+	}
+
+	if err := p.expectString("Derive("); err != nil {
+		return err
+	}
+
+	err := p.list(func() error {
+		fields, err := p.strings(4)
+		if err != nil {
+			return errors.WithMessage(err, "parsing output")
+		}
+		drv.Outputs[fields[0]] = Output{Path: fields[1], HashAlgo: fields[2], Hash: fields[3]}
+		return nil
+	})
+	if err != nil {
+		return errors.WithMessage(err, "parsing outputs")
+	}
+
+	if err := p.comma(); err != nil {
+		return err
+	}
+
+	err = p.list(func() error {
+		if err := p.expect('('); err != nil {
+			return err
+		}
+		path, err := p.str()
+		if err != nil {
+			return err
+		}
+		if err := p.comma(); err != nil {
+			return err
+		}
+		outputs, err := p.stringList()
+		if err != nil {
+			return err
+		}
+		drv.InputDrvs[path] = outputs
+		return p.expect(')')
+	})
+	if err != nil {
+		return errors.WithMessage(err, "parsing input derivations")
+	}
+
+	if err := p.comma(); err != nil {
+		return err
+	}
+
+	if drv.InputSrcs, err = p.stringList(); err != nil {
+		return errors.WithMessage(err, "parsing input sources")
+	}
+
+	for _, field := range []*string{&drv.System, &drv.Builder} {
+		if err := p.comma(); err != nil {
+			return err
+		}
+		if *field, err = p.str(); err != nil {
+			return err
+		}
+	}
+
+	if err := p.comma(); err != nil {
+		return err
+	}
+
+	if drv.Args, err = p.stringList(); err != nil {
+		return errors.WithMessage(err, "parsing args")
+	}
+
+	if err := p.comma(); err != nil {
+		return err
+	}
+
+	err = p.list(func() error {
+		pair, err := p.strings(2)
+		if err != nil {
+			return err
+		}
+		drv.Env[pair[0]] = pair[1]
+		return nil
+	})
+	if err != nil {
+		return errors.WithMessage(err, "parsing env")
+	}
+
+	if err := p.expect(')'); err != nil {
+		return err
+	}
+
+	if _, err := p.rd.ReadByte(); err != io.EOF {
+		return errors.New("unexpected data after derivation")
+	}
+
+	return nil
+}
+
+func (p *parser) expect(expected byte) error {
+	c, err := p.rd.ReadByte()
+	if err != nil {
+		return errors.WithMessagef(err, "expected %q", expected)
+	} else if c != expected {
+		return errors.Errorf("expected %q but got %q", expected, c)
+	}
+	return nil
+}
+
+func (p *parser) expectString(expected string) error {
+	for i := 0; i < len(expected); i++ {
+		if err := p.expect(expected[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) comma() error {
+	return p.expect(',')
+}
+
+// list calls item for every element of a list until the closing bracket.
+func (p *parser) list(item func() error) error {
+	if err := p.expect('['); err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		c, err := p.rd.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case c == ']':
+			return nil
+		case i == 0:
+			if err := p.rd.UnreadByte(); err != nil {
+				return err
+			}
+		case c != ',':
+			return errors.Errorf("expected ',' or ']' but got %q", c)
+		}
+
+		if err := item(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	list := []string{}
+	err := p.list(func() error {
+		s, err := p.str()
+		list = append(list, s)
+		return err
+	})
+	return list, err
+}
+
+// strings parses a tuple of n strings.
+func (p *parser) strings(n int) ([]string, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, n)
+	for i := range fields {
+		if i > 0 {
+			if err := p.comma(); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		if fields[i], err = p.str(); err != nil {
+			return nil, err
+		}
+	}
+
+	return fields, p.expect(')')
+}
+
+func (p *parser) str() (string, error) {
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+
+	s := strings.Builder{}
+	for {
+		c, err := p.rd.ReadByte()
+		if err != nil {
+			return "", errors.WithMessage(err, "unterminated string")
+		}
+
+		switch c {
+		case '"':
+			return s.String(), nil
+		case '\\':
+			if c, err = p.rd.ReadByte(); err != nil {
+				return "", errors.WithMessage(err, "unterminated string")
+			}
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			}
+		}
+
+		s.WriteByte(c)
+	}
+}
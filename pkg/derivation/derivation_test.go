@@ -0,0 +1,66 @@
+package derivation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+const helloDrv = `Derive([("out","/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12","","")],` +
+	`[("/nix/store/1mx2xwpgb8dxqsqvm6nbqflqkwklc1xg-bash-5.1-p16.drv",["out"]),("/nix/store/6pj63b323pn53gpw3l5kdh1rly55aj15-stdenv-linux.drv",["dev","out"])],` +
+	`["/nix/store/9krlzvny65gdc8s7kpb6lkx8cd02c25b-default-builder.sh"],` +
+	`"x86_64-linux","/nix/store/1b9p07z77phvv2hf6gm9f28syp39f1ag-bash-5.1-p16/bin/bash",` +
+	`["-e","/nix/store/9krlzvny65gdc8s7kpb6lkx8cd02c25b-default-builder.sh"],` +
+	`[("name","hello-2.12"),("out","/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12"),("script","echo \"hi\"\nexit 0")])`
+
+func TestDerivationUnmarshal(t *testing.T) {
+	v := apitest.DefaultVerifier{}
+
+	drv := &Derivation{}
+	v.NoError(t, drv.Unmarshal(strings.NewReader(helloDrv)))
+
+	v.Equal(t, map[string]Output{"out": {Path: "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12"}}, drv.Outputs)
+	v.Equal(t, map[string][]string{
+		"/nix/store/1mx2xwpgb8dxqsqvm6nbqflqkwklc1xg-bash-5.1-p16.drv": {"out"},
+		"/nix/store/6pj63b323pn53gpw3l5kdh1rly55aj15-stdenv-linux.drv": {"dev", "out"},
+	}, drv.InputDrvs)
+	v.Equal(t, []string{"/nix/store/9krlzvny65gdc8s7kpb6lkx8cd02c25b-default-builder.sh"}, drv.InputSrcs)
+	v.Equal(t, "x86_64-linux", drv.System)
+	v.Equal(t, "/nix/store/1b9p07z77phvv2hf6gm9f28syp39f1ag-bash-5.1-p16/bin/bash", drv.Builder)
+	v.Equal(t, []string{"-e", "/nix/store/9krlzvny65gdc8s7kpb6lkx8cd02c25b-default-builder.sh"}, drv.Args)
+	v.Equal(t, "echo \"hi\"\nexit 0", drv.Env["script"])
+	v.Equal(t, 3, len(drv.Env))
+}
+
+func TestDerivationUnmarshalFixedOutput(t *testing.T) {
+	v := apitest.DefaultVerifier{}
+
+	drv := &Derivation{}
+	v.NoError(t, drv.Unmarshal(strings.NewReader(
+		`Derive([("out","/nix/store/sbldylj3clbkc0aqvjjzfa6slp4zdvlj-src.tar.gz","sha256","8d99142afd92576f30b0cd7cb42a8dc6809998bc5d607d88761f512e26c7db20")],[],[],"builtin","builtin:fetchurl",[],[])`)))
+
+	v.Equal(t, Output{
+		Path:     "/nix/store/sbldylj3clbkc0aqvjjzfa6slp4zdvlj-src.tar.gz",
+		HashAlgo: "sha256",
+		Hash:     "8d99142afd92576f30b0cd7cb42a8dc6809998bc5d607d88761f512e26c7db20",
+	}, drv.Outputs["out"])
+	v.Equal(t, 0, len(drv.InputDrvs))
+	v.Equal(t, []string{}, drv.Args)
+}
+
+func TestDerivationUnmarshalInvalid(t *testing.T) {
+	v := apitest.DefaultVerifier{}
+
+	for _, input := range []string{
+		"",
+		"Derive(",
+		`Derive([("out","/nix/store/x")],[],[],"s","b",[],[])`,
+		`Derive([],[],[],"s","b",[],[("unterminated)])`,
+		`Derive([],[],[],"s","b",[],[]) trailing`,
+		`Derive([],[],["a""b"],"s","b",[],[])`,
+	} {
+		drv := &Derivation{}
+		v.Equal(t, true, drv.Unmarshal(strings.NewReader(input)) != nil)
+	}
+}
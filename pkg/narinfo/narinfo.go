@@ -1,4 +1,6 @@
-package main
+// Package narinfo parses, validates and signs the narinfo files served by Nix
+// binary caches.
+package narinfo
 
 import (
 	"bufio"
@@ -30,49 +32,6 @@ type Narinfo struct {
 	CA          string   `json:"ca"`
 }
 
-/*
-func (proxy *Proxy) validateNarinfo(dir, path string, remove bool) error {
-	info := &Narinfo{}
-	f, err := os.Open(path)
-	if err != nil {
-		proxy.log.Error("Failed to open narinfo", zap.String("path", path), zap.Error(err))
-		return nil
-	}
-
-	if err := info.Unmarshal(f); err != nil {
-		proxy.log.Error("Failed to unmarshal narinfo", zap.String("path", path), zap.Error(err))
-		if remove {
-			os.Remove(path)
-		}
-		return nil
-	}
-
-	narPath := filepath.Join(dir, info.URL)
-	stat, err := os.Stat(narPath)
-	if err != nil {
-		proxy.log.Error("Failed to find NAR", zap.String("nar_path", narPath), zap.String("path", path), zap.Error(err))
-		if remove {
-			os.Remove(path)
-		}
-		return nil
-	}
-
-	ssize := stat.Size()
-
-	if ssize != info.FileSize {
-		log.Printf("%q should be size %d but has %d", narPath, info.FileSize, ssize)
-		proxy.log.Error("NAR has wrong size", zap.String("nar_path", narPath), zap.String("path", path), zap.Int64("expected", info.FileSize), zap.Int64("actual", ssize))
-		if remove {
-			os.Remove(path)
-			os.Remove(narPath)
-		}
-		return nil
-	}
-
-	return nil
-}
-*/
-
 func (info *Narinfo) PrepareForStorage(
 	trustedKeys map[string]ed25519.PublicKey,
 	secretKeys map[string]ed25519.PrivateKey,
@@ -147,6 +106,12 @@ func (info *Narinfo) Marshal(output io.Writer) error {
 		}
 	}
 
+	if info.CA != "" {
+		if err := write("CA: %s\n", info.CA); err != nil {
+			return err
+		}
+	}
+
 	return out.Flush()
 }
 
@@ -258,8 +223,8 @@ var (
 	nixHash           = `[0-9a-df-np-sv-z]`
 	validNixStorePath = regexp.MustCompile(`\A/nix/store/` + nixHash + `{32}-.+\z`)
 	validStorePath    = regexp.MustCompile(`\A` + nixHash + `{32}-.+\z`)
-	validURL          = regexp.MustCompile(`\Anar/` + nixHash + `{52}(\.drv|\.nar(\.(xz|bz2|zst|lzip|lz4|br))?)\z`)
-	validCompression  = regexp.MustCompile(`\A(|none|xz|bzip2|br|zst)\z`)
+	validURL          = regexp.MustCompile(`\A(?:https?://\S+/)?nar/` + nixHash + `{52}(\.drv|\.nar(\.(xz|bz2|zst|lzip|lz4|br))?)\z`)
+	validCompression  = regexp.MustCompile(`\A(|none|xz|bzip2|br|zst|zstd)\z`)
 	validHash         = regexp.MustCompile(`\Asha256:` + nixHash + `{52}\z`)
 	validDeriver      = regexp.MustCompile(`\A` + nixHash + `{32}-.+\.drv\z`)
 )
@@ -1,4 +1,4 @@
-package main
+package narinfo
 
 import (
 	"bytes"
@@ -42,6 +42,24 @@ Deriver: `+validNarinfo.Deriver+`
 `)
 }
 
+func TestNarinfoMarshalCA(t *testing.T) {
+	v := apitest.DefaultVerifier{}
+
+	info := *validNarinfo
+	info.URL = "https://cdn.example.com/nar/0000000000000000000000000000000000000000000000000000.nar.zst"
+	info.Compression = "zstd"
+	info.CA = "fixed:r:sha256:0f54iihf02azn24vm6gky7xxpadq5693qrjzkaavbnd68shvgbd7"
+
+	buf := bytes.Buffer{}
+	v.NoError(t, info.Marshal(&buf))
+
+	parsed := &Narinfo{}
+	v.NoError(t, parsed.Unmarshal(&buf))
+	v.Equal(t, info.CA, parsed.CA)
+	v.Equal(t, info.URL, parsed.URL)
+	v.Equal(t, "zstd", parsed.Compression)
+}
+
 func TestNarinfoValidate(t *testing.T) {
 	v := apitest.DefaultVerifier{}
 
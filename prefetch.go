@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var (
+	metricPrefetchQueued  = metrics.MustInteger("spongix_prefetch_queued", "Number of referenced store paths waiting to be prefetched")
+	metricPrefetchDropped = metrics.MustCounter("spongix_prefetch_dropped", "Number of referenced store paths not prefetched because the queue was full")
+	metricPrefetchCopied  = metrics.MustCounter("spongix_prefetch_copied", "Number of referenced store paths copied from the substituters before they were requested")
+	metricPrefetchFailed  = metrics.MustCounter("spongix_prefetch_failed", "Number of referenced store paths no substituter had or that failed to copy")
+)
+
+// upper bound of reference narinfos announced per response, so closures with
+// many references don't blow up the response headers.
+const maxPrefetchLinks = 64
+
+// setPrefetchLinks announces the NAR and the narinfos of the references of a
+// narinfo with RFC 8288 Link headers, so clients and CDNs can fetch them
+// before they're asked for.
+func setPrefetchLinks(header http.Header, narinfoPath string, info *narinfo.Narinfo) {
+	dir := path.Dir(narinfoPath)
+	self := strings.TrimSuffix(path.Base(narinfoPath), ".narinfo")
+
+	if strings.HasPrefix(info.URL, "http://") || strings.HasPrefix(info.URL, "https://") {
+		header.Add("Link", "<"+info.URL+">; rel=prefetch")
+	} else if info.URL != "" {
+		header.Add("Link", "<"+path.Join(dir, info.URL)+">; rel=prefetch")
+	}
+
+	links := 0
+	for _, ref := range info.References {
+		hash := storePathHash(ref)
+		if hash == self || !validStorePathHash.MatchString(hash) {
+			continue
+		}
+
+		if links >= maxPrefetchLinks {
+			break
+		}
+		links++
+
+		header.Add("Link", "<"+path.Join(dir, hash+".narinfo")+">; rel=prefetch")
+	}
+}
+
+// referenced store paths waiting for a prefetch worker, further ones are
+// dropped until the workers caught up.
+const prefetchQueueSize = 1000
+
+// narinfos larger than this aren't looked at for references to prefetch.
+const maxPrefetchNarinfo = 1 << 20
+
+// prefetchQueue holds the hashes of store paths referenced by served narinfos.
+// Like the cacheQueue it's best effort, a path that was dropped is copied
+// once it's requested.
+type prefetchQueue struct {
+	ch      chan string
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+func newPrefetchQueue(size int) *prefetchQueue {
+	return &prefetchQueue{
+		ch:      make(chan string, size),
+		pending: map[string]struct{}{},
+	}
+}
+
+func (q *prefetchQueue) enqueue(hash string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, found := q.pending[hash]; found {
+		return
+	}
+
+	select {
+	case q.ch <- hash:
+		q.pending[hash] = yes
+		metricPrefetchQueued.Set(int64(len(q.pending)))
+	default:
+		metricPrefetchDropped.Add(1)
+	}
+}
+
+func (q *prefetchQueue) finish(hash string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, hash)
+	metricPrefetchQueued.Set(int64(len(q.pending)))
+}
+
+// startPrefetch starts the workers copying referenced store paths, so the
+// number of concurrent copies stays bounded no matter how many narinfos are
+// served.
+func (proxy *Proxy) startPrefetch() {
+	for i := 0; i < proxy.PrefetchWorkers; i++ {
+		go func() {
+			for hash := range proxy.prefetch.ch {
+				proxy.prefetchPath(hash)
+				proxy.prefetch.finish(hash)
+			}
+		}()
+	}
+}
+
+// prefetchPath copies the narinfo and NAR of the store path from the
+// substituters like the mirror does, unless one of the stores has it already.
+func (proxy *Proxy) prefetchPath(hash string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	if _, copied, err := proxy.mirrorPath(ctx, hash); err != nil {
+		metricPrefetchFailed.Add(1)
+		// references missing upstream are common, like those of paths
+		// built locally.
+		proxy.log.Debug("prefetching reference", zap.String("hash", hash), zap.Error(err))
+	} else if copied {
+		metricPrefetchCopied.Add(1)
+	}
+}
+
+// prefetchRecorder keeps a copy of the narinfo while it's sent.
+type prefetchRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *prefetchRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *prefetchRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.body.Len()+len(p) > maxPrefetchNarinfo {
+		r.overflow = true
+	} else if !r.overflow {
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// withReferencePrefetch queues the references of every narinfo served, as
+// Nix asks for them right after. They're copied in the background, the
+// response doesn't wait for it.
+func (proxy *Proxy) withReferencePrefetch() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if proxy.PrefetchWorkers <= 0 {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &prefetchRecorder{ResponseWriter: w}
+			h.ServeHTTP(rec, r)
+			if rec.status != http.StatusOK || rec.overflow {
+				return
+			}
+
+			info := &narinfo.Narinfo{}
+			if err := info.Unmarshal(bytes.NewReader(rec.body.Bytes())); err != nil {
+				return
+			}
+
+			self := strings.TrimSuffix(path.Base(r.URL.Path), ".narinfo")
+			for _, ref := range info.References {
+				if hash := storePathHash(ref); hash != self && validStorePathHash.MatchString(hash) {
+					proxy.prefetch.enqueue(hash)
+				}
+			}
+		})
+	}
+}
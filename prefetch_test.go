@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterPrefetchLinks(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.PrefetchLinks = true
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+
+	res := httptest.NewRecorder()
+	testRouter(proxy).ServeHTTP(res, httptest.NewRequest("GET", "/cache"+fNarinfo, nil))
+
+	// the narinfo references itself, which isn't announced.
+	links := res.Header().Values("Link")
+	expected := []string{
+		`</8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5.narinfo>; rel="successor-version"`,
+		`</cache/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar>; rel=prefetch`,
+	}
+	if res.Code != http.StatusOK || strings.Join(links, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected links: %d %q", res.Code, links)
+	}
+
+	info := &narinfo.Narinfo{URL: "nar/x.nar", References: []string{"8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-a", "0m8sd5qbmvfhyamwfv3af1ff18ykywf3-b"}}
+	header := http.Header{}
+	setPrefetchLinks(header, fNarinfo, info)
+	if links := header.Values("Link"); len(links) != 2 || links[1] != `</0m8sd5qbmvfhyamwfv3af1ff18ykywf3.narinfo>; rel=prefetch` {
+		t.Fatalf("unexpected links: %q", links)
+	}
+
+	info.URL = "https://example.com/nar/x.nar"
+	header = http.Header{}
+	setPrefetchLinks(header, fNarinfo, info)
+	if links := header.Values("Link"); len(links) != 2 || links[0] != `<https://example.com/nar/x.nar>; rel=prefetch` {
+		t.Fatalf("unexpected links: %q", links)
+	}
+}
+
+func TestRouterReferencePrefetch(t *testing.T) {
+	narURL := "/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fNarinfo:
+			_, _ = w.Write(testdata[fNarinfo])
+		case narURL:
+			_, _ = w.Write(testdata[fNar])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	proxy := testProxy(t)
+	proxy.Substituters = []string{upstream.URL}
+	proxy.PrefetchWorkers = 1
+	router := testRouter(proxy)
+	proxy.startPrefetch()
+
+	info := &narinfo.Narinfo{
+		StorePath:   "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello",
+		URL:         "nar/0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz.nar",
+		Compression: "none",
+		FileHash:    "sha256:0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz",
+		FileSize:    1,
+		NarHash:     "sha256:0m8sd5qbmvfhyamwfv3af1ff18ykywf3zx5qwawhhp3jv1h777xz",
+		NarSize:     1,
+		References: []string{
+			"g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello",
+			"8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10",
+			"lr1d6vb4dlxsxv7ayk7vmmdr6f5gyqf5-missing",
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := info.Marshal(buf); err != nil {
+		t.Fatal(err)
+	} else if err := proxy.storeLocal("g2m8kfw7kpgpph05v2fxcx4d5an09hl3.narinfo", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, failed := metricPrefetchCopied.Get(), metricPrefetchFailed.Get()
+
+	apitest.New().
+		Handler(router).
+		Get("/g2m8kfw7kpgpph05v2fxcx4d5an09hl3.narinfo").
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Status(http.StatusOK).
+		End()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for metricPrefetchCopied.Get() < copied+1 || metricPrefetchFailed.Get() < failed+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("references weren't prefetched: %d copied, %d failed", metricPrefetchCopied.Get()-copied, metricPrefetchFailed.Get()-failed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the upstream is gone, so these can only come from the local store.
+	upstream.Close()
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Body(string(testdata[fNarinfo])).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get(narURL).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Status(http.StatusOK).
+		End()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	minio "github.com/minio/minio-go/v6"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// preflightCheck is something we need to run. All of them are checked before
+// setting anything up, so every problem is reported at once.
+type preflightCheck struct {
+	name string
+	hint string
+	run  func() error
+}
+
+type preflightFailure struct {
+	check preflightCheck
+	err   error
+}
+
+func runPreflight(checks []preflightCheck) []preflightFailure {
+	failures := []preflightFailure{}
+	for _, check := range checks {
+		if err := check.run(); err != nil {
+			failures = append(failures, preflightFailure{check: check, err: err})
+		}
+	}
+	return failures
+}
+
+func (proxy *Proxy) preflightChecks() []preflightCheck {
+	checks := []preflightCheck{{
+		name: "cache directory " + proxy.Dir,
+		hint: "create it or set --dir to a directory spongix may write to",
+		run:  func() error { return checkWritableDir(proxy.Dir) },
+	}}
+
+	for _, path := range proxy.SecretKeyFiles {
+		path := path
+		checks = append(checks, preflightCheck{
+			name: "secret key file " + path,
+			hint: "generate one with nix-store --generate-binary-cache-key and make it readable",
+			run: func() error {
+				_, err := loadNixPrivateKeys([]string{path})
+				return err
+			},
+		})
+	}
+
+	if proxy.TLSCert != "" && proxy.TLSKey != "" {
+		checks = append(checks, preflightCheck{
+			name: "TLS certificate " + proxy.TLSCert,
+			hint: "check that the certificate and key are readable PEM files that belong together",
+			run: func() error {
+				_, err := tls.LoadX509KeyPair(proxy.TLSCert, proxy.TLSKey)
+				return err
+			},
+		})
+	}
+
+	if proxy.MetricsTokenFile != "" {
+		checks = append(checks, preflightCheck{
+			name: "metrics token file " + proxy.MetricsTokenFile,
+			hint: "make it readable and put the token your scraper sends in it",
+			run: func() error {
+				_, err := readTokenFile(proxy.MetricsTokenFile)
+				return err
+			},
+		})
+	}
+
+	if proxy.AdminTokenFile != "" {
+		checks = append(checks, preflightCheck{
+			name: "admin token file " + proxy.AdminTokenFile,
+			hint: "make it readable and put the token admin clients send in it",
+			run: func() error {
+				_, err := readTokenFile(proxy.AdminTokenFile)
+				return err
+			},
+		})
+	}
+
+	for _, listen := range []string{proxy.Listen, proxy.PublicListen, proxy.AdminListen} {
+		if listen == "" {
+			continue
+		}
+		listen := listen
+		checks = append(checks, preflightCheck{
+			name: "listen address " + listen,
+			hint: "stop whatever uses the port or listen on another address",
+			run:  func() error { return checkListen(listen) },
+		})
+	}
+
+	s3Hint := "check the URL, the region and that the credentials in MINIO_ACCESS_KEY/AWS_ACCESS_KEY_ID may put, get and delete objects"
+	if proxy.BucketURL != "" && proxy.BucketRegion != "" {
+		checks = append(checks, preflightCheck{
+			name: "bucket " + redactURL(proxy.BucketURL),
+			hint: s3Hint,
+			run:  func() error { return checkS3Bucket(proxy.BucketURL, proxy.BucketRegion, true) },
+		})
+	}
+
+	for _, raw := range proxy.Secondaries {
+		if !strings.HasPrefix(raw, "s3+") {
+			continue
+		}
+		raw := raw
+		checks = append(checks, preflightCheck{
+			name: "secondary " + redactURL(raw),
+			hint: s3Hint,
+			run:  func() error { return checkS3Bucket(raw, proxy.BucketRegion, true) },
+		})
+	}
+
+	if proxy.HydraBucketURL != "" {
+		checks = append(checks, preflightCheck{
+			name: "hydra bucket " + redactURL(proxy.HydraBucketURL),
+			hint: "check the URL, the region and that the credentials may list and get objects",
+			run:  func() error { return checkS3Bucket(proxy.HydraBucketURL, proxy.BucketRegion, false) },
+		})
+	}
+
+	return checks
+}
+
+// preflight logs every failed check and exits if there were any.
+func (proxy *Proxy) preflight() {
+	failures := runPreflight(proxy.preflightChecks())
+	for _, failure := range failures {
+		proxy.log.Error("preflight check failed",
+			zap.String("check", failure.check.name),
+			zap.Error(failure.err),
+			zap.String("hint", failure.check.hint))
+	}
+
+	if len(failures) > 0 {
+		proxy.log.Fatal("preflight checks failed, see above", zap.Int("failed", len(failures)))
+	}
+}
+
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	fd, err := os.CreateTemp(dir, ".preflight")
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
+
+func checkListen(listen string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// checkS3Bucket writes, reads and deletes a probe object, or only lists the
+// bucket if we never write to it.
+func checkS3Bucket(raw, region string, write bool) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	client, bucket, prefix, err := newS3Client(u, region)
+	if err != nil {
+		return err
+	}
+
+	if !write {
+		done := make(chan struct{})
+		defer close(done)
+		for object := range client.ListObjectsV2(bucket, prefix, false, done) {
+			return object.Err
+		}
+		return nil
+	}
+
+	key := prefix + ".spongix-preflight-" + randomHex(8)
+	probe := []byte("spongix preflight\n")
+
+	if _, err := client.PutObject(bucket, key, bytes.NewReader(probe), int64(len(probe)), minio.PutObjectOptions{}); err != nil {
+		return errors.WithMessage(err, "writing probe")
+	}
+
+	object, err := client.GetObject(bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return errors.WithMessage(err, "reading probe")
+	}
+	content, err := io.ReadAll(object)
+	object.Close()
+	if err != nil {
+		return errors.WithMessage(err, "reading probe")
+	} else if !bytes.Equal(content, probe) {
+		return errors.New("probe read back differs from what was written")
+	}
+
+	return errors.WithMessage(client.RemoveObject(bucket, key), "deleting probe")
+}
+
+// redactURL removes credentials that may be part of the URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
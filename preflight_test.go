@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	proxy := testProxy(t)
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	proxy.Listen = taken.Addr().String()
+	proxy.SecretKeyFiles = []string{filepath.Join(t.TempDir(), "missing.sec")}
+
+	failures := runPreflight(proxy.preflightChecks())
+	failed := []string{}
+	for _, failure := range failures {
+		failed = append(failed, failure.check.name)
+	}
+
+	expected := []string{"secret key file " + proxy.SecretKeyFiles[0], "listen address " + proxy.Listen}
+	if strings.Join(failed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected failed checks %v, got %v", expected, failed)
+	}
+
+	taken.Close()
+	proxy.SecretKeyFiles = nil
+	if failures := runPreflight(proxy.preflightChecks()); len(failures) != 0 {
+		t.Fatalf("expected no failures, got %v", failures)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// proxyRoute caches everything below /proxy/<name>/ from a base URL, for
+// example a GOPROXY or PyPI mirror.
+type proxyRoute struct {
+	name string
+	base *url.URL
+	// paths matching this are never revalidated, may be nil.
+	immutable *regexp.Regexp
+	ttl       time.Duration
+}
+
+// parseProxyRoute takes a route like name=https://proxy.golang.org, the
+// immutable paths and TTL are taken from the query parameters of the URL like
+// https://proxy.golang.org?immutable=@v/.*\.(zip|mod|info)$&ttl=5m.
+func parseProxyRoute(raw string, ttl time.Duration) (*proxyRoute, error) {
+	name, rawURL, ok := strings.Cut(raw, "=")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return nil, errors.Errorf("expected <name>=<url>, got %q", raw)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("unsupported scheme in %q", rawURL)
+	}
+
+	route := &proxyRoute{name: name, base: u, ttl: ttl}
+	query := u.Query()
+
+	if value := query.Get("immutable"); value != "" {
+		if route.immutable, err = regexp.Compile(value); err != nil {
+			return nil, errors.WithMessage(err, "parsing immutable")
+		}
+		query.Del("immutable")
+	}
+
+	if value := query.Get("ttl"); value != "" {
+		if route.ttl, err = time.ParseDuration(value); err != nil {
+			return nil, errors.WithMessage(err, "parsing ttl")
+		}
+		query.Del("ttl")
+	}
+
+	u.RawQuery = query.Encode()
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return route, nil
+}
+
+func (proxy *Proxy) setupProxyRoutes() {
+	proxy.proxyRoutes = map[string]*proxyRoute{}
+	for _, raw := range proxy.ProxyRoutes {
+		route, err := parseProxyRoute(raw, proxy.ArtifactTTL)
+		if err != nil {
+			proxy.log.Fatal("failed parsing proxy route", zap.String("route", raw), zap.Error(err))
+		}
+		proxy.proxyRoutes[route.name] = route
+	}
+}
+
+// url returns the origin URL of a path below the route.
+func (route *proxyRoute) url(path, rawQuery string) string {
+	u := *route.base
+	u.Path += "/" + path
+	u.RawPath = ""
+	if rawQuery != "" {
+		u.RawQuery = rawQuery
+	}
+	return u.String()
+}
+
+// GET /proxy/<name>/<path>
+// Serves the path below the base URL of the route through the artifact cache.
+func (proxy *Proxy) serveProxyRoute(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	route, found := proxy.proxyRoutes[vars["name"]]
+	if !found {
+		serveNotFound(w, r)
+		return
+	}
+
+	path := vars["path"]
+	immutable := route.immutable != nil && route.immutable.MatchString(path)
+	proxy.serveCachedURL(w, r, route.url(path, r.URL.RawQuery), immutable, route.ttl)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterProxyRoutes(t *testing.T) {
+	requests := map[string]int{}
+	mu := sync.Mutex{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/mirror/example.com/mod/@v/list":
+			_, _ = w.Write([]byte("v1.0.0\n"))
+		case "/mirror/example.com/mod/@v/v1.0.0.zip":
+			_, _ = w.Write([]byte("zip"))
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer origin.Close()
+
+	proxy := testProxy(t)
+	proxy.ProxyRoutes = []string{"go=" + origin.URL + "/mirror/?immutable=" + url.QueryEscape(`@v/.*\.zip$`) + "&ttl=0s"}
+	router := testRouter(proxy)
+
+	for i := 0; i < 2; i++ {
+		apitest.New().
+			Handler(router).
+			Get("/proxy/go/example.com/mod/@v/v1.0.0.zip").
+			Expect(t).
+			Body("zip").
+			Status(http.StatusOK).
+			End()
+
+		apitest.New().
+			Handler(router).
+			Get("/proxy/go/example.com/mod/@v/list").
+			Expect(t).
+			Body("v1.0.0\n").
+			Status(http.StatusOK).
+			End()
+	}
+
+	if n := requests["/mirror/example.com/mod/@v/v1.0.0.zip"]; n != 1 {
+		t.Fatalf("expected the immutable zip to be fetched once, got %d", n)
+	} else if n := requests["/mirror/example.com/mod/@v/list"]; n != 2 {
+		t.Fatalf("expected the mutable list to be revalidated, got %d requests", n)
+	}
+
+	apitest.New().
+		Handler(router).
+		Get("/proxy/go/example.com/other/@v/list").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get("/proxy/pypi/simple/").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestParseProxyRoute(t *testing.T) {
+	route, err := parseProxyRoute("pypi=https://pypi.org/?ttl=5m&immutable=^packages/", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	} else if route.name != "pypi" || route.ttl != 5*time.Minute {
+		t.Fatalf("unexpected route %#v", route)
+	} else if !route.immutable.MatchString("packages/a.whl") || route.immutable.MatchString("simple/a/") {
+		t.Fatalf("unexpected immutable paths %s", route.immutable)
+	} else if u := route.url("simple/a/", ""); u != "https://pypi.org/simple/a/" {
+		t.Fatalf("unexpected URL %s", u)
+	}
+
+	for _, raw := range []string{"https://pypi.org", "pypi=ftp://pypi.org", "pypi=https://pypi.org?ttl=soon", "a/b=https://pypi.org"} {
+		if _, err := parseProxyRoute(raw, time.Hour); err == nil {
+			t.Fatalf("expected %q to be rejected", raw)
+		}
+	}
+}
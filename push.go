@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/numtide/go-nix/nixbase32"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// PushCmd uploads the closures of local store paths, like `nix copy --to`
+// but without needing nix to be configured for the cache.
+type PushCmd struct {
+	URL        string   `arg:"--url,required,env:SPONGIX_URL" help:"spongix to push to, like http://127.0.0.1:7745"`
+	Jobs       uint64   `arg:"-j,--jobs" default:"4" help:"Number of store paths uploaded at once"`
+	Retries    uint64   `arg:"--retries" default:"2" help:"Number of times a failed upload of a store path is retried"`
+	StorePaths []string `arg:"positional,required" help:"Store paths whose closures are pushed"`
+}
+
+// pushSource reads the local store, nixStoreCLI does it using nix-store.
+type pushSource interface {
+	closure(ctx context.Context, storePaths []string) ([]string, error)
+	references(ctx context.Context, storePath string) ([]string, error)
+	deriver(ctx context.Context, storePath string) (string, error)
+	dump(ctx context.Context, storePath string, w io.Writer) error
+}
+
+type nixStoreCLI struct{}
+
+func (nixStoreCLI) query(ctx context.Context, args ...string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "nix-store", append([]string{"--query"}, args...)...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "nix-store --query %s: %s", strings.Join(args, " "), bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (n nixStoreCLI) closure(ctx context.Context, storePaths []string) ([]string, error) {
+	return n.query(ctx, append([]string{"--requisites"}, storePaths...)...)
+}
+
+func (n nixStoreCLI) references(ctx context.Context, storePath string) ([]string, error) {
+	return n.query(ctx, "--references", storePath)
+}
+
+func (n nixStoreCLI) deriver(ctx context.Context, storePath string) (string, error) {
+	out, err := n.query(ctx, "--deriver", storePath)
+	if err != nil || len(out) == 0 || out[0] == "unknown-deriver" {
+		return "", err
+	}
+	return out[0], nil
+}
+
+func (nixStoreCLI) dump(ctx context.Context, storePath string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, "nix-store", "--dump", storePath)
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return errors.WithMessagef(err, "nix-store --dump %s: %s", storePath, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+func (proxy *Proxy) runPush(cmd *PushCmd) error {
+	c, err := client.New(cmd.URL)
+	if err != nil {
+		return err
+	}
+
+	return proxy.push(context.Background(), c, nixStoreCLI{}, cmd.StorePaths, cmd.Jobs, cmd.Retries)
+}
+
+// push uploads every path in the closures that the cache doesn't have yet, so
+// an interrupted push continues where it stopped when run again.
+func (proxy *Proxy) push(ctx context.Context, c *client.Client, source pushSource, storePaths []string, jobs, retries uint64) error {
+	closure, err := source.closure(ctx, storePaths)
+	if err != nil {
+		return err
+	}
+
+	if jobs == 0 {
+		jobs = 1
+	}
+
+	queue := make(chan string)
+	mu := &sync.Mutex{}
+	pushed, skipped, failed := 0, 0, 0
+	wg := &sync.WaitGroup{}
+
+	for i := uint64(0); i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for storePath := range queue {
+				done, err := proxy.pushPathRetrying(ctx, c, source, storePath, retries)
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					proxy.log.Error("pushing store path", zap.String("store_path", storePath), zap.Error(err))
+					failed++
+				case done:
+					pushed++
+				default:
+					skipped++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// requisites are listed before the paths referring to them.
+	for _, storePath := range closure {
+		queue <- storePath
+	}
+	close(queue)
+	wg.Wait()
+
+	proxy.log.Info("pushed closure", zap.Int("pushed", pushed), zap.Int("skipped", skipped), zap.Int("failed", failed))
+
+	if failed > 0 {
+		return errors.Errorf("failed pushing %d of %d store paths", failed, len(closure))
+	}
+	return nil
+}
+
+// pushPathRetrying backs off exponentially between attempts, starting at a
+// second.
+func (proxy *Proxy) pushPathRetrying(ctx context.Context, c *client.Client, source pushSource, storePath string, retries uint64) (bool, error) {
+	backoff := pushRetryBackoff
+	for attempt := uint64(0); ; attempt++ {
+		done, err := proxy.pushPath(ctx, c, source, storePath)
+		if err == nil || attempt >= retries {
+			return done, err
+		}
+
+		proxy.log.Warn("pushing store path, retrying",
+			zap.String("store_path", storePath),
+			zap.Uint64("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// pushPath uploads the NAR and then the narinfo of the store path, unless the
+// cache already has it.
+func (proxy *Proxy) pushPath(ctx context.Context, c *client.Client, source pushSource, storePath string) (bool, error) {
+	hash := storePathHash(strings.TrimPrefix(storePath, storeDirPrefix))
+	if found, err := c.HasNarinfo(ctx, hash); err != nil {
+		return false, err
+	} else if found {
+		return false, nil
+	}
+
+	// the NAR is hashed before uploading, its name depends on the hash.
+	fd, err := os.CreateTemp("", "spongix-push")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	sum := sha256.New()
+	counter := &countingWriter{}
+	if err := source.dump(ctx, storePath, io.MultiWriter(fd, sum, counter)); err != nil {
+		return false, err
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	narHash := "sha256:" + nixbase32.EncodeToString(sum.Sum(nil))
+	narURL := "nar/" + strings.TrimPrefix(narHash, "sha256:") + ".nar"
+
+	references, err := source.references(ctx, storePath)
+	if err != nil {
+		return false, err
+	}
+	for i, ref := range references {
+		references[i] = path.Base(ref)
+	}
+
+	deriver, err := source.deriver(ctx, storePath)
+	if err != nil {
+		return false, err
+	}
+	if deriver != "" {
+		deriver = path.Base(deriver)
+	}
+
+	if err := c.PutNar(ctx, narURL, fd); err != nil {
+		return false, errors.WithMessage(err, "uploading NAR")
+	}
+
+	info := &narinfo.Narinfo{
+		StorePath:   storePath,
+		URL:         narURL,
+		Compression: "none",
+		FileHash:    narHash,
+		FileSize:    counter.n,
+		NarHash:     narHash,
+		NarSize:     counter.n,
+		References:  references,
+		Deriver:     deriver,
+	}
+
+	// signing locally lets the cache keep our signature if it trusts the key.
+	for name, key := range proxy.secretKeys {
+		info.Sign(name, key)
+	}
+
+	return true, errors.WithMessage(c.PutNarinfo(ctx, hash, info), "uploading narinfo")
+}
+
+// a var, so tests don't have to wait.
+var pushRetryBackoff = time.Second
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
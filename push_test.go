@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+)
+
+type fakePushSource map[string][]byte
+
+func (s fakePushSource) closure(ctx context.Context, storePaths []string) ([]string, error) {
+	return storePaths, nil
+}
+
+func (s fakePushSource) references(ctx context.Context, storePath string) ([]string, error) {
+	return []string{storePath}, nil
+}
+
+func (s fakePushSource) deriver(ctx context.Context, storePath string) (string, error) {
+	return "", nil
+}
+
+func (s fakePushSource) dump(ctx context.Context, storePath string, w io.Writer) error {
+	_, err := w.Write(s[storePath])
+	return err
+}
+
+func TestPush(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.VerifyNarHash = true
+	server := httptest.NewServer(testRouter(proxy))
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storePath := "/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10"
+	source := fakePushSource{storePath: testdata[fNar]}
+
+	for i := 0; i < 2; i++ {
+		if err := proxy.push(context.Background(), c, source, []string{storePath}, 2, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := c.GetNarinfo(context.Background(), "8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.StorePath != storePath || info.URL != strings.TrimPrefix(fNar, "/") {
+		t.Fatalf("unexpected narinfo %+v", info)
+	}
+
+	nar, err := c.GetNar(context.Background(), info.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nar.Close()
+
+	if content, err := io.ReadAll(nar); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(content, testdata[fNar]) {
+		t.Fatal("pushed NAR differs")
+	}
+}
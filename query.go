@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var metricQueryMissingHashes = metrics.MustCounter("spongix_query_missing_hashes", "Number of store path hashes checked through query-missing")
+
+const (
+	// upper bound of hashes accepted in a single query-missing request.
+	queryMissingLimit = 100000
+	// upper bound of the request body, enough for the limit of full store
+	// paths with long names.
+	queryMissingMaxBody = queryMissingLimit * 256
+	// the local index is listed once instead of looking up more hashes than
+	// this one by one.
+	queryMissingListThreshold = 1000
+	// number of lookups done at once in other index stores.
+	queryMissingWorkers = 16
+)
+
+var validStorePathHash = regexp.MustCompile(`\A[0-9a-df-np-sv-z]{32}\z`)
+
+type queryMissingResponse struct {
+	Present []string `json:"present"`
+	Missing []string `json:"missing"`
+}
+
+// parseStorePathHashes accepts either a JSON array or a newline separated list
+// of store path hashes. Full store paths are reduced to their hash.
+func parseStorePathHashes(body []byte) ([]string, error) {
+	raw := []string{}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				raw = append(raw, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	hashes := make([]string, 0, len(raw))
+	for _, entry := range raw {
+		hash := storePathHash(strings.TrimPrefix(entry, storeDirPrefix))
+		if !validStorePathHash.MatchString(hash) {
+			return nil, errors.Errorf("invalid store path hash: %q", entry)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+func hasIndex(index desync.IndexStore, name string) bool {
+	if index == nil {
+		return false
+	}
+
+	rd, err := index.GetIndexReader(name)
+	if err != nil {
+		return false
+	}
+	_ = rd.Close()
+	return true
+}
+
+// POST /query-missing
+// Tells which of the given store path hashes have a narinfo in this cache, so
+// clients can check a whole closure in one request instead of one HEAD each.
+func (proxy *Proxy) queryMissing(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, queryMissingMaxBody+1))
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, "failed reading body\n")
+		return
+	} else if len(body) > queryMissingMaxBody {
+		answer(w, http.StatusRequestEntityTooLarge, mimeText, "too many hashes\n")
+		return
+	}
+
+	hashes, err := parseStorePathHashes(body)
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+		return
+	} else if len(hashes) > queryMissingLimit {
+		answer(w, http.StatusRequestEntityTooLarge, mimeText, "too many hashes\n")
+		return
+	}
+
+	metricQueryMissingHashes.Add(uint64(len(hashes)))
+
+	names := make([]string, 0, len(hashes))
+	seen := map[string]struct{}{}
+	for _, hash := range hashes {
+		if _, found := seen[hash]; !found {
+			seen[hash] = yes
+			names = append(names, hash+".narinfo")
+		}
+	}
+
+	present := proxy.presentIndices(names)
+	res := queryMissingResponse{Present: []string{}, Missing: []string{}}
+	for _, name := range names {
+		hash := strings.TrimSuffix(name, ".narinfo")
+		if _, found := present[name]; found {
+			res.Present = append(res.Present, hash)
+		} else {
+			res.Missing = append(res.Missing, hash)
+		}
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		proxy.log.Error("encoding query-missing response", zap.Error(err))
+	}
+}
+
+// presentIndices returns which of the names are found in any tier. Every tier
+// is only asked for the names the ones before it don't have, a local index is
+// listed once if that's cheaper than looking them up one by one.
+func (proxy *Proxy) presentIndices(names []string) map[string]struct{} {
+	present := map[string]struct{}{}
+	remaining := names
+
+	for _, tier := range proxy.indexTiers() {
+		if len(remaining) == 0 {
+			break
+		}
+
+		found := map[string]struct{}{}
+		if local, ok := tier.index.(desync.LocalIndexStore); ok && len(remaining) > queryMissingListThreshold {
+			entries, err := os.ReadDir(local.Path)
+			if err != nil {
+				proxy.log.Error("listing local index", zap.Error(err))
+			}
+			for _, entry := range entries {
+				found[entry.Name()] = yes
+			}
+		} else {
+			found = lookupIndices(tier.index, remaining)
+		}
+
+		missing := []string{}
+		for _, name := range remaining {
+			if _, ok := found[name]; ok {
+				present[name] = yes
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		remaining = missing
+	}
+
+	return present
+}
+
+// lookupIndices checks a few names at once, so stores with a high latency like
+// S3 don't take one round trip per name.
+func lookupIndices(index desync.IndexStore, names []string) map[string]struct{} {
+	found := map[string]struct{}{}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	work := make(chan string)
+
+	for i := 0; i < queryMissingWorkers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				if hasIndex(index, name) {
+					mu.Lock()
+					found[name] = yes
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, name := range names {
+		work <- name
+	}
+	close(work)
+	wg.Wait()
+
+	return found
+}
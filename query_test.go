@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterQueryMissing(t *testing.T) {
+	proxy := withS3(testProxy(t))
+	insertFake(t, proxy.s3Store, proxy.s3Index, fNarinfo)
+	router := testRouter(proxy)
+
+	missing := "0c7c5s9ccz4wdd9ckdwfkblslj4m4lgg"
+	expect := `{"present":["8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5"],"missing":["` + missing + `"]}`
+
+	for name, body := range map[string]string{
+		"json":     `["/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10", "` + missing + `"]`,
+		"newlines": "8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5\n" + missing + "\n" + missing + "\n",
+	} {
+		t.Run(name, func(tt *testing.T) {
+			apitest.New().
+				Handler(router).
+				Method("POST").
+				URL("/query-missing").
+				Body(body).
+				Expect(tt).
+				Header(headerContentType, mimeJson).
+				Body(expect).
+				Status(http.StatusOK).
+				End()
+		})
+	}
+
+	t.Run("rejects invalid hashes", func(tt *testing.T) {
+		apitest.New().
+			Handler(router).
+			Method("POST").
+			URL("/query-missing").
+			Body("not-a-hash\n").
+			Expect(tt).
+			Status(http.StatusBadRequest).
+			End()
+	})
+
+	t.Run("lists the local index for many hashes", func(tt *testing.T) {
+		insertFake(tt, proxy.localStore, proxy.localIndex, fNarinfo)
+
+		body := "8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5\n"
+		for i := 0; i < queryMissingListThreshold; i++ {
+			n := strconv.Itoa(i)
+			body += strings.Repeat("0", 32-len(n)) + n + "\n"
+		}
+
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("POST", "/query-missing", strings.NewReader(body)))
+
+		response := queryMissingResponse{}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			tt.Fatal(err)
+		} else if len(response.Present) != 1 || len(response.Missing) != queryMissingListThreshold {
+			tt.Fatalf("unexpected response: %d present, %d missing", len(response.Present), len(response.Missing))
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+)
+
+var metricRateLimited = metrics.Must1LabelCounter("spongix_rate_limited", "method")
+
+func init() {
+	metrics.MustHelp("spongix_rate_limited", "Number of requests rejected because the client exceeded its rate limit")
+}
+
+// tokenBucket holds up to burst tokens and gains rate tokens per second.
+// Bytes are only known after a transfer, so the bucket may go into debt and
+// the client has to wait until it's paid off.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until min tokens are available.
+func (b *tokenBucket) wait(min float64) time.Duration {
+	if b.tokens >= min {
+		return 0
+	}
+	return time.Duration((min - b.tokens) / b.rate * float64(time.Second))
+}
+
+type rateLimit struct {
+	requests uint64
+	bytes    uint64
+}
+
+type clientBuckets struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+}
+
+// rateLimiter keeps a pair of token buckets per client and kind of request.
+type rateLimiter struct {
+	limits    map[string]rateLimit
+	mu        sync.Mutex
+	buckets   map[string]*clientBuckets
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(limits map[string]rateLimit) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: map[string]*clientBuckets{},
+		now:     time.Now,
+	}
+}
+
+func (l *rateLimiter) bucketsFor(kind, client string, limit rateLimit, now time.Time) *clientBuckets {
+	key := kind + " " + client
+	if b, ok := l.buckets[key]; ok {
+		return b
+	}
+
+	b := &clientBuckets{}
+	if limit.requests > 0 {
+		rate := float64(limit.requests)
+		b.requests = &tokenBucket{rate: rate, burst: rate, tokens: rate, last: now}
+	}
+	if limit.bytes > 0 {
+		rate := float64(limit.bytes)
+		b.bytes = &tokenBucket{rate: rate, burst: rate, tokens: rate, last: now}
+	}
+	l.buckets[key] = b
+	return b
+}
+
+// sweep forgets buckets that refilled completely, they're the same as new
+// ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		full := true
+		for _, bucket := range []*tokenBucket{b.requests, b.bytes} {
+			if bucket != nil {
+				bucket.refill(now)
+				full = full && bucket.tokens >= bucket.burst
+			}
+		}
+		if full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// take admits a request if the client has a request token left and isn't in
+// debt for bytes. Otherwise it returns how long the client should wait.
+func (l *rateLimiter) take(kind, client string) (bool, time.Duration) {
+	limit, ok := l.limits[kind]
+	if !ok || (limit.requests == 0 && limit.bytes == 0) {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b := l.bucketsFor(kind, client, limit, now)
+
+	wait := time.Duration(0)
+	if b.requests != nil {
+		b.requests.refill(now)
+		wait = b.requests.wait(1)
+	}
+	if b.bytes != nil {
+		b.bytes.refill(now)
+		if w := b.bytes.wait(0); w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		return false, wait
+	}
+
+	if b.requests != nil {
+		b.requests.tokens--
+	}
+	return true, 0
+}
+
+// charge takes the transferred bytes from the client's byte bucket.
+func (l *rateLimiter) charge(kind, client string, n int64) {
+	limit, ok := l.limits[kind]
+	if !ok || limit.bytes == 0 || n == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b := l.bucketsFor(kind, client, limit, now)
+	b.bytes.refill(now)
+	b.bytes.tokens -= float64(n)
+}
+
+// rateLimitClient identifies the client by its IP. Credentials aren't checked
+// by us, so anyone could pick a new token or user to get a fresh limit. Only
+// the admin token is verified, its holder shares one limit from anywhere.
+func (proxy *Proxy) rateLimitClient(r *http.Request) string {
+	if proxy.adminToken != "" && hasBearerToken(r, proxy.adminToken) {
+		return "admin"
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+func rateLimitKind(method string) string {
+	if method == "GET" || method == "HEAD" {
+		return "GET"
+	}
+	return "PUT"
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withRateLimit turns away clients exceeding their requests or bytes per
+// second with a 429, so a runaway CI job can't exhaust the S3 backend.
+// Reads and writes are limited separately.
+func (proxy *Proxy) withRateLimit() mux.MiddlewareFunc {
+	limits := map[string]rateLimit{
+		"GET": {requests: proxy.GetRateLimit, bytes: proxy.GetByteRateLimit},
+		"PUT": {requests: proxy.PutRateLimit, bytes: proxy.PutByteRateLimit},
+	}
+
+	enabled := false
+	for _, limit := range limits {
+		enabled = enabled || limit.requests > 0 || limit.bytes > 0
+	}
+	if !enabled {
+		return func(h http.Handler) http.Handler { return h }
+	}
+
+	if proxy.rateLimiter == nil {
+		proxy.rateLimiter = newRateLimiter(limits)
+	}
+	limiter := proxy.rateLimiter
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/metrics" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			kind := rateLimitKind(r.Method)
+			client := proxy.rateLimitClient(r)
+
+			if ok, wait := limiter.take(kind, client); !ok {
+				metricRateLimited(kind).Add(1)
+				w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+				answer(w, http.StatusTooManyRequests, mimeText, "rate limit exceeded\n")
+				return
+			}
+
+			if kind == "GET" {
+				counter := &countingResponseWriter{ResponseWriter: w}
+				h.ServeHTTP(counter, r)
+				limiter.charge(kind, client, counter.n)
+				return
+			}
+
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+			h.ServeHTTP(w, r)
+			limiter.charge(kind, client, body.n)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterRateLimit(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.GetRateLimit = 1
+	proxy.PutByteRateLimit = 10
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	router := testRouter(proxy)
+
+	now := time.Now()
+	proxy.rateLimiter.now = func() time.Time { return now }
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Header("Retry-After", "1").
+		Body("rate limit exceeded\n").
+		Status(http.StatusTooManyRequests).
+		End()
+
+	// unverified credentials don't get a limit of their own.
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		BasicAuth("ci", "secret").
+		Expect(t).
+		Status(http.StatusTooManyRequests).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	now = now.Add(time.Second)
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	// the first upload may exceed the byte rate, the next one has to wait
+	// until it's paid off.
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Header("Retry-After", strconv.Itoa((len(testdata[fNar])-10)/10)).
+		Status(http.StatusTooManyRequests).
+		End()
+}
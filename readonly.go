@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// withReadOnly rejects everything that could write to the cache. GET requests
+// are still served and copied from upstream, so a frozen cache keeps working
+// as a mirror. Other methods are only let through for the routes that just
+// read, so new routes are refused until they're known to be safe.
+func (proxy *Proxy) withReadOnly() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if !proxy.ReadOnly {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" || readOnlyAllowed(r) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Allow", "GET, HEAD")
+			answer(w, http.StatusMethodNotAllowed, mimeText, "this cache is read-only\n")
+		})
+	}
+}
+
+// readOnlyAllowed reports whether r is a POST that only reads from the cache.
+func readOnlyAllowed(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+
+	return strings.TrimPrefix(r.URL.Path, legacyPrefix) == "/query-missing" ||
+		strings.HasPrefix(r.URL.Path, "/verify/")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterReadOnly(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.ReadOnly = true
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	router := testRouter(proxy)
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Header("Allow", "GET, HEAD").
+		Status(http.StatusMethodNotAllowed).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Post("/seed").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusMethodNotAllowed).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Post("/jobs/gc/pause").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusMethodNotAllowed).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Post("/query-missing").
+		Body("/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10\n").
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get(fNarinfo).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Body(string(testdata[fNarinfo])).
+		Status(http.StatusOK).
+		End()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var metricReconcileQuarantined = metrics.MustCounter("spongix_reconcile_quarantined", "Number of inconsistent indices moved to the trash by reconciliation")
+
+// indices written this recently may still be in flight, like a narinfo
+// whose NAR is being uploaded.
+const reconcileGrace = time.Minute
+
+type reconcileProblem struct {
+	Name    string `json:"name"`
+	Problem string `json:"problem"`
+}
+
+type reconcileReport struct {
+	Time        time.Time          `json:"time"`
+	Duration    time.Duration      `json:"duration"`
+	Repair      bool               `json:"repair"`
+	Narinfos    int                `json:"narinfos"`
+	Nars        int                `json:"nars"`
+	OrphanNars  int                `json:"orphan_nars"`
+	Problems    []reconcileProblem `json:"problems"`
+	Quarantined int                `json:"quarantined"`
+}
+
+// reconciler makes sure only one reconciliation runs at a time.
+type reconciler struct {
+	mu sync.Mutex
+}
+
+// missingChunks returns how many chunks of the index the store lacks.
+func missingChunks(store desync.Store, idx desync.Index) (int, error) {
+	missing := 0
+	for _, chunk := range idx.Chunks {
+		if found, err := store.HasChunk(chunk.ID); err != nil {
+			return missing, err
+		} else if !found {
+			missing++
+		}
+	}
+	return missing, nil
+}
+
+// reconcile cross-checks narinfos, NARs and chunks of the local store, which
+// can get out of sync after a crash: indices may be truncated, narinfos may
+// point to NARs that don't exist and indices may miss chunks. With repair,
+// inconsistent indices are moved to the trash, so they're cache misses again
+// instead of failing downloads.
+func (proxy *Proxy) reconcile(repair bool) (*reconcileReport, error) {
+	store, ok := proxy.chunkDisk()
+	if !ok {
+		return nil, errors.New("local store isn't on disk")
+	}
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return nil, errors.New("local index isn't on disk")
+	}
+
+	proxy.reconciler.mu.Lock()
+	defer proxy.reconciler.mu.Unlock()
+
+	report := &reconcileReport{Time: time.Now(), Repair: repair, Problems: []reconcileProblem{}}
+	cutoff := report.Time.Add(-reconcileGrace)
+	nars := map[string]struct{}{}
+	narinfos := []string{}
+
+	err := filepath.Walk(indices.Path, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		name := strings.TrimPrefix(path[len(indices.Path):], "/")
+		if info.IsDir() || !validIndexName(name) || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		if strings.HasSuffix(name, ".narinfo") {
+			narinfos = append(narinfos, name)
+		} else {
+			nars[name] = yes
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	problem := func(name, msg string) {
+		report.Problems = append(report.Problems, reconcileProblem{Name: name, Problem: msg})
+		if !repair {
+			return
+		}
+
+		if err := proxy.quarantineIndex(name); err != nil {
+			proxy.log.Error("moving inconsistent index to the trash", zap.String("name", name), zap.Error(err))
+			return
+		}
+		report.Quarantined++
+		metricReconcileQuarantined.Add(1)
+	}
+
+	// NARs are checked first, so narinfos pointing to broken ones go too.
+	brokenNars := map[string]struct{}{}
+	narNames := make([]string, 0, len(nars))
+	for name := range nars {
+		narNames = append(narNames, name)
+	}
+	sort.Strings(narNames)
+
+	for _, name := range narNames {
+		report.Nars++
+		idx, err := indices.GetIndex(name)
+		if err != nil {
+			brokenNars[name] = yes
+			problem(name, "unreadable index: "+err.Error())
+			continue
+		}
+
+		if missing, err := missingChunks(store, idx); err != nil {
+			return nil, err
+		} else if missing > 0 {
+			brokenNars[name] = yes
+			problem(name, strconv.Itoa(missing)+" chunks missing")
+		}
+	}
+
+	referenced := map[string]struct{}{}
+	sort.Strings(narinfos)
+	for _, name := range narinfos {
+		report.Narinfos++
+		idx, err := indices.GetIndex(name)
+		if err != nil {
+			problem(name, "unreadable index: "+err.Error())
+			continue
+		}
+
+		info, err := assembleNarinfo(store, idx)
+		if err != nil {
+			problem(name, "unreadable narinfo: "+err.Error())
+			continue
+		}
+
+		narName := narIndexName(info.URL)
+		referenced[narName] = yes
+
+		if _, found := brokenNars[narName]; found {
+			problem(name, "NAR "+narName+" is inconsistent")
+		} else if _, found := nars[narName]; !found {
+			if _, err := os.Stat(filepath.Join(indices.Path, narName)); os.IsNotExist(err) {
+				problem(name, "NAR "+narName+" is missing")
+			}
+		}
+	}
+
+	for name := range nars {
+		if _, found := referenced[name]; !found {
+			report.OrphanNars++
+		}
+	}
+
+	report.Duration = time.Since(report.Time)
+	return report, nil
+}
+
+// reconcileOnStart runs a reconciliation with repairs after startup and logs
+// the result.
+func (proxy *Proxy) reconcileOnStart() {
+	report, err := proxy.reconcile(true)
+	if err != nil {
+		proxy.log.Error("reconciling the local store", zap.Error(err))
+		return
+	}
+
+	for _, p := range report.Problems {
+		proxy.log.Warn("inconsistent index", zap.String("name", p.Name), zap.String("problem", p.Problem))
+	}
+
+	proxy.log.Info("reconciled the local store",
+		zap.Int("narinfos", report.Narinfos),
+		zap.Int("nars", report.Nars),
+		zap.Int("orphan_nars", report.OrphanNars),
+		zap.Int("problems", len(report.Problems)),
+		zap.Int("quarantined", report.Quarantined),
+		zap.Duration("duration", report.Duration))
+}
+
+// POST /reconcile?repair=true
+// Without repair it only reports what it would move to the trash.
+func (proxy *Proxy) reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	repair := r.URL.Query().Get("repair") == "true"
+
+	report, err := proxy.reconcile(repair)
+	if err != nil {
+		proxy.log.Error("reconciling the local store", zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed reconciling\n")
+		return
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		proxy.log.Error("encoding reconcile report", zap.Error(err))
+	}
+}
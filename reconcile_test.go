@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+func TestRouterReconcile(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	indices := proxy.localIndex.(desync.LocalIndexStore)
+
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	narIdx, err := proxy.localIndex.GetIndex(strings.TrimPrefix(fNar, "/"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := proxy.localIndex.StoreIndex("nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar", narIdx); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := filepath.Join(indices.Path, "nar", "0000000000000000000000000000000000000000000000000000.nar")
+	if err := os.WriteFile(truncated, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend everything was written before the grace period.
+	old := time.Now().Add(-time.Hour)
+	age := func() {
+		err := filepath.Walk(indices.Path, func(path string, info fs.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			return os.Chtimes(path, old, old)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	age()
+
+	reconcile := func(repair bool) reconcileReport {
+		req := httptest.NewRequest("POST", "/reconcile?repair="+strconv.FormatBool(repair), nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", res.Code, res.Body)
+		}
+
+		report := reconcileReport{}
+		if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	report := reconcile(false)
+	if report.Narinfos != 1 || report.Nars != 3 || report.OrphanNars != 2 || len(report.Problems) != 1 || report.Quarantined != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// the narinfo's NAR loses a chunk.
+	if err := proxy.localStore.(desync.LocalStore).RemoveChunk(narIdx.Chunks[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	report = reconcile(true)
+	if len(report.Problems) != 4 || report.Quarantined != 4 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if _, err := os.Stat(filepath.Join(proxy.Dir, "trash", "index", filepath.Base(fNarinfo))); err != nil {
+		t.Fatal("narinfo with a broken NAR wasn't moved to the trash")
+	}
+
+	report = reconcile(true)
+	if report.Narinfos != 0 || report.Nars != 0 || len(report.Problems) != 0 {
+		t.Fatalf("unexpected report after repair: %+v", report)
+	}
+}
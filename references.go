@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var metricReferencesRejected = metrics.MustCounter("spongix_references_rejected", "Number of narinfo uploads rejected because the NAR references undeclared store paths")
+
+const storeDirPrefix = "/nix/store/"
+
+var storeReferenceRegexp = regexp.MustCompile(storeDirPrefix + `([0-9a-df-np-sv-z]{32})`)
+
+// referenceScanner collects the hashes of all store paths mentioned in the
+// content written to it. Matches may span multiple writes.
+type referenceScanner struct {
+	tail   []byte
+	hashes map[string]struct{}
+}
+
+func newReferenceScanner() *referenceScanner {
+	return &referenceScanner{hashes: map[string]struct{}{}}
+}
+
+func (s *referenceScanner) Write(p []byte) (int, error) {
+	buf := append(s.tail, p...)
+	for _, match := range storeReferenceRegexp.FindAllSubmatch(buf, -1) {
+		s.hashes[string(match[1])] = yes
+	}
+
+	keep := len(storeDirPrefix) + 32 - 1
+	if len(buf) > keep {
+		buf = buf[len(buf)-keep:]
+	}
+	s.tail = append(s.tail[:0], buf...)
+
+	return len(p), nil
+}
+
+// undeclaredReferences returns the store path hashes found in the NAR that are
+// neither the path itself nor listed in the References of info.
+func undeclaredReferences(info *narinfo.Narinfo, nar io.Reader) ([]string, error) {
+	scanner := newReferenceScanner()
+	if _, err := io.Copy(scanner, nar); err != nil {
+		return nil, err
+	}
+
+	declared := map[string]struct{}{
+		storePathHash(strings.TrimPrefix(info.StorePath, storeDirPrefix)): yes,
+	}
+	for _, ref := range info.References {
+		declared[storePathHash(ref)] = yes
+	}
+
+	undeclared := []string{}
+	for hash := range scanner.hashes {
+		if _, found := declared[hash]; !found {
+			undeclared = append(undeclared, hash)
+		}
+	}
+	sort.Strings(undeclared)
+
+	return undeclared, nil
+}
+
+func storePathHash(name string) string {
+	if len(name) < 32 {
+		return name
+	}
+	return name[:32]
+}
+
+// narReader streams the NAR named by the narinfo URL from the first store
+// that has it.
+func (proxy *Proxy) narReader(narURL string) (io.Reader, error) {
+	u, err := url.Parse("/" + narURL)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := urlToIndexName(u)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, store, err := proxy.resolveIndex(name)
+	if err != nil {
+		return nil, errors.Errorf("NAR %q not found", narURL)
+	}
+
+	return newChunkReader(store, idx), nil
+}
+
+// chunkReader reads the chunks of an index in order.
+type chunkReader struct {
+	store  desync.Store
+	chunks []desync.IndexChunk
+	buf    []byte
+}
+
+func newChunkReader(store desync.Store, idx desync.Index) *chunkReader {
+	return &chunkReader{store: store, chunks: idx.Chunks}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+
+		chunk, err := r.store.GetChunk(r.chunks[0].ID)
+		if err != nil {
+			return 0, errors.WithMessage(err, "getting chunk")
+		}
+
+		if r.buf, err = chunk.Data(); err != nil {
+			return 0, errors.WithMessage(err, "reading chunk data")
+		}
+
+		r.chunks = r.chunks[1:]
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// withStrictReferences rejects narinfo uploads if the NAR they point to
+// mentions store paths missing from their References. The NAR has to be
+// uploaded before the narinfo, which is what `nix copy` does.
+func (proxy *Proxy) withStrictReferences() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if !proxy.StrictReferences {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			info, err := uploadedNarinfo(r)
+			if err != nil {
+				answer(w, http.StatusBadRequest, mimeText, err.Error())
+				return
+			}
+
+			nar, err := proxy.narReader(info.URL)
+			if err != nil {
+				metricReferencesRejected.Add(1)
+				answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+				return
+			}
+
+			undeclared, err := undeclaredReferences(info, nar)
+			if err != nil {
+				proxy.log.Error("scanning NAR references", zap.String("url", info.URL), zap.Error(err))
+				answer(w, http.StatusInternalServerError, mimeText, "failed scanning NAR references\n")
+				return
+			}
+
+			if len(undeclared) > 0 {
+				metricReferencesRejected.Add(1)
+				proxy.log.Warn("rejecting narinfo with undeclared references",
+					zap.String("store_path", info.StorePath),
+					zap.Strings("undeclared", undeclared))
+				answer(w, http.StatusBadRequest, mimeText,
+					"NAR references undeclared store paths: "+strings.Join(undeclared, " ")+"\n")
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
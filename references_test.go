@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterStrictReferences(t *testing.T) {
+	narURL := "/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar"
+
+	for name, tc := range map[string]struct {
+		nar    string
+		status int
+	}{
+		"accepts declared":   {string(narMagic) + "/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10/lib", http.StatusOK},
+		"rejects undeclared": {string(narMagic) + "/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring /nix/store/0c7c5s9ccz4wdd9ckdwfkblslj4m4lgg-glibc", http.StatusBadRequest},
+	} {
+		t.Run(name, func(tt *testing.T) {
+			proxy := testProxy(tt)
+			proxy.StrictReferences = true
+			router := testRouter(proxy)
+
+			apitest.New().
+				Handler(router).
+				Method("PUT").
+				URL(narURL).
+				Body(tc.nar).
+				Expect(tt).
+				Status(http.StatusOK).
+				End()
+
+			apitest.New().
+				Handler(router).
+				Method("PUT").
+				URL(fNarinfo).
+				Body(string(testdata[fNarinfo])).
+				Expect(tt).
+				Status(tc.status).
+				End()
+		})
+	}
+
+	t.Run("rejects missing NAR", func(tt *testing.T) {
+		proxy := testProxy(tt)
+		proxy.StrictReferences = true
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Method("PUT").
+			URL(fNarinfo).
+			Body(string(testdata[fNarinfo])).
+			Expect(tt).
+			Status(http.StatusBadRequest).
+			End()
+	})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricReplicationLagEvents  = metrics.MustInteger("spongix_replication_lag_events", "Number of leader uploads not yet replicated")
+	metricReplicationLagSeconds = metrics.MustReal("spongix_replication_lag_seconds", "Age of the oldest leader upload not yet replicated")
+	metricReplicationApplied    = metrics.MustCounter("spongix_replication_applied", "Number of leader uploads replicated")
+	metricReplicationFailed     = metrics.MustCounter("spongix_replication_failed", "Number of leader uploads that failed to replicate")
+	metricReplicationSkipped    = metrics.MustCounter("spongix_replication_skipped", "Number of leader uploads skipped because they can't be replicated")
+)
+
+// number of upload events kept in memory for standby instances to catch up.
+const eventLogSize = 10000
+
+const (
+	eventOpUpload = "upload"
+	eventOpDelete = "delete"
+)
+
+type uploadEvent struct {
+	Seq  uint64    `json:"seq"`
+	Op   string    `json:"op"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+type eventsResponse struct {
+	Epoch     string        `json:"epoch"`
+	Seq       uint64        `json:"seq"`
+	Truncated bool          `json:"truncated"`
+	Events    []uploadEvent `json:"events"`
+}
+
+// snapshotResponse lists everything the leader has, events up to Seq are
+// included in it.
+type snapshotResponse struct {
+	Epoch string   `json:"epoch"`
+	Seq   uint64   `json:"seq"`
+	Paths []string `json:"paths"`
+}
+
+// replicationCursor is how far a standby has replicated. Sequence numbers
+// only count within an epoch, the leader starts a new one whenever it starts.
+type replicationCursor struct {
+	epoch string
+	seq   uint64
+}
+
+// eventLog is a ring buffer of the most recent uploads and deletions.
+type eventLog struct {
+	mu     sync.RWMutex
+	epoch  string
+	seq    uint64
+	events []uploadEvent
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{epoch: randomHex(8), events: make([]uploadEvent, 0, eventLogSize)}
+}
+
+func (l *eventLog) add(op, path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	event := uploadEvent{Seq: l.seq, Op: op, Path: path, Time: time.Now()}
+	if len(l.events) < eventLogSize {
+		l.events = append(l.events, event)
+	} else {
+		l.events[(l.seq-1)%eventLogSize] = event
+	}
+}
+
+// since returns all events after seq in order. It's truncated if some of
+// those events were already dropped from the log.
+func (l *eventLog) since(seq uint64) eventsResponse {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	res := eventsResponse{Epoch: l.epoch, Seq: l.seq, Events: []uploadEvent{}}
+	if seq >= l.seq {
+		return res
+	}
+
+	oldest := uint64(1)
+	if l.seq > eventLogSize {
+		oldest = l.seq - eventLogSize + 1
+	}
+
+	if seq+1 < oldest {
+		res.Truncated = true
+		seq = oldest - 1
+	}
+
+	for s := seq + 1; s <= l.seq; s++ {
+		res.Events = append(res.Events, l.events[(s-1)%eventLogSize])
+	}
+
+	return res
+}
+
+func (l *eventLog) position() replicationCursor {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return replicationCursor{epoch: l.epoch, seq: l.seq}
+}
+
+func (proxy *Proxy) isStandby() bool {
+	return atomic.LoadInt32(&proxy.standby) == 1
+}
+
+// withReplication records successful uploads for standby instances, and
+// rejects uploads while running as standby.
+func (proxy *Proxy) withReplication() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if proxy.isStandby() {
+				answer(w, http.StatusServiceUnavailable, mimeText, "this instance is a standby\n")
+				return
+			}
+
+			record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(record, r)
+
+			if record.status == http.StatusOK {
+				if name, err := urlToIndexName(r.URL); err == nil {
+					proxy.events.add(eventOpUpload, "/"+name)
+				}
+			}
+		})
+	}
+}
+
+// GET /replication/events?since=<seq>
+func (proxy *Proxy) replicationEvents(w http.ResponseWriter, r *http.Request) {
+	since := uint64(0)
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		var err error
+		if since, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			answer(w, http.StatusBadRequest, mimeText, "invalid since parameter\n")
+			return
+		}
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(proxy.events.since(since)); err != nil {
+		proxy.log.Error("encoding replication events", zap.Error(err))
+	}
+}
+
+// GET /replication/snapshot
+func (proxy *Proxy) replicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	// taken before listing, so uploads during the listing are replayed from
+	// the events.
+	position := proxy.events.position()
+
+	names, err := proxy.seedAll()
+	if err != nil {
+		proxy.log.Error("listing indices for replication", zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed listing indices\n")
+		return
+	}
+
+	res := snapshotResponse{Epoch: position.epoch, Seq: position.seq, Paths: make([]string, 0, len(names))}
+	for _, name := range names {
+		res.Paths = append(res.Paths, "/"+name)
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		proxy.log.Error("encoding replication snapshot", zap.Error(err))
+	}
+}
+
+// POST /replication/promote
+func (proxy *Proxy) replicationPromote(w http.ResponseWriter, r *http.Request) {
+	if atomic.CompareAndSwapInt32(&proxy.standby, 1, 0) {
+		proxy.log.Info("promoted standby to leader")
+		answer(w, http.StatusOK, mimeText, "promoted\n")
+	} else {
+		answer(w, http.StatusConflict, mimeText, "not a standby\n")
+	}
+}
+
+// replicate tails the upload events of the leader until promoted.
+func (proxy *Proxy) replicate() {
+	proxy.log.Info("Starting replication", zap.String("leader", proxy.LeaderURL))
+
+	ticker := time.NewTicker(proxy.ReplicationInterval)
+	defer ticker.Stop()
+
+	cursor := replicationCursor{}
+	for proxy.isStandby() {
+		var err error
+		if cursor, err = proxy.replicateOnce(cursor); err != nil {
+			proxy.log.Error("replication failed", zap.Error(err))
+		}
+		<-ticker.C
+	}
+
+	proxy.log.Info("Stopped replication", zap.String("leader", proxy.LeaderURL))
+}
+
+func (proxy *Proxy) setupLeaderToken() {
+	if proxy.LeaderTokenFile == "" {
+		return
+	}
+
+	token, err := readTokenFile(proxy.LeaderTokenFile)
+	if err != nil {
+		proxy.log.Fatal("reading leader token", zap.Error(err))
+	}
+	proxy.leaderToken = token
+}
+
+// leaderURL resolves ref relative to base, keeping its path.
+func leaderURL(base, ref string) (*url.URL, error) {
+	leader, err := url.Parse(base)
+	if err != nil {
+		return nil, errors.WithMessage(err, "parsing leader URL")
+	}
+	leader.Path = strings.TrimSuffix(leader.Path, "/") + "/"
+
+	rel, err := url.Parse(strings.TrimPrefix(ref, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return leader.ResolveReference(rel), nil
+}
+
+// getLeader asks the replication routes of the leader, which are admin
+// routes, on the LeaderAdminURL if it has a separate admin listener.
+func (proxy *Proxy) getLeader(ref string, v interface{}) error {
+	base := proxy.LeaderURL
+	if proxy.LeaderAdminURL != "" {
+		base = proxy.LeaderAdminURL
+	}
+
+	u, err := leaderURL(base, ref)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return errors.WithMessage(err, "creating request")
+	}
+	if proxy.leaderToken != "" {
+		req.Header.Set("Authorization", "Bearer "+proxy.leaderToken)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.WithMessagef(err, "fetching %s", ref)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("fetching %s: received status %d", ref, res.StatusCode)
+	}
+
+	return errors.WithMessagef(json.NewDecoder(res.Body).Decode(v), "decoding %s", ref)
+}
+
+// replicateOnce copies everything uploaded to the leader after the cursor and
+// returns how far it got. Without a cursor, or if the leader restarted or
+// dropped events we didn't see yet, everything the leader has is compared
+// with what we have instead.
+func (proxy *Proxy) replicateOnce(cursor replicationCursor) (replicationCursor, error) {
+	if cursor.epoch == "" {
+		return proxy.resyncOnce(cursor)
+	}
+
+	events := eventsResponse{}
+	if err := proxy.getLeader("replication/events?since="+strconv.FormatUint(cursor.seq, 10), &events); err != nil {
+		return cursor, err
+	}
+
+	switch {
+	case events.Epoch != cursor.epoch, events.Seq < cursor.seq:
+		proxy.log.Warn("leader restarted, resyncing everything", zap.String("epoch", events.Epoch))
+		return proxy.resyncOnce(cursor)
+	case events.Truncated:
+		proxy.log.Warn("standby fell too far behind, resyncing everything")
+		return proxy.resyncOnce(cursor)
+	}
+
+	for _, event := range events.Events {
+		metricReplicationLagEvents.Set(int64(events.Seq - cursor.seq))
+		metricReplicationLagSeconds.Set(time.Since(event.Time).Seconds())
+
+		if !proxy.isStandby() {
+			break
+		}
+
+		if err := proxy.replicateEvent(event); err != nil {
+			return cursor, err
+		}
+		cursor.seq = event.Seq
+	}
+
+	metricReplicationLagEvents.Set(int64(events.Seq - cursor.seq))
+	if cursor.seq == events.Seq {
+		metricReplicationLagSeconds.Set(0)
+	}
+
+	return cursor, nil
+}
+
+// resyncOnce copies everything the leader has and we don't, and continues
+// with the events after the snapshot.
+func (proxy *Proxy) resyncOnce(cursor replicationCursor) (replicationCursor, error) {
+	snapshot := snapshotResponse{}
+	if err := proxy.getLeader("replication/snapshot", &snapshot); err != nil {
+		return cursor, err
+	}
+
+	for i, path := range snapshot.Paths {
+		metricReplicationLagEvents.Set(int64(len(snapshot.Paths) - i))
+
+		if !proxy.isStandby() {
+			return cursor, nil
+		}
+
+		if _, err := proxy.localIndex.GetIndex(strings.TrimPrefix(path, "/")); err == nil {
+			continue
+		}
+
+		if err := proxy.replicatePath(path); err != nil {
+			return cursor, err
+		}
+	}
+
+	metricReplicationLagEvents.Set(0)
+	metricReplicationLagSeconds.Set(0)
+	return replicationCursor{epoch: snapshot.Epoch, seq: snapshot.Seq}, nil
+}
+
+func (proxy *Proxy) replicateEvent(event uploadEvent) error {
+	if event.Op != eventOpDelete {
+		return proxy.replicatePath(event.Path)
+	}
+
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return nil
+	}
+
+	name := strings.TrimPrefix(event.Path, "/")
+	if !validIndexName(name) {
+		proxy.log.Warn("skipping invalid replicated deletion", zap.String("path", event.Path))
+		metricReplicationSkipped.Add(1)
+		return nil
+	}
+
+	if deleted, err := proxy.removeIndex(indices, name); err != nil {
+		metricReplicationFailed.Add(1)
+		return errors.WithMessagef(err, "replicating deletion of %s", event.Path)
+	} else if !deleted {
+		// keeps it from being fetched from the upstreams here too.
+		if err := proxy.addTombstone(name); err != nil {
+			proxy.log.Error("adding tombstone", zap.String("name", name), zap.Error(err))
+		}
+	}
+
+	metricReplicationApplied.Add(1)
+	return nil
+}
+
+// replicatePath copies path from the leader. Paths that can't be copied at
+// all, because the leader lost them or we reject them, are skipped, or the
+// standby would retry them forever instead of continuing with later ones.
+func (proxy *Proxy) replicatePath(path string) error {
+	u, err := leaderURL(proxy.LeaderURL, path)
+	if err != nil {
+		return err
+	}
+
+	// the leader has it, so it was uploaded again after a replicated deletion.
+	if err := os.Remove(proxy.tombstonePath(strings.TrimPrefix(path, "/"))); err != nil && !os.IsNotExist(err) {
+		proxy.log.Error("removing tombstone", zap.String("path", path), zap.Error(err))
+	}
+
+	if err := proxy.cacheUrl(u.String()); err != nil {
+		if _, ok := errors.Cause(err).(permanentError); ok {
+			proxy.log.Warn("skipping replication", zap.String("path", path), zap.Error(err))
+			metricReplicationSkipped.Add(1)
+			return nil
+		}
+
+		metricReplicationFailed.Add(1)
+		return errors.WithMessagef(err, "replicating %s", path)
+	}
+
+	metricReplicationApplied.Add(1)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterReplication(t *testing.T) {
+	leader := withS3(testProxy(t))
+	srv := httptest.NewServer(testRouter(leader))
+	defer srv.Close()
+
+	apitest.New().
+		Handler(testRouter(leader)).
+		Method("PUT").
+		URL(fNarXz).
+		Body(string(testdata[fNarXz])).
+		Expect(t).
+		Body("ok\n").
+		Status(http.StatusOK).
+		End()
+
+	if events := leader.events.since(0); events.Seq != 1 || events.Events[0].Path != fNar {
+		t.Fatalf("unexpected events: %v", events)
+	}
+
+	standby := testProxy(t)
+	standby.LeaderURL = srv.URL
+	standby.leaderToken = testAdminToken
+	standby.standby = 1
+	router := testRouter(standby)
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Status(http.StatusServiceUnavailable).
+		End()
+
+	cursor, err := standby.replicateOnce(replicationCursor{})
+	if err != nil {
+		t.Fatal(err)
+	} else if cursor.seq != 1 || cursor.epoch != leader.events.epoch {
+		t.Fatalf("expected seq 1 of the leader's epoch, got %v", cursor)
+	}
+
+	apitest.New().
+		Handler(router).
+		Method("GET").
+		URL(fNar).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Body(string(testdata[fNar])).
+		Status(http.StatusOK).
+		End()
+
+	// the leader restarts and forgets its events, what it got since is
+	// only found by resyncing.
+	insertFake(t, leader.localStore, leader.localIndex, fNarinfo)
+	leader.events = newEventLog()
+
+	if cursor, err = standby.replicateOnce(cursor); err != nil {
+		t.Fatal(err)
+	} else if cursor.epoch != leader.events.epoch {
+		t.Fatalf("expected the new epoch of the leader, got %v", cursor)
+	}
+
+	if _, err := standby.localIndex.GetIndex(strings.TrimPrefix(fNarinfo, "/")); err != nil {
+		t.Fatal("expected the narinfo to be resynced")
+	}
+
+	apitest.New().
+		Handler(router).
+		Post("/replication/promote").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Body("promoted\n").
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Body("ok\n").
+		Status(http.StatusOK).
+		End()
+}
+
+func TestReplicationSkipsAndDeletes(t *testing.T) {
+	leader := testProxy(t)
+	srv := httptest.NewServer(testRouter(leader))
+	defer srv.Close()
+	insertFake(t, leader.localStore, leader.localIndex, fNar)
+
+	standby := testProxy(t)
+	standby.LeaderURL = srv.URL
+	standby.standby = 1
+	testRouter(standby)
+
+	// the replication routes are admin routes.
+	if _, err := standby.replicateOnce(replicationCursor{}); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Fatalf("expected the leader to refuse without token, got %v", err)
+	}
+
+	standby.leaderToken = testAdminToken
+	cursor, err := standby.replicateOnce(replicationCursor{})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := standby.localIndex.GetIndex(strings.TrimPrefix(fNar, "/")); err != nil {
+		t.Fatal("expected the NAR to be resynced")
+	}
+
+	// the leader no longer has this one, and the deletion comes after it.
+	leader.events.add(eventOpUpload, "/"+strings.Repeat("0", 32)+".narinfo")
+	apitest.New().
+		Handler(testRouter(leader)).
+		Delete(fNar).
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	if cursor, err = standby.replicateOnce(cursor); err != nil {
+		t.Fatal(err)
+	} else if cursor.seq != 2 {
+		t.Fatalf("expected seq 2, got %v", cursor)
+	}
+
+	if _, err := standby.localIndex.GetIndex(strings.TrimPrefix(fNar, "/")); err == nil {
+		t.Fatal("expected the NAR to be deleted")
+	} else if !standby.tombstoned(strings.TrimPrefix(fNar, "/")) {
+		t.Fatal("expected a tombstone for the NAR")
+	}
+}
+
+func TestReplicationLeaderURL(t *testing.T) {
+	u, err := leaderURL("http://leader.example.com/cache", "/nar/"+strings.Repeat("0", 52)+".nar")
+	if err != nil {
+		t.Fatal(err)
+	} else if u.String() != "http://leader.example.com/cache/nar/"+strings.Repeat("0", 52)+".nar" {
+		t.Fatalf("expected the path prefix to be kept, got %s", u)
+	}
+}
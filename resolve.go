@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/pkg/errors"
+)
+
+// indexTier is an index store together with the store holding the chunks of
+// its indices.
+type indexTier struct {
+	index desync.IndexWriteStore
+	store desync.WriteStore
+	touch func(desync.Index)
+}
+
+// indexTiers lists the configured places to look for indices, nearest first.
+func (proxy *Proxy) indexTiers() []indexTier {
+	tiers := []indexTier{}
+	for _, tier := range []indexTier{
+		{proxy.localIndex, proxy.localStore, proxy.touchChunks()},
+		{proxy.s3Index, proxy.s3Store, nil},
+	} {
+		if tier.index != nil && tier.store != nil {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// withIndexTiers serves requests from the first of the tiers that has the
+// index, and passes them on to h if none has.
+func (proxy *Proxy) withIndexTiers(tiers []indexTier) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		for i := len(tiers) - 1; i >= 0; i-- {
+			h = withCacheHandler(
+				proxy.log,
+				tiers[i].store,
+				tiers[i].index,
+				proxy.trustedKeys,
+				proxy.secretKeys,
+				proxy.PrefetchLinks,
+				tiers[i].touch,
+				proxy.compressed,
+			)(h)
+		}
+		return h
+	}
+}
+
+// resolveIndex returns the index with the given name and the store with its
+// chunks from the first tier that has it, like requests are served.
+func (proxy *Proxy) resolveIndex(name string) (desync.Index, desync.Store, error) {
+	for _, tier := range proxy.indexTiers() {
+		if idx, err := tier.index.GetIndex(name); err == nil {
+			return idx, tier.store, nil
+		}
+	}
+	return desync.Index{}, nil, errors.Errorf("index %q not found", name)
+}
+
+// resolveNarinfo returns the narinfo of the store path hash.
+func (proxy *Proxy) resolveNarinfo(hash string) (*narinfo.Narinfo, error) {
+	idx, store, err := proxy.resolveIndex(hash + ".narinfo")
+	if err != nil {
+		return nil, err
+	}
+	return assembleNarinfo(store, idx)
+}
+
+// indexExists is like resolveIndex, but doesn't decode the index.
+func (proxy *Proxy) indexExists(name string) bool {
+	for _, tier := range proxy.indexTiers() {
+		if hasIndex(tier.index, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/folbricht/desync"
+)
+
+func TestResolveIndex(t *testing.T) {
+	proxy := withS3(testProxy(t))
+	name := strings.TrimPrefix(fNarinfo, "/")
+
+	if _, _, err := proxy.resolveIndex(name); err == nil {
+		t.Fatal("resolved a missing index")
+	} else if proxy.indexExists(name) {
+		t.Fatal("missing index exists")
+	}
+
+	insertFake(t, proxy.s3Store, proxy.s3Index, fNarinfo)
+	if _, store, err := proxy.resolveIndex(name); err != nil {
+		t.Fatal(err)
+	} else if _, local := store.(desync.LocalStore); local {
+		t.Fatal("expected the index from s3")
+	} else if !proxy.indexExists(name) {
+		t.Fatal("index in s3 doesn't exist")
+	}
+
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	if _, store, err := proxy.resolveIndex(name); err != nil {
+		t.Fatal(err)
+	} else if _, local := store.(desync.LocalStore); !local {
+		t.Fatal("expected the local index first")
+	}
+
+	infos, err := proxy.closureNarinfos([]string{"/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 1 {
+		t.Fatalf("unexpected closure: %v", infos)
+	}
+}
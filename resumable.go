@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricStagedParts   = metrics.MustCounter("spongix_staged_upload_parts", "Number of partial NAR uploads received")
+	metricStagedExpired = metrics.MustCounter("spongix_staged_upload_expired", "Number of partial NAR uploads removed after the staging TTL")
+)
+
+var contentRangeRegexp = regexp.MustCompile(`\Abytes (?:(\d+)-(\d+)|\*)/(\d+)\z`)
+
+type contentRange struct {
+	start, end, total int64
+	query             bool
+}
+
+// parseContentRange parses `bytes <start>-<end>/<total>`, or `bytes */<total>`
+// which asks how much was received so far.
+func parseContentRange(raw string) (contentRange, error) {
+	match := contentRangeRegexp.FindStringSubmatch(raw)
+	if match == nil {
+		return contentRange{}, errors.Errorf("invalid Content-Range: %q", raw)
+	}
+
+	cr := contentRange{query: match[1] == ""}
+	var err error
+	if cr.total, err = strconv.ParseInt(match[3], 10, 64); err != nil {
+		return cr, err
+	}
+
+	if cr.query {
+		return cr, nil
+	}
+
+	if cr.start, err = strconv.ParseInt(match[1], 10, 64); err != nil {
+		return cr, err
+	} else if cr.end, err = strconv.ParseInt(match[2], 10, 64); err != nil {
+		return cr, err
+	} else if cr.end < cr.start || cr.end >= cr.total {
+		return cr, errors.Errorf("invalid Content-Range: %q", raw)
+	}
+
+	return cr, nil
+}
+
+// stagedUploads keeps partial NAR uploads on disk until all parts arrived.
+// The total announced by the first part is kept next to it, so later parts
+// can't change it.
+type stagedUploads struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*stagedLock
+}
+
+type stagedLock struct {
+	sync.Mutex
+	users int
+}
+
+const stagedTotalExt = ".total"
+
+func newStagedUploads(dir string) *stagedUploads {
+	return &stagedUploads{dir: dir, locks: map[string]*stagedLock{}}
+}
+
+func (proxy *Proxy) setupStagedUploads() {
+	proxy.staged = newStagedUploads(filepath.Join(proxy.Dir, "tmp", "uploads"))
+}
+
+// lock serializes access to a staged upload, the lock is forgotten once
+// nobody holds or waits for it.
+func (s *stagedUploads) lock(name string) func() {
+	s.mu.Lock()
+	l, found := s.locks[name]
+	if !found {
+		l = &stagedLock{}
+		s.locks[name] = l
+	}
+	l.users++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		s.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(s.locks, name)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *stagedUploads) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *stagedUploads) size(name string) (int64, error) {
+	info, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// total returns the total size announced for the staged upload, 0 if it
+// wasn't started yet.
+func (s *stagedUploads) total(name string) (int64, error) {
+	raw, err := os.ReadFile(s.path(name) + stagedTotalExt)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+func (s *stagedUploads) start(name string, total int64) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(name)+stagedTotalExt, []byte(strconv.FormatInt(total, 10)), 0o644)
+}
+
+func (s *stagedUploads) remove(name string) {
+	_ = os.Remove(s.path(name))
+	_ = os.Remove(s.path(name) + stagedTotalExt)
+}
+
+// truncate drops what was appended beyond size.
+func (s *stagedUploads) truncate(name string, size int64) error {
+	return os.Truncate(s.path(name), size)
+}
+
+// append writes the part to the staged file and returns the new size.
+func (s *stagedUploads) append(name string, rd io.Reader) (int64, error) {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return 0, err
+	}
+
+	fd, err := os.OpenFile(s.path(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	if _, err := io.Copy(fd, rd); err != nil {
+		return 0, err
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// expire removes staged uploads that weren't touched within ttl.
+func (s *stagedUploads) expire(ttl time.Duration) error {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == stagedTotalExt {
+			// only the staged file is touched by every part.
+			name := strings.TrimSuffix(entry.Name(), stagedTotalExt)
+			if _, err := os.Stat(s.path(name)); os.IsNotExist(err) {
+				_ = os.Remove(s.path(entry.Name()))
+			}
+			continue
+		}
+
+		unlock := s.lock(entry.Name())
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > ttl {
+			if err := os.Remove(s.path(entry.Name())); err == nil {
+				_ = os.Remove(s.path(entry.Name()) + stagedTotalExt)
+				metricStagedExpired.Add(1)
+			}
+		}
+		unlock()
+	}
+
+	return nil
+}
+
+func (proxy *Proxy) expireStagedUploads() {
+	if proxy.UploadStagingTTL == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(proxy.UploadStagingTTL / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := proxy.staged.expire(proxy.UploadStagingTTL); err != nil {
+			proxy.log.Error("expiring staged uploads", zap.Error(err))
+		}
+	}
+}
+
+// errStagedPart means the part was rejected and the response already sent.
+var errStagedPart = errors.New("part rejected")
+
+// stagePart appends the part to the staged upload and returns its new size.
+func (proxy *Proxy) stagePart(w http.ResponseWriter, r *http.Request, name string, size int64, cr contentRange) (int64, error) {
+	if cr.start != size {
+		setStagedRange(w, size)
+		answer(w, http.StatusRequestedRangeNotSatisfiable, mimeText, "part doesn't start at the end of the staged upload\n")
+		return 0, errStagedPart
+	}
+
+	if size == 0 {
+		if err := proxy.staged.start(name, cr.total); err != nil {
+			proxy.log.Error("starting staged upload", zap.String("name", name), zap.Error(err))
+			answer(w, http.StatusInternalServerError, mimeText, "failed staging upload\n")
+			return 0, err
+		}
+	}
+
+	appended, err := proxy.staged.append(name, io.LimitReader(r.Body, cr.end-cr.start+1))
+	if err != nil {
+		proxy.log.Error("staging upload", zap.String("name", name), zap.Error(err))
+		answer(w, http.StatusInternalServerError, mimeText, "failed staging upload\n")
+		return 0, err
+	}
+
+	if appended != cr.end+1 {
+		// the part is shorter than announced, so the next one would be at
+		// the wrong offset.
+		if err := proxy.staged.truncate(name, size); err != nil {
+			proxy.log.Error("dropping short part", zap.String("name", name), zap.Error(err))
+		}
+		setStagedRange(w, size)
+		answer(w, http.StatusBadRequest, mimeText, "part is shorter than its Content-Range\n")
+		return 0, errStagedPart
+	}
+
+	metricStagedParts.Add(1)
+	return appended, nil
+}
+
+func setStagedRange(w http.ResponseWriter, size int64) {
+	if size > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+	}
+}
+
+// withResumableUploads lets clients upload a NAR in parts using PUT with a
+// Content-Range header. Parts must arrive in order, each is answered with 202
+// and the Range received so far. Once the last byte arrived, the whole NAR is
+// passed on as a regular upload.
+func (proxy *Proxy) withResumableUploads() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw := r.Header.Get("Content-Range")
+			if r.Method != "PUT" || raw == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cr, err := parseContentRange(raw)
+			if err != nil {
+				answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+				return
+			}
+
+			name := filepath.Base(r.URL.Path)
+			unlock := proxy.staged.lock(name)
+			defer unlock()
+
+			size, err := proxy.staged.size(name)
+			if err != nil {
+				proxy.log.Error("checking staged upload", zap.String("name", name), zap.Error(err))
+				answer(w, http.StatusInternalServerError, mimeText, "failed checking staged upload\n")
+				return
+			}
+
+			total, err := proxy.staged.total(name)
+			if err != nil {
+				proxy.log.Error("checking staged upload total", zap.String("name", name), zap.Error(err))
+				answer(w, http.StatusInternalServerError, mimeText, "failed checking staged upload\n")
+				return
+			}
+
+			if size > 0 && total != 0 && total != cr.total {
+				setStagedRange(w, size)
+				answer(w, http.StatusBadRequest, mimeText, "total doesn't match the staged upload\n")
+				return
+			}
+
+			if cr.query && (size == 0 || size < cr.total) {
+				setStagedRange(w, size)
+				answer(w, http.StatusAccepted, mimeText, "")
+				return
+			}
+
+			// asking for the range of a complete upload finishes it again,
+			// if passing it on failed the first time.
+			if !cr.query {
+				if size, err = proxy.stagePart(w, r, name, size, cr); err != nil {
+					return
+				}
+			}
+
+			if size < cr.total {
+				setStagedRange(w, size)
+				answer(w, http.StatusAccepted, mimeText, "")
+				return
+			}
+
+			fd, err := os.Open(proxy.staged.path(name))
+			if err != nil {
+				proxy.log.Error("opening staged upload", zap.String("name", name), zap.Error(err))
+				answer(w, http.StatusInternalServerError, mimeText, "failed opening staged upload\n")
+				return
+			}
+			defer fd.Close()
+
+			r.Header.Del("Content-Range")
+			r.Body = fd
+			r.ContentLength = size
+			record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(record, r)
+
+			// keep the parts if the upload failed, so it can be finished
+			// later instead of starting over.
+			if record.status == http.StatusOK {
+				proxy.staged.remove(name)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterResumableUpload(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	nar := string(testdata[fNar])
+	total := strconv.Itoa(len(nar))
+	half := len(nar) / 2
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Header("Content-Range", "bytes 0-"+strconv.Itoa(half-1)+"/"+total).
+		Body(nar[:half]).
+		Expect(t).
+		Header("Range", "bytes=0-"+strconv.Itoa(half-1)).
+		Status(http.StatusAccepted).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Header("Content-Range", "bytes */"+total).
+		Expect(t).
+		Header("Range", "bytes=0-"+strconv.Itoa(half-1)).
+		Status(http.StatusAccepted).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Header("Content-Range", "bytes 0-"+strconv.Itoa(half-1)+"/"+total).
+		Body(nar[:half]).
+		Expect(t).
+		Status(http.StatusRequestedRangeNotSatisfiable).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Header("Content-Range", "bytes "+strconv.Itoa(half)+"-"+strconv.Itoa(len(nar)-1)+"/"+strconv.Itoa(len(nar)+1)).
+		Body(nar[half:]).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Header("Content-Range", "bytes "+strconv.Itoa(half)+"-"+strconv.Itoa(len(nar)-1)+"/"+total).
+		Body(nar[half:len(nar)-1]).
+		Expect(t).
+		Header("Range", "bytes=0-"+strconv.Itoa(half-1)).
+		Status(http.StatusBadRequest).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Method("PUT").
+		URL(fNar).
+		Header("Content-Range", "bytes "+strconv.Itoa(half)+"-"+strconv.Itoa(len(nar)-1)+"/"+total).
+		Body(nar[half:]).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(router).
+		Get(fNar).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Body(nar).
+		Status(http.StatusOK).
+		End()
+
+	if len(proxy.staged.locks) != 0 {
+		t.Fatalf("expected the locks to be pruned, got %d", len(proxy.staged.locks))
+	}
+
+	t.Run("keeps the parts if passing them on fails", func(tt *testing.T) {
+		url := "/nar/0000000000000000000000000000000000000000000000000000.nar"
+		apitest.New().
+			Handler(router).
+			Method("PUT").
+			URL(url).
+			Header("Content-Range", "bytes 0-9/10").
+			Body("not a nar!").
+			Expect(tt).
+			Status(http.StatusBadRequest).
+			End()
+
+		if size, _ := proxy.staged.size(filepath.Base(url)); size != 10 {
+			tt.Fatalf("expected the staged upload to be kept, got %d bytes", size)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -8,6 +9,7 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
 )
 
 const (
@@ -15,88 +17,195 @@ const (
 	mimeNar          = "application/x-nix-nar"
 	mimeText         = "text/plain"
 	mimeNixCacheInfo = "text/x-nix-cache-info"
+	mimeOctetStream  = "application/octet-stream"
 )
 
+var metricUnknownUploads = metrics.MustCounter("spongix_unknown_uploads", "Number of uploads to paths that take none")
+
 func (proxy *Proxy) router() *mux.Router {
 	r := mux.NewRouter()
-	r.NotFoundHandler = notFound{}
-	r.MethodNotAllowedHandler = notAllowed{}
+	r.NotFoundHandler = notFound{proxy.log}
+	r.MethodNotAllowedHandler = notAllowed{proxy.log}
 	r.Use(
+		withTracing(),
 		withHTTPLogging(proxy.log),
 		handlers.RecoveryHandler(handlers.PrintRecoveryStack(true)),
+		withLegacyRoutes(),
+		proxy.withAudit(),
+		proxy.withStats(),
+		proxy.withCacheEvents(),
+		proxy.withRateLimit(),
+		proxy.withReadOnly(),
 	)
 
-	r.HandleFunc("/metrics", metrics.ServeHTTP)
+	r.HandleFunc("/healthz", proxy.serveHealthz).Methods("GET")
+	r.HandleFunc("/readyz", proxy.serveReadyz).Methods("GET")
+	r.HandleFunc("/events", proxy.serveEvents).Methods("GET")
+	r.HandleFunc("/derivations/{hash:[0-9a-df-np-sv-z]{52}}.drv", proxy.derivationJSON).Methods("GET")
+	r.HandleFunc("/derivations/by-output/{hash:[0-9a-df-np-sv-z]{32}}", proxy.derivationByOutput).Methods("GET")
+	r.HandleFunc("/index/{name:[0-9a-df-np-sv-z]{32}\\.narinfo|nar/[0-9a-df-np-sv-z]{52}(?:\\.nar|\\.drv)}.caibx", proxy.serveChunkIndex).Methods("HEAD", "GET")
+	r.HandleFunc("/artifacts/{host}/{path:.+}", proxy.serveArtifact).Methods("HEAD", "GET")
+	r.HandleFunc("/proxy/{name}/{path:.+}", proxy.serveProxyRoute).Methods("HEAD", "GET")
+	r.HandleFunc("/chunks/{id:[0-9a-f]{64}}", proxy.serveChunk).Methods("HEAD", "GET")
+	r.HandleFunc("/chunks/{prefix:[0-9a-f]{4}}/{id:[0-9a-f]{64}}.cacnk", proxy.serveChunk).Methods("HEAD", "GET")
+	if proxy.AdminListen == "" {
+		r.HandleFunc("/metrics", proxy.serveMetrics)
+		admin := r.NewRoute().Subrouter()
+		admin.Use(proxy.withAdminAuth())
+		proxy.adminRoutes(admin)
+	}
+
+	var rewrite narinfoRewriter
+	if proxy.RewriteUpstreamNarinfo {
+		rewrite = proxy.rewriteNarinfo
+	}
 
 	newDockerHandler(proxy.log, proxy.localStore, proxy.localIndex, filepath.Join(proxy.Dir, "oci"), r)
 
+	// both chains are wrapped once here, mux would wrap route middlewares again
+	// on every request.
+	narinfo := proxy.narinfoHandler(rewrite)
+	nar := chain(http.HandlerFunc(serveNotFound),
+		proxy.withCacheControl(true),
+		proxy.withUploadLimiter(),
+		proxy.withIdempotencyKeys(),
+		proxy.withTombstones(),
+		proxy.withZstdResponses(),
+		proxy.withReplication(),
+		proxy.withSecondaries(),
+		proxy.withDedupStats(),
+		proxy.withResumableUploads(),
+		proxy.withCanaryHandler(),
+		withRemoteHandler(proxy.log, proxy.upstreams, []string{"", ".xz"}, proxy.cacheQueue, nil),
+	)
+
 	// backwards compat
-	for _, prefix := range []string{"/cache", ""} {
+	for _, prefix := range []string{legacyPrefix, ""} {
 		r.HandleFunc(prefix+"/nix-cache-info", proxy.nixCacheInfo).Methods("GET")
+		r.HandleFunc(prefix+"/query-missing", proxy.queryMissing).Methods("POST")
 
-		narinfo := r.Name("narinfo").Path(prefix + "/{hash:[0-9a-df-np-sv-z]{32}}.narinfo").Subrouter()
-		narinfo.Use(
-			proxy.withLocalCacheHandler(),
-			proxy.withS3CacheHandler(),
-			withRemoteHandler(proxy.log, proxy.Substituters, []string{""}, proxy.cacheChan),
-		)
-		narinfo.Methods("HEAD", "GET", "PUT").HandlerFunc(serveNotFound)
-
-		nar := r.Name("nar").Path(prefix + "/nar/{hash:[0-9a-df-np-sv-z]{52}}{ext:\\.nar(?:\\.xz|)}").Subrouter()
-		nar.Use(
-			proxy.withLocalCacheHandler(),
-			proxy.withS3CacheHandler(),
-			withRemoteHandler(proxy.log, proxy.Substituters, []string{"", ".xz"}, proxy.cacheChan),
-		)
-		nar.Methods("HEAD", "GET", "PUT").HandlerFunc(serveNotFound)
+		r.Name("narinfo").Path(prefix+"/{hash:[0-9a-df-np-sv-z]{32}}.narinfo").
+			Methods("HEAD", "GET", "PUT").Handler(narinfo)
+		r.Name("nar").Path(prefix+"/nar/{hash:[0-9a-df-np-sv-z]{52}}{ext:\\.nar(?:\\.xz|\\.zst|\\.bz2|)|\\.drv}").
+			Methods("HEAD", "GET", "PUT").Handler(nar)
 	}
 
+	// registered last, so it only gets the uploads no other route takes. Not
+	// using Methods, other methods would get a mismatch instead of a 404.
+	isPut := func(r *http.Request, _ *mux.RouteMatch) bool { return r.Method == "PUT" }
+	r.MatcherFunc(isPut).HandlerFunc(proxy.unknownUpload)
+
 	return r
 }
 
-func (proxy *Proxy) withLocalCacheHandler() mux.MiddlewareFunc {
-	return withCacheHandler(
-		proxy.log,
-		proxy.localStore,
-		proxy.localIndex,
-		proxy.trustedKeys,
-		proxy.secretKeys,
+// narinfoHandler serves and takes narinfos, shared by the narinfo routes and
+// seeds, so narinfos from seeds are checked like uploads.
+func (proxy *Proxy) narinfoHandler(rewrite narinfoRewriter) http.Handler {
+	return chain(http.HandlerFunc(serveNotFound),
+		proxy.withCacheControl(false),
+		proxy.withUploadLimiter(),
+		proxy.withIdempotencyKeys(),
+		proxy.withTombstones(),
+		proxy.withNarinfoHistory(),
+		proxy.withReplication(),
+		proxy.withSecondaries(),
+		proxy.withDedupStats(),
+		withUploadedNarinfo(),
+		proxy.withDeriverPolicy(),
+		proxy.withStrictReferences(),
+		proxy.withNarHashVerification(),
+		proxy.withNarinfoPolicy(),
+		proxy.withReferencePrefetch(),
+		proxy.withNarinfoCache(),
+		proxy.withCanaryHandler(),
+		withRemoteHandler(proxy.log, proxy.upstreams, []string{""}, proxy.cacheQueue, rewrite),
 	)
 }
 
-func (proxy *Proxy) withS3CacheHandler() mux.MiddlewareFunc {
-	return withCacheHandler(
-		proxy.log,
-		proxy.s3Store,
-		proxy.s3Index,
-		proxy.trustedKeys,
-		proxy.secretKeys,
-	)
+// chain wraps h in the middlewares, the first one is called first.
+func chain(h http.Handler, middlewares ...mux.MiddlewareFunc) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
 }
 
-type notAllowed struct{}
+type notAllowed struct {
+	log *zap.Logger
+}
 
 func (n notAllowed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	pp("*** 405", r.Method, r.URL.Path, mux.Vars(r))
+	n.log.Debug("method not allowed", zap.String("method", r.Method), zap.String("path", r.URL.Path))
+	answer(w, http.StatusMethodNotAllowed, mimeText, "method not allowed\n")
 }
 
-type notFound struct{}
+type notFound struct {
+	log *zap.Logger
+}
 
 func (n notFound) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.log.Debug("no route", zap.String("method", r.Method), zap.String("path", r.URL.Path))
 	serveNotFound(w, r)
 }
 
 func serveNotFound(w http.ResponseWriter, r *http.Request) {
-	pp("*** 404", r.Method, r.URL.Path, mux.Vars(r))
 	w.Header().Set(headerContentType, mimeText)
 	w.Header().Set(headerCache, headerCacheMiss)
 	w.WriteHeader(http.StatusNotFound)
 	_, _ = w.Write([]byte("not found"))
 }
 
+type unknownUploadError struct {
+	Error    string   `json:"error"`
+	Path     string   `json:"path"`
+	Expected []string `json:"expected"`
+}
+
+// PUT to any other path
+// Usually a typo in the cache URL of a CI job, like an extra path segment, so
+// this says where uploads go instead of answering with a bare 404.
+func (proxy *Proxy) unknownUpload(w http.ResponseWriter, r *http.Request) {
+	metricUnknownUploads.Add(1)
+	proxy.log.Warn("upload to unknown path", zap.String("path", r.URL.Path))
+
+	w.Header().Set(headerContentType, mimeJson)
+	w.WriteHeader(proxy.UnknownUploadStatus)
+	if err := json.NewEncoder(w).Encode(unknownUploadError{
+		Error: "nothing can be uploaded to this path",
+		Path:  r.URL.Path,
+		Expected: []string{
+			"/<hash>.narinfo",
+			"/nar/<hash>.nar[.xz|.zst|.bz2]",
+			"/nar/<hash>.drv",
+			"/v2/<name>/manifests/<reference>",
+		},
+	}); err != nil {
+		proxy.log.Error("encoding unknown upload error", zap.Error(err))
+	}
+}
+
 // GET /nix-cache-info
+// If any of the stores are unhealthy, we either advertise a low priority or
+// respond with 503 so Nix prefers other substituters.
 func (proxy *Proxy) nixCacheInfo(w http.ResponseWriter, r *http.Request) {
+	priority := proxy.CacheInfoPriority
+
+	if err := proxy.checkHealthCached(); err != nil {
+		proxy.log.Error("store is unhealthy", zap.Error(err))
+		if proxy.UnhealthyUnavailable {
+			answer(w, http.StatusServiceUnavailable, mimeText, "unhealthy\n")
+			return
+		}
+		priority = proxy.UnhealthyPriority
+	}
+
+	wantMassQuery := "0"
+	if proxy.WantMassQuery {
+		wantMassQuery = "1"
+	}
+
+	w.Header().Set(headerInstance, proxy.instance)
 	answer(w, http.StatusOK, mimeNixCacheInfo, `StoreDir: /nix/store
-WantMassQuery: 1
-Priority: `+strconv.FormatUint(proxy.CacheInfoPriority, 10))
+WantMassQuery: `+wantMassQuery+`
+Priority: `+strconv.FormatUint(priority, 10))
 }
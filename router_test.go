@@ -4,13 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/klauspost/compress/zstd"
 	"github.com/steinfletcher/apitest"
 	"go.uber.org/zap"
 )
@@ -37,6 +45,9 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// testAdminToken authorizes admin requests on the cache listener in tests.
+const testAdminToken = "admin"
+
 func testProxy(t *testing.T) *Proxy {
 	proxy := NewProxy()
 	proxy.Substituters = []string{"http://example.com"}
@@ -60,11 +71,28 @@ func testProxy(t *testing.T) *Proxy {
 	proxy.Dir = t.TempDir()
 	proxy.TrustedPublicKeys = []string{"cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="}
 	proxy.setupKeys()
+	proxy.adminToken = testAdminToken
 	// NOTE: uncomment this line to enable logging
 	proxy.log = zap.NewNop()
 	return proxy
 }
 
+// testRouter sets up the handlers like main does, once the test is done
+// configuring the proxy.
+func testRouter(proxy *Proxy) *mux.Router {
+	if proxy.jobs == nil {
+		proxy.setupHandlers()
+	}
+	return proxy.router()
+}
+
+// testAdminRequest is a request to the admin routes with the admin token.
+func testAdminRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
 func withS3(proxy *Proxy) *Proxy {
 	proxy.s3Index = newFakeIndex()
 	proxy.s3Store = newFakeStore()
@@ -75,7 +103,7 @@ func TestRouterNixCacheInfo(t *testing.T) {
 	proxy := testProxy(t)
 
 	apitest.New().
-		Handler(proxy.router()).
+		Handler(testRouter(proxy)).
 		Get("/nix-cache-info").
 		Expect(t).
 		Header(headerContentType, mimeNixCacheInfo).
@@ -86,12 +114,45 @@ Priority: 50`).
 		End()
 }
 
+func TestRouterNixCacheInfoUnhealthy(t *testing.T) {
+	t.Run("low priority", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+		proxy.s3Store.(*fakeStore).err = errors.New("connection refused")
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Get("/nix-cache-info").
+			Expect(tt).
+			Header(headerContentType, mimeNixCacheInfo).
+			Body(`StoreDir: /nix/store
+WantMassQuery: 1
+Priority: 1000`).
+			Status(http.StatusOK).
+			End()
+	})
+
+	t.Run("unavailable", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+		proxy.UnhealthyUnavailable = true
+		proxy.s3Store.(*fakeStore).err = errors.New("connection refused")
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Get("/nix-cache-info").
+			Expect(tt).
+			Header(headerContentType, mimeText).
+			Body("unhealthy\n").
+			Status(http.StatusServiceUnavailable).
+			End()
+	})
+}
+
 func TestRouterNarinfoHead(t *testing.T) {
 	t.Run("not found", func(tt *testing.T) {
 		proxy := testProxy(tt)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNarinfo).
 			Expect(tt).
@@ -113,7 +174,7 @@ func TestRouterNarinfoHead(t *testing.T) {
 					Status(http.StatusOK).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNarinfo).
 			Expect(tt).
@@ -130,7 +191,7 @@ func TestRouterNarinfoHead(t *testing.T) {
 		insertFake(tt, proxy.localStore, proxy.localIndex, fNarinfo)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNarinfo).
 			Expect(tt).
@@ -146,7 +207,7 @@ func TestRouterNarinfoHead(t *testing.T) {
 		insertFake(tt, proxy.s3Store, proxy.s3Index, fNarinfo)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNarinfo).
 			Expect(tt).
@@ -174,7 +235,7 @@ func TestRouterNarHead(t *testing.T) {
 					RespondWith().
 					Status(http.StatusNotFound).
 					End()).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNar).
 			Expect(tt).
@@ -201,7 +262,7 @@ func TestRouterNarHead(t *testing.T) {
 					Status(http.StatusNotFound).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNar).
 			Expect(tt).
@@ -218,7 +279,7 @@ func TestRouterNarHead(t *testing.T) {
 		insertFake(tt, proxy.localStore, proxy.localIndex, fNar)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNar).
 			Expect(tt).
@@ -241,7 +302,7 @@ func TestRouterNarHead(t *testing.T) {
 					Status(http.StatusNotFound).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("HEAD").
 			URL(fNar).
 			Expect(tt).
@@ -270,7 +331,7 @@ func TestRouterNarGet(t *testing.T) {
 					Status(http.StatusNotFound).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNar).
 			Expect(tt).
@@ -298,7 +359,7 @@ func TestRouterNarGet(t *testing.T) {
 					Status(http.StatusNotFound).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNar).
 			Expect(tt).
@@ -327,7 +388,7 @@ func TestRouterNarGet(t *testing.T) {
 					Status(http.StatusNotFound).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarXz).
 			Expect(tt).
@@ -344,7 +405,7 @@ func TestRouterNarGet(t *testing.T) {
 		insertFake(tt, proxy.localStore, proxy.localIndex, fNar)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNar).
 			Expect(tt).
@@ -355,12 +416,42 @@ func TestRouterNarGet(t *testing.T) {
 			End()
 	})
 
+	t.Run("found local with zstd encoding", func(tt *testing.T) {
+		proxy := testProxy(tt)
+		proxy.ZstdResponses = true
+		insertFake(tt, proxy.localStore, proxy.localIndex, fNar)
+
+		req := httptest.NewRequest("GET", fNar, nil)
+		req.Header.Set("Accept-Encoding", "gzip, zstd")
+		res := httptest.NewRecorder()
+		testRouter(proxy).ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK {
+			tt.Fatalf("expected status 200, got %d", res.Code)
+		} else if res.Header().Get("Content-Encoding") != "zstd" {
+			tt.Fatalf("expected zstd encoding, got %q", res.Header().Get("Content-Encoding"))
+		}
+
+		dec, err := zstd.NewReader(res.Body)
+		if err != nil {
+			tt.Fatal(err)
+		}
+		defer dec.Close()
+
+		body, err := io.ReadAll(dec)
+		if err != nil {
+			tt.Fatal(err)
+		} else if !bytes.Equal(body, testdata[fNar]) {
+			tt.Fatal("decompressed body doesn't match")
+		}
+	})
+
 	t.Run("found s3", func(tt *testing.T) {
 		proxy := withS3(testProxy(tt))
 		insertFake(tt, proxy.s3Store, proxy.s3Index, fNar)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNar).
 			Expect(tt).
@@ -377,7 +468,7 @@ func TestRouterNarinfoGet(t *testing.T) {
 		proxy := testProxy(tt)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -393,7 +484,7 @@ func TestRouterNarinfoGet(t *testing.T) {
 		insertFake(tt, proxy.localStore, proxy.localIndex, fNarinfo)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -409,7 +500,7 @@ func TestRouterNarinfoGet(t *testing.T) {
 		insertFake(tt, proxy.s3Store, proxy.s3Index, fNarinfo)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -434,7 +525,7 @@ func TestRouterNarinfoGet(t *testing.T) {
 					Status(http.StatusOK).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -446,10 +537,67 @@ func TestRouterNarinfoGet(t *testing.T) {
 			End()
 	})
 
+	t.Run("rewrites remote", func(tt *testing.T) {
+		proxy := testProxy(tt)
+		proxy.RewriteUpstreamNarinfo = true
+		proxy.secretKeys["foo"] = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+		expectInfo := &narinfo.Narinfo{}
+		if err := expectInfo.Unmarshal(bytes.NewReader(testdata[fNarinfo])); err != nil {
+			tt.Fatal(err)
+		}
+		expectInfo.Sign("foo", proxy.secretKeys["foo"])
+		expect := &bytes.Buffer{}
+		if err := expectInfo.Marshal(expect); err != nil {
+			tt.Fatal(err)
+		}
+
+		apitest.New().
+			Mocks(
+				apitest.NewMock().
+					Get(fNarinfo).
+					RespondWith().
+					Body(string(testdata[fNarinfo])).
+					Status(http.StatusOK).
+					End(),
+			).
+			Handler(testRouter(proxy)).
+			Method("GET").
+			URL(fNarinfo).
+			Expect(tt).
+			Header(headerCache, headerCacheRemote).
+			Body(expect.String()).
+			Status(http.StatusOK).
+			End()
+	})
+
+	t.Run("rejects untrusted remote", func(tt *testing.T) {
+		proxy := testProxy(tt)
+		proxy.RewriteUpstreamNarinfo = true
+		proxy.trustedKeys = map[string]ed25519.PublicKey{}
+
+		apitest.New().
+			Mocks(
+				apitest.NewMock().
+					Get(fNarinfo).
+					RespondWith().
+					Body(string(testdata[fNarinfo])).
+					Status(http.StatusOK).
+					End(),
+			).
+			Handler(testRouter(proxy)).
+			Method("GET").
+			URL(fNarinfo).
+			Expect(tt).
+			Header(headerCache, headerCacheMiss).
+			Status(http.StatusNotFound).
+			End()
+	})
+
 	t.Run("copies remote to local", func(tt *testing.T) {
 		proxy := testProxy(tt)
 		go proxy.startCache()
-		defer close(proxy.cacheChan)
+		defer proxy.cacheQueue.close()
 
 		mockReset := apitest.NewStandaloneMocks(
 			apitest.NewMock().
@@ -470,7 +618,7 @@ func TestRouterNarinfoGet(t *testing.T) {
 					Status(http.StatusOK).
 					End(),
 			).
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -486,7 +634,7 @@ func TestRouterNarinfoGet(t *testing.T) {
 		}
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -503,7 +651,7 @@ func TestRouterNarinfoPut(t *testing.T) {
 		proxy := withS3(testProxy(tt))
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("PUT").
 			URL(fNarinfo).
 			Body(string(testdata[fNarinfo])).
@@ -514,7 +662,7 @@ func TestRouterNarinfoPut(t *testing.T) {
 			End()
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -529,7 +677,7 @@ func TestRouterNarinfoPut(t *testing.T) {
 		proxy := testProxy(tt)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("PUT").
 			URL(fNarinfo).
 			Body("blah").
@@ -540,11 +688,26 @@ func TestRouterNarinfoPut(t *testing.T) {
 			End()
 	})
 
+	t.Run("upload too large", func(tt *testing.T) {
+		proxy := testProxy(tt)
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Method("PUT").
+			URL(fNarinfo).
+			Body(strings.Repeat("References: x\n", maxNarinfoSize/14+1)).
+			Expect(tt).
+			Header(headerContentType, mimeText).
+			Body("narinfo is too large\n").
+			Status(http.StatusRequestEntityTooLarge).
+			End()
+	})
+
 	t.Run("upload unsigned", func(tt *testing.T) {
 		proxy := testProxy(tt)
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("PUT").
 			URL(fNarinfo).
 			Body("blah").
@@ -561,7 +724,7 @@ func TestRouterNarinfoPut(t *testing.T) {
 		seed := make([]byte, ed25519.SeedSize)
 		proxy.secretKeys["foo"] = ed25519.NewKeyFromSeed(seed)
 
-		emptyInfo := &Narinfo{}
+		emptyInfo := &narinfo.Narinfo{}
 		if err := emptyInfo.Unmarshal(bytes.NewReader(testdata[fNarinfo])); err != nil {
 			tt.Fatal(err)
 		}
@@ -572,7 +735,7 @@ func TestRouterNarinfoPut(t *testing.T) {
 		}
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("PUT").
 			URL(fNarinfo).
 			Body(empty.String()).
@@ -582,7 +745,7 @@ func TestRouterNarinfoPut(t *testing.T) {
 			Status(http.StatusOK).
 			End()
 
-		expectInfo := &Narinfo{}
+		expectInfo := &narinfo.Narinfo{}
 		if err := expectInfo.Unmarshal(bytes.NewReader(testdata[fNarinfo])); err != nil {
 			tt.Fatal(err)
 		}
@@ -593,7 +756,7 @@ func TestRouterNarinfoPut(t *testing.T) {
 		}
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNarinfo).
 			Expect(tt).
@@ -610,7 +773,7 @@ func TestRouterNarPut(t *testing.T) {
 		proxy := withS3(testProxy(tt))
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("PUT").
 			URL(fNar).
 			Body(string(testdata[fNar])).
@@ -621,7 +784,7 @@ func TestRouterNarPut(t *testing.T) {
 			End()
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNar).
 			Expect(tt).
@@ -636,7 +799,7 @@ func TestRouterNarPut(t *testing.T) {
 		proxy := withS3(testProxy(tt))
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("PUT").
 			URL(fNarXz).
 			Body(string(testdata[fNarXz])).
@@ -647,7 +810,71 @@ func TestRouterNarPut(t *testing.T) {
 			End()
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
+			Method("GET").
+			URL(fNar).
+			Expect(tt).
+			Header(headerContentType, mimeNar).
+			Header(headerCache, headerCacheHit).
+			Body(string(testdata[fNar])).
+			Status(http.StatusOK).
+			End()
+	})
+
+	t.Run("upload of unknown length success", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+
+		for _, url := range []string{fNar, fNarXz} {
+			body := io.MultiReader(bytes.NewReader(testdata[url]))
+			req := httptest.NewRequest("PUT", url, body)
+			if req.ContentLength != -1 {
+				tt.Fatalf("expected unknown content length, got %d", req.ContentLength)
+			}
+
+			res := httptest.NewRecorder()
+			testRouter(proxy).ServeHTTP(res, req)
+			if res.Code != http.StatusOK {
+				tt.Fatalf("expected status 200, got %d: %s", res.Code, res.Body.String())
+			}
+		}
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Method("GET").
+			URL(fNar).
+			Expect(tt).
+			Header(headerContentType, mimeNar).
+			Header(headerCache, headerCacheHit).
+			Body(string(testdata[fNar])).
+			Status(http.StatusOK).
+			End()
+	})
+
+	t.Run("upload zst success", func(tt *testing.T) {
+		proxy := withS3(testProxy(tt))
+
+		compressed := &bytes.Buffer{}
+		if enc, err := zstd.NewWriter(compressed); err != nil {
+			tt.Fatal(err)
+		} else if _, err := enc.Write(testdata[fNar]); err != nil {
+			tt.Fatal(err)
+		} else if err := enc.Close(); err != nil {
+			tt.Fatal(err)
+		}
+
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Method("PUT").
+			URL(fNar+".zst").
+			Body(compressed.String()).
+			Expect(tt).
+			Header(headerContentType, mimeText).
+			Body("ok\n").
+			Status(http.StatusOK).
+			End()
+
+		apitest.New().
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNar).
 			Expect(tt).
@@ -662,7 +889,7 @@ func TestRouterNarPut(t *testing.T) {
 		proxy := withS3(testProxy(tt))
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("PUT").
 			URL("/cache"+fNarXz).
 			Body(string(testdata[fNarXz])).
@@ -673,7 +900,7 @@ func TestRouterNarPut(t *testing.T) {
 			End()
 
 		apitest.New().
-			Handler(proxy.router()).
+			Handler(testRouter(proxy)).
 			Method("GET").
 			URL(fNar).
 			Expect(tt).
@@ -685,6 +912,70 @@ func TestRouterNarPut(t *testing.T) {
 	})
 }
 
+func TestRouterNixCacheInfoWantMassQuery(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.WantMassQuery = false
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get("/nix-cache-info").
+		Expect(t).
+		Body(`StoreDir: /nix/store
+WantMassQuery: 0
+Priority: 50`).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestRouterUnknownUpload(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("PUT", "/ci-cahce"+fNarinfo, bytes.NewReader(testdata[fNarinfo])))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+
+	report := unknownUploadError{}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	} else if report.Path != "/ci-cahce"+fNarinfo || len(report.Expected) == 0 {
+		t.Fatalf("unexpected error %+v", report)
+	}
+
+	// other methods still get a plain 404.
+	apitest.New().
+		Handler(router).
+		Get("/ci-cahce"+fNarinfo).
+		Expect(t).
+		Header(headerContentType, mimeText).
+		Status(http.StatusNotFound).
+		End()
+
+	proxy = testProxy(t)
+	proxy.UnknownUploadStatus = http.StatusForbidden
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Method("PUT").
+		URL("/nar/invalid.nar").
+		Expect(t).
+		Header(headerContentType, mimeJson).
+		Status(http.StatusForbidden).
+		End()
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	apitest.New().
+		Handler(testRouter(testProxy(t))).
+		Post("/healthz").
+		Expect(t).
+		Body("method not allowed\n").
+		Status(http.StatusMethodNotAllowed).
+		End()
+}
+
 func insertFake(
 	t *testing.T,
 	store desync.WriteStore,
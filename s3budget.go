@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	minio "github.com/minio/minio-go/v6"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	metricS3Requests        = metrics.Must1LabelCounter("spongix_s3_requests", "op")
+	metricS3Throttled       = metrics.MustCounter("spongix_s3_throttled", "Number of S3 requests rejected with SlowDown")
+	metricS3ListObjects     = metrics.MustCounter("spongix_s3_list_objects", "Number of objects returned by S3 LIST requests")
+	metricS3ListPages       = metrics.MustCounter("spongix_s3_list_pages", "Number of pages of S3 LIST requests")
+	metricS3ListTime        = metrics.MustCounter("spongix_s3_list_time", "Total time spent listing S3 prefixes in ms")
+	metricS3BudgetExhausted = metrics.MustCounter("spongix_s3_budget_exhausted", "Number of background S3 requests refused because the request budget was used up")
+)
+
+func init() {
+	metrics.MustHelp("spongix_s3_requests", "Number of requests sent to S3")
+}
+
+var errS3BudgetExhausted = errors.New("S3 request budget exhausted")
+
+// s3Budget limits the S3 requests of background jobs to a number per hour.
+// Requests serving clients are never refused, but use up the budget, so jobs
+// back off while traffic is high. A nil budget only counts requests.
+type s3Budget struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+	now    func() time.Time
+}
+
+func newS3Budget(perHour uint64) *s3Budget {
+	if perHour == 0 {
+		return nil
+	}
+
+	now := time.Now
+	return &s3Budget{
+		bucket: &tokenBucket{
+			rate:   float64(perHour) / time.Hour.Seconds(),
+			burst:  float64(perHour),
+			tokens: float64(perHour),
+			last:   now(),
+		},
+		now: now,
+	}
+}
+
+func (proxy *Proxy) setupS3Budget() {
+	proxy.s3Budget = newS3Budget(proxy.S3RequestBudget)
+}
+
+// spend records a request that is sent regardless of the budget.
+func (b *s3Budget) spend(op string) {
+	metricS3Requests(op).Add(1)
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket.refill(b.now())
+	b.bucket.tokens--
+}
+
+// take records a request of a background job, or refuses it if the budget is
+// used up.
+func (b *s3Budget) take(op string) error {
+	if b != nil {
+		b.mu.Lock()
+		b.bucket.refill(b.now())
+		exhausted := b.bucket.tokens < 1
+		b.mu.Unlock()
+
+		if exhausted {
+			metricS3BudgetExhausted.Add(1)
+			return errS3BudgetExhausted
+		}
+	}
+
+	b.spend(op)
+	return nil
+}
+
+// countS3Error records throttling, which S3 answers with SlowDown.
+func countS3Error(err error) error {
+	if err != nil && minio.ToErrorResponse(errors.Cause(err)).Code == "SlowDown" {
+		metricS3Throttled.Add(1)
+	}
+	return err
+}
+
+// budgetedStore counts the requests to an S3 chunk store.
+type budgetedStore struct {
+	desync.WriteStore
+	budget *s3Budget
+}
+
+func (s budgetedStore) GetChunk(id desync.ChunkID) (*desync.Chunk, error) {
+	s.budget.spend("get")
+	chunk, err := s.WriteStore.GetChunk(id)
+	return chunk, countS3Error(err)
+}
+
+func (s budgetedStore) HasChunk(id desync.ChunkID) (bool, error) {
+	s.budget.spend("head")
+	found, err := s.WriteStore.HasChunk(id)
+	return found, countS3Error(err)
+}
+
+func (s budgetedStore) StoreChunk(chunk *desync.Chunk) error {
+	s.budget.spend("put")
+	return countS3Error(s.WriteStore.StoreChunk(chunk))
+}
+
+// budgetedIndex counts the requests to an S3 index store.
+type budgetedIndex struct {
+	desync.IndexWriteStore
+	budget *s3Budget
+}
+
+func (s budgetedIndex) GetIndexReader(name string) (io.ReadCloser, error) {
+	s.budget.spend("get")
+	rd, err := s.IndexWriteStore.GetIndexReader(name)
+	return rd, countS3Error(err)
+}
+
+func (s budgetedIndex) GetIndex(name string) (desync.Index, error) {
+	s.budget.spend("get")
+	idx, err := s.IndexWriteStore.GetIndex(name)
+	return idx, countS3Error(err)
+}
+
+func (s budgetedIndex) StoreIndex(name string, idx desync.Index) error {
+	s.budget.spend("put")
+	return countS3Error(s.IndexWriteStore.StoreIndex(name, idx))
+}
+
+func (s budgetedIndex) RemoveIndex(name string) error {
+	remover, ok := s.IndexWriteStore.(indexRemover)
+	if !ok {
+		return errors.New("the index store doesn't support deletion")
+	}
+
+	s.budget.spend("delete")
+	return countS3Error(remover.RemoveIndex(name))
+}
+
+// listS3 lists the keys below the prefix page by page, every page is a
+// request taken from the budget.
+func listS3(core minio.Core, bucket, prefix string, budget *s3Budget) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		if err := budget.take("list"); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		page, err := core.ListObjectsV2(bucket, prefix, token, false, "", 1000, "")
+		metricS3ListTime.Add(uint64(time.Since(start).Milliseconds()))
+		if err != nil {
+			return nil, errors.WithMessagef(countS3Error(err), "listing %s/%s", bucket, prefix)
+		}
+
+		metricS3ListPages.Add(1)
+		metricS3ListObjects.Add(uint64(len(page.Contents)))
+		for _, object := range page.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		if !page.IsTruncated {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
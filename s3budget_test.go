@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+func TestS3Budget(t *testing.T) {
+	budget := newS3Budget(3)
+	now := time.Now()
+	budget.now = func() time.Time { return now }
+	budget.bucket.last = now
+
+	for i := 0; i < 2; i++ {
+		if err := budget.take("list"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// serving clients is never refused, but uses up what jobs could have.
+	budget.spend("get")
+	budget.spend("get")
+	if err := budget.take("list"); err != errS3BudgetExhausted {
+		t.Fatalf("expected the budget to be exhausted, got %v", err)
+	}
+
+	now = now.Add(40 * time.Minute)
+	if err := budget.take("list"); err != nil {
+		t.Fatal(err)
+	}
+
+	var unlimited *s3Budget
+	if err := unlimited.take("list"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBudgetedIndexRemove(t *testing.T) {
+	index := budgetedIndex{newFakeIndex(), nil}
+	if err := index.StoreIndex("a.narinfo", desync.Index{}); err != nil {
+		t.Fatal(err)
+	} else if err := index.RemoveIndex("a.narinfo"); err != nil {
+		t.Fatal(err)
+	} else if _, err := index.GetIndex("a.narinfo"); err == nil {
+		t.Fatal("expected the index to be removed")
+	}
+}
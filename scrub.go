@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/pascaldekloe/metrics"
+	"go.uber.org/zap"
+)
+
+var (
+	metricScrubTime    = metrics.MustReal("spongix_scrub_time_seconds", "Total time spent scrubbing recently written chunks")
+	metricScrubChunks  = metrics.MustCounter("spongix_scrub_chunks_local", "Number of recently written chunks verified")
+	metricScrubInvalid = metrics.MustCounter("spongix_scrub_invalid_local", "Number of invalid chunks removed by scrubbing")
+)
+
+// scrubOnce verifies the chunks of indices written after since, but no
+// earlier than the scrub window. Fresh chunks are the most likely to be
+// corrupted by partial writes, and a full verify of the store may be hours
+// away. It returns the time to pass as since on the next run.
+func (proxy *Proxy) scrubOnce(since time.Time) time.Time {
+	store, ok := proxy.chunkDisk()
+	if !ok {
+		return since
+	}
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return since
+	}
+
+	start := time.Now()
+	if cutoff := start.Add(-proxy.ScrubWindow); since.Before(cutoff) {
+		since = cutoff
+	}
+
+	// checked tells whether a chunk was found intact, so every index using a
+	// bad chunk is removed, not just the first one.
+	checked := map[desync.ChunkID]bool{}
+	scrubbed, invalid := 0, 0
+
+	err := filepath.Walk(indices.Path, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || info.ModTime().Before(since) {
+			return nil
+		}
+
+		name := path[len(indices.Path):]
+		idx, err := indices.GetIndex(name)
+		if err != nil {
+			proxy.log.Warn("reading index to scrub", zap.Error(err), zap.String("name", name))
+			return nil
+		}
+		scrubbed++
+
+		for _, indexChunk := range idx.Chunks {
+			intact, found := checked[indexChunk.ID]
+			if !found {
+				intact = proxy.scrubChunk(store, name, indexChunk.ID)
+				checked[indexChunk.ID] = intact
+				if !intact {
+					invalid++
+				}
+			}
+			if intact {
+				continue
+			}
+
+			// without the index it's a cache miss again, so the content is
+			// fetched or uploaded anew. GC removes older indices using the chunk.
+			if err := os.Remove(path); err != nil {
+				proxy.log.Error("removing scrubbed index", zap.Error(err), zap.String("name", name))
+			}
+			break
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		proxy.log.Error("scrubbing failed", zap.Error(err))
+		return since
+	}
+
+	proxy.log.Info("scrubbed recent writes",
+		zap.Int("indices", scrubbed),
+		zap.Int("chunks", len(checked)),
+		zap.Int("invalid", invalid))
+
+	return start
+}
+
+// scrubChunk reports whether the chunk is intact, and removes it if it's
+// invalid.
+func (proxy *Proxy) scrubChunk(store chunkDisk, name string, id desync.ChunkID) bool {
+	metricScrubChunks.Add(1)
+
+	_, err := store.GetChunk(id)
+	switch err.(type) {
+	case nil:
+		return true
+	case desync.ChunkMissing:
+		proxy.log.Warn("scrubbed index is missing a chunk", zap.String("name", name), zap.String("chunk", id.String()))
+	default:
+		proxy.log.Error("scrubbed invalid chunk", zap.Error(err), zap.String("name", name), zap.String("chunk", id.String()))
+		metricScrubInvalid.Add(1)
+		if err := store.RemoveChunk(id); err != nil {
+			proxy.log.Error("removing chunk", zap.Error(err), zap.String("chunk", id.String()))
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+func TestScrubRecentWrites(t *testing.T) {
+	proxy := testProxy(t)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+
+	indices := proxy.localIndex.(desync.LocalIndexStore)
+	store := proxy.localStore.(desync.LocalStore)
+
+	narIdx, err := indices.GetIndex(strings.TrimPrefix(fNar, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := "nar/0000000000000000000000000000000000000000000000000000.nar"
+	if err := indices.StoreIndex(other, narIdx); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the chunk as if it was only partially written.
+	id := narIdx.Chunks[0].ID
+	chunkPath := filepath.Join(store.Base, id.String()[0:4], id.String()+desync.CompressedChunkExt)
+	if err := os.WriteFile(chunkPath, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := metricScrubInvalid.Get()
+	since := proxy.scrubOnce(time.Time{})
+
+	if n := metricScrubInvalid.Get() - invalid; n != 1 {
+		t.Fatalf("expected one invalid chunk, got %d", n)
+	}
+	if _, err := os.Stat(chunkPath); !os.IsNotExist(err) {
+		t.Fatalf("expected invalid chunk to be removed, got %v", err)
+	}
+	if hasIndex(proxy.localIndex, strings.TrimPrefix(fNar, "/")) {
+		t.Fatal("expected index with invalid chunk to be removed")
+	}
+	if hasIndex(proxy.localIndex, other) {
+		t.Fatal("expected every index with the invalid chunk to be removed")
+	}
+	if !hasIndex(proxy.localIndex, strings.TrimPrefix(fNarinfo, "/")) {
+		t.Fatal("expected valid narinfo to be kept")
+	}
+
+	chunks := metricScrubChunks.Get()
+	proxy.scrubOnce(since)
+	if n := metricScrubChunks.Get() - chunks; n != 0 {
+		t.Fatalf("expected no chunks scrubbed again, got %d", n)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricSecondaryQueued  = metrics.Must1LabelInteger("spongix_secondary_queued", "secondary")
+	metricSecondaryLag     = metrics.Must1LabelReal("spongix_secondary_lag_seconds", "secondary")
+	metricSecondaryOk      = metrics.Must1LabelCounter("spongix_secondary_ok", "secondary")
+	metricSecondaryFailure = metrics.Must1LabelCounter("spongix_secondary_failures", "secondary")
+	metricSecondaryDead    = metrics.Must1LabelCounter("spongix_secondary_dead", "secondary")
+)
+
+func init() {
+	metrics.MustHelp("spongix_secondary_queued", "Number of indices waiting to be copied to the secondary")
+	metrics.MustHelp("spongix_secondary_lag_seconds", "Age of the oldest index waiting to be copied to the secondary")
+	metrics.MustHelp("spongix_secondary_ok", "Number of indices copied to the secondary")
+	metrics.MustHelp("spongix_secondary_failures", "Number of failed attempts to copy an index to the secondary")
+	metrics.MustHelp("spongix_secondary_dead", "Number of indices given up on after failing to copy them too often")
+}
+
+const (
+	secondaryRetryMin = 1 * time.Second
+	secondaryRetryMax = 5 * time.Minute
+	// attempts to copy an index before it's moved to the failed directory.
+	secondaryMaxAttempts = 10
+)
+
+// secondaryTarget receives a copy of every index we store.
+type secondaryTarget interface {
+	copyIndex(name string, idx desync.Index, store desync.Store) error
+}
+
+// s3Secondary copies the index and all chunks it doesn't have yet into a
+// bucket, chunks go below /store and indices below /index.
+type s3Secondary struct {
+	store desync.WriteStore
+	index desync.IndexWriteStore
+}
+
+func newS3Secondary(u *url.URL, region string, opts desync.StoreOptions, budget *s3Budget) (*s3Secondary, error) {
+	creds := credentials.NewChainCredentials(
+		[]credentials.Provider{
+			&credentials.EnvMinio{},
+			&credentials.EnvAWS{},
+		},
+	)
+
+	storeURL := *u
+	storeURL.Path = strings.TrimSuffix(u.Path, "/") + "/store"
+	store, err := desync.NewS3Store(&storeURL, creds, region, opts, minio.BucketLookupAuto)
+	if err != nil {
+		return nil, errors.WithMessage(err, "creating s3 store")
+	}
+
+	indexURL := *u
+	indexURL.Path = strings.TrimSuffix(u.Path, "/") + "/index"
+	index, err := desync.NewS3IndexStore(&indexURL, creds, region, opts, minio.BucketLookupAuto)
+	if err != nil {
+		return nil, errors.WithMessage(err, "creating s3 index")
+	}
+
+	return &s3Secondary{store: budgetedStore{store, budget}, index: budgetedIndex{index, budget}}, nil
+}
+
+func (s *s3Secondary) copyIndex(name string, idx desync.Index, store desync.Store) error {
+	for _, indexChunk := range idx.Chunks {
+		if found, err := s.store.HasChunk(indexChunk.ID); err != nil {
+			return errors.WithMessage(err, "checking chunk")
+		} else if found {
+			continue
+		}
+
+		chunk, err := store.GetChunk(indexChunk.ID)
+		if err != nil {
+			return errors.WithMessage(err, "getting chunk")
+		}
+
+		if err := s.store.StoreChunk(chunk); err != nil {
+			return errors.WithMessage(err, "storing chunk")
+		}
+	}
+
+	return s.index.StoreIndex(name, idx)
+}
+
+// httpSecondary uploads the assembled file to another spongix.
+type httpSecondary struct {
+	url *url.URL
+}
+
+func (s *httpSecondary) copyIndex(name string, idx desync.Index, store desync.Store) error {
+	target, err := s.url.Parse(strings.TrimSuffix(s.url.Path, "/") + "/" + name)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), "PUT", target.String(), newChunkReader(store, idx))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = idx.Length()
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.WithMessage(err, "uploading")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("uploading: received status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// secondary keeps the names of pending indices as marker files in dir, so
+// nothing is lost if we restart before they were copied. Markers of indices
+// that failed too often are moved to the failed directory below it.
+type secondary struct {
+	name   string
+	target secondaryTarget
+	dir    string
+	log    *zap.Logger
+
+	mu       sync.Mutex
+	pending  map[string]time.Time
+	attempts map[string]int
+	wake     chan struct{}
+}
+
+func newSecondary(log *zap.Logger, name string, target secondaryTarget, dir string) (*secondary, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &secondary{
+		name:     name,
+		target:   target,
+		dir:      dir,
+		log:      log.Named("secondary").With(zap.String("secondary", name)),
+		pending:  map[string]time.Time{},
+		attempts: map[string]int{},
+		wake:     make(chan struct{}, 1),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if indexName, err := url.PathUnescape(entry.Name()); err == nil {
+			if info, err := entry.Info(); err == nil {
+				s.pending[indexName] = info.ModTime()
+			}
+		}
+	}
+
+	s.updateMetrics()
+
+	return s, nil
+}
+
+func (s *secondary) enqueue(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.pending[name]; !found {
+		marker := filepath.Join(s.dir, url.PathEscape(name))
+		if err := os.WriteFile(marker, nil, 0o644); err != nil {
+			s.log.Error("persisting pending index", zap.String("name", name), zap.Error(err))
+		}
+		s.pending[name] = time.Now()
+	}
+
+	s.updateMetricsLocked()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *secondary) done(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, name)
+	delete(s.attempts, name)
+	if err := os.Remove(filepath.Join(s.dir, url.PathEscape(name))); err != nil && !os.IsNotExist(err) {
+		s.log.Error("removing pending marker", zap.String("name", name), zap.Error(err))
+	}
+
+	s.updateMetricsLocked()
+}
+
+// failed moves the index to the back of the queue, so one that can't be
+// copied doesn't hold up the others. After too many attempts it's given up
+// on and its marker is kept in the failed directory for inspection.
+func (s *secondary) failed(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	marker := filepath.Join(s.dir, url.PathEscape(name))
+	s.attempts[name]++
+	if s.attempts[name] < secondaryMaxAttempts {
+		now := time.Now()
+		s.pending[name] = now
+		_ = os.Chtimes(marker, now, now)
+		return
+	}
+
+	metricSecondaryDead(s.name).Add(1)
+	s.log.Error("giving up on copying index", zap.String("name", name), zap.Int("attempts", s.attempts[name]))
+	delete(s.pending, name)
+	delete(s.attempts, name)
+
+	failedDir := filepath.Join(s.dir, "failed")
+	if err := os.MkdirAll(failedDir, 0o755); err != nil {
+		s.log.Error("creating failed directory", zap.Error(err))
+	} else if err := os.Rename(marker, filepath.Join(failedDir, url.PathEscape(name))); err != nil {
+		s.log.Error("moving pending marker", zap.String("name", name), zap.Error(err))
+	}
+
+	s.updateMetricsLocked()
+}
+
+// oldest returns the name of the index that has waited the longest.
+func (s *secondary) oldest() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldestName, oldestTime, found := "", time.Time{}, false
+	for name, queued := range s.pending {
+		if !found || queued.Before(oldestTime) {
+			oldestName, oldestTime, found = name, queued, true
+		}
+	}
+
+	return oldestName, found
+}
+
+func (s *secondary) updateMetrics() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateMetricsLocked()
+}
+
+func (s *secondary) updateMetricsLocked() {
+	metricSecondaryQueued(s.name).Set(int64(len(s.pending)))
+
+	lag := float64(0)
+	for _, queued := range s.pending {
+		if age := time.Since(queued).Seconds(); age > lag {
+			lag = age
+		}
+	}
+	metricSecondaryLag(s.name).Set(lag)
+}
+
+// run copies pending indices oldest first, backing off while the secondary
+// keeps failing.
+func (s *secondary) run(index desync.IndexStore, store desync.Store) {
+	backoff := secondaryRetryMin
+
+	for {
+		name, found := s.oldest()
+		if !found {
+			<-s.wake
+			continue
+		}
+
+		idx, err := index.GetIndex(name)
+		if err != nil {
+			// the index is gone, most likely collected, so there's nothing to copy.
+			s.log.Warn("pending index not found", zap.String("name", name), zap.Error(err))
+			s.done(name)
+			continue
+		}
+
+		if err := s.target.copyIndex(name, idx, store); err != nil {
+			metricSecondaryFailure(s.name).Add(1)
+			s.log.Error("copying index", zap.String("name", name), zap.Error(err), zap.Duration("retry", backoff))
+			s.failed(name)
+			s.updateMetrics()
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > secondaryRetryMax {
+				backoff = secondaryRetryMax
+			}
+			continue
+		}
+
+		metricSecondaryOk(s.name).Add(1)
+		backoff = secondaryRetryMin
+		s.done(name)
+	}
+}
+
+func (proxy *Proxy) setupSecondaries() {
+	for _, raw := range proxy.Secondaries {
+		u, err := url.Parse(raw)
+		if err != nil {
+			proxy.log.Fatal("couldn't parse secondary url", zap.Error(err), zap.String("url", raw))
+		}
+
+		var target secondaryTarget
+		switch {
+		case strings.HasPrefix(u.Scheme, "s3+"):
+			if target, err = newS3Secondary(u, proxy.BucketRegion, proxy.s3StoreOptions(), proxy.s3Budget); err != nil {
+				proxy.log.Fatal("failed creating s3 secondary", zap.Error(err), zap.String("url", raw))
+			}
+		case u.Scheme == "http" || u.Scheme == "https":
+			target = &httpSecondary{url: u}
+		default:
+			proxy.log.Fatal("unsupported secondary url", zap.String("url", raw))
+		}
+
+		// credentials may be part of the URL, so don't use it as metric label.
+		name := u.Scheme + "://" + u.Host + u.Path
+		dir := filepath.Join(proxy.Dir, "secondary", url.PathEscape(name))
+		s, err := newSecondary(proxy.log, name, target, dir)
+		if err != nil {
+			proxy.log.Fatal("failed setting up secondary", zap.Error(err), zap.String("url", raw))
+		}
+
+		proxy.secondaries = append(proxy.secondaries, s)
+	}
+}
+
+func (proxy *Proxy) startSecondaries() {
+	for _, s := range proxy.secondaries {
+		go s.run(proxy.localIndex, proxy.localStore)
+	}
+}
+
+func (proxy *Proxy) enqueueSecondaries(name string) {
+	for _, s := range proxy.secondaries {
+		s.enqueue(name)
+	}
+}
+
+// withSecondaries queues every successful upload for copying to the
+// secondaries.
+func (proxy *Proxy) withSecondaries() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" || len(proxy.secondaries) == 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			record := &LogRecord{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(record, r)
+
+			if record.status == http.StatusOK {
+				if name, err := urlToIndexName(r.URL); err == nil {
+					proxy.enqueueSecondaries(name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+	"go.uber.org/zap"
+)
+
+func TestSecondaryFailed(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSecondary(zap.NewNop(), "test", &httpSecondary{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.enqueue("a.narinfo")
+	time.Sleep(time.Millisecond)
+	s.enqueue("b.narinfo")
+
+	s.failed("a.narinfo")
+	if name, _ := s.oldest(); name != "b.narinfo" {
+		t.Fatalf("expected the failed index to be retried last, got %s", name)
+	}
+
+	for i := 1; i < secondaryMaxAttempts; i++ {
+		s.failed("a.narinfo")
+	}
+
+	if _, found := s.pending["a.narinfo"]; found {
+		t.Fatal("expected the index to be given up on")
+	} else if _, err := os.Stat(filepath.Join(dir, "failed", "a.narinfo")); err != nil {
+		t.Fatal("expected the marker to be kept in the failed directory")
+	}
+
+	// the failed directory isn't mistaken for a pending index on restart.
+	if s, err = newSecondary(zap.NewNop(), "test", &httpSecondary{}, dir); err != nil {
+		t.Fatal(err)
+	} else if len(s.pending) != 1 {
+		t.Fatalf("expected only b to be pending, got %v", s.pending)
+	}
+}
+
+func TestRouterSecondaries(t *testing.T) {
+	secondary := testProxy(t)
+	srv := httptest.NewServer(testRouter(secondary))
+	defer srv.Close()
+
+	proxy := testProxy(t)
+	proxy.Secondaries = []string{srv.URL}
+	proxy.setupSecondaries()
+	proxy.startSecondaries()
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Method("PUT").
+		URL(fNar).
+		Body(string(testdata[fNar])).
+		Expect(t).
+		Status(http.StatusOK).
+		End()
+
+	for i := 0; ; i++ {
+		if _, found := proxy.secondaries[0].oldest(); !found {
+			break
+		} else if i > 100 {
+			t.Fatal("upload is still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	name, _ := filepath.Rel("/", fNar)
+	if _, err := secondary.localIndex.GetIndex(name); err != nil {
+		t.Fatal("upload was not copied to the secondary")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/gorilla/mux"
+	"github.com/input-output-hk/spongix/pkg/narinfo"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// SeedCmd creates and applies seed files: a zstd compressed tar with the
+// indices and chunks of some closures, used to prime a fresh spongix.
+type SeedCmd struct {
+	Create *SeedCreateCmd `arg:"subcommand:create" help:"Write the closures of the given store paths to a seed file"`
+	Apply  *SeedApplyCmd  `arg:"subcommand:apply" help:"Import a seed file into the local store"`
+}
+
+type SeedCreateCmd struct {
+	Output     string   `arg:"-o,--output,required" help:"Seed file to write"`
+	All        bool     `arg:"--all" help:"Include everything in the local store, to move a whole cache"`
+	StorePaths []string `arg:"positional" help:"Store paths or hashes whose closures are included"`
+}
+
+type SeedApplyCmd struct {
+	Input string `arg:"positional,required" help:"Seed file to read"`
+}
+
+const (
+	seedIndexPrefix = "index/"
+	seedChunkPrefix = "chunk/"
+)
+
+func (proxy *Proxy) runSeed(cmd *SeedCmd) error {
+	switch {
+	case cmd.Create != nil:
+		names, err := proxy.seedNames(cmd.Create.All, cmd.Create.StorePaths)
+		if err != nil {
+			return err
+		}
+
+		fd, err := os.Create(cmd.Create.Output)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		if err := proxy.writeSeed(fd, names); err != nil {
+			return err
+		}
+		return fd.Close()
+	case cmd.Apply != nil:
+		if err := proxy.waitForGC(context.Background()); err != nil {
+			return err
+		}
+
+		fd, err := os.Open(cmd.Apply.Input)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		return proxy.applySeed(fd)
+	default:
+		return errors.New("missing seed subcommand, use create or apply")
+	}
+}
+
+// closureNarinfos returns the narinfos of the closures of the given store
+// paths, keyed by store path hash.
+func (proxy *Proxy) closureNarinfos(storePaths []string) (map[string]*narinfo.Narinfo, error) {
+	infos := map[string]*narinfo.Narinfo{}
+	queue := []string{}
+	for _, storePath := range storePaths {
+		queue = append(queue, storePathHash(strings.TrimPrefix(storePath, storeDirPrefix)))
+	}
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		if _, found := infos[hash]; found {
+			continue
+		}
+
+		info, err := proxy.resolveNarinfo(hash)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "getting narinfo %s", hash)
+		}
+		infos[hash] = info
+
+		for _, ref := range info.References {
+			queue = append(queue, storePathHash(ref))
+		}
+	}
+
+	return infos, nil
+}
+
+// seedClosure returns the names of the narinfo and NAR indices of the closures
+// of the given store paths.
+func (proxy *Proxy) seedClosure(storePaths []string) ([]string, error) {
+	infos, err := proxy.closureNarinfos(storePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, 2*len(infos))
+	for hash, info := range infos {
+		names = append(names, hash+".narinfo", narIndexName(info.URL))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// seedAll returns the names of all narinfo, NAR and .drv indices in the local
+// store.
+func (proxy *Proxy) seedAll() ([]string, error) {
+	indices, ok := proxy.localIndex.(desync.LocalIndexStore)
+	if !ok {
+		return nil, errors.New("the local index can't be listed")
+	}
+
+	names := []string{}
+	err := filepath.WalkDir(indices.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		if name, err := filepath.Rel(indices.Path, path); err == nil && validIndexName(filepath.ToSlash(name)) {
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	sort.Strings(names)
+
+	return names, err
+}
+
+// seedNames returns the indices to put in a seed, either the closures of the
+// store paths or everything.
+func (proxy *Proxy) seedNames(all bool, storePaths []string) ([]string, error) {
+	switch {
+	case all && len(storePaths) > 0:
+		return nil, errors.New("either give store paths or --all")
+	case all:
+		return proxy.seedAll()
+	case len(storePaths) == 0:
+		return nil, errors.New("missing store paths, or --all for everything")
+	default:
+		return proxy.seedClosure(storePaths)
+	}
+}
+
+func (proxy *Proxy) createSeed(wr io.Writer, storePaths []string) error {
+	names, err := proxy.seedClosure(storePaths)
+	if err != nil {
+		return err
+	}
+	return proxy.writeSeed(wr, names)
+}
+
+// writeSeed writes the indices with the given names and their chunks.
+func (proxy *Proxy) writeSeed(wr io.Writer, names []string) error {
+	enc, err := zstd.NewWriter(wr, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(enc)
+	now := time.Now()
+	write := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	chunks := map[desync.ChunkID]struct{}{}
+	for _, name := range names {
+		idx, store, err := proxy.resolveIndex(name)
+		if err != nil {
+			return errors.WithMessagef(err, "getting index %s", name)
+		}
+
+		for _, indexChunk := range idx.Chunks {
+			if _, found := chunks[indexChunk.ID]; found {
+				continue
+			}
+			chunks[indexChunk.ID] = yes
+
+			chunk, err := store.GetChunk(indexChunk.ID)
+			if err != nil {
+				return errors.WithMessagef(err, "getting chunk of %s", name)
+			}
+
+			data, err := chunk.Data()
+			if err != nil {
+				return errors.WithMessagef(err, "reading chunk of %s", name)
+			}
+
+			if err := write(seedChunkPrefix+indexChunk.ID.String(), data); err != nil {
+				return err
+			}
+		}
+
+		// chunks come first, so an interrupted apply never leaves an index
+		// without its chunks.
+		buf := &bytes.Buffer{}
+		if _, err := idx.WriteTo(buf); err != nil {
+			return errors.WithMessagef(err, "encoding index %s", name)
+		}
+
+		if err := write(seedIndexPrefix+name, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	proxy.log.Info("created seed", zap.Int("indices", len(names)), zap.Int("chunks", len(chunks)))
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// applySeed stores everything in the seed file locally. Existing indices are
+// left alone, so applying a seed never overwrites newer uploads. Narinfos are
+// taken last, like uploads after their NARs, and go through the same checks.
+func (proxy *Proxy) applySeed(rd io.Reader) error {
+	dec, err := zstd.NewReader(rd)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	type seedNarinfo struct {
+		name string
+		idx  desync.Index
+	}
+
+	tr := tar.NewReader(dec)
+	narinfos := []seedNarinfo{}
+	indices, chunks := 0, 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.WithMessage(err, "reading seed")
+		}
+
+		switch {
+		case strings.HasPrefix(header.Name, seedChunkPrefix):
+			id, err := desync.ChunkIDFromString(strings.TrimPrefix(header.Name, seedChunkPrefix))
+			if err != nil {
+				return errors.WithMessagef(err, "invalid chunk %s", header.Name)
+			} else if header.Size > int64(chunkSizeMax()) {
+				return errors.Errorf("chunk %s is larger than %d bytes", header.Name, chunkSizeMax())
+			}
+
+			data, err := io.ReadAll(io.LimitReader(tr, int64(chunkSizeMax())))
+			if err != nil {
+				return err
+			}
+
+			chunk, err := desync.NewChunkWithID(id, data, false)
+			if err != nil {
+				return errors.WithMessagef(err, "invalid chunk %s", header.Name)
+			}
+
+			if err := proxy.localStore.StoreChunk(chunk); err != nil {
+				return errors.WithMessagef(err, "storing chunk %s", header.Name)
+			}
+			chunks++
+		case strings.HasPrefix(header.Name, seedIndexPrefix):
+			name := strings.TrimPrefix(header.Name, seedIndexPrefix)
+			if !validIndexName(name) {
+				return errors.Errorf("invalid index name %s", header.Name)
+			}
+
+			idx, err := desync.IndexFromReader(tr)
+			if err != nil {
+				return errors.WithMessagef(err, "invalid index %s", header.Name)
+			}
+
+			if _, err := proxy.localIndex.GetIndex(name); err == nil {
+				continue
+			}
+
+			if strings.HasSuffix(name, ".narinfo") {
+				narinfos = append(narinfos, seedNarinfo{name: name, idx: idx})
+				continue
+			}
+
+			if err := proxy.localIndex.StoreIndex(name, idx); err != nil {
+				return errors.WithMessagef(err, "storing index %s", name)
+			}
+			indices++
+		}
+	}
+
+	handler := proxy.seedNarinfoHandler()
+	for _, info := range narinfos {
+		if err := proxy.putSeedNarinfo(handler, info.name, info.idx); err != nil {
+			return err
+		}
+		indices++
+	}
+
+	proxy.log.Info("applied seed", zap.Int("indices", indices), zap.Int("chunks", chunks))
+
+	return nil
+}
+
+// seedNarinfoHandler takes narinfos like the narinfo route does, with their
+// signatures checked, the upload policies and everything done after uploads.
+func (proxy *Proxy) seedNarinfoHandler() http.Handler {
+	r := mux.NewRouter()
+	r.NotFoundHandler = notFound{proxy.log}
+	r.Path("/{hash:[0-9a-df-np-sv-z]{32}}.narinfo").Methods("PUT").Handler(proxy.narinfoHandler(nil))
+	return r
+}
+
+// seedResponse keeps what the handler answered to a narinfo from a seed.
+type seedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *seedResponse) Header() http.Header { return r.header }
+
+func (r *seedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *seedResponse) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(p)
+}
+
+// putSeedNarinfo uploads the narinfo with the given index to handler, its
+// chunks have to be in the local store already.
+func (proxy *Proxy) putSeedNarinfo(handler http.Handler, name string, idx desync.Index) error {
+	body, err := io.ReadAll(io.LimitReader(newChunkReader(proxy.localStore, idx), maxNarinfoSize+1))
+	if err != nil {
+		return errors.WithMessagef(err, "reading narinfo %s", name)
+	} else if len(body) > maxNarinfoSize {
+		return errors.Errorf("narinfo %s is too large", name)
+	}
+
+	r, err := http.NewRequest("PUT", "/"+name, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	res := &seedResponse{header: http.Header{}}
+	handler.ServeHTTP(res, r)
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	if res.status/100 != 2 {
+		return errors.Errorf("narinfo %s rejected: %s", name, strings.TrimSpace(res.body.String()))
+	}
+
+	return nil
+}
+
+// GET /seed?path=<store path>&path=...
+// GET /seed?all
+// Streams a seed file with the closures of the store paths, or with
+// everything in the local store.
+func (proxy *Proxy) seedExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	_, all := query["all"]
+	names, err := proxy.seedNames(all, query["path"])
+	if err != nil {
+		answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+		return
+	}
+
+	w.Header().Set(headerContentType, "application/zstd")
+	w.Header().Set("Content-Disposition", `attachment; filename="spongix.seed"`)
+	if err := proxy.writeSeed(w, names); err != nil {
+		proxy.log.Error("writing seed", zap.Error(err))
+	}
+}
+
+// POST /seed
+// Applies the seed file in the body, like seed apply.
+func (proxy *Proxy) seedImport(w http.ResponseWriter, r *http.Request) {
+	if err := proxy.waitForGC(r.Context()); err != nil {
+		answer(w, http.StatusServiceUnavailable, mimeText, err.Error()+"\n")
+		return
+	}
+
+	// chunks are stored before their indices, the GC mustn't see them in
+	// between.
+	lease, err := proxy.acquireGCLease()
+	if err != nil {
+		answer(w, http.StatusServiceUnavailable, mimeText, err.Error()+"\n")
+		return
+	}
+	defer lease.release()
+
+	if err := proxy.applySeed(r.Body); err != nil {
+		answer(w, http.StatusBadRequest, mimeText, err.Error()+"\n")
+		return
+	}
+
+	answer(w, http.StatusOK, mimeText, "applied\n")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/folbricht/desync"
+	"github.com/klauspost/compress/zstd"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestSeed(t *testing.T) {
+	proxy := testProxy(t)
+	narURL := "/nar/1n02zg7nnkfrcf7rl8z5p030hkjakry6d60mnd248fa94s0bn301.nar"
+
+	for url, body := range map[string][]byte{
+		narURL:   testdata[fNar],
+		fNarinfo: testdata[fNarinfo],
+	} {
+		apitest.New().
+			Handler(testRouter(proxy)).
+			Method("PUT").
+			URL(url).
+			Body(string(body)).
+			Expect(t).
+			Status(http.StatusOK).
+			End()
+	}
+
+	seed := &bytes.Buffer{}
+	if err := proxy.createSeed(seed, []string{"/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := testProxy(t)
+	if err := fresh.applySeed(seed); err != nil {
+		t.Fatal(err)
+	}
+
+	apitest.New().
+		Handler(testRouter(fresh)).
+		Get(narURL).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Body(string(testdata[fNar])).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(testRouter(fresh)).
+		Get(fNarinfo).
+		Expect(t).
+		Header(headerCache, headerCacheHit).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestApplySeedChecks(t *testing.T) {
+	tarSeed := func(name string, size int64, content []byte) *bytes.Buffer {
+		seed := &bytes.Buffer{}
+		enc, _ := zstd.NewWriter(seed)
+		tw := tar.NewWriter(enc)
+		_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size})
+		_, _ = tw.Write(content)
+		_ = tw.Close()
+		_ = enc.Close()
+		return seed
+	}
+
+	if err := testProxy(t).applySeed(tarSeed("index/../gc.lock", 0, nil)); err == nil || !strings.Contains(err.Error(), "invalid index name") {
+		t.Fatalf("expected an invalid index name, got %v", err)
+	}
+
+	huge := make([]byte, chunkSizeMax()+1)
+	if err := testProxy(t).applySeed(tarSeed(seedChunkPrefix+strings.Repeat("0", 64), int64(len(huge)), huge)); err == nil || !strings.Contains(err.Error(), "is larger than") {
+		t.Fatalf("expected a too large chunk, got %v", err)
+	}
+
+	// narinfos are taken like uploads.
+	seedWith := func(narinfo []byte) *bytes.Buffer {
+		source := testProxy(t)
+		insertFake(t, source.localStore, source.localIndex, fNar)
+		chunker, err := desync.NewChunker(bytes.NewReader(narinfo), chunkSizeMin(), chunkSizeAvg, chunkSizeMax())
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := desync.ChunkStream(context.Background(), chunker, source.localStore, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := source.localIndex.StoreIndex(strings.TrimPrefix(fNarinfo, "/"), idx); err != nil {
+			t.Fatal(err)
+		}
+
+		seed := &bytes.Buffer{}
+		if err := source.writeSeed(seed, []string{strings.TrimPrefix(fNar, "/"), strings.TrimPrefix(fNarinfo, "/")}); err != nil {
+			t.Fatal(err)
+		}
+		return seed
+	}
+
+	absolute := bytes.Replace(testdata[fNarinfo], []byte("URL: nar/"), []byte("URL: https://example.com/nar/"), 1)
+	if err := testProxy(t).applySeed(seedWith(absolute)); err == nil || !strings.Contains(err.Error(), "URL must be relative") {
+		t.Fatalf("expected a rejected URL, got %v", err)
+	}
+
+	strict := testProxy(t)
+	strict.AllowedDerivers = []string{"*-release.drv"}
+	if err := strict.applySeed(seedWith(testdata[fNarinfo])); err == nil || !strings.Contains(err.Error(), "isn't allowed") {
+		t.Fatalf("expected a rejected deriver, got %v", err)
+	}
+
+	// signatures of keys that aren't trusted are dropped.
+	untrusting := testProxy(t)
+	untrusting.TrustedPublicKeys = nil
+	untrusting.setupKeys()
+	if err := untrusting.applySeed(seedWith(testdata[fNarinfo])); err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	testRouter(untrusting).ServeHTTP(res, httptest.NewRequest("GET", fNarinfo, nil))
+	if res.Code != http.StatusOK || strings.Contains(res.Body.String(), "Sig:") {
+		t.Fatalf("expected the narinfo without signatures, got %d %q", res.Code, res.Body.String())
+	}
+}
+
+func TestRouterSeedAll(t *testing.T) {
+	proxy := testProxy(t)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNar)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+	router := testRouter(proxy)
+
+	apitest.New().
+		Handler(router).
+		Get("/seed").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Expect(t).
+		Body("missing store paths, or --all for everything\n").
+		Status(http.StatusBadRequest).
+		End()
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, testAdminRequest("GET", "/seed?all", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body.String())
+	}
+
+	fresh := testProxy(t)
+	freshRouter := testRouter(fresh)
+	apitest.New().
+		Handler(freshRouter).
+		Post("/seed").
+		Header("Authorization", "Bearer "+testAdminToken).
+		Body(res.Body.String()).
+		Expect(t).
+		Body("applied\n").
+		Status(http.StatusOK).
+		End()
+
+	// everything, not only closures of narinfos.
+	for _, path := range []string{fNar, fNarinfo} {
+		apitest.New().
+			Handler(freshRouter).
+			Get(path).
+			Expect(t).
+			Header(headerCache, headerCacheHit).
+			Body(string(testdata[path])).
+			Status(http.StatusOK).
+			End()
+	}
+}
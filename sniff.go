@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+)
+
+var metricUploadSniffRejected = metrics.MustCounter("spongix_upload_sniff_rejected", "Number of uploads rejected because their first bytes didn't match their type")
+
+var compressionMagics = map[string][]byte{
+	".xz":  {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	".zst": {0x28, 0xb5, 0x2f, 0xfd},
+	".bz2": []byte("BZh"),
+}
+
+// sniffNar rejects uploads whose first bytes don't match the file extension
+// in name, before anything is chunked. It returns a reader of the whole body.
+func sniffNar(name string, rd io.Reader) (io.Reader, error) {
+	magic, found := compressionMagics[filepath.Ext(name)]
+	if !found {
+		magic = narMagic
+	}
+
+	head := make([]byte, len(magic))
+	n, err := io.ReadFull(rd, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	} else if !bytes.Equal(head[:n], magic) {
+		metricUploadSniffRejected.Add(1)
+		if found {
+			return nil, errors.Errorf("body is not %s compressed", strings.TrimPrefix(filepath.Ext(name), "."))
+		}
+		return nil, errors.New("body is not a NAR")
+	}
+
+	return io.MultiReader(bytes.NewReader(head), rd), nil
+}
+
+// the start of a narinfo that has to be text, binary data shows there.
+const narinfoSniffSize = 512
+
+// sniffNarinfo rejects narinfos with NUL bytes or invalid UTF-8 at the start,
+// they're binary data uploaded to the wrong URL.
+func sniffNarinfo(rd io.Reader) (io.Reader, error) {
+	buf := bufio.NewReaderSize(rd, narinfoSniffSize)
+	head, err := buf.Peek(narinfoSniffSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// a multi-byte rune may be cut off at the end.
+	if len(head) == narinfoSniffSize {
+		for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+			head = head[:len(head)-1]
+		}
+	}
+
+	if bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(head) {
+		metricUploadSniffRejected.Add(1)
+		return nil, errors.New("narinfo is not text")
+	}
+	return buf, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterUploadSniffing(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+
+	for name, tc := range map[string]struct {
+		url    string
+		body   string
+		status int
+		answer string
+	}{
+		"nar":            {fNar, string(testdata[fNar]), http.StatusOK, "ok\n"},
+		"xz":             {fNarXz, string(testdata[fNarXz]), http.StatusOK, "ok\n"},
+		"junk nar":       {fNar, "<html>login required</html>", http.StatusBadRequest, "body is not a NAR\n"},
+		"uncompressed":   {fNarXz, string(testdata[fNar]), http.StatusBadRequest, "body is not xz compressed\n"},
+		"empty":          {fNar, "", http.StatusBadRequest, "body is not a NAR\n"},
+		"binary narinfo": {fNarinfo, string(testdata[fNarXz]), http.StatusBadRequest, "narinfo is not text\n"},
+	} {
+		t.Run(name, func(tt *testing.T) {
+			apitest.New().
+				Handler(router).
+				Put(tc.url).
+				Body(tc.body).
+				Expect(tt).
+				Body(tc.answer).
+				Status(tc.status).
+				End()
+		})
+	}
+
+	if hasIndex(proxy.localIndex, strings.TrimPrefix(fNarinfo, "/")) {
+		t.Fatal("expected the binary narinfo to be rejected before storing it")
+	}
+}
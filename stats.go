@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// how often the rollups are written to disk, so a restart loses at most this
+// much of the counts.
+const statsSaveInterval = time.Minute
+
+var statsPeriods = map[string]func(time.Time) time.Time{
+	"hour": func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) },
+	"day": func(t time.Time) time.Time {
+		t = t.UTC()
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	},
+}
+
+type statsKey struct {
+	period string
+	start  time.Time
+	kind   string
+}
+
+type statsRollup struct {
+	Period   string    `json:"period"`
+	Start    time.Time `json:"start"`
+	Kind     string    `json:"kind"`
+	Requests uint64    `json:"requests"`
+	Hits     uint64    `json:"hits"`
+	Remote   uint64    `json:"remote"`
+	Misses   uint64    `json:"misses"`
+	Uploads  uint64    `json:"uploads"`
+	Errors   uint64    `json:"errors"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+}
+
+// statsRollups sums up requests per hour and day for each kind of object, so
+// small deployments can graph their usage without running Prometheus.
+type statsRollups struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	rollups   map[statsKey]*statsRollup
+}
+
+func newStatsRollups(path string, retention time.Duration) *statsRollups {
+	return &statsRollups{path: path, retention: retention, rollups: map[statsKey]*statsRollup{}}
+}
+
+func (proxy *Proxy) setupStats() {
+	if proxy.StatsRetention == 0 {
+		return
+	}
+
+	stats := newStatsRollups(filepath.Join(proxy.Dir, "stats.json"), proxy.StatsRetention)
+	if err := stats.load(); err != nil {
+		proxy.log.Error("loading stats rollups, starting empty", zap.Error(err))
+	}
+	proxy.stats = stats
+}
+
+// statsKind is the kind of object requested, or "" for requests that aren't
+// counted, like the admin API.
+func statsKind(path string) string {
+	path = strings.TrimPrefix(path, legacyPrefix)
+	switch {
+	case strings.HasSuffix(path, ".narinfo"):
+		return "narinfo"
+	case strings.HasPrefix(path, "/nar/"):
+		return "nar"
+	case strings.HasPrefix(path, "/v2/"):
+		return "oci"
+	default:
+		return ""
+	}
+}
+
+func (s *statsRollups) add(at time.Time, kind string, count func(*statsRollup)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for period, truncate := range statsPeriods {
+		key := statsKey{period: period, start: truncate(at), kind: kind}
+		rollup, found := s.rollups[key]
+		if !found {
+			rollup = &statsRollup{Period: period, Start: key.start, Kind: kind}
+			s.rollups[key] = rollup
+		}
+		count(rollup)
+	}
+}
+
+// query returns the rollups of the period started at or after since, oldest
+// first. An empty kind matches all kinds.
+func (s *statsRollups) query(period, kind string, since time.Time) []statsRollup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := []statsRollup{}
+	for key, rollup := range s.rollups {
+		if key.period == period && (kind == "" || key.kind == kind) && !key.start.Before(since) {
+			found = append(found, *rollup)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Start.Equal(found[j].Start) {
+			return found[i].Kind < found[j].Kind
+		}
+		return found[i].Start.Before(found[j].Start)
+	})
+	return found
+}
+
+// prune drops the rollups of periods that ended before the retention.
+func (s *statsRollups) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-s.retention)
+	for key := range s.rollups {
+		if key.start.Before(statsPeriods[key.period](cutoff)) {
+			delete(s.rollups, key)
+		}
+	}
+}
+
+func (s *statsRollups) load() error {
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	rollups := []statsRollup{}
+	if err := json.Unmarshal(content, &rollups); err != nil {
+		return errors.WithMessage(err, "decoding "+s.path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range rollups {
+		rollup := rollups[i]
+		if _, found := statsPeriods[rollup.Period]; !found {
+			continue
+		}
+		s.rollups[statsKey{period: rollup.Period, start: rollup.Start, kind: rollup.Kind}] = &rollup
+	}
+	return nil
+}
+
+// save writes the rollups to a temporary file first, a crash must not leave
+// a truncated file behind.
+func (s *statsRollups) save() error {
+	s.mu.Lock()
+	rollups := make([]statsRollup, 0, len(s.rollups))
+	for _, rollup := range s.rollups {
+		rollups = append(rollups, *rollup)
+	}
+	s.mu.Unlock()
+
+	content, err := json.Marshal(rollups)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// saveStats prunes and writes the rollups every statsSaveInterval.
+func (proxy *Proxy) saveStats() {
+	if proxy.stats == nil {
+		return
+	}
+
+	for range time.Tick(statsSaveInterval) {
+		proxy.stats.prune(time.Now())
+		if err := proxy.stats.save(); err != nil {
+			proxy.log.Error("saving stats rollups", zap.Error(err))
+		}
+	}
+}
+
+type statsRecord struct {
+	LogRecord
+	written uint64
+}
+
+func (r *statsRecord) Write(p []byte) (int, error) {
+	n, err := r.LogRecord.Write(p)
+	r.written += uint64(n)
+	return n, err
+}
+
+// withStats counts requests for narinfos, NARs and OCI blobs in the rollups.
+func (proxy *Proxy) withStats() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		if proxy.stats == nil {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			kind := statsKind(r.URL.Path)
+			if kind == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+			record := &statsRecord{LogRecord: LogRecord{ResponseWriter: w, status: http.StatusOK}}
+
+			h.ServeHTTP(record, r)
+
+			proxy.stats.add(start, kind, func(rollup *statsRollup) {
+				rollup.Requests++
+				rollup.BytesIn += uint64(body.n)
+				rollup.BytesOut += record.written
+
+				switch {
+				case record.status >= 500:
+					rollup.Errors++
+				case r.Method == "PUT":
+					if record.status < 300 {
+						rollup.Uploads++
+					}
+				case record.status == http.StatusNotFound:
+					rollup.Misses++
+				case w.Header().Get(headerCache) == headerCacheRemote:
+					rollup.Remote++
+				case record.status < 300:
+					rollup.Hits++
+				}
+			})
+		})
+	}
+}
+
+// GET /stats?period=hour&kind=nar&since=2022-01-01T00:00:00Z
+// period is hour or day, kind one of narinfo, nar or oci, all are optional.
+func (proxy *Proxy) statsReport(w http.ResponseWriter, r *http.Request) {
+	if proxy.stats == nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+
+	period := query.Get("period")
+	if period == "" {
+		period = "hour"
+	} else if _, found := statsPeriods[period]; !found {
+		answer(w, http.StatusBadRequest, mimeText, "period must be hour or day\n")
+		return
+	}
+
+	since := time.Time{}
+	if raw := query.Get("since"); raw != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, raw); err != nil {
+			answer(w, http.StatusBadRequest, mimeText, "invalid since parameter\n")
+			return
+		}
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(proxy.stats.query(period, query.Get("kind"), since)); err != nil {
+		proxy.log.Error("encoding stats rollups", zap.Error(err))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRouterStats(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+
+	for _, url := range []string{fNarinfo, fNarinfo, "/0m8sd5qbmvfhyamwfv3af1ff18ykywf3.narinfo", "/nix-cache-info"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	stats := func(query string) []statsRollup {
+		req := testAdminRequest("GET", "/stats"+query, nil)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", res.Code, res.Body)
+		}
+
+		rollups := []statsRollup{}
+		if err := json.NewDecoder(res.Body).Decode(&rollups); err != nil {
+			t.Fatal(err)
+		}
+		return rollups
+	}
+
+	for _, period := range []string{"hour", "day"} {
+		rollups := stats("?period=" + period)
+		if len(rollups) != 1 {
+			t.Fatalf("expected one %s rollup, got %+v", period, rollups)
+		}
+		if r := rollups[0]; r.Kind != "narinfo" || r.Requests != 3 || r.Hits != 2 || r.Misses != 1 || r.BytesOut == 0 {
+			t.Fatalf("unexpected %s rollup: %+v", period, r)
+		}
+	}
+
+	if rollups := stats("?kind=nar"); len(rollups) != 0 {
+		t.Fatalf("expected no nar rollups, got %+v", rollups)
+	}
+	if rollups := stats("?since=" + time.Now().Add(time.Hour).Format(time.RFC3339)); len(rollups) != 0 {
+		t.Fatalf("expected no future rollups, got %+v", rollups)
+	}
+
+	// rollups survive a restart.
+	if err := proxy.stats.save(); err != nil {
+		t.Fatal(err)
+	}
+	proxy.stats = nil
+	proxy.setupStats()
+	if rollups := stats(""); len(rollups) != 1 || rollups[0].Requests != 3 {
+		t.Fatalf("rollups weren't restored: %+v", rollups)
+	}
+
+	proxy.stats.prune(time.Now().Add(proxy.StatsRetention + 25*time.Hour))
+	if rollups := stats("?period=day"); len(rollups) != 0 {
+		t.Fatalf("expected rollups to be pruned, got %+v", rollups)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// setupTLS loads the certificate, or lets autocert obtain certificates from
+// Let's Encrypt for the ACME domains. Without either we serve plain HTTP.
+func (proxy *Proxy) setupTLS() {
+	switch {
+	case len(proxy.ACMEDomains) > 0:
+		if proxy.TLSCert != "" || proxy.TLSKey != "" {
+			proxy.log.Fatal("use either ACME domains or a TLS certificate, not both")
+		}
+
+		cacheDir := proxy.ACMECacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(proxy.Dir, "acme")
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(proxy.ACMEDomains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      proxy.ACMEEmail,
+		}
+		// challenges are answered via TLS-ALPN on the listener itself.
+		proxy.tlsConfig = manager.TLSConfig()
+	case proxy.TLSCert != "" || proxy.TLSKey != "":
+		if proxy.TLSCert == "" || proxy.TLSKey == "" {
+			proxy.log.Fatal("TLS needs both a certificate and a key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(proxy.TLSCert, proxy.TLSKey)
+		if err != nil {
+			proxy.log.Fatal("failed loading TLS certificate", zap.Error(err))
+		}
+
+		proxy.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+}
+
+// serve starts srv with TLS if it's configured.
+func (proxy *Proxy) serve(srv *http.Server) error {
+	if proxy.tlsConfig == nil {
+		return srv.ListenAndServe()
+	}
+
+	srv.TLSConfig = proxy.tlsConfig
+	return srv.ListenAndServeTLS("", "")
+}
+
+// isLoopbackAddress reports whether listen only accepts local connections.
+func isLoopbackAddress(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
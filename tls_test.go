@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestIsLoopbackAddress(t *testing.T) {
+	for listen, expected := range map[string]bool{
+		"127.0.0.1:7747": true,
+		"[::1]:7747":     true,
+		"localhost:7747": true,
+		":7747":          false,
+		"0.0.0.0:7747":   false,
+		"10.0.0.1:7747":  false,
+	} {
+		if actual := isLoopbackAddress(listen); actual != expected {
+			t.Errorf("isLoopbackAddress(%q) = %v, expected %v", listen, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+	"github.com/pkg/errors"
+)
+
+// TopCmd shows what a running spongix is doing, refreshed until interrupted.
+type TopCmd struct {
+	URL            string        `arg:"--url,required,env:SPONGIX_URL" help:"spongix to watch, like http://127.0.0.1:7745"`
+	AdminURL       string        `arg:"--admin-url" help:"Its --admin-listen address, if set, like http://127.0.0.1:7746"`
+	AdminTokenFile string        `arg:"--admin-token-file,env:SPONGIX_ADMIN_TOKEN_FILE" help:"File with its admin token, needed without --admin-url"`
+	Interval       time.Duration `arg:"--interval" default:"2s" help:"Time between refreshes"`
+	Limit          int           `arg:"--limit" default:"10" help:"Number of largest paths and recent uploads shown"`
+	Once           bool          `arg:"--once" help:"Print a single view without clearing the screen and exit"`
+}
+
+// topView is refreshed from the catalog, stats, jobs and upload events APIs.
+// Each refresh only asks for what changed where the API allows it.
+type topView struct {
+	limit int
+
+	largest []client.CatalogEntry
+	// NAR size of the smallest of the largest paths, so the next refresh
+	// doesn't have to transfer the whole catalog.
+	minSize int64
+
+	seq     uint64
+	uploads []client.UploadEvent
+
+	since   time.Time
+	rollups []client.StatsRollup
+	gc      *client.Job
+
+	errs []string
+}
+
+func (proxy *Proxy) runTop(cmd *TopCmd) error {
+	c, err := client.New(cmd.URL)
+	if err != nil {
+		return err
+	}
+
+	admin := c
+	if cmd.AdminURL != "" {
+		if admin, err = client.New(cmd.AdminURL); err != nil {
+			return err
+		}
+	}
+
+	if cmd.AdminTokenFile != "" {
+		if admin.Token, err = readTokenFile(cmd.AdminTokenFile); err != nil {
+			return errors.WithMessage(err, "reading admin token")
+		}
+	}
+
+	view := &topView{limit: cmd.Limit}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), cmd.Interval+10*time.Second)
+		view.refresh(ctx, admin, time.Now())
+		cancel()
+
+		if cmd.Once {
+			view.render(os.Stdout, cmd.URL, time.Now())
+			if len(view.errs) > 0 {
+				return errors.Errorf("%d requests failed", len(view.errs))
+			}
+			return nil
+		}
+
+		// move to the top left and clear the screen.
+		fmt.Fprint(os.Stdout, "\x1b[H\x1b[2J")
+		view.render(os.Stdout, cmd.URL, time.Now())
+		time.Sleep(cmd.Interval)
+	}
+}
+
+// refresh asks the admin API, which may have its own listener.
+func (v *topView) refresh(ctx context.Context, admin *client.Client, now time.Time) {
+	v.errs = nil
+	fail := func(what string, err error) {
+		v.errs = append(v.errs, fmt.Sprintf("%s: %s", what, err))
+	}
+
+	if err := v.refreshLargest(ctx, admin); err != nil {
+		fail("catalog", err)
+	}
+
+	if events, err := admin.UploadEvents(ctx, v.seq); err != nil {
+		fail("upload events", err)
+	} else {
+		v.seq = events.Seq
+		for _, event := range events.Events {
+			if event.Op != "delete" {
+				v.uploads = append(v.uploads, event)
+			}
+		}
+		if len(v.uploads) > v.limit {
+			v.uploads = v.uploads[len(v.uploads)-v.limit:]
+		}
+	}
+
+	// the current and the previous hour, so the rate doesn't start from
+	// nothing on every full hour.
+	v.since = now.UTC().Truncate(time.Hour).Add(-time.Hour)
+	if rollups, err := admin.Stats(ctx, "hour", "", v.since); errors.Is(err, client.ErrNotFound) {
+		v.rollups = nil
+	} else if err != nil {
+		fail("stats", err)
+	} else {
+		v.rollups = rollups
+	}
+
+	v.gc = nil
+	if jobs, err := admin.Jobs(ctx); err != nil {
+		fail("jobs", err)
+	} else {
+		for i := range jobs {
+			if jobs[i].Name == "gc" {
+				v.gc = &jobs[i]
+			}
+		}
+	}
+}
+
+// refreshLargest lists the catalog entries at least as large as the smallest
+// one shown, and everything again if some of those were deleted.
+func (v *topView) refreshLargest(ctx context.Context, c *client.Client) error {
+	largest := []client.CatalogEntry{}
+	q := client.CatalogQuery{MinSize: v.minSize, Limit: catalogLimit}
+	for {
+		page, err := c.Catalog(ctx, q)
+		if err != nil {
+			return err
+		}
+
+		largest = append(largest, page.Entries...)
+		sort.Slice(largest, func(i, j int) bool { return largest[i].NarSize > largest[j].NarSize })
+		if len(largest) > v.limit {
+			largest = largest[:v.limit]
+		}
+
+		if page.Next == "" {
+			break
+		}
+		q.After = page.Next
+	}
+
+	v.largest = largest
+	if len(largest) < v.limit {
+		v.minSize = 0
+	} else {
+		v.minSize = largest[len(largest)-1].NarSize
+	}
+	return nil
+}
+
+func (v *topView) render(w io.Writer, url string, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "spongix %s\t%s\n\n", url, now.Format(time.RFC3339))
+
+	if v.rollups == nil {
+		fmt.Fprintf(tw, "HIT RATE\tstats are disabled\n")
+	} else {
+		fmt.Fprintf(tw, "HIT RATE SINCE %s\tREQUESTS\tHITS\tREMOTE\tMISSES\tERRORS\tOUT\n", v.since.Local().Format("15:04"))
+		total := client.StatsRollup{Kind: "total"}
+		kinds := map[string]*client.StatsRollup{}
+		order := []string{}
+		for _, rollup := range v.rollups {
+			sum, found := kinds[rollup.Kind]
+			if !found {
+				sum = &client.StatsRollup{Kind: rollup.Kind}
+				kinds[rollup.Kind] = sum
+				order = append(order, rollup.Kind)
+			}
+			for _, s := range []*client.StatsRollup{sum, &total} {
+				s.Requests += rollup.Requests
+				s.Hits += rollup.Hits
+				s.Remote += rollup.Remote
+				s.Misses += rollup.Misses
+				s.Errors += rollup.Errors
+				s.BytesOut += rollup.BytesOut
+			}
+		}
+		sort.Strings(order)
+		for _, kind := range order {
+			renderRollup(tw, kinds[kind])
+		}
+		renderRollup(tw, &total)
+	}
+
+	fmt.Fprintln(tw)
+	switch {
+	case v.gc == nil:
+		fmt.Fprintf(tw, "GC\tdisabled\n")
+	case v.gc.Running:
+		fmt.Fprintf(tw, "GC\trunning for %s\n", now.Sub(v.gc.LastStart).Round(time.Second))
+	case v.gc.Paused:
+		fmt.Fprintf(tw, "GC\tpaused\n")
+	case v.gc.LastStart.IsZero():
+		fmt.Fprintf(tw, "GC\twaiting for other jobs\n")
+	default:
+		next := v.gc.LastStart.Add(v.gc.Interval).Sub(now)
+		if next < 0 {
+			next = 0
+		}
+		fmt.Fprintf(tw, "GC\tnext in %s, last took %s\n", next.Round(time.Second), v.gc.LastDuration.Round(time.Second))
+	}
+
+	fmt.Fprintf(tw, "\nLARGEST PATHS\tNAR SIZE\tFILE SIZE\tUPLOADED\n")
+	for _, entry := range v.largest {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", path.Base(entry.StorePath), formatBytes(entry.NarSize), formatBytes(entry.FileSize), entry.Uploaded.Local().Format("2006-01-02 15:04"))
+	}
+
+	fmt.Fprintf(tw, "\nRECENT UPLOADS\tAGO\n")
+	for i := len(v.uploads) - 1; i >= 0; i-- {
+		fmt.Fprintf(tw, "%s\t%s\n", path.Base(v.uploads[i].Path), now.Sub(v.uploads[i].Time).Round(time.Second))
+	}
+
+	if len(v.errs) > 0 {
+		fmt.Fprintln(tw)
+	}
+	for _, err := range v.errs {
+		fmt.Fprintf(tw, "ERROR\t%s\n", err)
+	}
+}
+
+func renderRollup(w io.Writer, r *client.StatsRollup) {
+	rate := "-"
+	if answered := r.Hits + r.Remote + r.Misses; answered > 0 {
+		rate = fmt.Sprintf("%.1f%%", float64(r.Hits)*100/float64(answered))
+	}
+	fmt.Fprintf(w, "  %s %s\t%d\t%d\t%d\t%d\t%d\t%s\n", r.Kind, rate, r.Requests, r.Hits, r.Remote, r.Misses, r.Errors, formatBytes(int64(r.BytesOut)))
+}
+
+// formatBytes uses binary units like du -h.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+)
+
+func TestTop(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.GcInterval = time.Hour
+	insertFake(t, proxy.localStore, proxy.localIndex, fNarinfo)
+
+	server := httptest.NewServer(testRouter(proxy))
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Token = testAdminToken
+
+	// a hit and an upload to show.
+	if _, err := c.GetNarinfo(context.Background(), "8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5"); err != nil {
+		t.Fatal(err)
+	}
+	proxy.events.add(eventOpUpload, "/nix/store/00000000000000000000000000000000-uploaded")
+
+	now := time.Now()
+	proxy.jobs.jobs["gc"].lastStart = now.Add(-time.Minute)
+
+	view := &topView{limit: 10}
+	view.refresh(context.Background(), c, now)
+	if len(view.errs) > 0 {
+		t.Fatal(view.errs)
+	}
+
+	out := &bytes.Buffer{}
+	view.render(out, server.URL, now)
+	for _, expected := range []string{"narinfo 100.0%", "GC  next in 59m0s", "8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10", "00000000000000000000000000000000-uploaded"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in\n%s", expected, out)
+		}
+	}
+
+	// only new events are asked for, and the largest paths are kept.
+	proxy.events.add(eventOpUpload, "/nix/store/11111111111111111111111111111111-uploaded")
+	view.refresh(context.Background(), c, now)
+	if len(view.uploads) != 2 || len(view.largest) != 1 {
+		t.Fatalf("expected 2 uploads and 1 path, got %v and %v", view.uploads, view.largest)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const headerTraceparent = "traceparent"
+
+var traceparentRegexp = regexp.MustCompile(`\A00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})\z`)
+
+// traceContext follows the W3C Trace Context format, so our logs can be
+// correlated with the tracing of clients and upstreams.
+type traceContext struct {
+	traceID string
+	spanID  string
+	flags   string
+}
+
+type traceContextKey struct{}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func parseTraceparent(raw string) (traceContext, bool) {
+	match := traceparentRegexp.FindStringSubmatch(raw)
+	if match == nil || match[1] == "00000000000000000000000000000000" || match[2] == "0000000000000000" {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: match[1], spanID: match[2], flags: match[3]}, true
+}
+
+// child returns a new span in the same trace.
+func (t traceContext) child() traceContext {
+	return traceContext{traceID: t.traceID, spanID: randomHex(8), flags: t.flags}
+}
+
+func (t traceContext) String() string {
+	return "00-" + t.traceID + "-" + t.spanID + "-" + t.flags
+}
+
+func traceFromContext(ctx context.Context) (traceContext, bool) {
+	t, ok := ctx.Value(traceContextKey{}).(traceContext)
+	return t, ok
+}
+
+// traceFields returns the log fields identifying the span in ctx.
+func traceFields(ctx context.Context) []zap.Field {
+	if t, ok := traceFromContext(ctx); ok {
+		return []zap.Field{zap.String("trace_id", t.traceID), zap.String("span_id", t.spanID)}
+	}
+	return nil
+}
+
+// propagateTrace adds a child span of the trace in ctx to an outgoing request.
+// It returns the context of the child span, to log the request with.
+func propagateTrace(ctx context.Context, req *http.Request) context.Context {
+	if t, ok := traceFromContext(ctx); ok {
+		child := t.child()
+		req.Header.Set(headerTraceparent, child.String())
+		return context.WithValue(ctx, traceContextKey{}, child)
+	}
+	return ctx
+}
+
+// logSpan logs how long the named step of a request took.
+func logSpan(ctx context.Context, log *zap.Logger, name string, start time.Time, fields ...zap.Field) {
+	fields = append(fields, zap.String("span", name), zap.Duration("duration", time.Since(start)))
+	log.Debug("SPAN", append(fields, traceFields(ctx)...)...)
+}
+
+// logUpstreamSpan logs a request to an upstream with the span it was sent
+// with, so it can be found in the logs of the upstream. res is nil if the
+// request failed.
+func logUpstreamSpan(ctx context.Context, log *zap.Logger, req *http.Request, res *http.Response, start time.Time) {
+	status := 0
+	if res != nil {
+		status = res.StatusCode
+	}
+	logSpan(ctx, log, "upstream request", start, zap.String("url", req.URL.String()), zap.Int("status", status))
+}
+
+// withTracing continues the trace of the client or starts a new one.
+func withTracing() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := parseTraceparent(r.Header.Get(headerTraceparent))
+			if ok {
+				t = t.child()
+			} else {
+				t = traceContext{traceID: randomHex(16), spanID: randomHex(8), flags: "01"}
+			}
+
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), traceContextKey{}, t)))
+		})
+	}
+}
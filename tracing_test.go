@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/steinfletcher/apitest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRouterTracePropagation(t *testing.T) {
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	received := make(chan string, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(headerTraceparent)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	proxy := testProxy(t)
+	proxy.Substituters = []string{srv.URL}
+	core, logs := observer.New(zap.DebugLevel)
+	proxy.log = zap.New(core)
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get(fNarinfo).
+		Header(headerTraceparent, "00-"+traceID+"-00f067aa0ba902b7-01").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	upstream, ok := parseTraceparent(<-received)
+	if !ok || upstream.traceID != traceID || upstream.spanID == "00f067aa0ba902b7" {
+		t.Fatalf("trace was not propagated: %v", upstream)
+	}
+
+	spans := logs.FilterMessage("SPAN").FilterField(zap.String("span_id", upstream.spanID)).All()
+	if len(spans) != 1 || spans[0].ContextMap()["span"] != "upstream request" {
+		t.Fatalf("expected the upstream span to be logged, got %v", spans)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+	"go.uber.org/zap"
+)
+
+// UploadHookCmd is meant to be nix's post-build-hook, it pushes the closures
+// of the paths in $OUT_PATHS.
+type UploadHookCmd struct {
+	URL         string        `arg:"--url,required,env:SPONGIX_URL" help:"spongix to push to, like http://127.0.0.1:7745"`
+	Jobs        uint64        `arg:"-j,--jobs" default:"4" help:"Number of store paths uploaded at once"`
+	Retries     uint64        `arg:"--retries" default:"3" help:"Number of times a failed upload of a store path is retried"`
+	Timeout     time.Duration `arg:"--timeout" default:"10m" help:"Time after which the upload is given up, nix waits for the hook before building further"`
+	FailOnError bool          `arg:"--fail-on-error" help:"Exit with an error if uploading failed, which makes nix stop building"`
+}
+
+func (proxy *Proxy) runUploadHook(cmd *UploadHookCmd) error {
+	c, err := client.New(cmd.URL)
+	if err != nil {
+		return err
+	}
+
+	return proxy.uploadHook(c, nixStoreCLI{}, cmd, strings.Fields(os.Getenv("OUT_PATHS")))
+}
+
+// uploadHook logs failures instead of returning them by default, a failing
+// post-build-hook fails the whole nix build.
+func (proxy *Proxy) uploadHook(c *client.Client, source pushSource, cmd *UploadHookCmd, storePaths []string) error {
+	if len(storePaths) == 0 {
+		proxy.log.Info("no OUT_PATHS, nothing to upload")
+		return nil
+	}
+
+	log := proxy.log.With(zap.String("drv_path", os.Getenv("DRV_PATH")), zap.Strings("out_paths", storePaths))
+
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := proxy.push(ctx, c, source, storePaths, cmd.Jobs, cmd.Retries)
+	if err != nil && !cmd.FailOnError {
+		log.Error("upload failed, continuing the build", zap.Error(err), zap.Duration("duration", time.Since(start)))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Info("uploaded", zap.Duration("duration", time.Since(start)))
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/input-output-hk/spongix/pkg/client"
+)
+
+func TestUploadHook(t *testing.T) {
+	defer func(backoff time.Duration) { pushRetryBackoff = backoff }(pushRetryBackoff)
+	pushRetryBackoff = time.Millisecond
+	proxy := testProxy(t)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.secretKeys = map[string]ed25519.PrivateKey{"builder-1": key}
+	proxy.trustedKeys["builder-1"] = key.Public().(ed25519.PublicKey)
+
+	// the first upload of every NAR fails.
+	failed := map[string]bool{}
+	mu := sync.Mutex{}
+	router := testRouter(proxy)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := r.Method == "PUT" && !failed[r.URL.Path]
+		failed[r.URL.Path] = true
+		mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storePath := "/nix/store/8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5-libunistring-0.9.10"
+	source := fakePushSource{storePath: testdata[fNar]}
+	cmd := &UploadHookCmd{Jobs: 1, Timeout: time.Minute}
+
+	t.Run("no retries", func(tt *testing.T) {
+		if err := proxy.uploadHook(c, source, cmd, []string{storePath}); err != nil {
+			tt.Fatalf("expected failures to be only logged, got %s", err)
+		}
+
+		cmd.FailOnError = true
+		if err := proxy.uploadHook(c, source, cmd, []string{"/nix/store/00000000000000000000000000000000-missing"}); err == nil {
+			tt.Fatal("expected --fail-on-error to return the failure")
+		}
+	})
+
+	t.Run("retries", func(tt *testing.T) {
+		failed = map[string]bool{}
+		cmd.Retries = 2
+		if err := proxy.uploadHook(c, source, cmd, []string{storePath}); err != nil {
+			tt.Fatal(err)
+		}
+
+		info, err := c.GetNarinfo(context.Background(), "8ckxc8biqqfdwyhr0w70jgrcb4h7a4y5")
+		if err != nil {
+			tt.Fatal(err)
+		}
+		valid, _ := info.ValidInvalidSignatures(map[string]ed25519.PublicKey{"builder-1": key.Public().(ed25519.PublicKey)})
+		if len(valid) != 1 {
+			tt.Fatalf("expected the builder's signature to be kept, got %v", info.Sig)
+		}
+	})
+
+	t.Run("nothing to do", func(tt *testing.T) {
+		if err := proxy.uploadHook(c, source, cmd, nil); err != nil {
+			tt.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pascaldekloe/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	metricUpstreamUp       = metrics.Must1LabelInteger("spongix_upstream_up", "upstream")
+	metricUpstreamLatency  = metrics.Must1LabelReal("spongix_upstream_latency_seconds", "upstream")
+	metricUpstreamFailures = metrics.Must1LabelCounter("spongix_upstream_failures", "upstream")
+	metricUpstreamInFlight = metrics.Must1LabelInteger("spongix_upstream_in_flight", "upstream")
+)
+
+func init() {
+	metrics.MustHelp("spongix_upstream_up", "Whether the upstream is considered available")
+	metrics.MustHelp("spongix_upstream_latency_seconds", "Latency of the last upstream health check")
+	metrics.MustHelp("spongix_upstream_failures", "Number of failed requests to the upstream")
+	metrics.MustHelp("spongix_upstream_in_flight", "Number of requests to the upstream that are in progress")
+}
+
+const (
+	// ask all substituters at once and use the first response.
+	upstreamPolicyFastest = "fastest"
+	// ask substituters one after the other by priority and latency.
+	upstreamPolicyPriority = "priority"
+	// like priority, but start with a different substituter every time,
+	// weighted by their weight parameter.
+	upstreamPolicyRoundRobin = "round-robin"
+)
+
+const (
+	// identifies a spongix instance in responses to nix-cache-info.
+	headerInstance = "X-Spongix-Instance"
+	// number of spongix instances a cache miss has already passed through.
+	headerHops = "X-Spongix-Hops"
+)
+
+type upstream struct {
+	url       *url.URL
+	priority  uint64
+	latency   time.Duration
+	downUntil time.Time
+	// set if the substituter turned out to be this instance.
+	self bool
+	// set if the priority was given in the substituter URL, it then takes
+	// precedence over the one in its nix-cache-info.
+	fixedPriority bool
+	weight        uint64
+	// maximum number of requests in flight to the upstream, 0 for no limit.
+	concurrency uint64
+	slots       chan struct{}
+}
+
+// upstreamHealth keeps track of which substituters are available, so we don't
+// wait for upstreams that are known to be down on every cache miss.
+type upstreamHealth struct {
+	// first so it's 64 bit aligned for atomic access.
+	next      uint64
+	mu        sync.RWMutex
+	upstreams []*upstream
+	cooldown  time.Duration
+	instance  string
+	maxHops   uint64
+	policy    string
+	// maximum number of substituters asked at once by the fastest policy,
+	// 0 asks all of them.
+	fanout uint64
+}
+
+func newUpstreamHealth(substituters []string, cooldown time.Duration, instance string, maxHops uint64) (*upstreamHealth, error) {
+	h := &upstreamHealth{cooldown: cooldown, instance: instance, maxHops: maxHops, policy: upstreamPolicyFastest}
+	for _, raw := range substituters {
+		up, err := parseSubstituter(raw)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "parsing substituter %q", raw)
+		}
+		h.upstreams = append(h.upstreams, up)
+		metricUpstreamUp(up.url.String()).Set(1)
+	}
+	return h, nil
+}
+
+// parseSubstituter takes the priority, weight and concurrency of a substituter
+// from the query parameters of its URL, like
+// https://cache.example.com?priority=10.
+func parseSubstituter(raw string) (*upstream, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &upstream{url: u, priority: 50, weight: 1}
+	query := u.Query()
+
+	if value := query.Get("priority"); value != "" {
+		if up.priority, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.WithMessage(err, "parsing priority")
+		}
+		up.fixedPriority = true
+		query.Del("priority")
+	}
+
+	if value := query.Get("weight"); value != "" {
+		if up.weight, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.WithMessage(err, "parsing weight")
+		} else if up.weight == 0 {
+			return nil, errors.New("weight must be at least 1")
+		}
+		query.Del("weight")
+	}
+
+	if value := query.Get("concurrency"); value != "" {
+		if up.concurrency, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.WithMessage(err, "parsing concurrency")
+		}
+		query.Del("concurrency")
+	}
+
+	u.RawQuery = query.Encode()
+	return up, nil
+}
+
+// isSelfAddress reports whether u points at the address we listen on via a
+// loopback host. Aliases are detected later by the instance header.
+func isSelfAddress(u *url.URL, listen string) bool {
+	_, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+
+	if port != listenPort {
+		return false
+	}
+
+	if u.Hostname() == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// markSelf stops using the upstream for good, requests to it would loop back
+// to us.
+func (h *upstreamHealth) markSelf(u *url.URL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if found := h.find(u); found != nil {
+		found.self = true
+		metricUpstreamUp(found.url.String()).Set(0)
+	}
+}
+
+// hops returns the hop count to send upstream for a request, and whether
+// going upstream is allowed at all.
+func (h *upstreamHealth) hops(r *http.Request) (uint64, bool) {
+	hops := uint64(0)
+	if raw := r.Header.Get(headerHops); raw != "" {
+		if parsed, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			hops = parsed
+		}
+	}
+	return hops + 1, h.maxHops == 0 || hops < h.maxHops
+}
+
+// available returns the substituters that aren't in their cooldown period,
+// ordered by priority and latency.
+func (h *upstreamHealth) available() []*url.URL {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	now := time.Now()
+	up := []*upstream{}
+	for _, u := range h.upstreams {
+		if !u.self && now.After(u.downUntil) {
+			up = append(up, u)
+		}
+	}
+
+	sort.SliceStable(up, func(i, j int) bool {
+		if up[i].priority != up[j].priority {
+			return up[i].priority < up[j].priority
+		}
+		return up[i].latency < up[j].latency
+	})
+
+	if h.policy == upstreamPolicyRoundRobin && len(up) > 1 {
+		up = h.rotate(up)
+	}
+
+	urls := make([]*url.URL, 0, len(up))
+	for _, u := range up {
+		urls = append(urls, u.url)
+	}
+	return urls
+}
+
+// rotate moves the next upstream in the weighted round-robin to the front,
+// the others stay in their order to fail over to.
+func (h *upstreamHealth) rotate(up []*upstream) []*upstream {
+	total := uint64(0)
+	for _, u := range up {
+		total += u.weight
+	}
+
+	slot := atomic.AddUint64(&h.next, 1) % total
+	first := 0
+	for i, u := range up {
+		if slot < u.weight {
+			first = i
+			break
+		}
+		slot -= u.weight
+	}
+
+	rotated := make([]*upstream, 0, len(up))
+	rotated = append(rotated, up[first])
+	rotated = append(rotated, up[:first]...)
+	return append(rotated, up[first+1:]...)
+}
+
+// limitConcurrency caps the requests in flight to every upstream that has no
+// concurrency of its own, 0 means no limit.
+func (h *upstreamHealth) limitConcurrency(concurrency uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, u := range h.upstreams {
+		if u.concurrency == 0 {
+			u.concurrency = concurrency
+		}
+		if u.concurrency > 0 {
+			u.slots = make(chan struct{}, u.concurrency)
+		}
+	}
+}
+
+// acquire waits for a free slot to send a request to the upstream serving u,
+// and returns the function to free it again. It fails if ctx is done first.
+func (h *upstreamHealth) acquire(ctx context.Context, u *url.URL) (func(), bool) {
+	h.mu.RLock()
+	found := h.find(u)
+	h.mu.RUnlock()
+
+	if found == nil {
+		return func() {}, true
+	}
+
+	name := found.url.String()
+	if found.slots != nil {
+		select {
+		case found.slots <- yes:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	metricUpstreamInFlight(name).Add(1)
+	return func() {
+		metricUpstreamInFlight(name).Add(-1)
+		if found.slots != nil {
+			<-found.slots
+		}
+	}, true
+}
+
+// releasingBody frees the upstream slot of a response once its body is
+// closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// find returns the substituter u belongs to. Substituters may share a host
+// below different paths, so the one with the longest matching path wins.
+func (h *upstreamHealth) find(u *url.URL) *upstream {
+	var found *upstream
+	for _, candidate := range h.upstreams {
+		if candidate.url.Scheme != u.Scheme || candidate.url.Host != u.Host {
+			continue
+		}
+
+		base := strings.TrimSuffix(candidate.url.Path, "/")
+		if u.Path != base && !strings.HasPrefix(u.Path, base+"/") {
+			continue
+		}
+
+		if found == nil || len(base) > len(strings.TrimSuffix(found.url.Path, "/")) {
+			found = candidate
+		}
+	}
+	return found
+}
+
+// markDown skips the upstream serving the given URL for the cooldown period.
+func (h *upstreamHealth) markDown(u *url.URL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if found := h.find(u); found != nil {
+		found.downUntil = time.Now().Add(h.cooldown)
+		metricUpstreamUp(found.url.String()).Set(0)
+		metricUpstreamFailures(found.url.String()).Add(1)
+	}
+}
+
+func (h *upstreamHealth) markUp(u *url.URL, priority uint64, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if found := h.find(u); found != nil && !found.self {
+		found.downUntil = time.Time{}
+		if !found.fixedPriority {
+			found.priority = priority
+		}
+		found.latency = latency
+		metricUpstreamUp(found.url.String()).Set(1)
+		metricUpstreamLatency(found.url.String()).Set(latency.Seconds())
+	}
+}
+
+// checkOnce fetches the nix-cache-info of every upstream to measure latency
+// and learn about their priority.
+func (h *upstreamHealth) checkOnce(log *zap.Logger, timeout time.Duration) {
+	h.mu.RLock()
+	urls := make([]*url.URL, 0, len(h.upstreams))
+	for _, u := range h.upstreams {
+		if !u.self {
+			urls = append(urls, u.url)
+		}
+	}
+	h.mu.RUnlock()
+
+	wg := &sync.WaitGroup{}
+	for _, u := range urls {
+		wg.Add(1)
+		go func(u *url.URL) {
+			defer wg.Done()
+			start := time.Now()
+			if priority, instance, err := fetchPriority(u, timeout); err != nil {
+				log.Warn("upstream is unhealthy", zap.String("upstream", u.String()), zap.Error(err))
+				h.markDown(u)
+			} else if instance != "" && instance == h.instance {
+				log.Warn("upstream is this spongix, ignoring it", zap.String("upstream", u.String()))
+				h.markSelf(u)
+			} else {
+				h.markUp(u, priority, time.Since(start))
+			}
+		}(u)
+	}
+	wg.Wait()
+}
+
+// fetchPriority returns the priority of the upstream, and its instance ID if
+// it's a spongix.
+func fetchPriority(u *url.URL, timeout time.Duration) (uint64, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	infoURL, err := u.Parse(strings.TrimSuffix(u.Path, "/") + "/nix-cache-info")
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", infoURL.String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return 0, "", errors.Errorf("received status %d", res.StatusCode)
+	}
+
+	priority := uint64(50)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if value := strings.TrimPrefix(scanner.Text(), "Priority: "); value != scanner.Text() {
+			if priority, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return 0, "", errors.WithMessage(err, "parsing Priority")
+			}
+		}
+	}
+
+	return priority, res.Header.Get(headerInstance), scanner.Err()
+}
+
+func (proxy *Proxy) setupUpstreams() {
+	upstreams, err := newUpstreamHealth(proxy.Substituters, proxy.UpstreamCooldown, proxy.instance, proxy.MaxHops)
+	if err != nil {
+		proxy.log.Fatal("failed setting up upstreams", zap.Error(err))
+	}
+
+	upstreams.fanout = proxy.UpstreamFanout
+	upstreams.limitConcurrency(proxy.UpstreamConcurrency)
+
+	switch proxy.UpstreamPolicy {
+	case "":
+	case upstreamPolicyFastest, upstreamPolicyPriority, upstreamPolicyRoundRobin:
+		upstreams.policy = proxy.UpstreamPolicy
+	default:
+		proxy.log.Fatal("unknown upstream policy", zap.String("policy", proxy.UpstreamPolicy))
+	}
+
+	for _, u := range upstreams.upstreams {
+		if isSelfAddress(u.url, proxy.Listen) {
+			proxy.log.Warn("substituter is this spongix, ignoring it", zap.String("upstream", u.url.String()))
+			upstreams.markSelf(u.url)
+		}
+	}
+
+	proxy.upstreams = upstreams
+}
+
+func (proxy *Proxy) checkUpstreams() {
+	proxy.log.Debug("Initializing upstream health checks", zap.Duration("interval", proxy.UpstreamCheckInterval))
+	proxy.upstreams.checkOnce(proxy.log, 10*time.Second)
+
+	ticker := time.NewTicker(proxy.UpstreamCheckInterval)
+	for {
+		<-ticker.C
+		proxy.upstreams.checkOnce(proxy.log, 10*time.Second)
+	}
+}
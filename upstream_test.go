@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/steinfletcher/apitest"
+)
+
+func TestRouterUpstreamCooldown(t *testing.T) {
+	proxy := testProxy(t)
+	router := testRouter(proxy)
+	upstream, _ := url.Parse("http://example.com")
+	proxy.upstreams.markDown(upstream)
+
+	apitest.New().
+		Mocks(
+			apitest.NewMock().
+				Head(fNarinfo).
+				RespondWith().
+				Status(http.StatusOK).
+				End(),
+		).
+		Handler(router).
+		Method("HEAD").
+		URL(fNarinfo).
+		Expect(t).
+		Header(headerCache, headerCacheMiss).
+		Status(http.StatusNotFound).
+		End()
+
+	proxy.upstreams.markUp(upstream, 40, time.Millisecond)
+
+	apitest.New().
+		Mocks(
+			apitest.NewMock().
+				Head(fNarinfo).
+				RespondWith().
+				Status(http.StatusOK).
+				End(),
+		).
+		Handler(router).
+		Method("HEAD").
+		URL(fNarinfo).
+		Expect(t).
+		Header(headerCache, headerCacheRemote).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestRouterSelfSubstituter(t *testing.T) {
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	proxy := testProxy(t)
+	proxy.Substituters = []string{srv.URL}
+	handler = testRouter(proxy)
+
+	proxy.upstreams.checkOnce(proxy.log, time.Second)
+	if available := proxy.upstreams.available(); len(available) != 0 {
+		t.Fatalf("expected self to be excluded, got %v", available)
+	}
+}
+
+func TestRouterMaxHops(t *testing.T) {
+	proxy := testProxy(t)
+	proxy.MaxHops = 2
+
+	apitest.New().
+		Mocks(
+			apitest.NewMock().
+				Get(fNarinfo).
+				Header(headerHops, "2").
+				RespondWith().
+				Body(string(testdata[fNarinfo])).
+				Status(http.StatusOK).
+				End(),
+		).
+		Handler(testRouter(proxy)).
+		Get(fNarinfo).
+		Header(headerHops, "1").
+		Expect(t).
+		Header(headerCache, headerCacheRemote).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get(fNarinfo).
+		Header(headerHops, "2").
+		Expect(t).
+		Header(headerCache, headerCacheMiss).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestRouterUpstreamFanout(t *testing.T) {
+	requests := map[string]*int32{"missing": new(int32), "first": new(int32), "second": new(int32)}
+	servers := map[string]*httptest.Server{}
+	for name, counter := range requests {
+		name, counter := name, counter
+		servers[name] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(counter, 1)
+			if name == "missing" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(testdata[fNarinfo])
+		}))
+		defer servers[name].Close()
+	}
+
+	proxy := testProxy(t)
+	proxy.UpstreamFanout = 2
+	proxy.Substituters = []string{
+		servers["second"].URL + "?priority=30",
+		servers["first"].URL + "?priority=20",
+		servers["missing"].URL + "?priority=10",
+	}
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get(fNarinfo).
+		Expect(t).
+		Header(headerCacheUpstream, servers["first"].URL+fNarinfo).
+		Status(http.StatusOK).
+		End()
+
+	// the request to the missing one may be cancelled before it arrives once
+	// the first one answered.
+	for name, expected := range map[string]int32{"missing": 1, "first": 1, "second": 0} {
+		if n := atomic.LoadInt32(requests[name]); n > expected || (name == "first" && n != expected) {
+			t.Errorf("expected %d requests to %s, got %d", expected, name, n)
+		}
+	}
+}
+
+func TestUpstreamConcurrency(t *testing.T) {
+	upstreams, err := newUpstreamHealth([]string{
+		"http://a.example.com",
+		"http://b.example.com?concurrency=2",
+	}, time.Minute, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams.limitConcurrency(1)
+
+	a, _ := url.Parse("http://a.example.com/nix-cache-info")
+	b, _ := url.Parse("http://b.example.com/nix-cache-info")
+
+	release, ok := upstreams.acquire(context.Background(), a)
+	if !ok {
+		t.Fatal("expected a free slot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := upstreams.acquire(ctx, a); ok {
+		t.Fatal("expected the upstream to be at its limit")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := upstreams.acquire(context.Background(), b); !ok {
+			t.Fatal("expected the concurrency parameter to override the limit")
+		}
+	}
+
+	release()
+	if _, ok := upstreams.acquire(context.Background(), a); !ok {
+		t.Fatal("expected the slot to be free again")
+	}
+}
+
+func TestUpstreamSlotHeldWhileStreaming(t *testing.T) {
+	streaming := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".nar") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_, _ = w.Write(testdata[fNar][:1])
+		w.(http.Flusher).Flush()
+		close(streaming)
+		<-release
+		_, _ = w.Write(testdata[fNar][1:])
+	}))
+	defer upstream.Close()
+
+	proxy := testProxy(t)
+	proxy.Substituters = []string{upstream.URL}
+	router := testRouter(proxy)
+	inFlight := metricUpstreamInFlight(upstream.URL)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("GET", fNar, nil))
+		done <- res
+	}()
+
+	<-streaming
+	held := inFlight.Get()
+	close(release)
+
+	if res := <-done; res.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d", res.Code)
+	} else if held < 1 {
+		t.Fatal("expected the slot to be held while streaming")
+	}
+
+	for i := 0; inFlight.Get() != 0; i++ {
+		if i > 100 {
+			t.Fatalf("expected the slot to be released, got %d in flight", inFlight.Get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouterUpstreamPriorityPolicy(t *testing.T) {
+	requests := map[string]*int32{"missing": new(int32), "first": new(int32), "second": new(int32)}
+	servers := map[string]*httptest.Server{}
+	for name, counter := range requests {
+		name, counter := name, counter
+		servers[name] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(counter, 1)
+			if name == "missing" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(testdata[fNarinfo])
+		}))
+		defer servers[name].Close()
+	}
+
+	proxy := testProxy(t)
+	proxy.UpstreamPolicy = upstreamPolicyPriority
+	proxy.Substituters = []string{
+		servers["second"].URL + "?priority=30",
+		servers["first"].URL + "?priority=20",
+		servers["missing"].URL + "?priority=10",
+	}
+
+	apitest.New().
+		Handler(testRouter(proxy)).
+		Get(fNarinfo).
+		Expect(t).
+		Header(headerCacheUpstream, servers["first"].URL+fNarinfo).
+		Status(http.StatusOK).
+		End()
+
+	for name, expected := range map[string]int32{"missing": 1, "first": 1, "second": 0} {
+		if n := atomic.LoadInt32(requests[name]); n != expected {
+			t.Errorf("expected %d requests to %s, got %d", expected, name, n)
+		}
+	}
+}
+
+func TestUpstreamFindByPath(t *testing.T) {
+	upstreams, err := newUpstreamHealth([]string{
+		"http://example.com/a?priority=10",
+		"http://example.com/a/b?priority=20",
+	}, time.Minute, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for raw, priority := range map[string]uint64{
+		"http://example.com/a":                 10,
+		"http://example.com/a/x.narinfo":       10,
+		"http://example.com/a/b":               20,
+		"http://example.com/a/b/nar/x.nar.xz":  20,
+		"http://example.com/ab/nix-cache-info": 0,
+		"https://example.com/a/nix-cache-info": 0,
+	} {
+		u, _ := url.Parse(raw)
+		found := upstreams.find(u)
+		switch {
+		case found == nil && priority != 0:
+			t.Fatalf("expected %s to be found", raw)
+		case found != nil && found.priority != priority:
+			t.Fatalf("expected %s to be matched with priority %d, got %d", raw, priority, found.priority)
+		}
+	}
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	upstreams, err := newUpstreamHealth([]string{
+		"http://a.example.com?weight=2",
+		"http://b.example.com?priority=60",
+	}, time.Minute, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := url.Parse("http://b.example.com")
+	upstreams.markUp(b, 10, time.Millisecond)
+
+	// the configured priority wins over the advertised one
+	upstreams.policy = upstreamPolicyPriority
+	if first := upstreams.available()[0]; first.Host != "a.example.com" {
+		t.Fatalf("expected a.example.com first, got %s", first)
+	}
+	upstreams.policy = upstreamPolicyRoundRobin
+
+	firsts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		available := upstreams.available()
+		if len(available) != 2 {
+			t.Fatalf("expected both upstreams, got %v", available)
+		}
+		firsts[available[0].Host]++
+	}
+
+	if firsts["a.example.com"] != 20 || firsts["b.example.com"] != 10 {
+		t.Fatalf("unexpected distribution: %v", firsts)
+	}
+}
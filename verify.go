@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/numtide/go-nix/nixbase32"
+	"go.uber.org/zap"
+)
+
+type verifyReport struct {
+	StorePath       string `json:"store_path"`
+	URL             string `json:"url"`
+	NarHash         string `json:"nar_hash"`
+	NarSize         int64  `json:"nar_size"`
+	ActualNarHash   string `json:"actual_nar_hash,omitempty"`
+	ActualNarSize   int64  `json:"actual_nar_size"`
+	ValidSignatures int    `json:"valid_signatures"`
+	OK              bool   `json:"ok"`
+	Error           string `json:"error,omitempty"`
+}
+
+// POST /verify/<hash>
+// Assembles the NAR of the narinfo and reports whether it matches NarHash and
+// NarSize, without the client downloading it.
+func (proxy *Proxy) verifyStorePath(w http.ResponseWriter, r *http.Request) {
+	info, err := proxy.resolveNarinfo(mux.Vars(r)["hash"])
+	if err != nil {
+		serveNotFound(w, r)
+		return
+	}
+
+	valid, _ := info.ValidInvalidSignatures(proxy.trustedKeys)
+	report := verifyReport{
+		StorePath:       info.StorePath,
+		URL:             info.URL,
+		NarHash:         info.NarHash,
+		NarSize:         info.NarSize,
+		ValidSignatures: len(valid),
+	}
+
+	if rd, err := proxy.narReader(info.URL); err != nil {
+		report.Error = err.Error()
+	} else {
+		hash := sha256.New()
+		if report.ActualNarSize, err = io.Copy(hash, rd); err != nil {
+			report.Error = "assembling NAR: " + err.Error()
+		} else {
+			report.ActualNarHash = "sha256:" + nixbase32.EncodeToString(hash.Sum(nil))
+			report.OK = report.ActualNarHash == info.NarHash && report.ActualNarSize == info.NarSize
+		}
+	}
+
+	if !report.OK {
+		proxy.log.Warn("store path failed verification",
+			zap.String("store_path", info.StorePath),
+			zap.String("error", report.Error),
+			zap.String("actual_nar_hash", report.ActualNarHash))
+	}
+
+	w.Header().Set(headerContentType, mimeJson)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		proxy.log.Error("encoding verify report", zap.Error(err))
+	}
+}
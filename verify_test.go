@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouterVerifyStorePath(t *testing.T) {
+	proxy := testProxy(t)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.secretKeys = map[string]ed25519.PrivateKey{"test-1": key}
+	proxy.trustedKeys["test-1"] = key.Public().(ed25519.PublicKey)
+	router := testRouter(proxy)
+
+	fixtures, err := proxy.fixtures([]string{"hello"}, "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := fixtures[0].info
+	hash := storePathHash(strings.TrimPrefix(info.StorePath, storeDirPrefix))
+
+	buf := &bytes.Buffer{}
+	if err := info.Marshal(buf); err != nil {
+		t.Fatal(err)
+	} else if err := proxy.storeLocal(hash+".narinfo", buf); err != nil {
+		t.Fatal(err)
+	} else if err := proxy.storeLocal(info.URL, bytes.NewReader(fixtures[0].nar)); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(hash string) (int, verifyReport) {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/verify/"+hash, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		router.ServeHTTP(res, req)
+		report := verifyReport{}
+		if res.Code == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.Code, report
+	}
+
+	if status, report := verify(hash); status != http.StatusOK || !report.OK || report.ValidSignatures != 1 {
+		t.Fatalf("expected a verified store path, got %d %#v", status, report)
+	} else if report.ActualNarHash != info.NarHash || report.ActualNarSize != info.NarSize {
+		t.Fatalf("unexpected NAR %s %d", report.ActualNarHash, report.ActualNarSize)
+	}
+
+	if err := proxy.storeLocal(info.URL, bytes.NewReader([]byte("tampered"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, report := verify(hash); report.OK || report.ActualNarSize != 8 {
+		t.Fatalf("expected a mismatch, got %#v", report)
+	}
+
+	if status, _ := verify(strings.Repeat("0", 32)); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing narinfo, got %d", status)
+	}
+}